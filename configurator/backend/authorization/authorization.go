@@ -1,9 +1,12 @@
 package authorization
 
 import (
+	"context"
 	"io"
+	"strings"
 
 	"github.com/jitsucom/jitsu/configurator/handlers"
+	"github.com/jitsucom/jitsu/configurator/middleware"
 	"github.com/pkg/errors"
 )
 
@@ -12,17 +15,23 @@ const (
 )
 
 var (
-	ErrUserExists    = handlers.ErrUserExists
-	errIsLocal       = errors.New("This API call is supported only for Firebase-based authorization")
-	errIsCloud       = errors.New("This API call is supported only for Redis-based authorization")
-	errUserNotFound  = errors.New("User is not found")
-	errMultipleUsers = errors.New("Multiple users found. Please use your own personal access token for this API call")
+	ErrUserExists     = handlers.ErrUserExists
+	ErrRefreshExpired = handlers.ErrRefreshExpired
+	ErrRefreshUnknown = handlers.ErrRefreshUnknown
+	ErrMailTransient  = handlers.ErrMailTransient
+	ErrMailPermanent  = handlers.ErrMailPermanent
+	errIsLocal        = errors.New("This API call is supported only for Firebase-based authorization")
+	errIsCloud        = errors.New("This API call is supported only for Redis-based authorization")
+	ErrUserNotFound   = errors.New("User is not found")
+	ErrUsernameExists = errors.New("Username is already taken")
+	errMultipleUsers  = errors.New("Multiple users found. Please use your own personal access token for this API call")
 )
 
 type MailSender interface {
 	IsConfigured() bool
 	SendResetPassword(email, link string) error
 	SendAccountCreated(email, link string) error
+	SendEmailVerification(email, link string) error
 }
 
 type SSOConfig struct {
@@ -42,3 +51,13 @@ type SSOConfigAutoProvision struct {
 func closeQuietly(closer io.Closer) {
 	_ = closer.Close()
 }
+
+// withRequestID prefixes log format with request ID from ctx if it is present.
+// The ID is escaped, so that it can't consume log arguments.
+func withRequestID(ctx context.Context, format string) string {
+	if requestID := middleware.GetRequestID(ctx); requestID != "" {
+		return "[request_id: " + strings.ReplaceAll(requestID, "%", "%%") + "] " + format
+	}
+
+	return format
+}
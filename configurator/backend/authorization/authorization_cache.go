@@ -0,0 +1,102 @@
+package authorization
+
+import (
+	"time"
+
+	lru "github.com/hashicorp/golang-lru"
+	"github.com/jitsucom/jitsu/configurator/middleware"
+	"github.com/pkg/errors"
+)
+
+const defaultAuthorizationCacheSize = 10000
+
+type authorizationCacheEntry struct {
+	authorization middleware.Authorization
+	expiresAt     time.Time
+}
+
+// authorizationCache keeps successful access token authorizations in process memory for a short time,
+// so that hot tokens don't hit Redis on every request. Nil cache is disabled.
+type authorizationCache struct {
+	ttl   time.Duration
+	now   func() time.Time
+	cache *lru.Cache
+}
+
+func newAuthorizationCache(ttl time.Duration, size int, now func() time.Time) (*authorizationCache, error) {
+	if ttl <= 0 {
+		return nil, nil
+	}
+
+	if size <= 0 {
+		size = defaultAuthorizationCacheSize
+	}
+
+	cache, err := lru.New(size)
+	if err != nil {
+		return nil, errors.Wrap(err, "create lru cache")
+	}
+
+	return &authorizationCache{
+		ttl:   ttl,
+		now:   now,
+		cache: cache,
+	}, nil
+}
+
+// get returns a copy of the cached authorization, so that callers can't modify the cached one.
+func (c *authorizationCache) get(token string) (*middleware.Authorization, bool) {
+	if c == nil {
+		return nil, false
+	}
+
+	value, ok := c.cache.Get(token)
+	if !ok {
+		return nil, false
+	}
+
+	entry := value.(*authorizationCacheEntry)
+	if !c.now().Before(entry.expiresAt) {
+		c.cache.Remove(token)
+		return nil, false
+	}
+
+	authorization := entry.authorization
+	if authorization.Scopes != nil {
+		authorization.Scopes = append([]string(nil), authorization.Scopes...)
+	}
+
+	if authorization.Metadata != nil {
+		metadata := make(map[string]string, len(authorization.Metadata))
+		for key, value := range authorization.Metadata {
+			metadata[key] = value
+		}
+
+		authorization.Metadata = metadata
+	}
+
+	return &authorization, true
+}
+
+// put caches the authorization for the cache TTL, but no longer than validFor, so that tokens expire on time.
+func (c *authorizationCache) put(token string, authorization *middleware.Authorization, validFor time.Duration) {
+	if c == nil || validFor <= 0 {
+		return
+	}
+
+	ttl := c.ttl
+	if validFor < ttl {
+		ttl = validFor
+	}
+
+	c.cache.Add(token, &authorizationCacheEntry{
+		authorization: *authorization,
+		expiresAt:     c.now().Add(ttl),
+	})
+}
+
+func (c *authorizationCache) remove(token string) {
+	if c != nil {
+		c.cache.Remove(token)
+	}
+}
@@ -106,6 +106,7 @@ func (fb *Firebase) Authorize(ctx context.Context, accessToken string) (*middlew
 			Id:    user.UID,
 			Email: user.Email,
 		},
+		Subject: user.UID,
 		IsAdmin: isAdmin,
 	}, nil
 }
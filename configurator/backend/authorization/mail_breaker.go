@@ -0,0 +1,120 @@
+package authorization
+
+import (
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultMailBreakerThreshold = 5
+	defaultMailBreakerCooldown  = time.Minute
+)
+
+// Mail circuit breaker states reported by Redis.MailBreakerState.
+const (
+	MailBreakerClosed   = "closed"
+	MailBreakerOpen     = "open"
+	MailBreakerHalfOpen = "half-open"
+)
+
+var errMailServiceUnavailable = errors.New("SMTP service is temporarily unavailable")
+
+// mailBreaker is a circuit breaker around MailSender. After threshold consecutive failures it fails fast
+// with errMailServiceUnavailable for cooldown, then lets a single probe through: success closes the circuit,
+// failure opens it for another cooldown. It keeps request goroutines from piling up on dial timeouts during outages.
+type mailBreaker struct {
+	sender    MailSender
+	threshold int
+	cooldown  time.Duration
+	now       func() time.Time
+
+	mu       sync.Mutex
+	failures int
+	openedAt time.Time
+	probing  bool
+}
+
+func newMailBreaker(sender MailSender, threshold int, cooldown time.Duration, now func() time.Time) *mailBreaker {
+	return &mailBreaker{
+		sender:    sender,
+		threshold: threshold,
+		cooldown:  cooldown,
+		now:       now,
+	}
+}
+
+func (b *mailBreaker) IsConfigured() bool {
+	return b.sender.IsConfigured()
+}
+
+func (b *mailBreaker) SendResetPassword(email, link string) error {
+	return b.call(func() error { return b.sender.SendResetPassword(email, link) })
+}
+
+func (b *mailBreaker) SendAccountCreated(email, link string) error {
+	return b.call(func() error { return b.sender.SendAccountCreated(email, link) })
+}
+
+func (b *mailBreaker) SendEmailVerification(email, link string) error {
+	return b.call(func() error { return b.sender.SendEmailVerification(email, link) })
+}
+
+func (b *mailBreaker) call(send func() error) error {
+	if err := b.acquire(); err != nil {
+		return err
+	}
+
+	err := send()
+	b.release(err)
+	return err
+}
+
+// acquire returns errMailServiceUnavailable if the call must not reach the sender.
+func (b *mailBreaker) acquire() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state() {
+	case MailBreakerOpen:
+		return errMailServiceUnavailable
+	case MailBreakerHalfOpen:
+		b.probing = true
+	}
+
+	return nil
+}
+
+func (b *mailBreaker) release(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probing = false
+	if err == nil {
+		b.failures = 0
+		return
+	}
+
+	b.failures++
+	if b.failures >= b.threshold {
+		b.openedAt = b.now()
+	}
+}
+
+// state must be called under mu.
+func (b *mailBreaker) state() string {
+	switch {
+	case b.failures < b.threshold:
+		return MailBreakerClosed
+	case b.probing || b.now().Sub(b.openedAt) < b.cooldown:
+		return MailBreakerOpen
+	default:
+		return MailBreakerHalfOpen
+	}
+}
+
+// State returns MailBreakerClosed, MailBreakerOpen or MailBreakerHalfOpen.
+func (b *mailBreaker) State() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state()
+}
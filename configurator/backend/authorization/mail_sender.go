@@ -0,0 +1,96 @@
+package authorization
+
+import (
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// mailError classifies a MailSender error as ErrMailTransient or ErrMailPermanent keeping the cause.
+type mailError struct {
+	class error
+	err   error
+}
+
+func (e *mailError) Error() string {
+	return e.err.Error()
+}
+
+func (e *mailError) Unwrap() error {
+	return e.err
+}
+
+func (e *mailError) Is(target error) bool {
+	return target == e.class
+}
+
+// classifyMailError marks errors of the open circuit breaker and errors reporting themselves as temporary
+// (e.g. emails.SendError of network failures) as ErrMailTransient, and all other errors as ErrMailPermanent.
+func classifyMailError(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	class := ErrMailPermanent
+	var temporary interface{ Temporary() bool }
+	if errors.Is(err, errMailServiceUnavailable) || errors.As(err, &temporary) && temporary.Temporary() {
+		class = ErrMailTransient
+	}
+
+	return &mailError{class: class, err: err}
+}
+
+// mailSenderHolder holds the current MailSender, so that it may be replaced at runtime, e.g. on SMTP provider rotation.
+// Every sender gets its own circuit breaker unless breakers are disabled with negative threshold.
+type mailSenderHolder struct {
+	threshold int
+	cooldown  time.Duration
+	now       func() time.Time
+
+	mu      sync.RWMutex
+	sender  MailSender
+	breaker *mailBreaker
+}
+
+func newMailSenderHolder(sender MailSender, threshold int, cooldown time.Duration, now func() time.Time) *mailSenderHolder {
+	holder := &mailSenderHolder{
+		threshold: threshold,
+		cooldown:  cooldown,
+		now:       now,
+	}
+
+	holder.set(sender)
+	return holder
+}
+
+// set replaces the sender. Sends started before keep using the previous one.
+func (h *mailSenderHolder) set(sender MailSender) {
+	var breaker *mailBreaker
+	if h.threshold >= 0 {
+		breaker = newMailBreaker(sender, h.threshold, h.cooldown, h.now)
+		sender = breaker
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.sender, h.breaker = sender, breaker
+}
+
+// get returns the current sender. Callers should use the same sender throughout an operation.
+func (h *mailSenderHolder) get() MailSender {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.sender
+}
+
+func (h *mailSenderHolder) breakerState() string {
+	h.mu.RLock()
+	breaker := h.breaker
+	h.mu.RUnlock()
+	if breaker == nil {
+		return MailBreakerClosed
+	}
+
+	return breaker.State()
+}
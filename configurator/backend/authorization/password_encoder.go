@@ -1,22 +1,52 @@
 package authorization
 
-import "golang.org/x/crypto/bcrypt"
+import (
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/bcrypt"
+)
 
 type PasswordEncoder interface {
 	Encode(value string) (string, error)
 	Compare(encoded, raw string) error
 }
 
-type _bcrypt struct{}
+// HashValidator is implemented by password encoders which can check that a hash imported from another system
+// can be compared against, see Redis.CreateUserWithHash.
+type HashValidator interface {
+	ValidateHash(encoded string) error
+}
+
+type _bcrypt struct {
+	cost int
+}
 
-func (_bcrypt) Encode(value string) (string, error) {
-	if hash, err := bcrypt.GenerateFromPassword([]byte(value), bcrypt.MinCost); err != nil {
+// newBcrypt creates bcrypt password encoder. Zero cost means bcrypt.DefaultCost.
+func newBcrypt(cost int) (_bcrypt, error) {
+	if cost == 0 {
+		return _bcrypt{cost: bcrypt.DefaultCost}, nil
+	}
+
+	if cost < bcrypt.MinCost || cost > bcrypt.MaxCost {
+		return _bcrypt{}, errors.Errorf("bcrypt cost must be in range [%d, %d], got %d", bcrypt.MinCost, bcrypt.MaxCost, cost)
+	}
+
+	return _bcrypt{cost: cost}, nil
+}
+
+func (b _bcrypt) Encode(value string) (string, error) {
+	if hash, err := bcrypt.GenerateFromPassword([]byte(value), b.cost); err != nil {
 		return "", err
 	} else {
 		return string(hash), nil
 	}
 }
 
+// ValidateHash accepts bcrypt hashes of any version and cost supported by Compare.
+func (_bcrypt) ValidateHash(encoded string) error {
+	_, err := bcrypt.Cost([]byte(encoded))
+	return err
+}
+
 func (_bcrypt) Compare(encoded, raw string) error {
 	return bcrypt.CompareHashAndPassword([]byte(encoded), []byte(raw))
 }
@@ -2,8 +2,15 @@ package authorization
 
 import (
 	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"net/url"
+	"regexp"
+	"sort"
 	"strings"
 	"time"
 
@@ -13,48 +20,429 @@ import (
 	"github.com/jitsucom/jitsu/configurator/openapi"
 	"github.com/jitsucom/jitsu/server/logging"
 	"github.com/jitsucom/jitsu/server/meta"
+	"github.com/jitsucom/jitsu/server/safego"
 	"github.com/jitsucom/jitsu/server/timestamp"
 	"github.com/pkg/errors"
 	uuid "github.com/satori/go.uuid"
 )
 
 var (
-	errUnknownToken             = errors.New("unknown token")
+	keyPrefixRegex = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+	usernameRegex  = regexp.MustCompile(`^[A-Za-z0-9_.-]{1,64}$`)
+)
+
+var (
+	errUnknownToken             = middleware.ErrUnknownToken
 	errExpiredToken             = errors.New("expired token")
 	errMailServiceNotConfigured = errors.New("SMTP service is not configured")
+	errInvalidEmail             = errors.New("invalid email")
+	errUserLimitReached         = errors.New("user limit reached")
+	errAccountLocked            = errors.New("user account is locked")
+	errCallbackNotAllowed       = errors.New("callback URL is not allowed")
+	errEmailNotVerified         = errors.New("email is not verified")
+	errUnknownUserEmail         = errors.New("email does not belong to the user")
+	errPrimaryEmailRemoval      = errors.New("primary email can't be removed, change it instead")
+	errInvalidUsername          = errors.New("invalid username: only 1 to 64 letters, digits, '_', '-' and '.' are allowed")
+	errDomainNotAllowed         = errors.New("email domain is not allowed")
 )
 
 const (
-	usersIndexKey           = "users_index"
-	userIDField             = "id"
-	userEmailField          = "email"
-	userHashedPasswordField = "hashed_password"
-	resetIDTTLSeconds       = 3600
-	ssoTokensKey            = "sso_tokens"
+	usersIndexKey              = "users_index"
+	usernamesIndexKey          = "usernames_index"
+	userIDsKey                 = "user_ids"
+	userIDField                = "id"
+	userEmailField             = "email"
+	userUsernameField          = "username"
+	userHashedPasswordField    = "hashed_password"
+	userPasswordChangedAtField = "password_changed_at"
+	userLockedField            = "locked"
+	userUnverifiedField        = "unverified"
+	resetIDTTLSeconds          = 3600
+	verifyIDTTLSeconds         = 24 * 3600
+	ssoTokensKey               = "sso_tokens"
+	serverTokenKey             = "server_token"
+	previousServerTokenKey     = "server_token_previous"
+	configuredServerTokenKey   = "server_token_configured"
+
+	// minTokenEntropyBits is the number of random bits in UUIDv4
+	minTokenEntropyBits = 122
+	// tokenGeneratorSamples is the number of values NewRedis draws from TokenGenerator for checking.
+	tokenGeneratorSamples = 16
+
+	defaultServerTokenGracePeriod = time.Hour
+	defaultResetPasswordCooldown  = 5 * time.Minute
+	maxChangeEmailAttempts        = 5
+	keyScanBatchSize              = 1000
+
+	hashedEmailPrefix = "hmac:"
 )
 
 type RedisInit struct {
 	PoolFactory *meta.RedisPoolFactory
 	MailSender  MailSender
+
+	// KeyPrefix namespaces all Redis keys as <KeyPrefix>:<key>, including token hashes and the users index,
+	// so that several environments or products may share the same Redis DB safely. It may contain only letters, digits, '_', '-' and '.'. Empty value means no prefix.
+	KeyPrefix string
+
+	// EmailIndexKey enables keying the users index by HMAC-SHA256 of emails instead of plaintext emails,
+	// so that emails can't be enumerated from the index. The index becomes lookup-only: users are still
+	// found by email, but ListUsers and FindOnlyUser resolve emails from user records, which still contain them.
+	// Existing plaintext index entries are rehashed on startup. The key must not change afterwards,
+	// since previously hashed entries can't be found with another key.
+	EmailIndexKey []byte
+
+	// ReplicaPoolFactory enables serving read-only lookups from a Redis replica. Writes always use PoolFactory.
+	// Replica reads may be stale due to replication lag: Authorize and AuthorizeBatch may reject tokens issued
+	// moments ago or accept tokens revoked moments ago, FindToken may miss them likewise, GetUser, GetUserEmail,
+	// GetUserIDByEmail, FindUserIDByEmail, FindOnlyUser, FindAnyUserID, HasUsers, ListUsers and ListUsersWithFields
+	// may miss recent user changes, ListAPIKeys and ListPendingResets may miss recently created or revoked entries.
+	// IsServerToken, AuthorizeAPIKey and VerifyPassword always read from the primary, so that rotated or revoked
+	// secrets don't work during replication lag.
+	ReplicaPoolFactory *meta.RedisPoolFactory
+
+	// CommandReadTimeout and CommandWriteTimeout bound every single Redis command on both pools, e.g. HGETALL
+	// of a large users index on a slow Redis. Request contexts only bound acquiring connections, commands in flight
+	// are not interrupted by them, so a request may take up to the context deadline plus a command timeout.
+	// Connections of timed out commands are discarded. Zero values keep the pool factory options, 10 seconds by default.
+	CommandReadTimeout  time.Duration
+	CommandWriteTimeout time.Duration
+
+	// IDGenerator is used for minting user IDs and API key IDs, e.g. time-ordered ULIDs. Defaults to UUIDv4.
+	// It is never used for secrets, since IDs need not be unpredictable.
+	IDGenerator func() string
+
+	// TokenGenerator mints tokens, reset IDs, API key secrets and random passwords, e.g. for shorter reset links,
+	// stronger API keys or deterministic tests. Defaults to UUIDv4. TokenEntropyBits is the number of random bits
+	// in every generated value, which must be at least 122 bits of UUIDv4. NewRedis samples the generator and rejects
+	// it if values repeat or are too short to carry the declared entropy, which catches broken generators,
+	// but can't prove randomness, so the declared entropy must be accurate.
+	TokenGenerator   func() string
+	TokenEntropyBits int
+
+	// Clock is used for token issue and expiration times and password change times. Defaults to timestamp.Now.
+	// Along with IDGenerator it makes token lifecycle deterministic in tests.
+	Clock func() time.Time
+
+	// ServerToken is accepted by Authorize as an admin service account token. Empty value disables it.
+	// Only its hash is stored in Redis. The stored token is replaced only when the configured value changes,
+	// so that the token rotated with RotateServerToken survives restarts.
+	ServerToken string
+
+	// BcryptCost is the password hashing cost. Defaults to bcrypt.DefaultCost.
+	// Every increment doubles hashing time of SignUp, SignIn and password changes, which makes brute-forcing
+	// leaked hashes harder, but adds latency on constrained hardware. Existing hashes keep their original cost.
+	BcryptCost int
+
+	// MaxPasswordAge makes SignIn report password_expired for passwords changed earlier than that.
+	// Zero value disables the check. Passwords set before password change time tracking are never reported.
+	MaxPasswordAge time.Duration
+
+	// OnUserCreated is called asynchronously after a new user is persisted, e.g. for notifying external systems.
+	// It gets a background context, because the request may already be finished by the time it is called.
+	OnUserCreated func(ctx context.Context, userID, email string)
+
+	// OnPasswordReset is called asynchronously after a user resets password with a reset link,
+	// e.g. for alerting on possible account takeovers. Slow or panicking hooks don't affect the reset.
+	OnPasswordReset func(userID string)
+
+	// RememberMeRefreshTTL is the refresh token TTL for sign-ins with SignInOptions.RememberMe. Defaults to 30 days.
+	RememberMeRefreshTTL time.Duration
+
+	// TokenDecorator is called for every issued token pair and may add custom claims to metadata,
+	// e.g. tenant ID or plan tier for downstream services. Claims are returned by Authorize.
+	TokenDecorator func(userID string, metadata map[string]string)
+
+	// MaxUsers limits the number of users which may sign up by themselves. Zero value means no limit.
+	// Users created by admins with CreateUser or AutoSignUp are not limited unless MaxUsersAppliesToAdmins is set,
+	// but they are counted anyway.
+	MaxUsers                int
+	MaxUsersAppliesToAdmins bool
+
+	// SlidingSessionTTL makes Authorize extend access token expiration to SlidingSessionTTL since now,
+	// so that sessions in active use don't expire. Tokens are never extended beyond SlidingSessionMaxLifetime
+	// since issue, which defaults to 7 days. Zero value disables sliding sessions, so that tokens expire
+	// at a fixed time. Refresh tokens are not affected.
+	SlidingSessionTTL         time.Duration
+	SlidingSessionMaxLifetime time.Duration
+
+	// ClockSkewGrace keeps tokens valid for this long after expiration, so that clock skew between nodes
+	// does not sign users out prematurely. Zero value means strict expiration.
+	ClockSkewGrace time.Duration
+
+	// ResetPasswordCooldown is the minimum interval between reset password links sent to the same email.
+	// Requests within the cooldown succeed without sending anything. Defaults to 5 minutes, negative value disables it.
+	ResetPasswordCooldown time.Duration
+
+	// AllowedCallbacks restricts callback URLs of reset password and invitation links, so that links
+	// can't point to phishing sites. Entries with scheme (e.g. https://app.example.com/reset) are URL prefixes
+	// matched up to a path boundary, other entries are host names. Empty value allows all callbacks.
+	AllowedCallbacks []string
+
+	// AllowedEmailDomains restricts emails of new users (SignUp, AutoSignUp, CreateUser and imports) as well as
+	// emails set with ChangeEmail and AddUserEmail to these domains, e.g. corporate ones. Domains are matched
+	// case-insensitively, "*.example.com" matches any subdomain of example.com, but not example.com itself.
+	// Empty value allows all domains. Existing users are not affected unless AllowedEmailDomainsApplyToSignIn is set,
+	// which makes SignIn reject users whose primary email domain is not allowed, e.g. ones signed up before the policy.
+	AllowedEmailDomains              []string
+	AllowedEmailDomainsApplyToSignIn bool
+
+	// MailBreakerThreshold is the number of consecutive MailSender failures after which sending fails fast
+	// for MailBreakerCooldown, so that requests don't wait for dial timeouts during SMTP outages.
+	// Defaults to 5 failures and a minute, negative threshold disables the breaker.
+	MailBreakerThreshold int
+	MailBreakerCooldown  time.Duration
+
+	// ServerTokenGracePeriod is how long the previous server token is accepted after rotation. Defaults to an hour.
+	ServerTokenGracePeriod time.Duration
+
+	// TokenEncryptionKeys enables AES-GCM encryption of persisted token payloads when not empty.
+	// Keys are 16, 24 or 32 bytes long and indexed by key ID. TokenEncryptionKeyID selects the key
+	// for new tokens, the others are only used for decrypting tokens saved before key rotation.
+	TokenEncryptionKeys  map[string][]byte
+	TokenEncryptionKeyID string
+
+	// TokenStorageVersion selects how new tokens are persisted. Version 1 (default) stores them as fields
+	// of two hashes, version 2 stores each token under its own key with TTL, so that Redis expires it.
+	// Both versions read and delete tokens persisted with either scheme, so instances may be switched one by one.
+	// Version 2 moves tokens from the hashes to individual keys with MigrateTokenStorage on startup.
+	TokenStorageVersion int
+
+	// AuthorizationCacheTTL enables caching successful Authorize results in process memory for this long,
+	// so that hot tokens don't hit Redis on every request. Tokens revoked by this instance are evicted immediately,
+	// but tokens revoked by other instances keep being accepted here for up to AuthorizationCacheTTL,
+	// so it should be a few seconds. Zero value disables the cache. CheckToken and AuthorizeBatch are never cached.
+	// AuthorizationCacheSize is the maximum number of cached tokens, defaults to 10000.
+	AuthorizationCacheTTL  time.Duration
+	AuthorizationCacheSize int
 }
 
 type Redis struct {
-	passwordEncoder PasswordEncoder
-	redisPool       *meta.RedisPool
-	mailSender      MailSender
+	passwordEncoder  PasswordEncoder
+	redisPool        *meta.RedisPool
+	replicaPool      *meta.RedisPool
+	keyPrefix        string
+	emailIndexKey    []byte
+	mailSender       *mailSenderHolder
+	allowedCallbacks []string
+	tokenCipher      *tokenCipher
+	authCache        *authorizationCache
+	idGenerator      func() string
+	tokenGenerator   func() string
+	now              func() time.Time
+	onUserCreated    func(ctx context.Context, userID, email string)
+	onPasswordReset  func(userID string)
+	tokenDecorator   func(userID string, metadata map[string]string)
+
+	maxUsers                int
+	maxUsersAppliesToAdmins bool
+
+	allowedDomains      []string
+	checkDomainOnSignIn bool
+
+	maxPasswordAge         time.Duration
+	clockSkewGrace         time.Duration
+	slidingSessionTTL      time.Duration
+	slidingSessionMaxLife  time.Duration
+	rememberMeRefreshTTL   time.Duration
+	resetPasswordCooldown  time.Duration
+	serverTokenGracePeriod time.Duration
+	tokenStorageVersion    int
+}
+
+// RedisUser contains user account details.
+type RedisUser struct {
+	ID    string
+	Email string
+
+	// Username is empty for users who have signed up without username.
+	Username string
+
+	// AdditionalEmails may be used to sign in and reset password along with the primary Email, see AddUserEmail.
+	AdditionalEmails []string
+
+	// Locked users can't sign in, see SetUserLocked.
+	Locked bool
+
+	// Unverified users have signed up with SignUpWithVerification and can't sign in until VerifyEmail.
+	Unverified bool
+
+	// PasswordChangedAt is zero for users whose password has not been changed since password change time tracking.
+	PasswordChangedAt time.Time
 }
 
 func NewRedis(init RedisInit) (*Redis, error) {
-	redisPool, err := init.PoolFactory.Create()
+	var tokenCipher *tokenCipher
+	if len(init.TokenEncryptionKeys) > 0 {
+		var err error
+		if tokenCipher, err = newTokenCipher(init.TokenEncryptionKeys, init.TokenEncryptionKeyID); err != nil {
+			return nil, errors.Wrap(err, "create token cipher")
+		}
+	}
+
+	var keyPrefix string
+	if init.KeyPrefix != "" {
+		if !keyPrefixRegex.MatchString(init.KeyPrefix) {
+			return nil, errors.Errorf("invalid key prefix [%s]: only letters, digits, '_', '-' and '.' are allowed", init.KeyPrefix)
+		}
+
+		keyPrefix = init.KeyPrefix + ":"
+	}
+
+	passwordEncoder, err := newBcrypt(init.BcryptCost)
+	if err != nil {
+		return nil, errors.Wrap(err, "create password encoder")
+	}
+
+	idGenerator := init.IDGenerator
+	if idGenerator == nil {
+		idGenerator = newUUID
+	}
+
+	tokenGenerator := init.TokenGenerator
+	if tokenGenerator == nil {
+		tokenGenerator = newUUID
+	} else if err := checkTokenGenerator(tokenGenerator, init.TokenEntropyBits); err != nil {
+		return nil, err
+	}
+
+	clock := init.Clock
+	if clock == nil {
+		clock = timestamp.Now
+	}
+
+	rememberMeRefreshTTL := init.RememberMeRefreshTTL
+	if rememberMeRefreshTTL <= 0 {
+		rememberMeRefreshTTL = defaultRememberMeRefreshTTL
+	}
+
+	if init.ClockSkewGrace < 0 {
+		return nil, errors.New("clock skew grace must not be negative")
+	}
+
+	slidingSessionMaxLifetime := init.SlidingSessionMaxLifetime
+	if slidingSessionMaxLifetime <= 0 {
+		slidingSessionMaxLifetime = defaultSlidingSessionMaxLifetime
+	}
+
+	tokenStorageVersion := init.TokenStorageVersion
+	switch tokenStorageVersion {
+	case 0:
+		tokenStorageVersion = tokenStorageHashes
+	case tokenStorageHashes, tokenStorageKeys:
+	default:
+		return nil, errors.Errorf("unsupported token storage version: %d", tokenStorageVersion)
+	}
+
+	resetPasswordCooldown := init.ResetPasswordCooldown
+	if resetPasswordCooldown == 0 {
+		resetPasswordCooldown = defaultResetPasswordCooldown
+	}
+
+	serverTokenGracePeriod := init.ServerTokenGracePeriod
+	if serverTokenGracePeriod <= 0 {
+		serverTokenGracePeriod = defaultServerTokenGracePeriod
+	}
+
+	mailBreakerThreshold := init.MailBreakerThreshold
+	if mailBreakerThreshold == 0 {
+		mailBreakerThreshold = defaultMailBreakerThreshold
+	}
+
+	mailBreakerCooldown := init.MailBreakerCooldown
+	if mailBreakerCooldown <= 0 {
+		mailBreakerCooldown = defaultMailBreakerCooldown
+	}
+
+	allowedDomains, err := parseAllowedEmailDomains(init.AllowedEmailDomains)
+	if err != nil {
+		return nil, err
+	}
+
+	authCache, err := newAuthorizationCache(init.AuthorizationCacheTTL, init.AuthorizationCacheSize, clock)
+	if err != nil {
+		return nil, errors.Wrap(err, "create authorization cache")
+	}
+
+	if init.CommandReadTimeout < 0 || init.CommandWriteTimeout < 0 {
+		return nil, errors.New("command timeouts must not be negative")
+	}
+
+	redisPool, err := createRedisPool(withCommandTimeouts(init.PoolFactory, init.CommandReadTimeout, init.CommandWriteTimeout))
 	if err != nil {
 		return nil, errors.Wrap(err, "create redis pool")
 	}
 
-	return &Redis{
-		passwordEncoder: _bcrypt{},
-		redisPool:       redisPool,
-		mailSender:      init.MailSender,
-	}, nil
+	replicaPool := redisPool
+	if init.ReplicaPoolFactory != nil {
+		replicaPoolFactory := withCommandTimeouts(init.ReplicaPoolFactory, init.CommandReadTimeout, init.CommandWriteTimeout)
+		if replicaPool, err = createRedisPool(replicaPoolFactory); err != nil {
+			_ = redisPool.Close()
+			return nil, errors.Wrap(err, "create redis replica pool")
+		}
+	}
+
+	r := &Redis{
+		passwordEncoder:         passwordEncoder,
+		redisPool:               redisPool,
+		replicaPool:             replicaPool,
+		keyPrefix:               keyPrefix,
+		emailIndexKey:           init.EmailIndexKey,
+		mailSender:              newMailSenderHolder(init.MailSender, mailBreakerThreshold, mailBreakerCooldown, clock),
+		allowedCallbacks:        init.AllowedCallbacks,
+		tokenCipher:             tokenCipher,
+		authCache:               authCache,
+		idGenerator:             idGenerator,
+		tokenGenerator:          tokenGenerator,
+		now:                     clock,
+		onUserCreated:           init.OnUserCreated,
+		onPasswordReset:         init.OnPasswordReset,
+		tokenDecorator:          init.TokenDecorator,
+		maxUsers:                init.MaxUsers,
+		maxUsersAppliesToAdmins: init.MaxUsersAppliesToAdmins,
+		allowedDomains:          allowedDomains,
+		checkDomainOnSignIn:     init.AllowedEmailDomainsApplyToSignIn,
+		maxPasswordAge:          init.MaxPasswordAge,
+		clockSkewGrace:          init.ClockSkewGrace,
+		slidingSessionTTL:       init.SlidingSessionTTL,
+		slidingSessionMaxLife:   slidingSessionMaxLifetime,
+		rememberMeRefreshTTL:    rememberMeRefreshTTL,
+		resetPasswordCooldown:   resetPasswordCooldown,
+		serverTokenGracePeriod:  serverTokenGracePeriod,
+		tokenStorageVersion:     tokenStorageVersion,
+	}
+
+	if init.ServerToken != "" {
+		if err := r.initServerToken(init.ServerToken); err != nil {
+			_ = r.Close()
+			return nil, errors.Wrap(err, "init server token")
+		}
+	}
+
+	if len(init.EmailIndexKey) > 0 {
+		if err := r.hashUsersIndex(); err != nil {
+			_ = r.Close()
+			return nil, errors.Wrap(err, "hash users index")
+		}
+	}
+
+	if r.maxUsers > 0 {
+		if err := r.initUserIDs(); err != nil {
+			_ = r.Close()
+			return nil, errors.Wrap(err, "init user IDs")
+		}
+	}
+
+	if tokenStorageVersion == tokenStorageKeys {
+		// tokens are still readable from the hashes, so failed migration may be retried later
+		if migrated, err := r.MigrateTokenStorage(context.Background()); err != nil {
+			logging.SystemErrorf("Failed to migrate tokens to individual keys: %v", err)
+		} else if migrated > 0 {
+			logging.Infof("Migrated %d tokens to individual keys", migrated)
+		}
+	}
+
+	return r, nil
 }
 
 func (r *Redis) AuthorizationType() string {
@@ -69,18 +457,62 @@ func (r *Redis) Cloud() (handlers.CloudAuthorizator, error) {
 	return nil, errIsLocal
 }
 
+// MailBreakerState returns the state of the mail sender circuit breaker for metrics.
+// It is always MailBreakerClosed if the breaker is disabled.
+func (r *Redis) MailBreakerState() string {
+	return r.mailSender.breakerState()
+}
+
+// SetMailSender replaces the mail sender without restart, e.g. when SMTP providers are rotated.
+// Sends in flight complete with the previous sender. The new sender starts with a closed circuit breaker.
+func (r *Redis) SetMailSender(sender MailSender) {
+	r.mailSender.set(sender)
+}
+
 func (r *Redis) Close() error {
+	if r.replicaPool != r.redisPool {
+		if err := r.replicaPool.Close(); err != nil {
+			logging.Warnf("Failed to close Redis replica pool: %v", err)
+		}
+	}
+
 	return r.redisPool.Close()
 }
 
 func (r *Redis) Authorize(ctx context.Context, accessToken string) (*middleware.Authorization, error) {
-	conn, err := r.redisPool.GetContext(ctx)
+	return r.authorize(ctx, accessToken, true)
+}
+
+// CheckToken acts like Authorize, but never deletes invalid tokens, so it is safe for read-only session introspection.
+// Expired tokens are reported with errExpiredToken.
+func (r *Redis) CheckToken(ctx context.Context, accessToken string) (*middleware.Authorization, error) {
+	return r.authorize(ctx, accessToken, false)
+}
+
+func (r *Redis) authorize(ctx context.Context, accessToken string, deleteInvalid bool) (*middleware.Authorization, error) {
+	// CheckToken is used for session introspection, so it always reads the current state
+	if deleteInvalid {
+		if authorization, ok := r.authCache.get(accessToken); ok {
+			return authorization, nil
+		}
+	}
+
+	conn, err := r.replicaPool.GetContext(ctx)
 	if err != nil {
 		return nil, err
 	}
 
 	defer closeQuietly(conn)
 
+	if ok, err := r.isServerToken(conn, accessToken); err != nil {
+		return nil, middleware.ReadableError{
+			Description: "Failed to load server token from Redis",
+			Cause:       err,
+		}
+	} else if ok {
+		return &middleware.Authorization{IsAdmin: true}, nil
+	}
+
 	tokenType := accessTokenType
 	token, err := r.getToken(conn, tokenType, accessToken)
 	if err != nil {
@@ -90,9 +522,9 @@ func (r *Redis) Authorize(ctx context.Context, accessToken string) (*middleware.
 		}
 	}
 
-	if err := token.validate(); err != nil {
-		if err := r.deleteToken(conn, tokenType, token); err != nil {
-			logging.SystemErrorf("revoke expired %s [%s] failed: %s", tokenType.name(), tokenType.get(token), err)
+	if err := token.validate(r.now(), r.clockSkewGrace); err != nil {
+		if deleteInvalid {
+			r.deleteInvalidTokens(ctx, conn, token)
 		}
 
 		return nil, middleware.ReadableError{
@@ -101,313 +533,427 @@ func (r *Redis) Authorize(ctx context.Context, accessToken string) (*middleware.
 		}
 	}
 
-	email, err := r.getUserEmail(conn, token.UserID)
-	if err != nil {
+	email, err := r.getActiveUserEmail(conn, token.UserID)
+	if errors.Is(err, errAccountLocked) {
+		return nil, err
+	} else if err != nil {
 		return nil, middleware.ReadableError{
 			Description: "Failed to load user email from Redis",
 			Cause:       err,
 		}
 	}
 
-	return &middleware.Authorization{
+	// CheckToken must not have side effects
+	if deleteInvalid && r.slidingSessionTTL > 0 {
+		if err := r.slideToken(ctx, token); err != nil {
+			logging.Warnf(withRequestID(ctx, "Failed to extend %s of user [%s]: %v"), tokenType.name(), token.UserID, err)
+		}
+	}
+
+	authorization := &middleware.Authorization{
 		User: openapi.UserBasicInfo{
 			Id:    token.UserID,
 			Email: email,
 		},
-	}, nil
+		Subject:  token.subject(),
+		Scopes:   token.Scopes,
+		Metadata: token.Metadata,
+	}
+
+	if deleteInvalid && r.authCache != nil {
+		// cached authorizations must not outlive the token
+		if ttl, err := token.ttl(r.now()); err == nil {
+			r.authCache.put(accessToken, authorization, ttl+r.clockSkewGrace)
+		}
+	}
+
+	return authorization, nil
 }
 
-func (r *Redis) FindOnlyUser(ctx context.Context) (*openapi.UserBasicInfo, error) {
+// RotateServerToken replaces the server token. The previous one is still accepted during the configured grace period.
+func (r *Redis) RotateServerToken(ctx context.Context, newToken string) error {
+	if newToken == "" {
+		return errors.New("server token must not be empty")
+	}
+
 	conn, err := r.redisPool.GetContext(ctx)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
 	defer closeQuietly(conn)
+	return r.rotateServerToken(conn, newToken)
+}
 
-	userIDs, err := redis.StringMap(conn.Do("HGETALL", usersIndexKey))
+func (r *Redis) rotateServerToken(conn redis.Conn, newToken string) error {
+	previousHash, err := redis.String(conn.Do("GET", r.key(serverTokenKey)))
 	switch {
 	case errors.Is(err, redis.ErrNil):
-		return nil, errUserNotFound
+		previousHash = ""
 	case err != nil:
-		return nil, middleware.ReadableError{
-			Description: "Failed to load users from Redis",
-			Cause:       err,
-		}
+		return errors.Wrap(err, "get server token")
 	}
 
-	var first *openapi.UserBasicInfo = nil
-	for email, userID := range userIDs {
-		if first != nil {
-			return nil, errMultipleUsers
-		} else {
-			first = &openapi.UserBasicInfo{
-				Id:    userID,
-				Email: email,
-			}
-		}
+	if _, err := conn.Do("MULTI"); err != nil {
+		return errors.Wrap(err, "start transaction")
 	}
 
-	if first == nil {
-		return nil, errUserNotFound
+	if previousHash != "" {
+		if _, err := conn.Do("SET", r.key(previousServerTokenKey), previousHash, "PX", r.serverTokenGracePeriod.Milliseconds()); err != nil {
+			discardQuietly(conn)
+			return errors.Wrap(err, "save previous server token")
+		}
 	}
 
-	return first, nil
-}
+	if _, err := conn.Do("SET", r.key(serverTokenKey), hashServerToken(newToken)); err != nil {
+		discardQuietly(conn)
+		return errors.Wrap(err, "save server token")
+	}
 
-func (r *Redis) HasUsers(ctx context.Context) (bool, error) {
-	_, err := r.FindOnlyUser(ctx)
-	switch {
-	case errors.Is(err, errUserNotFound):
-		return false, nil
-	case errors.Is(err, errMultipleUsers):
-		return true, nil
-	case err != nil:
-		return false, err
-	default:
-		return true, nil
+	if err := execTransaction(conn); err != nil {
+		return errors.Wrap(err, "rotate server token")
 	}
+
+	return nil
 }
 
-func (r *Redis) GetUserEmail(ctx context.Context, userID string) (string, error) {
-	conn, err := r.redisPool.GetContext(ctx)
-	if err != nil {
-		return "", err
+// initServerToken reconciles the configured server token with the stored one. Tokens rotated with RotateServerToken
+// are kept until the configured value changes, which rotates the stored token to it.
+func (r *Redis) initServerToken(token string) error {
+	conn := r.redisPool.Get()
+	defer closeQuietly(conn)
+
+	hash := hashServerToken(token)
+	configuredHash, err := redis.String(conn.Do("GET", r.key(configuredServerTokenKey)))
+	if err != nil && !errors.Is(err, redis.ErrNil) {
+		return errors.Wrap(err, "get configured server token")
 	}
 
-	defer closeQuietly(conn)
-	email, err := r.getUserEmail(conn, userID)
-	if err != nil {
-		return "", middleware.ReadableError{
-			Description: "Failed to load user email from Redis",
-			Cause:       err,
+	if configuredHash != hash {
+		if err := r.rotateServerToken(conn, token); err != nil {
+			return err
+		}
+
+		if _, err := conn.Do("SET", r.key(configuredServerTokenKey), hash); err != nil {
+			return errors.Wrap(err, "save configured server token")
 		}
+
+		if configuredHash != "" {
+			logging.Infof("Stored server token has been replaced with the changed configured one")
+		}
+
+		return nil
 	}
 
-	return email, nil
+	if _, err := conn.Do("SET", r.key(serverTokenKey), hash, "NX"); err != nil {
+		return errors.Wrap(err, "save server token")
+	}
+
+	if ok, err := r.isServerToken(conn, token); err != nil {
+		return err
+	} else if !ok {
+		logging.Warnf("⚠️ Configured server token (server.auth) has been rotated and is not accepted anymore. " +
+			"Change the configured token to replace the rotated one.")
+	}
+
+	return nil
 }
 
-func (r *Redis) GetUserIDByEmail(ctx context.Context, userEmail string) (string, error) {
+// IsServerToken checks if the token is the stored server token or the previous one within the rotation grace period.
+// It reads from the primary, so that rotations take effect immediately regardless of replication lag.
+func (r *Redis) IsServerToken(ctx context.Context, token string) (bool, error) {
 	conn, err := r.redisPool.GetContext(ctx)
 	if err != nil {
-		return "", err
+		return false, err
 	}
 
 	defer closeQuietly(conn)
-	email, err := r.getUserIDByEmail(conn, userEmail)
+	return r.isServerToken(conn, token)
+}
+
+func (r *Redis) isServerToken(conn redis.Conn, token string) (bool, error) {
+	hashes, err := r.getServerTokenHashes(conn)
 	if err != nil {
-		return "", middleware.ReadableError{
-			Description: "Failed to load user by email from Redis",
-			Cause:       err,
+		return false, err
+	}
+
+	return matchServerToken(hashes, token), nil
+}
+
+func (r *Redis) getServerTokenHashes(conn redis.Conn) ([]string, error) {
+	return redis.Strings(conn.Do("MGET", r.key(serverTokenKey), r.key(previousServerTokenKey)))
+}
+
+func matchServerToken(hashes []string, token string) bool {
+	hash := []byte(hashServerToken(token))
+	matched := 0
+	for _, stored := range hashes {
+		if stored != "" {
+			matched |= subtle.ConstantTimeCompare([]byte(stored), hash)
 		}
 	}
 
-	return email, nil
+	return matched == 1
 }
 
-func (r *Redis) RefreshToken(ctx context.Context, refreshToken string) (*openapi.TokensResponse, error) {
-	conn, err := r.redisPool.GetContext(ctx)
+// AuthorizeBatch authorizes multiple access tokens using a single connection and pipelined lookups.
+// Results are positional: for each access token either the authorization or the error is set.
+func (r *Redis) AuthorizeBatch(ctx context.Context, accessTokens []string) ([]*middleware.Authorization, []error) {
+	results := make([]*middleware.Authorization, len(accessTokens))
+	errs := make([]error, len(accessTokens))
+	failAll := func(err error) ([]*middleware.Authorization, []error) {
+		for i := range errs {
+			errs[i] = err
+		}
+
+		return results, errs
+	}
+
+	conn, err := r.replicaPool.GetContext(ctx)
 	if err != nil {
-		return nil, err
+		return failAll(err)
 	}
 
 	defer closeQuietly(conn)
 
-	tokenType := refreshTokenType
-	token, err := r.getToken(conn, tokenType, refreshToken)
+	serverTokenHashes, err := r.getServerTokenHashes(conn)
 	if err != nil {
-		return nil, middleware.ReadableError{
-			Description: "Failed to load user refresh token from Redis",
+		return failAll(middleware.ReadableError{
+			Description: "Failed to load server token from Redis",
 			Cause:       err,
+		})
+	}
+
+	tokenType := accessTokenType
+	for _, accessToken := range accessTokens {
+		if err := r.sendTokenLookups(conn, tokenType, accessToken); err != nil {
+			return failAll(errors.Wrap(err, "send token lookup"))
 		}
 	}
 
-	if err := token.validate(); err != nil {
-		if errors.Is(err, errExpiredToken) {
-			if err := r.revokeToken(conn, token); err != nil {
-				logging.SystemErrorf("revoke expired %s [%s] failed: %s", tokenType.name(), token, err)
+	if err := conn.Flush(); err != nil {
+		return failAll(errors.Wrap(err, "flush token lookups"))
+	}
+
+	tokens := make([]*redisToken, len(accessTokens))
+	for i, accessToken := range accessTokens {
+		data, err := receiveTokenLookups(conn)
+		token, err := r.parseToken(accessToken, data, err)
+		switch {
+		case matchServerToken(serverTokenHashes, accessToken):
+			results[i] = &middleware.Authorization{IsAdmin: true}
+		case err != nil:
+			errs[i] = middleware.ReadableError{
+				Description: "Failed to load user access token from Redis",
+				Cause:       err,
 			}
+		default:
+			tokens[i] = token
 		}
+	}
 
-		return nil, middleware.ReadableError{
-			Description: "Failed to validate user refresh token",
-			Cause:       err,
+	var invalid []*redisToken
+	for i, token := range tokens {
+		if token == nil {
+			continue
+		}
+
+		if err := token.validate(r.now(), r.clockSkewGrace); err != nil {
+			invalid = append(invalid, token)
+			tokens[i], errs[i] = nil, middleware.ReadableError{
+				Description: "User access token is invalid",
+				Cause:       err,
+			}
 		}
 	}
 
-	if err := r.revokeToken(conn, token); err != nil {
-		return nil, middleware.ReadableError{
-			Description: "Failed to revoke previous user token",
-			Cause:       err,
+	if len(invalid) > 0 {
+		r.deleteInvalidTokens(ctx, conn, invalid...)
+	}
+
+	for i, token := range tokens {
+		if token == nil {
+			continue
+		}
+
+		if err := conn.Send("HMGET", r.key(userKey(token.UserID)), userEmailField, userLockedField); err != nil {
+			tokens[i], errs[i] = nil, errors.Wrap(err, "send user email lookup")
 		}
 	}
 
-	tokenPair, err := r.generateTokenPair(conn, token.UserID, defaultTokenPairTTL)
-	if err != nil {
-		return nil, middleware.ReadableError{
-			Description: "Failed to generate new token pair in Redis",
-			Cause:       err,
+	if err := conn.Flush(); err != nil {
+		for i, token := range tokens {
+			if token != nil {
+				errs[i] = errors.Wrap(err, "flush user email lookups")
+			}
 		}
+
+		return results, errs
 	}
 
-	return tokenPair, nil
+	for i, token := range tokens {
+		if token == nil {
+			continue
+		}
+
+		if email, err := parseActiveUserEmail(redis.Strings(conn.Receive())); errors.Is(err, errAccountLocked) {
+			errs[i] = err
+		} else if err != nil {
+			errs[i] = middleware.ReadableError{
+				Description: "Failed to load user email from Redis",
+				Cause:       err,
+			}
+		} else {
+			results[i] = &middleware.Authorization{
+				User: openapi.UserBasicInfo{
+					Id:    token.UserID,
+					Email: email,
+				},
+				Subject:  token.subject(),
+				Scopes:   token.Scopes,
+				Metadata: token.Metadata,
+			}
+		}
+	}
+
+	return results, errs
 }
 
-func (r *Redis) SignOut(ctx context.Context, accessToken string) error {
-	conn, err := r.redisPool.GetContext(ctx)
+func (r *Redis) FindOnlyUser(ctx context.Context) (*openapi.UserBasicInfo, error) {
+	conn, err := r.replicaPool.GetContext(ctx)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	defer closeQuietly(conn)
 
-	token, err := r.getToken(conn, accessTokenType, accessToken)
+	users, err := r.listIndexedUsers(conn)
 	switch {
-	case errors.Is(err, errUnknownToken):
-		return nil
+	case errors.Is(err, redis.ErrNil):
+		return nil, ErrUserNotFound
 	case err != nil:
-		return middleware.ReadableError{
-			Description: "Failed to load user access token from Redis",
+		return nil, middleware.ReadableError{
+			Description: "Failed to load users from Redis",
 			Cause:       err,
 		}
 	}
 
-	if err := r.revokeToken(conn, token); err != nil {
-		return middleware.ReadableError{
-			Description: "Failed to revoke user token",
-			Cause:       err,
-		}
+	switch len(users) {
+	case 0:
+		return nil, ErrUserNotFound
+	case 1:
+		return &users[0], nil
+	default:
+		return nil, errMultipleUsers
 	}
-
-	return nil
 }
 
-func (r *Redis) AutoSignUp(ctx context.Context, email string, callback *string) (string, error) {
-	conn, err := r.redisPool.GetContext(ctx)
+// HasUsers checks the users index size, so that it doesn't load the index.
+func (r *Redis) HasUsers(ctx context.Context) (bool, error) {
+	conn, err := r.replicaPool.GetContext(ctx)
 	if err != nil {
-		return "", err
+		return false, err
 	}
 
 	defer closeQuietly(conn)
 
-	precondition := func() error {
-		switch {
-		case callback == nil || *callback == "":
-			return errors.New("callback URL is required")
-		case !r.mailSender.IsConfigured():
-			return errMailServiceNotConfigured
-		default:
-			return nil
-		}
-	}
-
-	userID, err := r.createUser(conn, email, uuid.NewV4().String(), precondition)
-	switch {
-	case errors.Is(err, ErrUserExists):
-		return userID, ErrUserExists
-	case err != nil:
-		return "", middleware.ReadableError{
-			Description: "Failed to create user",
-			Cause:       err,
-		}
-	}
-
-	err = r.sendResetPasswordLink(conn, userID, email, *callback, r.mailSender.SendAccountCreated)
+	count, err := redis.Int(conn.Do("HLEN", r.key(usersIndexKey)))
 	if err != nil {
-		if err := r.DeleteUser(ctx, userID); err != nil {
-			logging.SystemErrorf("Failed to rollback Redis user creation for [%s] with ID [%s]: %v", email, userID, err)
-		}
-
-		return "", middleware.ReadableError{
-			Description: "Failed to send user invitation email due to an error (user won't be added)",
+		return false, middleware.ReadableError{
+			Description: "Failed to load users count from Redis",
 			Cause:       err,
 		}
 	}
 
-	return userID, nil
+	return count > 0, nil
 }
 
-func (r *Redis) SignIn(ctx context.Context, email, password string) (*openapi.TokensResponse, error) {
-	conn, err := r.redisPool.GetContext(ctx)
+// FindAnyUserID returns ID of an arbitrary indexed user or ErrUserNotFound if there are no users.
+// It scans the users index in small batches, so that large indexes are not loaded at once.
+func (r *Redis) FindAnyUserID(ctx context.Context) (string, error) {
+	conn, err := r.replicaPool.GetContext(ctx)
 	if err != nil {
-		return nil, err
+		return "", err
 	}
 
 	defer closeQuietly(conn)
 
-	userID, err := r.getUserIDByEmail(conn, email)
-	if err != nil {
-		return nil, middleware.ReadableError{
-			Description: "Failed to load user ID from Redis",
-			Cause:       err,
+	cursor := 0
+	for {
+		reply, err := redis.Values(conn.Do("HSCAN", r.key(usersIndexKey), cursor, "COUNT", 1))
+		if err != nil {
+			return "", middleware.ReadableError{
+				Description: "Failed to scan users index in Redis",
+				Cause:       err,
+			}
 		}
-	}
 
-	hashedPassword, err := redis.String(conn.Do("HGET", userKey(userID), userHashedPasswordField))
-	switch {
-	case errors.Is(err, redis.ErrNil):
-		logging.SystemErrorf("User [%s] exists in [%s], but not under [%s]", userID, usersIndexKey, userKey(userID))
-		return nil, errUserNotFound
-	case err != nil:
-		return nil, middleware.ReadableError{
-			Description: "Failed to load user data from Redis",
-			Cause:       err,
+		var entries []string
+		if _, err := redis.Scan(reply, &cursor, &entries); err != nil {
+			return "", errors.Wrapf(err, "parse %s entries", r.key(usersIndexKey))
+		}
+
+		// entries are field-value pairs, and HSCAN may return empty batches before the end
+		for i := 1; i < len(entries); i += 2 {
+			if entries[i] != "" {
+				return entries[i], nil
+			}
+		}
+
+		if cursor == 0 {
+			return "", ErrUserNotFound
 		}
 	}
+}
 
-	if err := r.passwordEncoder.Compare(hashedPassword, password); err != nil {
-		return nil, errors.New("invalid password")
+func (r *Redis) GetUserEmail(ctx context.Context, userID string) (string, error) {
+	conn, err := r.replicaPool.GetContext(ctx)
+	if err != nil {
+		return "", err
 	}
 
-	tokenPair, err := r.generateTokenPair(conn, userID, defaultTokenPairTTL)
+	defer closeQuietly(conn)
+	email, err := r.getUserEmail(conn, userID)
 	if err != nil {
-		return nil, middleware.ReadableError{
-			Description: "Failed to generate new token pair",
+		return "", middleware.ReadableError{
+			Description: "Failed to load user email from Redis",
 			Cause:       err,
 		}
 	}
 
-	return tokenPair, nil
+	return email, nil
 }
 
-func (r *Redis) SignInSSO(ctx context.Context, provider string, sso *handlers.SSOSession, ttl time.Duration) (*openapi.TokensResponse, error) {
-	conn, err := r.redisPool.GetContext(ctx)
+func (r *Redis) GetUserIDByEmail(ctx context.Context, userEmail string) (string, error) {
+	conn, err := r.replicaPool.GetContext(ctx)
 	if err != nil {
-		return nil, err
+		return "", err
 	}
 
 	defer closeQuietly(conn)
-
-	userID, err := r.getUserIDByEmail(conn, sso.Email)
+	email, err := r.getUserIDByEmail(conn, userEmail)
 	if err != nil {
-		return nil, middleware.ReadableError{
-			Description: fmt.Sprintf("User %s cannot be found", sso.Email),
+		return "", middleware.ReadableError{
+			Description: "Failed to load user by email from Redis",
 			Cause:       err,
 		}
 	}
 
-	tokenPair, err := r.generateTokenPair(conn, userID, tokenPairTTL{access: ttl, refresh: time.Second})
-	if err != nil {
-		return nil, middleware.ReadableError{
-			Description: "Failed to generate new token pair",
-			Cause:       err,
-		}
-	}
+	return email, nil
+}
 
-	if ssoToken, err := json.Marshal(ssoRedisToken{
-		Provider:    provider,
-		UserID:      sso.UserID,
-		AccessToken: sso.AccessToken,
-	}); err != nil {
-		return nil, errors.Wrap(err, "marshal sso token")
-	} else if _, err := conn.Do("HSET", ssoTokensKey, userID, ssoToken); err != nil {
-		return nil, errors.Wrap(err, "persist sso token")
+// FindUserIDByEmail returns ID of the user with the given email or ErrUserNotFound.
+func (r *Redis) FindUserIDByEmail(ctx context.Context, email string) (string, error) {
+	conn, err := r.replicaPool.GetContext(ctx)
+	if err != nil {
+		return "", err
 	}
 
-	return tokenPair, nil
+	defer closeQuietly(conn)
+	return r.getUserIDByEmail(conn, email)
 }
 
-func (r *Redis) SignUp(ctx context.Context, email, password string) (*openapi.TokensResponse, error) {
+func (r *Redis) RefreshToken(ctx context.Context, refreshToken string) (*openapi.TokensResponse, error) {
 	conn, err := r.redisPool.GetContext(ctx)
 	if err != nil {
 		return nil, err
@@ -415,30 +961,53 @@ func (r *Redis) SignUp(ctx context.Context, email, password string) (*openapi.To
 
 	defer closeQuietly(conn)
 
-	userID, err := r.createUser(conn, email, password, always)
-	if err != nil {
+	tokenType := refreshTokenType
+	token, err := r.getToken(conn, tokenType, refreshToken)
+	switch {
+	case errors.Is(err, errUnknownToken):
+		return nil, ErrRefreshUnknown
+	case err != nil:
 		return nil, middleware.ReadableError{
-			Description: "Failed to create new user in Redis",
+			Description: "Failed to load user refresh token from Redis",
 			Cause:       err,
 		}
 	}
 
-	tokenPair, err := r.generateTokenPair(conn, userID, defaultTokenPairTTL)
+	if err := token.validate(r.now(), r.clockSkewGrace); err != nil {
+		if errors.Is(err, errExpiredToken) {
+			if err := r.revokeToken(conn, token); err != nil {
+				logging.SystemErrorf(withRequestID(ctx, "revoke expired %s [%s] failed: %s"), tokenType.name(), token, err)
+			}
+
+			return nil, ErrRefreshExpired
+		}
+
+		return nil, middleware.ReadableError{
+			Description: "Failed to validate user refresh token",
+			Cause:       err,
+		}
+	}
+
+	if err := r.revokeToken(conn, token); err != nil {
+		return nil, middleware.ReadableError{
+			Description: "Failed to revoke previous user token",
+			Cause:       err,
+		}
+	}
+
+	tokenPair, err := r.generateScopedTokenPair(conn, token.UserID, r.renewedTokenPairTTL(token), token.Scopes)
 	if err != nil {
 		return nil, middleware.ReadableError{
-			Description: "Failed to generate new token pair",
+			Description: "Failed to generate new token pair in Redis",
 			Cause:       err,
 		}
 	}
 
+	logging.Debugf(withRequestID(ctx, "User [%s] has refreshed tokens"), token.UserID)
 	return tokenPair, nil
 }
 
-func (r *Redis) SendResetPasswordLink(ctx context.Context, email, callback string) error {
-	if !r.mailSender.IsConfigured() {
-		return errMailServiceNotConfigured
-	}
-
+func (r *Redis) SignOut(ctx context.Context, accessToken string) error {
 	conn, err := r.redisPool.GetContext(ctx)
 	if err != nil {
 		return err
@@ -446,67 +1015,66 @@ func (r *Redis) SendResetPasswordLink(ctx context.Context, email, callback strin
 
 	defer closeQuietly(conn)
 
-	userID, err := r.getUserIDByEmail(conn, email)
-	if err != nil {
+	token, err := r.getToken(conn, accessTokenType, accessToken)
+	switch {
+	case errors.Is(err, errUnknownToken):
+		return nil
+	case err != nil:
 		return middleware.ReadableError{
-			Description: "Failed to load user ID by email",
+			Description: "Failed to load user access token from Redis",
 			Cause:       err,
 		}
 	}
 
-	if err := r.sendResetPasswordLink(conn, userID, email, callback, r.mailSender.SendResetPassword); err != nil {
+	if err := r.revokeToken(conn, token); err != nil {
 		return middleware.ReadableError{
-			Description: "Failed to send reset password link",
+			Description: "Failed to revoke user token",
 			Cause:       err,
 		}
 	}
 
+	logging.Debugf(withRequestID(ctx, "User [%s] has signed out"), token.UserID)
+
 	return nil
 }
 
-func (r *Redis) ResetPassword(ctx context.Context, resetID, newPassword string) (*openapi.TokensResponse, error) {
+// SignOutAccessOnly revokes the access token, but keeps the linked refresh token valid, so that the client
+// may re-establish the session later with RefreshToken without asking for credentials.
+// Security-wise the session stays alive until the refresh token expires or is revoked with RevokeToken,
+// SignOutUsers or a password change, so clients must store it as securely as the credentials themselves.
+// Use SignOut to end the session completely. Unknown tokens are ignored.
+func (r *Redis) SignOutAccessOnly(ctx context.Context, accessToken string) error {
 	conn, err := r.redisPool.GetContext(ctx)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
 	defer closeQuietly(conn)
 
-	resetKey := resetKey(resetID)
-	userID, err := redis.String(conn.Do("GET", resetKey))
+	token, err := r.getToken(conn, accessTokenType, accessToken)
 	switch {
-	case errors.Is(err, redis.ErrNil):
-		return nil, errors.New("Invalid reset password ID")
+	case errors.Is(err, errUnknownToken):
+		return nil
 	case err != nil:
-		return nil, middleware.ReadableError{
-			Description: "Failed to load user ID by reset password ID",
-			Cause:       err,
-		}
-	}
-
-	if err := r.changePassword(conn, userID, newPassword); err != nil {
-		return nil, middleware.ReadableError{
-			Description: "Failed to change user password in Redis",
+		return middleware.ReadableError{
+			Description: "Failed to load user access token from Redis",
 			Cause:       err,
 		}
 	}
 
-	if _, err := conn.Do("DEL", resetKey); err != nil {
-		return nil, errors.Wrap(err, "delete reset id")
-	}
-
-	tokenPair, err := r.generateTokenPair(conn, userID, defaultTokenPairTTL)
-	if err != nil {
-		return nil, middleware.ReadableError{
-			Description: "Failed to generate new token pair",
+	if err := r.deleteToken(conn, accessTokenType, token); err != nil {
+		return middleware.ReadableError{
+			Description: "Failed to revoke user access token",
 			Cause:       err,
 		}
 	}
 
-	return tokenPair, nil
+	return nil
 }
 
-func (r *Redis) ChangePassword(ctx context.Context, accessToken, newPassword string) (*openapi.TokensResponse, error) {
+// IssueAccessOnly issues an access token without refresh token for clients which never refresh,
+// e.g. short-lived CLI sessions. RefreshToken and RefreshExpiresAt of the response are empty.
+func (r *Redis) IssueAccessOnly(ctx context.Context, userID string) (*openapi.TokensResponse, error) {
 	conn, err := r.redisPool.GetContext(ctx)
 	if err != nil {
 		return nil, err
@@ -514,42 +1082,53 @@ func (r *Redis) ChangePassword(ctx context.Context, accessToken, newPassword str
 
 	defer closeQuietly(conn)
 
-	token, err := r.getToken(conn, accessTokenType, accessToken)
-	if err != nil {
-		return nil, middleware.ReadableError{
-			Description: "Failed to load user access token from Redis",
-			Cause:       err,
-		}
-	}
-
-	if err := r.changePassword(conn, token.UserID, newPassword); err != nil {
+	if _, err := r.getUserEmail(conn, userID); err != nil {
 		return nil, middleware.ReadableError{
-			Description: "Failed to change user password in Redis",
+			Description: "Failed to load user from Redis",
 			Cause:       err,
 		}
 	}
 
-	tokenPair, err := r.generateTokenPair(conn, token.UserID, defaultTokenPairTTL)
-	if err != nil {
+	access := newRedisToken(r.now(), userID, accessTokenType, r.tokenGenerator(), defaultTokenPairTTL.access, defaultTokenScopes)
+	r.decorateTokens(userID, access)
+	if err := r.saveToken(conn, accessTokenType, access); err != nil {
 		return nil, middleware.ReadableError{
-			Description: "Failed to generate new token pair",
+			Description: "Failed to save access token in Redis",
 			Cause:       err,
 		}
 	}
 
-	return tokenPair, nil
+	return &openapi.TokensResponse{
+		UserId:          userID,
+		AccessToken:     access.AccessToken,
+		AccessExpiresAt: access.ExpiredAt,
+	}, nil
 }
 
-func (r *Redis) UpdatePassword(ctx context.Context, userID, newPassword string) error {
+// RevokeToken revokes the token pair linked to the given access or refresh token, leaving other user sessions intact.
+// Unknown tokens are ignored.
+func (r *Redis) RevokeToken(ctx context.Context, token string) error {
 	conn, err := r.redisPool.GetContext(ctx)
 	if err != nil {
 		return err
 	}
 
 	defer closeQuietly(conn)
-	if err := r.changePassword(conn, userID, newPassword); err != nil {
+
+	linked, _, err := r.findToken(conn, token)
+	switch {
+	case errors.Is(err, errUnknownToken):
+		return nil
+	case err != nil:
 		return middleware.ReadableError{
-			Description: "Failed to change user password in Redis",
+			Description: "Failed to load user token from Redis",
+			Cause:       err,
+		}
+	}
+
+	if err := r.revokeToken(conn, linked); err != nil {
+		return middleware.ReadableError{
+			Description: "Failed to revoke user token",
 			Cause:       err,
 		}
 	}
@@ -557,106 +1136,1742 @@ func (r *Redis) UpdatePassword(ctx context.Context, userID, newPassword string)
 	return nil
 }
 
-func (r *Redis) ChangeEmail(ctx context.Context, oldEmail, newEmail string) (string, error) {
-	conn, err := r.redisPool.GetContext(ctx)
+// FindToken looks the token up as an access token first and then as a refresh token and returns the matched type.
+// It returns errUnknownToken if the token is neither. Token expiration is not checked, see TokenInfo.ExpiresAt.
+func (r *Redis) FindToken(ctx context.Context, token string) (*TokenInfo, redisTokenType, error) {
+	conn, err := r.replicaPool.GetContext(ctx)
 	if err != nil {
-		return "", err
+		return nil, nil, err
 	}
 
 	defer closeQuietly(conn)
 
-	userID, err := r.getUserIDByEmail(conn, oldEmail)
-	if err != nil {
-		return "", middleware.ReadableError{
-			Description: "Failed to load user ID by email from Redis",
-			Cause:       err,
-		}
-	}
-
-	_, err = r.getUserIDByEmail(conn, newEmail)
+	found, tokenType, err := r.findToken(conn, token)
 	switch {
-	case errors.Is(err, errUserNotFound):
-	// is ok
+	case errors.Is(err, errUnknownToken):
+		return nil, nil, err
 	case err != nil:
-		return "", middleware.ReadableError{
-			Description: "Unable to check email uniqueness",
+		return nil, nil, middleware.ReadableError{
+			Description: "Failed to load user token from Redis",
 			Cause:       err,
 		}
-	default:
-		return "", ErrUserExists
 	}
 
-	userKey := userKey(userID)
-	if _, err := conn.Do("HSET", userKey, userEmailField, newEmail); err != nil {
-		return "", errors.Wrapf(err, "update %s", userEmailField)
+	info, err := found.info()
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "malformed %s of user [%s]", tokenType.name(), found.UserID)
 	}
 
-	if _, err := conn.Do("HSET", usersIndexKey, newEmail, userID); err != nil {
-		return "", errors.Wrapf(err, "update %s", usersIndexKey)
+	return info, tokenType, nil
+}
+
+// SignOutUsers revokes all sessions of the given users on a single connection.
+// It keeps going when revocation fails for some user and returns these failures keyed by user ID.
+// Note that each user revocation scans all stored tokens, so the whole call is O(users * tokens).
+func (r *Redis) SignOutUsers(ctx context.Context, userIDs []string) (map[string]error, error) {
+	conn, err := r.redisPool.GetContext(ctx)
+	if err != nil {
+		return nil, err
 	}
 
-	if _, err := conn.Do("HDEL", usersIndexKey, oldEmail); err != nil {
-		return "", errors.Wrapf(err, "remove previous email association from %s", usersIndexKey)
+	defer closeQuietly(conn)
+
+	failed := make(map[string]error)
+	for _, userID := range userIDs {
+		if err := r.revokeTokens(conn, userID); err != nil {
+			logging.SystemErrorf(withRequestID(ctx, "Failed to revoke user [%s] tokens: %v"), userID, err)
+			failed[userID] = err
+		}
 	}
 
-	return userID, nil
+	return failed, nil
 }
 
-func (r *Redis) ListUsers(ctx context.Context) ([]openapi.UserBasicInfo, error) {
+// RevokeTokensIssuedBefore revokes token pairs of all users issued before cutoff, e.g. after key material compromise.
+// Tokens persisted without issue time are revoked too. Malformed tokens are skipped.
+// It scans and decodes all stored tokens, so it is expensive.
+func (r *Redis) RevokeTokensIssuedBefore(ctx context.Context, cutoff time.Time) (int, error) {
 	conn, err := r.redisPool.GetContext(ctx)
 	if err != nil {
-		return nil, err
+		return 0, err
 	}
 
 	defer closeQuietly(conn)
 
-	values, err := redis.StringMap(conn.Do("HGETALL", usersIndexKey))
-	if err != nil {
-		return nil, middleware.ReadableError{
-			Description: "Failed to load user email index from Redis",
-			Cause:       err,
+	// access tokens of revoked pairs, so that refresh tokens of the same pairs are not counted twice
+	revoked := make(map[string]bool)
+	for _, tokenType := range []redisTokenType{accessTokenType, refreshTokenType} {
+		scanned := 0
+		var revokeErr error
+		if err := r.forEachTokenBatch(conn, tokenType, func(batch map[string][]byte) error {
+			scanned += len(batch)
+			for key, data := range batch {
+				token, err := r.decodeToken(key, data)
+				if err != nil {
+					logging.Warnf(withRequestID(ctx, "Skipping malformed %s data: %v"), tokenType.name(), err)
+					continue
+				}
+
+				if revoked[token.AccessToken] {
+					continue
+				}
+
+				if issuedBefore, err := token.issuedBefore(cutoff); err != nil {
+					logging.Warnf(withRequestID(ctx, "Skipping %s of user [%s]: %v"), tokenType.name(), token.UserID, err)
+					continue
+				} else if !issuedBefore {
+					continue
+				}
+
+				if err := r.revokeToken(conn, token); err != nil {
+					revokeErr = err
+					return err
+				}
+
+				revoked[token.AccessToken] = true
+			}
+
+			return nil
+		}); revokeErr != nil {
+			return len(revoked), middleware.ReadableError{
+				Description: "Failed to revoke user token",
+				Cause:       revokeErr,
+			}
+		} else if err != nil {
+			return len(revoked), middleware.ReadableError{
+				Description: fmt.Sprintf("Failed to load %s tokens from Redis", tokenType.name()),
+				Cause:       err,
+			}
 		}
-	}
 
-	result := make([]openapi.UserBasicInfo, 0, len(values))
-	for email, userID := range values {
-		result = append(result, openapi.UserBasicInfo{
-			Id:    userID,
-			Email: email,
-		})
+		logging.Infof(withRequestID(ctx, "Scanned %d %s entries, revoked %d token pairs issued before %s so far"),
+			scanned, tokenType.name(), len(revoked), timestamp.ToISOFormat(cutoff.UTC()))
 	}
 
-	return result, nil
+	return len(revoked), nil
 }
 
-func (r *Redis) CreateUser(ctx context.Context, email string) (*handlers.CreatedUser, error) {
+func (r *Redis) AutoSignUp(ctx context.Context, email string, callback *string) (string, error) {
 	conn, err := r.redisPool.GetContext(ctx)
 	if err != nil {
-		return nil, err
+		return "", err
 	}
 
 	defer closeQuietly(conn)
 
-	userID, err := r.createUser(conn, email, uuid.NewV4().String(), always)
-	if err != nil {
-		return nil, middleware.ReadableError{
-			Description: "Failed to create new user in Redis",
-			Cause:       err,
+	mailSender := r.mailSender.get()
+	precondition := func() error {
+		switch {
+		case callback == nil || *callback == "":
+			return errors.New("callback URL is required")
+		case !r.isCallbackAllowed(*callback):
+			return errCallbackNotAllowed
+		case !mailSender.IsConfigured():
+			return errMailServiceNotConfigured
+		default:
+			return r.checkAdminUserLimit(conn)
+		}
+	}
+
+	userID, err := r.createUser(conn, email, "", r.tokenGenerator(), precondition)
+	switch {
+	case errors.Is(err, ErrUserExists):
+		return userID, ErrUserExists
+	case err != nil:
+		return "", middleware.ReadableError{
+			Description: "Failed to create user",
+			Cause:       err,
+		}
+	}
+
+	err = r.sendResetPasswordLink(conn, userID, email, *callback, mailSender.SendAccountCreated)
+	if err != nil {
+		if err := r.DeleteUser(ctx, userID); err != nil {
+			logging.SystemErrorf(withRequestID(ctx, "Failed to rollback Redis user creation for [%s] with ID [%s]: %v"), email, userID, err)
+		}
+
+		return "", middleware.ReadableError{
+			Description: "Failed to send user invitation email due to an error (user won't be added)",
+			Cause:       err,
+		}
+	}
+
+	return userID, nil
+}
+
+func (r *Redis) SignIn(ctx context.Context, email, password string) (*openapi.TokensResponse, error) {
+	return r.SignInWithOptions(ctx, email, password, handlers.SignInOptions{})
+}
+
+// SignInScoped issues a token pair which may only access the given scopes.
+func (r *Redis) SignInScoped(ctx context.Context, email, password string, scopes []string) (*openapi.TokensResponse, error) {
+	return r.SignInWithOptions(ctx, email, password, handlers.SignInOptions{Scopes: scopes})
+}
+
+func (r *Redis) SignInWithOptions(ctx context.Context, email, password string, opts handlers.SignInOptions) (*openapi.TokensResponse, error) {
+	return r.signIn(ctx, func(conn redis.Conn) (string, error) { return r.getUserIDByEmail(conn, email) }, password, opts)
+}
+
+// SignInByUsername acts like SignIn for users who have signed up with a username.
+func (r *Redis) SignInByUsername(ctx context.Context, username, password string) (*openapi.TokensResponse, error) {
+	return r.signIn(ctx, func(conn redis.Conn) (string, error) { return r.getUserIDByUsername(conn, username) }, password, handlers.SignInOptions{})
+}
+
+func (r *Redis) signIn(ctx context.Context, findUserID func(conn redis.Conn) (string, error), password string, opts handlers.SignInOptions) (*openapi.TokensResponse, error) {
+	scopes := opts.Scopes
+	if len(scopes) == 0 {
+		scopes = defaultTokenScopes
+	} else if err := validateScopes(scopes); err != nil {
+		return nil, err
+	}
+
+	conn, err := r.redisPool.GetContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	defer closeQuietly(conn)
+
+	userID, err := findUserID(conn)
+	if err != nil {
+		return nil, middleware.ReadableError{
+			Description: "Failed to load user ID from Redis",
+			Cause:       err,
+		}
+	}
+
+	hashedPassword, err := redis.String(conn.Do("HGET", r.key(userKey(userID)), userHashedPasswordField))
+	switch {
+	case errors.Is(err, redis.ErrNil):
+		logging.SystemErrorf(withRequestID(ctx, "User [%s] exists in index, but not under [%s]"), userID, r.key(userKey(userID)))
+		return nil, ErrUserNotFound
+	case err != nil:
+		return nil, middleware.ReadableError{
+			Description: "Failed to load user data from Redis",
+			Cause:       err,
+		}
+	}
+
+	if err := r.passwordEncoder.Compare(hashedPassword, password); err != nil {
+		return nil, errors.New("invalid password")
+	}
+
+	// checked after password, so that lock status is not disclosed to anyone but the user
+	email, err := r.getActiveUserEmail(conn, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	if r.checkDomainOnSignIn {
+		if err := r.checkEmailDomain(email); err != nil {
+			return nil, err
+		}
+	}
+
+	if unverified, err := redis.Bool(conn.Do("HEXISTS", r.key(userKey(userID)), userUnverifiedField)); err != nil {
+		return nil, middleware.ReadableError{
+			Description: "Failed to load user verification status from Redis",
+			Cause:       err,
+		}
+	} else if unverified {
+		return nil, errEmailNotVerified
+	}
+
+	passwordExpired, err := r.isPasswordExpired(conn, userID)
+	if err != nil {
+		return nil, middleware.ReadableError{
+			Description: "Failed to load user password change time from Redis",
+			Cause:       err,
+		}
+	}
+
+	ttl := defaultTokenPairTTL
+	if opts.RememberMe {
+		ttl = r.rememberMeTokenPairTTL()
+	}
+
+	tokenPair, err := r.generateScopedTokenPair(conn, userID, ttl, scopes)
+	if err != nil {
+		return nil, middleware.ReadableError{
+			Description: "Failed to generate new token pair",
+			Cause:       err,
+		}
+	}
+
+	if passwordExpired {
+		tokenPair.PasswordExpired = &passwordExpired
+	}
+
+	logging.Debugf(withRequestID(ctx, "User [%s] has signed in"), userID)
+	return tokenPair, nil
+}
+
+func (r *Redis) SignInSSO(ctx context.Context, provider string, sso *handlers.SSOSession, ttl time.Duration) (*openapi.TokensResponse, error) {
+	conn, err := r.redisPool.GetContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	defer closeQuietly(conn)
+
+	userID, err := r.getUserIDByEmail(conn, sso.Email)
+	if err != nil {
+		return nil, middleware.ReadableError{
+			Description: fmt.Sprintf("User %s cannot be found", sso.Email),
+			Cause:       err,
+		}
+	}
+
+	tokenPair, err := r.generateTokenPair(conn, userID, tokenPairTTL{access: ttl, refresh: time.Second})
+	if err != nil {
+		return nil, middleware.ReadableError{
+			Description: "Failed to generate new token pair",
+			Cause:       err,
+		}
+	}
+
+	if ssoToken, err := json.Marshal(ssoRedisToken{
+		Provider:    provider,
+		UserID:      sso.UserID,
+		AccessToken: sso.AccessToken,
+	}); err != nil {
+		return nil, errors.Wrap(err, "marshal sso token")
+	} else if _, err := conn.Do("HSET", r.key(ssoTokensKey), userID, ssoToken); err != nil {
+		return nil, errors.Wrap(err, "persist sso token")
+	}
+
+	return tokenPair, nil
+}
+
+func (r *Redis) SignUp(ctx context.Context, email, password string) (*openapi.TokensResponse, error) {
+	return r.SignUpWithUsername(ctx, email, "", password)
+}
+
+// SignUpWithUsername acts like SignUp, but also lets the user sign in with the username. Empty username is ignored.
+// Usernames are unique like emails, ErrUsernameExists is returned for taken ones.
+func (r *Redis) SignUpWithUsername(ctx context.Context, email, username, password string) (*openapi.TokensResponse, error) {
+	conn, err := r.redisPool.GetContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	defer closeQuietly(conn)
+
+	userID, err := r.createUser(conn, email, username, password, func() error { return r.checkUserLimit(conn) })
+	if err != nil {
+		return nil, middleware.ReadableError{
+			Description: "Failed to create new user in Redis",
+			Cause:       err,
+		}
+	}
+
+	tokenPair, err := r.generateTokenPair(conn, userID, defaultTokenPairTTL)
+	if err != nil {
+		return nil, middleware.ReadableError{
+			Description: "Failed to generate new token pair",
+			Cause:       err,
+		}
+	}
+
+	logging.Debugf(withRequestID(ctx, "User [%s] has signed up"), userID)
+	return tokenPair, nil
+}
+
+// SignUpWithVerification creates a user who can't sign in until the email is verified with the link sent
+// to it. The link is callback with {{token}} replaced by verification ID for VerifyEmail. The user is not created
+// if the link can't be sent. Use SignUp for deployments which don't verify emails.
+func (r *Redis) SignUpWithVerification(ctx context.Context, email, password, callback string) (string, error) {
+	conn, err := r.redisPool.GetContext(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	defer closeQuietly(conn)
+
+	mailSender := r.mailSender.get()
+	precondition := func() error {
+		switch {
+		case callback == "":
+			return errors.New("callback URL is required")
+		case !r.isCallbackAllowed(callback):
+			return errCallbackNotAllowed
+		case !mailSender.IsConfigured():
+			return errMailServiceNotConfigured
+		default:
+			return r.checkUserLimit(conn)
+		}
+	}
+
+	userID, err := r.createUser(conn, email, "", password, precondition, userUnverifiedField, timestamp.ToISOFormat(r.now().UTC()))
+	if err != nil {
+		return "", middleware.ReadableError{
+			Description: "Failed to create new user in Redis",
+			Cause:       err,
+		}
+	}
+
+	verifyID := "verify-" + r.tokenGenerator()
+	if _, err = conn.Do("SET", r.key(verifyKey(verifyID)), userID, "EX", verifyIDTTLSeconds); err == nil {
+		err = mailSender.SendEmailVerification(email, strings.ReplaceAll(callback, "{{token}}", verifyID))
+	}
+
+	if err != nil {
+		if err := r.DeleteUser(ctx, userID); err != nil {
+			logging.SystemErrorf(withRequestID(ctx, "Failed to rollback Redis user creation for [%s] with ID [%s]: %v"), email, userID, err)
+		}
+
+		return "", middleware.ReadableError{
+			Description: "Failed to send email verification link due to an error (user won't be added)",
+			Cause:       err,
+		}
+	}
+
+	return userID, nil
+}
+
+// VerifyEmail activates the user signed up with SignUpWithVerification. Verification IDs are single-use.
+func (r *Redis) VerifyEmail(ctx context.Context, verifyID string) error {
+	conn, err := r.redisPool.GetContext(ctx)
+	if err != nil {
+		return err
+	}
+
+	defer closeQuietly(conn)
+
+	verifyKey := r.key(verifyKey(verifyID))
+	userID, err := redis.String(conn.Do("GET", verifyKey))
+	switch {
+	case errors.Is(err, redis.ErrNil):
+		return errors.New("Invalid email verification ID")
+	case err != nil:
+		return middleware.ReadableError{
+			Description: "Failed to load user ID by email verification ID",
+			Cause:       err,
+		}
+	}
+
+	if _, err := r.getUserEmail(conn, userID); err != nil {
+		return middleware.ReadableError{
+			Description: "Failed to load user from Redis",
+			Cause:       err,
+		}
+	}
+
+	if _, err := conn.Do("HDEL", r.key(userKey(userID)), userUnverifiedField); err != nil {
+		return errors.Wrap(err, "mark email verified")
+	}
+
+	if _, err := conn.Do("DEL", verifyKey); err != nil {
+		return errors.Wrap(err, "delete email verification id")
+	}
+
+	return nil
+}
+
+func (r *Redis) SendResetPasswordLink(ctx context.Context, email, callback string) error {
+	mailSender := r.mailSender.get()
+	if !mailSender.IsConfigured() {
+		return errMailServiceNotConfigured
+	}
+
+	if !r.isCallbackAllowed(callback) {
+		return errCallbackNotAllowed
+	}
+
+	conn, err := r.redisPool.GetContext(ctx)
+	if err != nil {
+		return err
+	}
+
+	defer closeQuietly(conn)
+
+	if ok, err := r.startResetPasswordCooldown(conn, email); err != nil {
+		return middleware.ReadableError{
+			Description: "Failed to check reset password cooldown",
+			Cause:       err,
+		}
+	} else if !ok {
+		logging.Infof(withRequestID(ctx, "Skipping reset password link for [%s]: cooldown is active"), email)
+		return nil
+	}
+
+	userID, err := r.getUserIDByEmail(conn, email)
+	if err != nil {
+		return middleware.ReadableError{
+			Description: "Failed to load user ID by email",
+			Cause:       err,
+		}
+	}
+
+	if err := r.sendResetPasswordLink(conn, userID, email, callback, mailSender.SendResetPassword); err != nil {
+		// let the user retry right away
+		if _, err := conn.Do("DEL", r.key(resetCooldownKey(email))); err != nil {
+			logging.SystemErrorf(withRequestID(ctx, "Failed to clear reset password cooldown for [%s]: %v"), email, err)
+		}
+
+		return middleware.ReadableError{
+			Description: "Failed to send reset password link",
+			Cause:       err,
+		}
+	}
+
+	return nil
+}
+
+// RevokeAllResetLinks invalidates outstanding reset password links of all users, e.g. if they may have leaked
+// through a compromised mail provider, and returns the number of revoked links. Links of created users are revoked too.
+// It iterates over all keys with SCAN, so it doesn't block Redis, but its cost grows with the whole keyspace size.
+func (r *Redis) RevokeAllResetLinks(ctx context.Context) (int, error) {
+	conn, err := r.redisPool.GetContext(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	defer closeQuietly(conn)
+
+	revoked, err := r.deleteKeys(conn, r.key(resetKey("*")))
+	if err != nil {
+		return revoked, middleware.ReadableError{
+			Description: "Failed to revoke reset password links",
+			Cause:       err,
+		}
+	}
+
+	// per-user tracking sets would point to missing reset IDs only
+	if _, err := r.deleteKeys(conn, r.key(userResetsKey("*"))); err != nil {
+		logging.SystemErrorf(withRequestID(ctx, "Failed to delete reset password link tracking: %v"), err)
+	}
+
+	logging.Infof(withRequestID(ctx, "Revoked %d reset password links"), revoked)
+	return revoked, nil
+}
+
+// PendingReset describes an outstanding reset password link. The reset ID itself is not exposed.
+type PendingReset struct {
+	UserID string
+
+	// Email is the primary email of the user. It is empty if the user has been deleted.
+	Email string
+
+	// ExpiresIn is the time left until the link expires.
+	ExpiresIn time.Duration
+}
+
+// ListPendingResets returns outstanding reset password links of all users sorted by user ID, including links
+// of created users who haven't set their passwords yet. It iterates over all keys with SCAN, so it doesn't block
+// Redis, but its cost grows with the whole keyspace size, not just with the number of links.
+func (r *Redis) ListPendingResets(ctx context.Context) ([]PendingReset, error) {
+	conn, err := r.replicaPool.GetContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	defer closeQuietly(conn)
+
+	var resets []PendingReset
+	if err := r.forEachKeyBatch(conn, r.key(resetKey("*")), func(keys []string) error {
+		for _, key := range keys {
+			if err := conn.Send("GET", key); err != nil {
+				return errors.Wrap(err, "send reset password link lookup")
+			} else if err := conn.Send("PTTL", key); err != nil {
+				return errors.Wrap(err, "send reset password link TTL lookup")
+			}
+		}
+
+		if err := conn.Flush(); err != nil {
+			return errors.Wrap(err, "flush reset password link lookups")
+		}
+
+		for range keys {
+			userID, err := redis.String(conn.Receive())
+			if err != nil && !errors.Is(err, redis.ErrNil) {
+				return errors.Wrap(err, "get reset password link user")
+			}
+
+			ttl, err := redis.Int64(conn.Receive())
+			if err != nil {
+				return errors.Wrap(err, "get reset password link TTL")
+			}
+
+			// the link has expired since SCAN
+			if userID == "" || ttl == -2 {
+				continue
+			}
+
+			reset := PendingReset{UserID: userID}
+			if ttl > 0 {
+				reset.ExpiresIn = time.Duration(ttl) * time.Millisecond
+			}
+
+			resets = append(resets, reset)
+		}
+
+		return nil
+	}); err != nil {
+		return nil, middleware.ReadableError{
+			Description: "Failed to load reset password links from Redis",
+			Cause:       err,
+		}
+	}
+
+	for _, reset := range resets {
+		if err := conn.Send("HGET", r.key(userKey(reset.UserID)), userEmailField); err != nil {
+			return nil, errors.Wrap(err, "send user email lookup")
+		}
+	}
+
+	if err := conn.Flush(); err != nil {
+		return nil, errors.Wrap(err, "flush user email lookups")
+	}
+
+	for i := range resets {
+		email, err := redis.String(conn.Receive())
+		if err != nil && !errors.Is(err, redis.ErrNil) {
+			return nil, middleware.ReadableError{
+				Description: "Failed to load users from Redis",
+				Cause:       errors.Wrapf(err, "get user [%s] email", resets[i].UserID),
+			}
+		}
+
+		resets[i].Email = email
+	}
+
+	sort.Slice(resets, func(i, j int) bool {
+		if resets[i].UserID != resets[j].UserID {
+			return resets[i].UserID < resets[j].UserID
+		}
+
+		return resets[i].ExpiresIn < resets[j].ExpiresIn
+	})
+
+	return resets, nil
+}
+
+// RevokeResetID invalidates a single reset password link, e.g. one generated for a wrong user.
+// Revoking an unknown or already used reset ID is not an error.
+func (r *Redis) RevokeResetID(ctx context.Context, resetID string) error {
+	conn, err := r.redisPool.GetContext(ctx)
+	if err != nil {
+		return err
+	}
+
+	defer closeQuietly(conn)
+
+	resetKey := r.key(resetKey(resetID))
+	userID, err := redis.String(conn.Do("GET", resetKey))
+	switch {
+	case errors.Is(err, redis.ErrNil):
+		return nil
+	case err != nil:
+		return middleware.ReadableError{
+			Description: "Failed to load user ID by reset password ID",
+			Cause:       err,
+		}
+	}
+
+	if _, err := conn.Do("DEL", resetKey); err != nil {
+		return middleware.ReadableError{
+			Description: "Failed to revoke reset password link",
+			Cause:       err,
+		}
+	}
+
+	if _, err := conn.Do("SREM", r.key(userResetsKey(userID)), resetID); err != nil {
+		logging.SystemErrorf(withRequestID(ctx, "Failed to delete reset password link tracking of user [%s]: %v"), userID, err)
+	}
+
+	logging.Infof(withRequestID(ctx, "Revoked reset password link of user [%s]"), userID)
+	return nil
+}
+
+// deleteKeys deletes keys matching the pattern in SCAN batches and returns the number of deleted keys.
+func (r *Redis) deleteKeys(conn redis.Conn, pattern string) (int, error) {
+	deleted := 0
+	err := r.forEachKeyBatch(conn, pattern, func(keys []string) error {
+		args := make([]interface{}, len(keys))
+		for i, key := range keys {
+			args[i] = key
+		}
+
+		count, err := redis.Int(conn.Do("DEL", args...))
+		if err != nil {
+			return errors.Wrapf(err, "delete %s keys", pattern)
+		}
+
+		deleted += count
+		return nil
+	})
+
+	return deleted, err
+}
+
+// forEachKeyBatch calls fn for every non-empty batch of keys matching pattern. Keys may be passed more than once,
+// since SCAN guarantees are weak.
+func (r *Redis) forEachKeyBatch(conn redis.Conn, pattern string, fn func(keys []string) error) error {
+	cursor := 0
+	for {
+		reply, err := redis.Values(conn.Do("SCAN", cursor, "MATCH", pattern, "COUNT", keyScanBatchSize))
+		if err != nil {
+			return errors.Wrapf(err, "scan %s", pattern)
+		}
+
+		var keys []string
+		if _, err := redis.Scan(reply, &cursor, &keys); err != nil {
+			return errors.Wrapf(err, "parse %s keys", pattern)
+		}
+
+		if len(keys) > 0 {
+			if err := fn(keys); err != nil {
+				return err
+			}
+		}
+
+		if cursor == 0 {
+			return nil
+		}
+	}
+}
+
+// startResetPasswordCooldown sets the cooldown marker for the email unless it is already set.
+// It returns false if the cooldown is still active.
+func (r *Redis) startResetPasswordCooldown(conn redis.Conn, email string) (bool, error) {
+	if r.resetPasswordCooldown < 0 {
+		return true, nil
+	}
+
+	_, err := redis.String(conn.Do("SET", r.key(resetCooldownKey(email)), timestamp.NowUTC(), "PX", r.resetPasswordCooldown.Milliseconds(), "NX"))
+	switch {
+	case errors.Is(err, redis.ErrNil):
+		return false, nil
+	case err != nil:
+		return false, err
+	default:
+		return true, nil
+	}
+}
+
+func (r *Redis) ResetPassword(ctx context.Context, resetID, newPassword string) (*openapi.TokensResponse, error) {
+	conn, err := r.redisPool.GetContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	defer closeQuietly(conn)
+
+	resetKey := r.key(resetKey(resetID))
+	userID, err := redis.String(conn.Do("GET", resetKey))
+	switch {
+	case errors.Is(err, redis.ErrNil):
+		return nil, errors.New("Invalid reset password ID")
+	case err != nil:
+		return nil, middleware.ReadableError{
+			Description: "Failed to load user ID by reset password ID",
+			Cause:       err,
+		}
+	}
+
+	if err := r.changePassword(conn, userID, newPassword); err != nil {
+		return nil, middleware.ReadableError{
+			Description: "Failed to change user password in Redis",
+			Cause:       err,
+		}
+	}
+
+	if _, err := conn.Do("DEL", resetKey); err != nil {
+		return nil, errors.Wrap(err, "delete reset id")
+	}
+
+	// the reset link proves the email ownership as well as the verification link
+	if _, err := conn.Do("HDEL", r.key(userKey(userID)), userUnverifiedField); err != nil {
+		return nil, errors.Wrap(err, "mark email verified")
+	}
+
+	if r.onPasswordReset != nil {
+		safego.Run(func() { r.onPasswordReset(userID) })
+	}
+
+	tokenPair, err := r.generateTokenPair(conn, userID, defaultTokenPairTTL)
+	if err != nil {
+		return nil, middleware.ReadableError{
+			Description: "Failed to generate new token pair",
+			Cause:       err,
+		}
+	}
+
+	logging.Debugf(withRequestID(ctx, "User [%s] has reset password"), userID)
+	return tokenPair, nil
+}
+
+func (r *Redis) ChangePassword(ctx context.Context, accessToken, newPassword string) (*openapi.TokensResponse, error) {
+	conn, err := r.redisPool.GetContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	defer closeQuietly(conn)
+
+	token, err := r.getToken(conn, accessTokenType, accessToken)
+	if err != nil {
+		return nil, middleware.ReadableError{
+			Description: "Failed to load user access token from Redis",
+			Cause:       err,
+		}
+	}
+
+	if err := r.changePassword(conn, token.UserID, newPassword); err != nil {
+		return nil, middleware.ReadableError{
+			Description: "Failed to change user password in Redis",
+			Cause:       err,
+		}
+	}
+
+	tokenPair, err := r.generateScopedTokenPair(conn, token.UserID, r.renewedTokenPairTTL(token), token.Scopes)
+	if err != nil {
+		return nil, middleware.ReadableError{
+			Description: "Failed to generate new token pair",
+			Cause:       err,
+		}
+	}
+
+	return tokenPair, nil
+}
+
+// UpdatePassword sets the user password on behalf of an admin. It returns ErrUserNotFound for empty or unknown
+// user IDs instead of writing the password into a new partial user record.
+func (r *Redis) UpdatePassword(ctx context.Context, userID, newPassword string) error {
+	if userID == "" {
+		return ErrUserNotFound
+	}
+
+	conn, err := r.redisPool.GetContext(ctx)
+	if err != nil {
+		return err
+	}
+
+	defer closeQuietly(conn)
+	if _, err := r.getUserEmail(conn, userID); err != nil {
+		return middleware.ReadableError{
+			Description: "Failed to load user from Redis",
+			Cause:       err,
+		}
+	}
+
+	if err := r.changePassword(conn, userID, newPassword); err != nil {
+		return middleware.ReadableError{
+			Description: "Failed to change user password in Redis",
+			Cause:       err,
+		}
+	}
+
+	return nil
+}
+
+// VerifyPassword checks the user password without issuing tokens, e.g. to confirm sensitive actions.
+// It returns false if the password does not match and an error only if the user is not found or can't be loaded.
+func (r *Redis) VerifyPassword(ctx context.Context, userID, password string) (bool, error) {
+	// changed passwords must not be accepted during replication lag
+	conn, err := r.redisPool.GetContext(ctx)
+	if err != nil {
+		return false, err
+	}
+
+	defer closeQuietly(conn)
+
+	hashedPassword, err := redis.String(conn.Do("HGET", r.key(userKey(userID)), userHashedPasswordField))
+	switch {
+	case errors.Is(err, redis.ErrNil):
+		return false, ErrUserNotFound
+	case err != nil:
+		return false, middleware.ReadableError{
+			Description: "Failed to load user data from Redis",
+			Cause:       err,
+		}
+	}
+
+	return r.passwordEncoder.Compare(hashedPassword, password) == nil, nil
+}
+
+func (r *Redis) ChangeEmail(ctx context.Context, oldEmail, newEmail string) (string, error) {
+	if err := r.checkEmailDomain(newEmail); err != nil {
+		return "", err
+	}
+
+	conn, err := r.redisPool.GetContext(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	// pooled connections are unwatched on close
+	defer closeQuietly(conn)
+
+	for attempt := 0; attempt < maxChangeEmailAttempts; attempt++ {
+		// the swap is discarded if the index changes after the uniqueness check
+		if _, err := conn.Do("WATCH", r.key(usersIndexKey)); err != nil {
+			return "", errors.Wrapf(err, "watch %s", r.key(usersIndexKey))
+		}
+
+		userID, err := r.getUserIDByEmail(conn, oldEmail)
+		if err != nil {
+			return "", middleware.ReadableError{
+				Description: "Failed to load user ID by email from Redis",
+				Cause:       err,
+			}
+		}
+
+		_, err = r.getUserIDByEmail(conn, newEmail)
+		switch {
+		case errors.Is(err, ErrUserNotFound):
+		// is ok
+		case err != nil:
+			return "", middleware.ReadableError{
+				Description: "Unable to check email uniqueness",
+				Cause:       err,
+			}
+		default:
+			return "", ErrUserExists
+		}
+
+		primaryEmail, err := r.getUserEmail(conn, userID)
+		if err != nil {
+			return "", middleware.ReadableError{
+				Description: "Failed to load user email from Redis",
+				Cause:       err,
+			}
+		}
+
+		if err := r.swapEmail(conn, userID, oldEmail, newEmail, oldEmail == primaryEmail); errors.Is(err, redis.ErrNil) {
+			logging.Debugf(withRequestID(ctx, "Retrying email change for user [%s] due to concurrent %s update"), userID, r.key(usersIndexKey))
+			continue
+		} else if err != nil {
+			return "", err
+		}
+
+		return userID, nil
+	}
+
+	return "", errors.Errorf("email change failed after %d attempts due to concurrent updates", maxChangeEmailAttempts)
+}
+
+// swapEmail replaces user primary or additional email in a transaction.
+// It returns redis.ErrNil if the transaction was aborted due to WATCH.
+func (r *Redis) swapEmail(conn redis.Conn, userID, oldEmail, newEmail string, primary bool) error {
+	if _, err := conn.Do("MULTI"); err != nil {
+		return errors.Wrap(err, "start transaction")
+	}
+
+	if primary {
+		if _, err := conn.Do("HSET", r.key(userKey(userID)), userEmailField, newEmail); err != nil {
+			discardQuietly(conn)
+			return errors.Wrapf(err, "update %s", userEmailField)
+		}
+	} else {
+		if _, err := conn.Do("SREM", r.key(userEmailsKey(userID)), oldEmail); err != nil {
+			discardQuietly(conn)
+			return errors.Wrap(err, "remove previous additional email")
+		}
+
+		if _, err := conn.Do("SADD", r.key(userEmailsKey(userID)), newEmail); err != nil {
+			discardQuietly(conn)
+			return errors.Wrap(err, "add additional email")
+		}
+	}
+
+	if _, err := conn.Do("HSET", r.key(usersIndexKey), r.indexField(newEmail), userID); err != nil {
+		discardQuietly(conn)
+		return errors.Wrapf(err, "update %s", r.key(usersIndexKey))
+	}
+
+	if _, err := conn.Do("HDEL", r.key(usersIndexKey), r.indexField(oldEmail)); err != nil {
+		discardQuietly(conn)
+		return errors.Wrapf(err, "remove previous email association from %s", r.key(usersIndexKey))
+	}
+
+	if err := execTransaction(conn); errors.Is(err, redis.ErrNil) {
+		return err
+	} else if err != nil {
+		return errors.Wrap(err, "swap email")
+	}
+
+	return nil
+}
+
+// AddUserEmail lets the user sign in and reset password with another email in addition to the primary one.
+// It returns ErrUserExists if the email belongs to another user and does nothing if it already belongs to this one.
+func (r *Redis) AddUserEmail(ctx context.Context, userID, email string) error {
+	if err := validateEmail(email); err != nil {
+		return err
+	} else if err := r.checkEmailDomain(email); err != nil {
+		return err
+	}
+
+	conn, err := r.redisPool.GetContext(ctx)
+	if err != nil {
+		return err
+	}
+
+	defer closeQuietly(conn)
+
+	if _, err := r.getUserEmail(conn, userID); err != nil {
+		return middleware.ReadableError{
+			Description: "Failed to load user from Redis",
+			Cause:       err,
+		}
+	}
+
+	// HSETNX claims the email atomically, so that concurrent sign-ups can't take the same one
+	if claimed, err := redis.Bool(conn.Do("HSETNX", r.key(usersIndexKey), r.indexField(email), userID)); err != nil {
+		return errors.Wrapf(err, "update %s", r.key(usersIndexKey))
+	} else if !claimed {
+		if ownerID, err := r.getUserIDByEmail(conn, email); err != nil {
+			return errors.Wrap(err, "get email owner")
+		} else if ownerID != userID {
+			return ErrUserExists
+		}
+
+		return nil
+	}
+
+	if _, err := conn.Do("SADD", r.key(userEmailsKey(userID)), email); err != nil {
+		if _, err := conn.Do("HDEL", r.key(usersIndexKey), r.indexField(email)); err != nil {
+			logging.SystemErrorf(withRequestID(ctx, "Failed to release email [%s] of user [%s]: %v"), email, userID, err)
+		}
+
+		return errors.Wrap(err, "add additional email")
+	}
+
+	return nil
+}
+
+// RemoveUserEmail removes an email added with AddUserEmail. The primary email can't be removed.
+func (r *Redis) RemoveUserEmail(ctx context.Context, userID, email string) error {
+	conn, err := r.redisPool.GetContext(ctx)
+	if err != nil {
+		return err
+	}
+
+	defer closeQuietly(conn)
+
+	primaryEmail, err := r.getUserEmail(conn, userID)
+	if err != nil {
+		return middleware.ReadableError{
+			Description: "Failed to load user from Redis",
+			Cause:       err,
+		}
+	} else if email == primaryEmail {
+		return errPrimaryEmailRemoval
+	}
+
+	if removed, err := redis.Bool(conn.Do("SREM", r.key(userEmailsKey(userID)), email)); err != nil {
+		return errors.Wrap(err, "remove additional email")
+	} else if !removed {
+		return errUnknownUserEmail
+	}
+
+	if ownerID, err := r.getUserIDByEmail(conn, email); err == nil && ownerID == userID {
+		if _, err := conn.Do("HDEL", r.key(usersIndexKey), r.indexField(email)); err != nil {
+			return errors.Wrapf(err, "remove %s from %s", email, r.key(usersIndexKey))
+		}
+	} else if err != nil && !errors.Is(err, ErrUserNotFound) {
+		return errors.Wrap(err, "get email owner")
+	}
+
+	return nil
+}
+
+func (r *Redis) GetUser(ctx context.Context, userID string) (*RedisUser, error) {
+	conn, err := r.replicaPool.GetContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	defer closeQuietly(conn)
+
+	values, err := redis.Strings(conn.Do("HMGET", r.key(userKey(userID)),
+		userEmailField, userPasswordChangedAtField, userUsernameField, userLockedField, userUnverifiedField))
+	if err != nil {
+		return nil, middleware.ReadableError{
+			Description: "Failed to load user data from Redis",
+			Cause:       err,
+		}
+	}
+
+	if values[0] == "" {
+		return nil, ErrUserNotFound
+	}
+
+	user := &RedisUser{ID: userID, Email: values[0], Username: values[2], Locked: values[3] != "", Unverified: values[4] != ""}
+	if user.AdditionalEmails, err = redis.Strings(conn.Do("SMEMBERS", r.key(userEmailsKey(userID)))); err != nil {
+		return nil, middleware.ReadableError{
+			Description: "Failed to load user additional emails from Redis",
+			Cause:       err,
+		}
+	}
+
+	if values[1] != "" {
+		if user.PasswordChangedAt, err = timestamp.ParseISOFormat(values[1]); err != nil {
+			return nil, errors.Wrapf(err, "parse %s", userPasswordChangedAtField)
+		}
+	}
+
+	return user, nil
+}
+
+func (r *Redis) ListUsers(ctx context.Context) ([]openapi.UserBasicInfo, error) {
+	conn, err := r.replicaPool.GetContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	defer closeQuietly(conn)
+
+	users, err := r.listIndexedUsers(conn)
+	if err != nil {
+		return nil, middleware.ReadableError{
+			Description: "Failed to load user email index from Redis",
+			Cause:       err,
+		}
+	}
+
+	return users, nil
+}
+
+// listableUserFields may be requested from ListUsersWithFields. The password hash is never listed.
+var listableUserFields = map[string]bool{
+	userIDField:                true,
+	userEmailField:             true,
+	userUsernameField:          true,
+	userPasswordChangedAtField: true,
+	userLockedField:            true,
+	userUnverifiedField:        true,
+}
+
+// ListUsersWithFields acts like ListUsers, but returns the requested user hash fields, e.g. password_changed_at
+// for flagging stale accounts. Every map contains the user ID under "id" and only the requested fields which are set.
+// Fields must be in listableUserFields, so that the password hash can't be listed.
+func (r *Redis) ListUsersWithFields(ctx context.Context, fields []string) ([]map[string]string, error) {
+	args := make([]interface{}, 0, len(fields)+1)
+	args = append(args, "")
+	for _, field := range fields {
+		if !listableUserFields[field] {
+			return nil, errors.Errorf("user field [%s] can't be listed", field)
+		}
+
+		args = append(args, field)
+	}
+
+	conn, err := r.replicaPool.GetContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	defer closeQuietly(conn)
+
+	users, err := r.listIndexedUsers(conn)
+	if err != nil {
+		return nil, middleware.ReadableError{
+			Description: "Failed to load user email index from Redis",
+			Cause:       err,
+		}
+	}
+
+	result := make([]map[string]string, 0, len(users))
+	if len(fields) == 0 {
+		for _, user := range users {
+			result = append(result, map[string]string{userIDField: user.Id})
+		}
+
+		return result, nil
+	}
+
+	for _, user := range users {
+		args[0] = r.key(userKey(user.Id))
+		if err := conn.Send("HMGET", args...); err != nil {
+			return nil, errors.Wrap(err, "send user fields lookup")
+		}
+	}
+
+	if err := conn.Flush(); err != nil {
+		return nil, errors.Wrap(err, "flush user fields lookups")
+	}
+
+	for _, user := range users {
+		values, err := redis.Strings(conn.Receive())
+		if err != nil {
+			return nil, errors.Wrapf(err, "get user [%s] fields", user.Id)
+		}
+
+		userFields := map[string]string{userIDField: user.Id}
+		for i, field := range fields {
+			if values[i] != "" {
+				userFields[field] = values[i]
+			}
+		}
+
+		result = append(result, userFields)
+	}
+
+	return result, nil
+}
+
+// ListActiveTokens returns summaries of all valid access tokens for security review.
+// Token values are not returned. Tokens which are malformed are skipped,
+// expired ones are deleted if purgeExpired is set.
+// It scans all access tokens, so it is expensive and should not be used in hot paths.
+func (r *Redis) ListActiveTokens(ctx context.Context, purgeExpired bool) ([]openapi.TokenSummary, error) {
+	conn, err := r.redisPool.GetContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	defer closeQuietly(conn)
+
+	result := make([]openapi.TokenSummary, 0)
+	// SCAN may return the same token twice
+	listed := make(map[string]bool)
+	if err := r.forEachTokenBatch(conn, accessTokenType, func(batch map[string][]byte) error {
+		for key, data := range batch {
+			if listed[key] {
+				continue
+			}
+
+			listed[key] = true
+			token, err := r.decodeToken(key, data)
+			if err != nil {
+				logging.Warnf(withRequestID(ctx, "Skipping malformed access token data: %v"), err)
+				continue
+			}
+
+			if err := token.validate(r.now(), r.clockSkewGrace); errors.Is(err, errExpiredToken) {
+				if purgeExpired {
+					if err := r.deleteToken(conn, accessTokenType, token); err != nil {
+						logging.SystemErrorf(withRequestID(ctx, "purge expired %s of user [%s] failed: %s"), accessTokenType.name(), token.UserID, err)
+					}
+				}
+
+				continue
+			} else if err != nil {
+				logging.Warnf(withRequestID(ctx, "Skipping invalid access token of user [%s]: %v"), token.UserID, err)
+				continue
+			}
+
+			summary := openapi.TokenSummary{
+				UserId:    token.UserID,
+				ExpiresAt: token.ExpiredAt,
+			}
+
+			if token.IssuedAt != "" {
+				issuedAt := token.IssuedAt
+				summary.IssuedAt = &issuedAt
+			}
+
+			result = append(result, summary)
+		}
+
+		return nil
+	}); err != nil {
+		return nil, middleware.ReadableError{
+			Description: "Failed to load access tokens from Redis",
+			Cause:       err,
+		}
+	}
+
+	return result, nil
+}
+
+// VerifyTokenLinks reports access tokens which are malformed or whose linked refresh token is missing
+// or is linked to another access token, e.g. after partial writes. Refresh tokens without access tokens
+// are fine, since expired access tokens are deleted independently, and so are access-only tokens.
+// Malformed refresh tokens are reported too.
+// If repair is set, reported entries are deleted. It scans all tokens, so it is expensive.
+func (r *Redis) VerifyTokenLinks(ctx context.Context, repair bool) ([]string, error) {
+	conn, err := r.redisPool.GetContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	defer closeQuietly(conn)
+
+	accessTokens, err := r.scanTokens(conn, accessTokenType)
+	if err != nil {
+		return nil, errors.Wrap(err, "get access tokens")
+	}
+
+	refreshTokens, err := r.scanTokens(conn, refreshTokenType)
+	if err != nil {
+		return nil, errors.Wrap(err, "get refresh tokens")
+	}
+
+	var issues []string
+	broken := make(map[redisTokenType][]string)
+	refreshLinks := make(map[string]string, len(refreshTokens))
+	for key, data := range refreshTokens {
+		if token, err := r.decodeToken(key, data); err != nil {
+			issues = append(issues, fmt.Sprintf("malformed %s data: %v", refreshTokenType.name(), err))
+			broken[refreshTokenType] = append(broken[refreshTokenType], key)
+		} else {
+			refreshLinks[key] = token.AccessToken
+		}
+	}
+
+	for key, data := range accessTokens {
+		token, err := r.decodeToken(key, data)
+		if err != nil {
+			issues = append(issues, fmt.Sprintf("malformed %s data: %v", accessTokenType.name(), err))
+		} else if token.RefreshToken == "" {
+			continue
+		} else if accessToken, ok := refreshLinks[token.RefreshToken]; !ok {
+			issues = append(issues, fmt.Sprintf("%s of user [%s] links to missing %s", accessTokenType.name(), token.UserID, refreshTokenType.name()))
+		} else if accessToken != key {
+			issues = append(issues, fmt.Sprintf("%s of user [%s] links to %s of another %s", accessTokenType.name(), token.UserID, refreshTokenType.name(), accessTokenType.name()))
+		} else {
+			continue
+		}
+
+		broken[accessTokenType] = append(broken[accessTokenType], key)
+	}
+
+	if repair {
+		for tokenType, keys := range broken {
+			for _, key := range keys {
+				if err := r.deleteTokenValue(conn, tokenType, key); err != nil {
+					return issues, errors.Wrapf(err, "delete broken %s", tokenType.name())
+				}
+			}
+		}
+	}
+
+	return issues, nil
+}
+
+// MigrateTokenStorage moves tokens persisted as hash fields to individual keys with TTL and returns
+// the number of moved tokens. Expired tokens are dropped, malformed ones are left in place. It requires
+// token storage version 2 and is safe to run repeatedly, also while other instances still write to the hashes.
+func (r *Redis) MigrateTokenStorage(ctx context.Context) (int, error) {
+	if r.tokenStorageVersion != tokenStorageKeys {
+		return 0, errors.Errorf("token storage version %d is required for migration", tokenStorageKeys)
+	}
+
+	conn, err := r.redisPool.GetContext(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	defer closeQuietly(conn)
+
+	migrated := 0
+	for _, tokenType := range []redisTokenType{accessTokenType, refreshTokenType} {
+		if err := r.forEachHashTokenBatch(conn, tokenType, func(batch map[string][]byte) error {
+			for key, data := range batch {
+				token, err := r.decodeToken(key, data)
+				if err != nil {
+					logging.Warnf(withRequestID(ctx, "Skipping malformed %s data during migration: %v"), tokenType.name(), err)
+					continue
+				}
+
+				ttl, err := r.keyTTL(token)
+				if err != nil {
+					logging.Warnf(withRequestID(ctx, "Skipping %s of user [%s] during migration: %v"), tokenType.name(), token.UserID, err)
+					continue
+				}
+
+				// copy and delete atomically, so that the token is never missing
+				if _, err := conn.Do("MULTI"); err != nil {
+					return errors.Wrap(err, "start transaction")
+				}
+
+				if ttl >= time.Millisecond {
+					if _, err := conn.Do("SET", r.key(tokenKey(tokenType, key)), data, "PX", ttl.Milliseconds()); err != nil {
+						discardQuietly(conn)
+						return errors.Wrapf(err, "save %s", tokenType.name())
+					}
+				}
+
+				if _, err := conn.Do("HDEL", r.key(tokenType.key()), key); err != nil {
+					discardQuietly(conn)
+					return errors.Wrapf(err, "delete %s hash field", tokenType.name())
+				}
+
+				if err := execTransaction(conn); err != nil {
+					return errors.Wrapf(err, "migrate %s", tokenType.name())
+				}
+
+				if ttl >= time.Millisecond {
+					migrated++
+				}
+			}
+
+			return nil
+		}); err != nil {
+			return migrated, err
+		}
+	}
+
+	return migrated, nil
+}
+
+// RepairUsersIndex removes email index entries pointing to non-existent users and returns removed emails.
+// Email hashes are returned instead of emails if EmailIndexKey is configured.
+// See ReconcileUsersIndex for a full reconciliation of inconsistencies reported by FindOrphanedUsers.
+func (r *Redis) RepairUsersIndex(ctx context.Context) ([]string, error) {
+	conn, err := r.redisPool.GetContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	defer closeQuietly(conn)
+
+	index, err := r.getUsersIndex(conn)
+	if err != nil {
+		return nil, errors.Wrapf(err, "get %s", r.key(usersIndexKey))
+	}
+
+	var removed []string
+	for email, userID := range index {
+		if exists, err := redis.Bool(conn.Do("EXISTS", r.key(userKey(userID)))); err != nil {
+			return removed, errors.Wrapf(err, "check user [%s] exists", userID)
+		} else if exists {
+			continue
+		}
+
+		if _, err := conn.Do("HDEL", r.key(usersIndexKey), email); err != nil {
+			return removed, errors.Wrapf(err, "remove %s from %s", email, r.key(usersIndexKey))
+		}
+
+		logging.Infof("Removed dangling %s entry [%s] pointing to missing user [%s]", r.key(usersIndexKey), email, userID)
+		removed = append(removed, email)
+	}
+
+	return removed, nil
+}
+
+func (r *Redis) CreateUser(ctx context.Context, email string) (*handlers.CreatedUser, error) {
+	conn, err := r.redisPool.GetContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	defer closeQuietly(conn)
+
+	userID, err := r.createUser(conn, email, "", r.tokenGenerator(), func() error { return r.checkAdminUserLimit(conn) })
+	if err != nil {
+		return nil, middleware.ReadableError{
+			Description: "Failed to create new user in Redis",
+			Cause:       err,
 		}
 	}
 
 	resetID, err := r.generateResetID(conn, userID)
 	if err != nil {
-		return nil, middleware.ReadableError{
-			Description: "Failed to generate password reset ID",
+		return nil, middleware.ReadableError{
+			Description: "Failed to generate password reset ID",
+			Cause:       err,
+		}
+	}
+
+	return &handlers.CreatedUser{
+		ID:      userID,
+		ResetID: resetID,
+	}, nil
+}
+
+// ReassignUserID changes ID of the user, e.g. on merging accounts, preserving the user data, emails, username,
+// sessions and API keys. It returns ErrUserExists if newID is taken. All changes are applied in a single
+// MULTI/EXEC transaction, which is aborted if the user is changed concurrently. It is meant for admin tooling:
+//   - tokens are found by scanning all stored tokens, so it is expensive, and tokens issued to the user
+//     during the call keep the old ID and stop working;
+//   - token subjects are kept, so that external services still identify sessions by the old ID;
+//   - outstanding reset password and email verification links are invalidated;
+//   - data stored outside of Redis authorization (e.g. project permissions) must be migrated separately.
+func (r *Redis) ReassignUserID(ctx context.Context, oldID, newID string) error {
+	if newID == "" || newID == oldID {
+		return errors.Errorf("invalid new user ID [%s]", newID)
+	}
+
+	conn, err := r.redisPool.GetContext(ctx)
+	if err != nil {
+		return err
+	}
+
+	defer closeQuietly(conn)
+
+	tokens, err := r.reassignUserID(conn, oldID, newID)
+	if err != nil {
+		return middleware.ReadableError{
+			Description: "Failed to reassign user ID",
+			Cause:       err,
+		}
+	}
+
+	for _, token := range tokens {
+		if token.tokenType == accessTokenType {
+			r.authCache.remove(token.AccessToken)
+		}
+	}
+
+	logging.Infof(withRequestID(ctx, "User [%s] has been reassigned to ID [%s] along with %d tokens"), oldID, newID, len(tokens))
+	return nil
+}
+
+// reassignedToken is a stored token of the reassigned user.
+type reassignedToken struct {
+	*redisToken
+	tokenType redisTokenType
+}
+
+// userIDReassignment holds the user data read before reassignUserID transaction.
+type userIDReassignment struct {
+	oldID, newID     string
+	values           map[string]string
+	additionalEmails []string
+	apiKeyIDs        []string
+	resetIDs         []string
+	ssoToken         string
+	tokens           []reassignedToken
+}
+
+// reassignUserID moves the user data under newID in a transaction and returns re-keyed tokens.
+func (r *Redis) reassignUserID(conn redis.Conn, oldID, newID string) ([]reassignedToken, error) {
+	oldKey, newKey := r.key(userKey(oldID)), r.key(userKey(newID))
+	oldEmailsKey, oldAPIKeysKey := r.key(userEmailsKey(oldID)), r.key(apiKeysKey(oldID))
+	if _, err := conn.Do("WATCH", oldKey, newKey, oldEmailsKey, oldAPIKeysKey); err != nil {
+		return nil, errors.Wrap(err, "watch user keys")
+	}
+
+	defer func() { _, _ = conn.Do("UNWATCH") }()
+	if exists, err := redis.Bool(conn.Do("EXISTS", newKey)); err != nil {
+		return nil, errors.Wrap(err, "check new user ID")
+	} else if exists {
+		return nil, ErrUserExists
+	}
+
+	values, err := redis.StringMap(conn.Do("HGETALL", oldKey))
+	if err != nil {
+		return nil, errors.Wrap(err, "get user")
+	} else if values[userEmailField] == "" {
+		return nil, ErrUserNotFound
+	}
+
+	additionalEmails, err := redis.Strings(conn.Do("SMEMBERS", oldEmailsKey))
+	if err != nil {
+		return nil, errors.Wrap(err, "get additional emails")
+	}
+
+	apiKeyIDs, err := redis.Strings(conn.Do("HKEYS", oldAPIKeysKey))
+	if err != nil {
+		return nil, errors.Wrap(err, "get API keys")
+	}
+
+	resetIDs, err := redis.Strings(conn.Do("SMEMBERS", r.key(userResetsKey(oldID))))
+	if err != nil {
+		return nil, errors.Wrap(err, "get reset ids")
+	}
+
+	ssoToken, err := redis.String(conn.Do("HGET", r.key(ssoTokensKey), oldID))
+	if err != nil && !errors.Is(err, redis.ErrNil) {
+		return nil, errors.Wrap(err, "get SSO token")
+	}
+
+	reassignment := &userIDReassignment{
+		oldID:            oldID,
+		newID:            newID,
+		values:           values,
+		additionalEmails: additionalEmails,
+		apiKeyIDs:        apiKeyIDs,
+		resetIDs:         resetIDs,
+		ssoToken:         ssoToken,
+	}
+
+	for _, tokenType := range []redisTokenType{accessTokenType, refreshTokenType} {
+		if err := r.forEachTokenBatch(conn, tokenType, func(batch map[string][]byte) error {
+			for key, data := range batch {
+				token, err := r.decodeToken(key, data)
+				if err != nil {
+					return err
+				}
+
+				if token.UserID == oldID {
+					reassignment.tokens = append(reassignment.tokens, reassignedToken{redisToken: token, tokenType: tokenType})
+				}
+			}
+
+			return nil
+		}); err != nil {
+			return nil, errors.Wrapf(err, "scan %ss", tokenType.name())
+		}
+	}
+
+	if _, err := conn.Do("MULTI"); err != nil {
+		return nil, errors.Wrap(err, "start transaction")
+	}
+
+	if err := r.queueUserIDReassignment(conn, reassignment); err != nil {
+		discardQuietly(conn)
+		return nil, err
+	}
+
+	if err := execTransaction(conn); errors.Is(err, redis.ErrNil) {
+		return nil, errors.New("user has been changed concurrently, please retry")
+	} else if err != nil {
+		return nil, errors.Wrap(err, "reassign user ID")
+	}
+
+	return reassignment.tokens, nil
+}
+
+// queueUserIDReassignment queues reassignUserID commands. Must be called in MULTI.
+func (r *Redis) queueUserIDReassignment(conn redis.Conn, reassignment *userIDReassignment) error {
+	oldID, newID, values := reassignment.oldID, reassignment.newID, reassignment.values
+	if _, err := conn.Do("RENAME", r.key(userKey(oldID)), r.key(userKey(newID))); err != nil {
+		return errors.Wrap(err, "move user")
+	} else if _, err := conn.Do("HSET", r.key(userKey(newID)), userIDField, newID); err != nil {
+		return errors.Wrap(err, "update user ID")
+	} else if _, err := conn.Do("SREM", r.key(userIDsKey), oldID); err != nil {
+		return errors.Wrapf(err, "remove user from %s", r.key(userIDsKey))
+	} else if _, err := conn.Do("SADD", r.key(userIDsKey), newID); err != nil {
+		return errors.Wrapf(err, "update %s", r.key(userIDsKey))
+	}
+
+	indexFields := []interface{}{r.key(usersIndexKey), r.indexField(values[userEmailField]), newID}
+	for _, email := range reassignment.additionalEmails {
+		indexFields = append(indexFields, r.indexField(email), newID)
+	}
+
+	if _, err := conn.Do("HSET", indexFields...); err != nil {
+		return errors.Wrapf(err, "update %s", r.key(usersIndexKey))
+	}
+
+	if len(reassignment.additionalEmails) > 0 {
+		if _, err := conn.Do("RENAME", r.key(userEmailsKey(oldID)), r.key(userEmailsKey(newID))); err != nil {
+			return errors.Wrap(err, "move additional emails")
+		}
+	}
+
+	if username := values[userUsernameField]; username != "" {
+		if _, err := conn.Do("HSET", r.key(usernamesIndexKey), username, newID); err != nil {
+			return errors.Wrapf(err, "update %s", r.key(usernamesIndexKey))
+		}
+	}
+
+	if len(reassignment.apiKeyIDs) > 0 {
+		if _, err := conn.Do("RENAME", r.key(apiKeysKey(oldID)), r.key(apiKeysKey(newID))); err != nil {
+			return errors.Wrap(err, "move API keys")
+		}
+
+		args := []interface{}{r.key(apiKeysIndexKey)}
+		for _, keyID := range reassignment.apiKeyIDs {
+			args = append(args, keyID, newID)
+		}
+
+		if _, err := conn.Do("HSET", args...); err != nil {
+			return errors.Wrapf(err, "update %s", r.key(apiKeysIndexKey))
+		}
+	}
+
+	if reassignment.ssoToken != "" {
+		if _, err := conn.Do("HSET", r.key(ssoTokensKey), newID, reassignment.ssoToken); err != nil {
+			return errors.Wrap(err, "move SSO token")
+		} else if _, err := conn.Do("HDEL", r.key(ssoTokensKey), oldID); err != nil {
+			return errors.Wrap(err, "delete old SSO token")
+		}
+	}
+
+	resetKeys := []interface{}{r.key(userResetsKey(oldID))}
+	for _, resetID := range reassignment.resetIDs {
+		resetKeys = append(resetKeys, r.key(resetKey(resetID)))
+	}
+
+	if _, err := conn.Do("DEL", resetKeys...); err != nil {
+		return errors.Wrap(err, "delete reset ids")
+	}
+
+	for _, token := range reassignment.tokens {
+		token.UserID = newID
+		if err := r.saveToken(conn, token.tokenType, token.redisToken); err != nil {
+			return errors.Wrapf(err, "re-key %s", token.tokenType.name())
+		}
+	}
+
+	return nil
+}
+
+// validatePasswordHash checks the password hash imported from another system can be compared against.
+func (r *Redis) validatePasswordHash(hashedPassword string) error {
+	validator, ok := r.passwordEncoder.(HashValidator)
+	if !ok {
+		return errors.New("password encoder does not support importing password hashes")
+	} else if err := validator.ValidateHash(hashedPassword); err != nil {
+		return errors.Wrap(err, "unsupported password hash")
+	}
+
+	return nil
+}
+
+// CreateUserWithHash imports a user with the password hash from another system, so that the user signs in
+// with the same password without resetting it. The hash must be supported by the password encoder (e.g. bcrypt
+// $2a$, $2b$ or $2y$ hash of any cost). It is meant for admin import tooling and is not exposed through the API.
+func (r *Redis) CreateUserWithHash(ctx context.Context, email, hashedPassword string) (string, error) {
+	if err := r.validatePasswordHash(hashedPassword); err != nil {
+		return "", err
+	}
+
+	conn, err := r.redisPool.GetContext(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	defer closeQuietly(conn)
+
+	userID, err := r.createUserWithHash(conn, email, "", func() (string, error) { return hashedPassword, nil },
+		func() error { return r.checkAdminUserLimit(conn) })
+	if err != nil {
+		return "", middleware.ReadableError{
+			Description: "Failed to import user in Redis",
 			Cause:       err,
 		}
 	}
 
-	return &handlers.CreatedUser{
-		ID:      userID,
-		ResetID: resetID,
-	}, nil
+	logging.Infof(withRequestID(ctx, "User [%s] has been imported with password hash"), userID)
+	return userID, nil
+}
+
+// SetUserLocked locks or unlocks the user account, e.g. on employee offboarding. Locked users can't sign in,
+// their existing sessions are revoked on lock and their tokens and API keys are rejected while locked.
+// Unlike DeleteUser, user data is preserved.
+func (r *Redis) SetUserLocked(ctx context.Context, userID string, locked bool) error {
+	conn, err := r.redisPool.GetContext(ctx)
+	if err != nil {
+		return err
+	}
+
+	defer closeQuietly(conn)
+
+	if _, err := r.getUserEmail(conn, userID); err != nil {
+		return middleware.ReadableError{
+			Description: "Failed to load user from Redis",
+			Cause:       err,
+		}
+	}
+
+	if !locked {
+		if _, err := conn.Do("HDEL", r.key(userKey(userID)), userLockedField); err != nil {
+			return errors.Wrap(err, "unlock user")
+		}
+
+		return nil
+	}
+
+	if _, err := conn.Do("HSET", r.key(userKey(userID)), userLockedField, timestamp.ToISOFormat(r.now().UTC())); err != nil {
+		return errors.Wrap(err, "lock user")
+	}
+
+	if err := r.revokeTokens(conn, userID); err != nil {
+		return middleware.ReadableError{
+			Description: "Failed to revoke locked user sessions",
+			Cause:       err,
+		}
+	}
+
+	return nil
 }
 
 func (r *Redis) DeleteUser(ctx context.Context, userID string) error {
@@ -676,25 +2891,256 @@ func (r *Redis) DeleteUser(ctx context.Context, userID string) error {
 	}
 
 	if err := r.revokeTokens(conn, userID); err != nil {
-		logging.SystemErrorf("Failed to revoke user [%s] tokens: %v", userID, err)
+		logging.SystemErrorf(withRequestID(ctx, "Failed to revoke user [%s] tokens: %v"), userID, err)
+	}
+
+	if err := r.revokeAPIKeys(conn, userID); err != nil {
+		logging.SystemErrorf(withRequestID(ctx, "Failed to revoke user [%s] API keys: %v"), userID, err)
+	}
+
+	if err := r.deleteResetIDs(conn, userID); err != nil {
+		logging.SystemErrorf(withRequestID(ctx, "Failed to delete user [%s] reset password IDs: %v"), userID, err)
+	}
+
+	username, err := redis.String(conn.Do("HGET", r.key(userKey(userID)), userUsernameField))
+	if err != nil && !errors.Is(err, redis.ErrNil) {
+		return errors.Wrap(err, "get username")
+	}
+
+	additionalEmails, err := redis.Strings(conn.Do("SMEMBERS", r.key(userEmailsKey(userID))))
+	if err != nil {
+		return errors.Wrap(err, "get additional emails")
 	}
 
-	if _, err := conn.Do("DEL", userKey(userID)); err != nil {
+	if _, err := conn.Do("DEL", r.key(userKey(userID)), r.key(userEmailsKey(userID))); err != nil {
 		return errors.Wrap(err, "remove user data")
 	}
 
-	if _, err := conn.Do("HDEL", usersIndexKey, email); err != nil {
-		return errors.Wrapf(err, "remove %s from %s", email, usersIndexKey)
+	if _, err := conn.Do("SREM", r.key(userIDsKey), userID); err != nil {
+		return errors.Wrapf(err, "remove user from %s", r.key(userIDsKey))
+	}
+
+	indexFields := []interface{}{r.key(usersIndexKey), r.indexField(email)}
+	for _, additionalEmail := range additionalEmails {
+		indexFields = append(indexFields, r.indexField(additionalEmail))
+	}
+
+	if _, err := conn.Do("HDEL", indexFields...); err != nil {
+		return errors.Wrapf(err, "remove %s from %s", email, r.key(usersIndexKey))
+	}
+
+	if username != "" {
+		if _, err := conn.Do("HDEL", r.key(usernamesIndexKey), username); err != nil {
+			return errors.Wrapf(err, "remove %s from %s", username, r.key(usernamesIndexKey))
+		}
+	}
+
+	return nil
+}
+
+// getUsersIndex returns email to user ID index. Unlike redis.StringMap, it skips malformed entries
+// (e.g. left by partial writes) instead of failing, so that a corrupt index doesn't break sign-in for everyone.
+func (r *Redis) getUsersIndex(conn redis.Conn) (map[string]string, error) {
+	values, err := redis.Values(conn.Do("HGETALL", r.key(usersIndexKey)))
+	if err != nil {
+		return nil, err
+	}
+
+	if len(values)%2 != 0 {
+		logging.SystemErrorf("%s has odd number of elements [%d], the last one is skipped", r.key(usersIndexKey), len(values))
+	}
+
+	result := make(map[string]string, len(values)/2)
+	for i := 0; i+1 < len(values); i += 2 {
+		email, emailErr := redis.String(values[i], nil)
+		userID, userIDErr := redis.String(values[i+1], nil)
+		if emailErr != nil || userIDErr != nil || email == "" || userID == "" {
+			logging.SystemErrorf("Skipping malformed %s entry [%v: %v]", r.key(usersIndexKey), values[i], values[i+1])
+			continue
+		}
+
+		result[email] = userID
+	}
+
+	return result, nil
+}
+
+// listIndexedUsers returns users from the index. If emails are hashed in the index or users have additional emails,
+// primary emails are loaded from user records and left empty for users whose records are missing.
+func (r *Redis) listIndexedUsers(conn redis.Conn) ([]openapi.UserBasicInfo, error) {
+	index, err := r.getUsersIndex(conn)
+	if err != nil {
+		return nil, err
+	}
+
+	users := make([]openapi.UserBasicInfo, 0, len(index))
+	positions := make(map[string]int, len(index))
+	for email, userID := range index {
+		if len(r.emailIndexKey) > 0 {
+			email = ""
+		}
+
+		if i, ok := positions[userID]; ok {
+			// the user has additional emails, so it is unknown which one is primary
+			users[i].Email = ""
+			continue
+		}
+
+		positions[userID] = len(users)
+		users = append(users, openapi.UserBasicInfo{
+			Id:    userID,
+			Email: email,
+		})
+	}
+
+	var lookups []int
+	for i := range users {
+		if users[i].Email == "" {
+			lookups = append(lookups, i)
+		}
+	}
+
+	if len(lookups) == 0 {
+		return users, nil
+	}
+
+	for _, i := range lookups {
+		if err := conn.Send("HGET", r.key(userKey(users[i].Id)), userEmailField); err != nil {
+			return nil, errors.Wrap(err, "send user email lookup")
+		}
+	}
+
+	if err := conn.Flush(); err != nil {
+		return nil, errors.Wrap(err, "flush user email lookups")
+	}
+
+	for _, i := range lookups {
+		email, err := parseUserEmail(redis.String(conn.Receive()))
+		switch {
+		case errors.Is(err, ErrUserNotFound):
+			logging.SystemErrorf("User [%s] exists in [%s], but not under [%s]", users[i].Id, r.key(usersIndexKey), r.key(userKey(users[i].Id)))
+		case err != nil:
+			return nil, errors.Wrapf(err, "get user [%s] email", users[i].Id)
+		default:
+			users[i].Email = email
+		}
+	}
+
+	return users, nil
+}
+
+// indexField returns users index field for the email.
+func (r *Redis) indexField(email string) string {
+	if len(r.emailIndexKey) == 0 {
+		return email
+	}
+
+	mac := hmac.New(sha256.New, r.emailIndexKey)
+	_, _ = mac.Write([]byte(email))
+	return hashedEmailPrefix + hex.EncodeToString(mac.Sum(nil))
+}
+
+// initUserIDs adds users created before the user IDs set was introduced to the set counted by checkUserLimit.
+// Users are added to and removed from the set on creation and deletion, so the index is loaded only on startup.
+func (r *Redis) initUserIDs() error {
+	conn := r.redisPool.Get()
+	defer closeQuietly(conn)
+
+	index, err := r.getUsersIndex(conn)
+	if err != nil {
+		return errors.Wrapf(err, "get %s", r.key(usersIndexKey))
+	} else if len(index) == 0 {
+		return nil
+	}
+
+	// SADD is idempotent, so concurrently starting instances and sign-ups don't break it
+	args := []interface{}{r.key(userIDsKey)}
+	for _, userID := range index {
+		if userID != "" {
+			args = append(args, userID)
+		}
+	}
+
+	if _, err := conn.Do("SADD", args...); err != nil {
+		return errors.Wrapf(err, "update %s", r.key(userIDsKey))
+	}
+
+	return nil
+}
+
+// hashUsersIndex replaces plaintext users index entries with email hashes.
+func (r *Redis) hashUsersIndex() error {
+	conn := r.redisPool.Get()
+	defer closeQuietly(conn)
+
+	index, err := r.getUsersIndex(conn)
+	if err != nil {
+		return errors.Wrapf(err, "get %s", r.key(usersIndexKey))
+	}
+
+	hashed := 0
+	for email, userID := range index {
+		if strings.HasPrefix(email, hashedEmailPrefix) {
+			continue
+		}
+
+		if _, err := conn.Do("MULTI"); err != nil {
+			return errors.Wrap(err, "start transaction")
+		}
+
+		if _, err := conn.Do("HSET", r.key(usersIndexKey), r.indexField(email), userID); err != nil {
+			discardQuietly(conn)
+			return errors.Wrapf(err, "add hashed entry for user [%s]", userID)
+		}
+
+		if _, err := conn.Do("HDEL", r.key(usersIndexKey), email); err != nil {
+			discardQuietly(conn)
+			return errors.Wrapf(err, "remove plaintext entry for user [%s]", userID)
+		}
+
+		if err := execTransaction(conn); err != nil {
+			return errors.Wrapf(err, "hash entry for user [%s]", userID)
+		}
+
+		hashed++
+	}
+
+	if hashed > 0 {
+		logging.Infof("Replaced %d plaintext %s entries with email hashes", hashed, r.key(usersIndexKey))
 	}
 
 	return nil
 }
 
 func (r *Redis) getUserEmail(conn redis.Conn, userID string) (string, error) {
-	email, err := redis.String(conn.Do("HGET", userKey(userID), userEmailField))
+	return parseUserEmail(redis.String(conn.Do("HGET", r.key(userKey(userID)), userEmailField)))
+}
+
+// getActiveUserEmail acts like getUserEmail, but returns errAccountLocked for locked users.
+func (r *Redis) getActiveUserEmail(conn redis.Conn, userID string) (string, error) {
+	return parseActiveUserEmail(redis.Strings(conn.Do("HMGET", r.key(userKey(userID)), userEmailField, userLockedField)))
+}
+
+// parseActiveUserEmail handles HMGET of email and locked fields.
+func parseActiveUserEmail(values []string, err error) (string, error) {
+	switch {
+	case err != nil:
+		return "", err
+	case len(values) != 2:
+		return "", errors.Errorf("unexpected user fields count: %d", len(values))
+	case values[0] == "":
+		return "", ErrUserNotFound
+	case values[1] != "":
+		return "", errAccountLocked
+	}
+
+	return values[0], nil
+}
+
+func parseUserEmail(email string, err error) (string, error) {
 	switch {
 	case errors.Is(err, redis.ErrNil):
-		return "", errUserNotFound
+		return "", ErrUserNotFound
 	case err != nil:
 		return "", err
 	}
@@ -708,24 +3154,70 @@ func (r *Redis) sendResetPasswordLink(conn redis.Conn, userID, email, callback s
 		return errors.Wrap(err, "generate reset id")
 	}
 
-	return send(email, strings.ReplaceAll(callback, "{{token}}", resetID))
+	return classifyMailError(send(email, strings.ReplaceAll(callback, "{{token}}", resetID)))
 }
 
 func (r *Redis) generateResetID(conn redis.Conn, userID string) (string, error) {
-	resetID := "reset-" + uuid.NewV4().String()
-	if _, err := conn.Do("SET", resetKey(resetID), userID, "EX", resetIDTTLSeconds); err != nil {
+	resetID := "reset-" + r.tokenGenerator()
+	if _, err := conn.Do("SET", r.key(resetKey(resetID)), userID, "EX", resetIDTTLSeconds); err != nil {
 		return "", errors.Wrap(err, "persist reset id")
 	}
 
+	// the set expires along with the latest reset ID, so that it does not outlive them
+	userResetsKey := r.key(userResetsKey(userID))
+	if _, err := conn.Do("SADD", userResetsKey, resetID); err != nil {
+		return "", errors.Wrap(err, "track reset id")
+	} else if _, err := conn.Do("EXPIRE", userResetsKey, resetIDTTLSeconds); err != nil {
+		return "", errors.Wrap(err, "set reset id tracking TTL")
+	}
+
 	return resetID, nil
 }
 
-func (r *Redis) createUser(conn redis.Conn, email, password string, precondition func() error) (string, error) {
+// deleteResetIDs invalidates all outstanding reset password links of the user.
+func (r *Redis) deleteResetIDs(conn redis.Conn, userID string) error {
+	userResetsKey := r.key(userResetsKey(userID))
+	resetIDs, err := redis.Strings(conn.Do("SMEMBERS", userResetsKey))
+	if err != nil {
+		return errors.Wrap(err, "get reset ids")
+	}
+
+	keys := []interface{}{userResetsKey}
+	for _, resetID := range resetIDs {
+		keys = append(keys, r.key(resetKey(resetID)))
+	}
+
+	if _, err := conn.Do("DEL", keys...); err != nil {
+		return errors.Wrap(err, "delete reset ids")
+	}
+
+	return nil
+}
+
+// createUser persists a new user. Extra fields are stored in the user hash along with the default ones.
+func (r *Redis) createUser(conn redis.Conn, email, username, password string, precondition func() error, extraFields ...interface{}) (string, error) {
+	encode := func() (string, error) { return r.passwordEncoder.Encode(password) }
+	return r.createUserWithHash(conn, email, username, encode, precondition, extraFields...)
+}
+
+// createUserWithHash acts like createUser, but takes the password hash from hashPassword,
+// which is called only if the user can be created.
+func (r *Redis) createUserWithHash(conn redis.Conn, email, username string, hashPassword func() (string, error), precondition func() error, extraFields ...interface{}) (string, error) {
+	if err := validateEmail(email); err != nil {
+		return "", err
+	} else if err := r.checkEmailDomain(email); err != nil {
+		return "", err
+	}
+
+	if username != "" && !usernameRegex.MatchString(username) {
+		return "", errInvalidUsername
+	}
+
 	userID, err := r.getUserIDByEmail(conn, email)
 	switch {
 	case err == nil:
 		return userID, ErrUserExists
-	case !errors.Is(err, errUserNotFound):
+	case !errors.Is(err, ErrUserNotFound):
 		return "", errors.Wrap(err, "get user by email")
 	}
 
@@ -733,25 +3225,179 @@ func (r *Redis) createUser(conn redis.Conn, email, password string, precondition
 		return "", err
 	}
 
-	hashedPassword, err := r.passwordEncoder.Encode(password)
+	hashedPassword, err := hashPassword()
 	if err != nil {
 		return "", errors.Wrap(err, "encode password")
 	}
 
-	id := "user-" + uuid.NewV4().String()
-	if _, err := conn.Do("HSET", userKey(id),
+	id := "user-" + r.idGenerator()
+	fields := []interface{}{
+		r.key(userKey(id)),
 		userIDField, id,
 		userEmailField, email,
 		userHashedPasswordField, hashedPassword,
-	); err != nil {
+		userPasswordChangedAtField, timestamp.ToISOFormat(r.now().UTC()),
+	}
+
+	fields = append(fields, extraFields...)
+	if username != "" {
+		// HSETNX claims the username atomically, so that concurrent sign-ups can't take the same one
+		if claimed, err := redis.Bool(conn.Do("HSETNX", r.key(usernamesIndexKey), username, id)); err != nil {
+			return "", errors.Wrapf(err, "update %s", r.key(usernamesIndexKey))
+		} else if !claimed {
+			return "", ErrUsernameExists
+		}
+
+		fields = append(fields, userUsernameField, username)
+	}
+
+	if _, err := conn.Do("HSET", fields...); err != nil {
+		r.releaseUsername(conn, username, id)
 		return "", errors.Wrap(err, "create user")
 	}
 
-	if _, err := conn.Do("HSET", usersIndexKey, email, id); err != nil {
-		return "", errors.Wrapf(err, "update %s", usersIndexKey)
+	// HSETNX claims the email atomically, so that concurrent sign-ups and email changes can't overwrite each other
+	field := r.indexField(email)
+	if claimed, err := redis.Bool(conn.Do("HSETNX", r.key(usersIndexKey), field, id)); err != nil || !claimed {
+		if _, err := conn.Do("DEL", r.key(userKey(id))); err != nil {
+			logging.SystemErrorf("Failed to delete not created user [%s]: %v", id, err)
+		}
+
+		r.releaseUsername(conn, username, id)
+		if err != nil {
+			return "", errors.Wrapf(err, "update %s", r.key(usersIndexKey))
+		}
+
+		existingID, err := redis.String(conn.Do("HGET", r.key(usersIndexKey), field))
+		if err != nil && !errors.Is(err, redis.ErrNil) {
+			return "", errors.Wrap(err, "get user by email")
+		}
+
+		return existingID, ErrUserExists
+	}
+
+	if _, err := conn.Do("SADD", r.key(userIDsKey), id); err != nil {
+		return "", errors.Wrapf(err, "update %s", r.key(userIDsKey))
+	}
+
+	if r.onUserCreated != nil {
+		safego.Run(func() { r.onUserCreated(context.Background(), id, email) })
+	}
+
+	return id, nil
+}
+
+// releaseUsername frees the username claimed for the user which has not been created. Failures are logged.
+func (r *Redis) releaseUsername(conn redis.Conn, username, userID string) {
+	if username == "" {
+		return
+	}
+
+	if _, err := conn.Do("HDEL", r.key(usernamesIndexKey), username); err != nil {
+		logging.SystemErrorf("Failed to release username [%s] of not created user [%s]: %v", username, userID, err)
+	}
+}
+
+// checkUserLimit returns errUserLimitReached if creating another user would exceed MaxUsers.
+func (r *Redis) checkUserLimit(conn redis.Conn) error {
+	if r.maxUsers <= 0 {
+		return nil
+	}
+
+	// users with additional emails have several index entries, so they are counted by ID
+	count, err := redis.Int(conn.Do("SCARD", r.key(userIDsKey)))
+	if err != nil {
+		return errors.Wrap(err, "count users")
+	}
+
+	if count >= r.maxUsers {
+		return errUserLimitReached
+	}
+
+	return nil
+}
+
+func (r *Redis) checkAdminUserLimit(conn redis.Conn) error {
+	if !r.maxUsersAppliesToAdmins {
+		return nil
+	}
+
+	return r.checkUserLimit(conn)
+}
+
+// isCallbackAllowed matches callback URL against AllowedCallbacks.
+func (r *Redis) isCallbackAllowed(callback string) bool {
+	if len(r.allowedCallbacks) == 0 {
+		return true
+	}
+
+	callbackURL, err := url.Parse(callback)
+	if err != nil {
+		return false
+	}
+
+	for _, allowed := range r.allowedCallbacks {
+		if !strings.Contains(allowed, "://") {
+			if strings.EqualFold(callbackURL.Hostname(), allowed) {
+				return true
+			}
+
+			continue
+		}
+
+		// https://app.example.com must not match https://app.example.com.evil.com
+		if rest := strings.TrimPrefix(callback, allowed); rest != callback &&
+			(rest == "" || strings.HasSuffix(allowed, "/") || strings.ContainsAny(rest[:1], "/?#")) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// checkEmailDomain returns errDomainNotAllowed if the email domain does not match AllowedEmailDomains.
+func (r *Redis) checkEmailDomain(email string) error {
+	if len(r.allowedDomains) == 0 {
+		return nil
+	}
+
+	domain := strings.ToLower(email[strings.LastIndex(email, "@")+1:])
+	for _, allowed := range r.allowedDomains {
+		if suffix := strings.TrimPrefix(allowed, "*"); suffix != allowed {
+			if strings.HasSuffix(domain, suffix) {
+				return nil
+			}
+		} else if domain == allowed {
+			return nil
+		}
+	}
+
+	return errors.Wrapf(errDomainNotAllowed, "[%s]", domain)
+}
+
+// parseAllowedEmailDomains validates and lowercases AllowedEmailDomains.
+func parseAllowedEmailDomains(domains []string) ([]string, error) {
+	parsed := make([]string, 0, len(domains))
+	for _, domain := range domains {
+		name := strings.TrimPrefix(domain, "*.")
+		if name == "" || strings.ContainsAny(name, "*@") {
+			return nil, errors.Errorf("invalid allowed email domain [%s]", domain)
+		}
+
+		parsed = append(parsed, strings.ToLower(domain))
+	}
+
+	return parsed, nil
+}
+
+// validateEmail performs only basic sanity checks, so that unusual but valid addresses are accepted.
+func validateEmail(email string) error {
+	parts := strings.Split(email, "@")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return errors.Wrapf(errInvalidEmail, "[%s]", email)
 	}
 
-	return id, nil
+	return nil
 }
 
 func (r *Redis) changePassword(conn redis.Conn, userID, newPassword string) error {
@@ -760,7 +3406,10 @@ func (r *Redis) changePassword(conn redis.Conn, userID, newPassword string) erro
 		return errors.Wrap(err, "encode password")
 	}
 
-	if _, err := conn.Do("HSET", userKey(userID), userHashedPasswordField, hashedPassword); err != nil {
+	if _, err := conn.Do("HSET", r.key(userKey(userID)),
+		userHashedPasswordField, hashedPassword,
+		userPasswordChangedAtField, timestamp.ToISOFormat(r.now().UTC()),
+	); err != nil {
 		return errors.Wrap(err, "update password")
 	}
 
@@ -768,37 +3417,118 @@ func (r *Redis) changePassword(conn redis.Conn, userID, newPassword string) erro
 		logging.SystemErrorf("Failed to revoke user [%s] tokens: %v", userID, err)
 	}
 
+	if err := r.deleteResetIDs(conn, userID); err != nil {
+		logging.SystemErrorf("Failed to delete user [%s] reset password IDs: %v", userID, err)
+	}
+
 	return nil
 }
 
+func (r *Redis) isPasswordExpired(conn redis.Conn, userID string) (bool, error) {
+	if r.maxPasswordAge <= 0 {
+		return false, nil
+	}
+
+	value, err := redis.String(conn.Do("HGET", r.key(userKey(userID)), userPasswordChangedAtField))
+	switch {
+	case errors.Is(err, redis.ErrNil):
+		return false, nil
+	case err != nil:
+		return false, err
+	}
+
+	changedAt, err := timestamp.ParseISOFormat(value)
+	if err != nil {
+		return false, errors.Wrapf(err, "parse %s", userPasswordChangedAtField)
+	}
+
+	return r.now().Sub(changedAt) > r.maxPasswordAge, nil
+}
+
+// rememberMeTokenPairTTL returns TTLs of token pairs issued with SignInOptions.RememberMe.
+func (r *Redis) rememberMeTokenPairTTL() tokenPairTTL {
+	ttl := defaultTokenPairTTL
+	ttl.refresh, ttl.rememberMe = r.rememberMeRefreshTTL, true
+	return ttl
+}
+
+// renewedTokenPairTTL returns TTLs of the token pair replacing the token, so that remember me sessions
+// keep the longer refresh TTL.
+func (r *Redis) renewedTokenPairTTL(token *redisToken) tokenPairTTL {
+	if token.RememberMe {
+		return r.rememberMeTokenPairTTL()
+	}
+
+	return defaultTokenPairTTL
+}
+
 func (r *Redis) generateTokenPair(conn redis.Conn, userID string, ttl tokenPairTTL) (*openapi.TokensResponse, error) {
-	now := timestamp.Now()
-	access := newRedisToken(now, userID, accessTokenType, ttl.access)
-	refresh := newRedisToken(now, userID, refreshTokenType, ttl.refresh)
+	return r.generateScopedTokenPair(conn, userID, ttl, defaultTokenScopes)
+}
+
+func (r *Redis) generateScopedTokenPair(conn redis.Conn, userID string, ttl tokenPairTTL, scopes []string) (*openapi.TokensResponse, error) {
+	now := r.now()
+	access := newRedisToken(now, userID, accessTokenType, r.tokenGenerator(), ttl.access, scopes)
+	refresh := newRedisToken(now, userID, refreshTokenType, r.tokenGenerator(), ttl.refresh, scopes)
+	access.RememberMe, refresh.RememberMe = ttl.rememberMe, ttl.rememberMe
+	r.decorateTokens(userID, access, refresh)
 
 	// link tokens
 	access.RefreshToken, refresh.AccessToken = refresh.RefreshToken, access.AccessToken
 
+	// persist both tokens or none of them
+	if _, err := conn.Do("MULTI"); err != nil {
+		return nil, errors.Wrap(err, "start transaction")
+	}
+
 	if err := r.saveToken(conn, accessTokenType, access); err != nil {
+		discardQuietly(conn)
 		return nil, errors.Wrapf(err, "save %s", accessTokenType.name())
 	}
 
 	if err := r.saveToken(conn, refreshTokenType, refresh); err != nil {
+		discardQuietly(conn)
 		return nil, errors.Wrapf(err, "save %s", refreshTokenType.name())
 	}
 
+	if err := execTransaction(conn); err != nil {
+		// EXEC does not roll back commands which have already been applied
+		if err := r.revokeToken(conn, access); err != nil {
+			logging.SystemErrorf("Failed to clean up partially saved token pair for user [%s]: %v", userID, err)
+		}
+
+		return nil, errors.Wrap(err, "save token pair")
+	}
+
 	return &openapi.TokensResponse{
-		UserId:       userID,
-		AccessToken:  access.AccessToken,
-		RefreshToken: refresh.RefreshToken,
+		UserId:           userID,
+		AccessToken:      access.AccessToken,
+		RefreshToken:     refresh.RefreshToken,
+		AccessExpiresAt:  access.ExpiredAt,
+		RefreshExpiresAt: refresh.ExpiredAt,
 	}, nil
 }
 
+// decorateTokens adds TokenDecorator claims to tokens of the user.
+func (r *Redis) decorateTokens(userID string, tokens ...*redisToken) {
+	if r.tokenDecorator == nil {
+		return
+	}
+
+	metadata := make(map[string]string)
+	r.tokenDecorator(userID, metadata)
+	if len(metadata) > 0 {
+		for _, token := range tokens {
+			token.Metadata = metadata
+		}
+	}
+}
+
 func (r *Redis) getUserIDByEmail(conn redis.Conn, email string) (string, error) {
-	userID, err := redis.String(conn.Do("HGET", usersIndexKey, email))
+	userID, err := redis.String(conn.Do("HGET", r.key(usersIndexKey), r.indexField(email)))
 	switch {
 	case errors.Is(err, redis.ErrNil):
-		return "", errUserNotFound
+		return "", ErrUserNotFound
 	case err != nil:
 		return "", errors.Wrap(err, "find user by email")
 	}
@@ -806,19 +3536,103 @@ func (r *Redis) getUserIDByEmail(conn redis.Conn, email string) (string, error)
 	return userID, nil
 }
 
+func (r *Redis) getUserIDByUsername(conn redis.Conn, username string) (string, error) {
+	userID, err := redis.String(conn.Do("HGET", r.key(usernamesIndexKey), username))
+	switch {
+	case errors.Is(err, redis.ErrNil):
+		return "", ErrUserNotFound
+	case err != nil:
+		return "", errors.Wrap(err, "find user by username")
+	}
+
+	return userID, nil
+}
+
 func (r *Redis) saveToken(conn redis.Conn, tokenType redisTokenType, token *redisToken) error {
-	data, err := json.Marshal(token)
+	value := tokenType.get(token)
+	data, err := r.encodeToken(value, token)
 	if err != nil {
-		return errors.Wrap(err, "marshal token")
+		return err
+	}
+
+	if r.tokenStorageVersion == tokenStorageKeys {
+		ttl, err := r.keyTTL(token)
+		if err != nil {
+			return err
+		} else if ttl < time.Millisecond {
+			// Redis would expire it right away
+			return nil
+		}
+
+		_, err = conn.Do("SET", r.key(tokenKey(tokenType, value)), data, "PX", ttl.Milliseconds())
+	} else {
+		_, err = conn.Do("HSET", r.key(tokenType.key()), value, data)
 	}
 
-	if _, err := conn.Do("HSET", tokenType.key(), tokenType.get(token), data); err != nil {
+	if err != nil {
 		return errors.Wrap(err, "persist token")
 	}
 
 	return nil
 }
 
+// slideToken extends access token expiration for sliding sessions. It does nothing if the token
+// is revoked or changed concurrently, so that revoked tokens are not resurrected.
+func (r *Redis) slideToken(ctx context.Context, token *redisToken) error {
+	expiredAt, ok, err := token.slidingExpiration(r.now(), r.slidingSessionTTL, r.slidingSessionMaxLife)
+	if err != nil || !ok {
+		return err
+	}
+
+	conn, err := r.redisPool.GetContext(ctx)
+	if err != nil {
+		return err
+	}
+
+	// pooled connections are unwatched on close
+	defer closeQuietly(conn)
+
+	key, exists := r.key(tokenKey(accessTokenType, token.AccessToken)), "EXISTS"
+	args := []interface{}{key}
+	if r.tokenStorageVersion != tokenStorageKeys {
+		key, exists = r.key(accessTokenType.key()), "HEXISTS"
+		args = []interface{}{key, token.AccessToken}
+	}
+
+	if _, err := conn.Do("WATCH", key); err != nil {
+		return errors.Wrapf(err, "watch %s", key)
+	}
+
+	if ok, err := redis.Bool(conn.Do(exists, args...)); err != nil {
+		return errors.Wrap(err, "check token exists")
+	} else if !ok {
+		return nil
+	}
+
+	extended := *token
+	extended.ExpiredAt = timestamp.ToISOFormat(expiredAt.UTC())
+	if _, err := conn.Do("MULTI"); err != nil {
+		return errors.Wrap(err, "start transaction")
+	}
+
+	if err := r.saveToken(conn, accessTokenType, &extended); err != nil {
+		discardQuietly(conn)
+		return err
+	}
+
+	if err := execTransaction(conn); err != nil && !errors.Is(err, redis.ErrNil) {
+		return errors.Wrap(err, "extend token")
+	}
+
+	return nil
+}
+
+// keyTTL returns TTL for the individual token key, which outlives the token by clock skew grace.
+func (r *Redis) keyTTL(token *redisToken) (time.Duration, error) {
+	ttl, err := token.ttl(r.now())
+	return ttl + r.clockSkewGrace, err
+}
+
 func (r *Redis) revokeTokens(conn redis.Conn, userID string) error {
 	if err := r.revokeTokenType(conn, userID, accessTokenType); err != nil {
 		return errors.Wrap(err, "revoke access tokens")
@@ -832,34 +3646,28 @@ func (r *Redis) revokeTokens(conn redis.Conn, userID string) error {
 }
 
 func (r *Redis) revokeTokenType(conn redis.Conn, userID string, tokenType redisTokenType) error {
-	data, err := redis.StringMap(conn.Do("HGETALL", tokenType.key()))
-	switch {
-	case errors.Is(err, redis.ErrNil):
-		return nil
-	case err != nil:
-		return errors.Wrap(err, "get tokens")
-	}
-
-	for _, data := range data {
-		var token redisToken
-		if err := json.Unmarshal([]byte(data), &token); err != nil {
-			err = errors.Wrapf(err, "malformed token data [%s] for user [%s]", data, userID)
-			logging.Info(err)
-			return err
-		}
+	return r.forEachTokenBatch(conn, tokenType, func(batch map[string][]byte) error {
+		for key, data := range batch {
+			token, err := r.decodeToken(key, data)
+			if err != nil {
+				err = errors.Wrapf(err, "malformed token data [%s] for user [%s]", data, userID)
+				logging.Info(err)
+				return err
+			}
 
-		if token.UserID != userID {
-			continue
-		}
+			if token.UserID != userID {
+				continue
+			}
 
-		if err := r.revokeToken(conn, &token); err != nil {
-			err = errors.Wrapf(err, "revoke token [%v]", token)
-			logging.Info(err)
-			return err
+			if err := r.revokeToken(conn, token); err != nil {
+				err = errors.Wrapf(err, "revoke token [%v]", token)
+				logging.Info(err)
+				return err
+			}
 		}
-	}
 
-	return nil
+		return nil
+	})
 }
 
 func (r *Redis) revokeToken(conn redis.Conn, token *redisToken) error {
@@ -872,13 +3680,220 @@ func (r *Redis) revokeToken(conn redis.Conn, token *redisToken) error {
 	}
 }
 
+// deleteInvalidTokens deletes access tokens which have failed validation on read paths.
+// Since conn may be a replica connection, deletion is performed on the primary.
+func (r *Redis) deleteInvalidTokens(ctx context.Context, conn redis.Conn, tokens ...*redisToken) {
+	if r.replicaPool != r.redisPool {
+		primary, err := r.redisPool.GetContext(ctx)
+		if err != nil {
+			logging.SystemErrorf(withRequestID(ctx, "Failed to get Redis connection for deleting invalid tokens: %v"), err)
+			return
+		}
+
+		defer closeQuietly(primary)
+		conn = primary
+	}
+
+	tokenType := accessTokenType
+	for _, token := range tokens {
+		if err := r.deleteToken(conn, tokenType, token); err != nil {
+			logging.SystemErrorf(withRequestID(ctx, "revoke expired %s [%s] failed: %s"), tokenType.name(), tokenType.get(token), err)
+		}
+	}
+}
+
 func (r *Redis) deleteToken(conn redis.Conn, tokenType redisTokenType, token *redisToken) error {
-	_, err := conn.Do("HDEL", tokenType.key(), tokenType.get(token))
+	value := tokenType.get(token)
+	if value == "" {
+		// access-only tokens have no refresh counterpart
+		return nil
+	}
+
+	return r.deleteTokenValue(conn, tokenType, value)
+}
+
+// deleteTokenValue deletes the token persisted with either storage scheme.
+func (r *Redis) deleteTokenValue(conn redis.Conn, tokenType redisTokenType, value string) error {
+	if tokenType == accessTokenType {
+		r.authCache.remove(value)
+	}
+
+	if _, err := conn.Do("DEL", r.key(tokenKey(tokenType, value))); err != nil {
+		return err
+	}
+
+	_, err := conn.Do("HDEL", r.key(tokenType.key()), value)
 	return err
 }
 
+// findToken probes access and refresh tokens in this order and returns the first match along with its type.
+func (r *Redis) findToken(conn redis.Conn, token string) (*redisToken, redisTokenType, error) {
+	for _, tokenType := range []redisTokenType{accessTokenType, refreshTokenType} {
+		found, err := r.getToken(conn, tokenType, token)
+		switch {
+		case errors.Is(err, errUnknownToken):
+			continue
+		case err != nil:
+			return nil, nil, errors.Wrapf(err, "get %s", tokenType.name())
+		}
+
+		return found, tokenType, nil
+	}
+
+	return nil, nil, errUnknownToken
+}
+
 func (r *Redis) getToken(conn redis.Conn, tokenType redisTokenType, token string) (*redisToken, error) {
-	data, err := redis.Bytes(conn.Do("HGET", tokenType.key(), token))
+	if err := r.sendTokenLookups(conn, tokenType, token); err != nil {
+		return nil, errors.Wrap(err, "send token lookup")
+	}
+
+	if err := conn.Flush(); err != nil {
+		return nil, errors.Wrap(err, "flush token lookup")
+	}
+
+	data, err := receiveTokenLookups(conn)
+	return r.parseToken(token, data, err)
+}
+
+// sendTokenLookups pipelines token lookups in both storage schemes, the configured one goes first.
+// Replies must be read with receiveTokenLookups.
+func (r *Redis) sendTokenLookups(conn redis.Conn, tokenType redisTokenType, token string) error {
+	type lookup struct {
+		command string
+		args    []interface{}
+	}
+
+	lookups := []lookup{
+		{"HGET", []interface{}{r.key(tokenType.key()), token}},
+		{"GET", []interface{}{r.key(tokenKey(tokenType, token))}},
+	}
+
+	if r.tokenStorageVersion == tokenStorageKeys {
+		lookups[0], lookups[1] = lookups[1], lookups[0]
+	}
+
+	for _, lookup := range lookups {
+		if err := conn.Send(lookup.command, lookup.args...); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// receiveTokenLookups reads replies of sendTokenLookups and returns the first found token data.
+func receiveTokenLookups(conn redis.Conn) ([]byte, error) {
+	data, err := redis.Bytes(conn.Receive())
+	fallbackData, fallbackErr := redis.Bytes(conn.Receive())
+	if errors.Is(err, redis.ErrNil) {
+		return fallbackData, fallbackErr
+	}
+
+	return data, err
+}
+
+// scanTokens returns data of all tokens of the type persisted with either storage scheme, indexed by token value,
+// at once. Prefer forEachTokenBatch unless all tokens are needed together.
+func (r *Redis) scanTokens(conn redis.Conn, tokenType redisTokenType) (map[string][]byte, error) {
+	result := make(map[string][]byte)
+	if err := r.forEachTokenBatch(conn, tokenType, func(batch map[string][]byte) error {
+		for key, data := range batch {
+			result[key] = data
+		}
+
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// forEachTokenBatch passes tokens of the type stored both in the hash and under individual keys to fn
+// in batches of about tokenScanBatchSize, so that large token sets never block Redis with a single command.
+// As usual for SCAN, tokens changed during iteration may be passed more than once or not at all.
+func (r *Redis) forEachTokenBatch(conn redis.Conn, tokenType redisTokenType, fn func(batch map[string][]byte) error) error {
+	if err := r.forEachHashTokenBatch(conn, tokenType, fn); err != nil {
+		return err
+	}
+
+	prefix := r.key(tokenKey(tokenType, ""))
+	cursor := 0
+	for {
+		reply, err := redis.Values(conn.Do("SCAN", cursor, "MATCH", prefix+"*", "COUNT", tokenScanBatchSize))
+		if err != nil {
+			return errors.Wrap(err, "scan token keys")
+		}
+
+		var keys []string
+		if _, err := redis.Scan(reply, &cursor, &keys); err != nil {
+			return errors.Wrap(err, "parse token keys")
+		}
+
+		if len(keys) > 0 {
+			args := make([]interface{}, len(keys))
+			for i, key := range keys {
+				args[i] = key
+			}
+
+			data, err := redis.ByteSlices(conn.Do("MGET", args...))
+			if err != nil {
+				return errors.Wrap(err, "get token keys")
+			}
+
+			batch := make(map[string][]byte, len(keys))
+			for i, key := range keys {
+				// nil if expired since SCAN
+				if data[i] != nil {
+					batch[strings.TrimPrefix(key, prefix)] = data[i]
+				}
+			}
+
+			if err := fn(batch); err != nil {
+				return err
+			}
+		}
+
+		if cursor == 0 {
+			return nil
+		}
+	}
+}
+
+// forEachHashTokenBatch acts like forEachTokenBatch for tokens stored in the hash only.
+func (r *Redis) forEachHashTokenBatch(conn redis.Conn, tokenType redisTokenType, fn func(batch map[string][]byte) error) error {
+	cursor := 0
+	for {
+		reply, err := redis.Values(conn.Do("HSCAN", r.key(tokenType.key()), cursor, "COUNT", tokenScanBatchSize))
+		if err != nil {
+			return errors.Wrap(err, "scan token hash")
+		}
+
+		var values [][]byte
+		if _, err := redis.Scan(reply, &cursor, &values); err != nil {
+			return errors.Wrap(err, "parse token hash")
+		}
+
+		if len(values) > 0 {
+			batch := make(map[string][]byte, len(values)/2)
+			for i := 0; i+1 < len(values); i += 2 {
+				batch[string(values[i])] = values[i+1]
+			}
+
+			if err := fn(batch); err != nil {
+				return err
+			}
+		}
+
+		if cursor == 0 {
+			return nil
+		}
+	}
+}
+
+// parseToken handles token lookup reply.
+func (r *Redis) parseToken(token string, data []byte, err error) (*redisToken, error) {
 	switch {
 	case errors.Is(err, redis.ErrNil):
 		return nil, errUnknownToken
@@ -890,24 +3905,133 @@ func (r *Redis) getToken(conn redis.Conn, tokenType redisTokenType, token string
 		return nil, errUnknownToken
 	}
 
-	var result redisToken
-	if err := json.Unmarshal(data, &result); err != nil {
+	result, err := r.decodeToken(token, data)
+	if err != nil {
 		err = errors.Wrapf(err, "malformed token [%s] data [%s]", token, string(data))
 		logging.SystemError(err)
 		return nil, err
 	}
 
-	return &result, nil
+	return result, nil
+}
+
+func (r *Redis) encodeToken(key string, token *redisToken) ([]byte, error) {
+	data, err := json.Marshal(token)
+	if err != nil {
+		return nil, errors.Wrap(err, "marshal token")
+	}
+
+	if r.tokenCipher != nil {
+		if data, err = r.tokenCipher.encrypt(data, []byte(key)); err != nil {
+			return nil, errors.Wrap(err, "encrypt token")
+		}
+	}
+
+	return data, nil
+}
+
+// decodeToken parses token data. Plaintext payloads are still accepted for tokens saved before encryption was enabled.
+func (r *Redis) decodeToken(key string, data []byte) (*redisToken, error) {
+	if isEncryptedToken(data) {
+		if r.tokenCipher == nil {
+			return nil, errors.New("token is encrypted, but token encryption is not configured")
+		}
+
+		var err error
+		if data, err = r.tokenCipher.decrypt(data, []byte(key)); err != nil {
+			return nil, errors.Wrap(err, "decrypt token")
+		}
+	}
+
+	var token redisToken
+	if err := json.Unmarshal(data, &token); err != nil {
+		return nil, err
+	}
+
+	return &token, nil
+}
+
+// execTransaction executes commands queued after MULTI and fails if any of them has failed.
+func execTransaction(conn redis.Conn) error {
+	replies, err := redis.Values(conn.Do("EXEC"))
+	if err != nil {
+		return err
+	}
+
+	for _, reply := range replies {
+		if err, ok := reply.(redis.Error); ok {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func discardQuietly(conn redis.Conn) {
+	_, _ = conn.Do("DISCARD")
+}
+
+// key returns Redis key namespaced with the configured prefix.
+func (r *Redis) key(key string) string {
+	return r.keyPrefix + key
 }
 
 func userKey(userID string) string {
 	return "user#" + userID
 }
 
+func tokenKey(tokenType redisTokenType, token string) string {
+	return tokenType.name() + "#" + token
+}
+
 func resetKey(resetID string) string {
 	return "password_reset#" + resetID
 }
 
-func always() error {
+func verifyKey(verifyID string) string {
+	return "email_verification#" + verifyID
+}
+
+func userResetsKey(userID string) string {
+	return "user_resets#" + userID
+}
+
+func userEmailsKey(userID string) string {
+	return "user_emails#" + userID
+}
+
+func resetCooldownKey(email string) string {
+	return "reset_cooldown#" + email
+}
+
+func hashServerToken(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(hash[:])
+}
+
+// checkTokenGenerator rejects token generators with insufficient declared entropy and sample values which
+// repeat or are shorter than entropyBits/8 bytes, since no encoding carries more than 8 bits per byte.
+func checkTokenGenerator(generate func() string, entropyBits int) error {
+	if entropyBits < minTokenEntropyBits {
+		return errors.Errorf("token generator entropy must be at least %d bits, got %d", minTokenEntropyBits, entropyBits)
+	}
+
+	minLength := (entropyBits + 7) / 8
+	samples := make(map[string]bool, tokenGeneratorSamples)
+	for i := 0; i < tokenGeneratorSamples; i++ {
+		token := generate()
+		if len(token) < minLength {
+			return errors.Errorf("token generator values must be at least %d bytes long to carry %d bits, got %d", minLength, entropyBits, len(token))
+		} else if samples[token] {
+			return errors.New("token generator values repeat")
+		}
+
+		samples[token] = true
+	}
+
 	return nil
 }
+
+func newUUID() string {
+	return uuid.NewV4().String()
+}
@@ -0,0 +1,265 @@
+package authorization
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/jitsucom/jitsu/configurator/middleware"
+	"github.com/jitsucom/jitsu/configurator/openapi"
+	"github.com/jitsucom/jitsu/server/timestamp"
+	"github.com/pkg/errors"
+)
+
+const (
+	apiKeysIndexKey = "api_keys_index"
+	apiKeySeparator = "."
+)
+
+var errUnknownAPIKey = errors.New("unknown API key")
+
+// APIKey describes a long-lived API key for server-to-server calls. The secret is never stored in plaintext.
+type APIKey struct {
+	ID        string
+	Label     string
+	CreatedAt time.Time
+}
+
+type redisAPIKey struct {
+	Label        string `json:"label"`
+	HashedSecret string `json:"hashed_secret"`
+	CreatedAt    string `json:"created_at"`
+}
+
+// CreateAPIKey issues a new API key for the user. The returned secret is shown only once and must be passed
+// to AuthorizeAPIKey as <key ID>.<secret>. Unlike session tokens, API keys do not expire and survive password changes.
+func (r *Redis) CreateAPIKey(ctx context.Context, userID, label string) (keyID, secret string, err error) {
+	conn, err := r.redisPool.GetContext(ctx)
+	if err != nil {
+		return "", "", err
+	}
+
+	defer closeQuietly(conn)
+
+	if _, err := r.getUserEmail(conn, userID); err != nil {
+		return "", "", middleware.ReadableError{
+			Description: "Failed to load user from Redis",
+			Cause:       err,
+		}
+	}
+
+	keyID, secret = r.idGenerator(), r.tokenGenerator()
+	data, err := json.Marshal(redisAPIKey{
+		Label:        label,
+		HashedSecret: hashServerToken(secret),
+		CreatedAt:    timestamp.ToISOFormat(r.now().UTC()),
+	})
+	if err != nil {
+		return "", "", errors.Wrap(err, "marshal API key")
+	}
+
+	if _, err := conn.Do("MULTI"); err != nil {
+		return "", "", errors.Wrap(err, "start transaction")
+	}
+
+	if _, err := conn.Do("HSET", r.key(apiKeysKey(userID)), keyID, data); err != nil {
+		discardQuietly(conn)
+		return "", "", errors.Wrap(err, "save API key")
+	}
+
+	if _, err := conn.Do("HSET", r.key(apiKeysIndexKey), keyID, userID); err != nil {
+		discardQuietly(conn)
+		return "", "", errors.Wrapf(err, "update %s", r.key(apiKeysIndexKey))
+	}
+
+	if err := execTransaction(conn); err != nil {
+		return "", "", middleware.ReadableError{
+			Description: "Failed to save API key in Redis",
+			Cause:       err,
+		}
+	}
+
+	return keyID, secret, nil
+}
+
+// AuthorizeAPIKey authorizes requests made with <key ID>.<secret> API keys.
+// AuthorizationInterceptor falls back to it for such tokens unknown to Authorize.
+func (r *Redis) AuthorizeAPIKey(ctx context.Context, key string) (*middleware.Authorization, error) {
+	parts := strings.SplitN(key, apiKeySeparator, 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return nil, errUnknownAPIKey
+	}
+
+	keyID, secret := parts[0], parts[1]
+	// revoked keys must not be accepted during replication lag
+	conn, err := r.redisPool.GetContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	defer closeQuietly(conn)
+
+	userID, err := redis.String(conn.Do("HGET", r.key(apiKeysIndexKey), keyID))
+	switch {
+	case errors.Is(err, redis.ErrNil):
+		return nil, errUnknownAPIKey
+	case err != nil:
+		return nil, middleware.ReadableError{
+			Description: "Failed to load API key from Redis",
+			Cause:       err,
+		}
+	}
+
+	apiKey, err := r.getAPIKey(conn, userID, keyID)
+	if err != nil {
+		return nil, err
+	}
+
+	if subtle.ConstantTimeCompare([]byte(apiKey.HashedSecret), []byte(hashServerToken(secret))) != 1 {
+		return nil, errUnknownAPIKey
+	}
+
+	email, err := r.getActiveUserEmail(conn, userID)
+	if errors.Is(err, errAccountLocked) {
+		return nil, err
+	} else if err != nil {
+		return nil, middleware.ReadableError{
+			Description: "Failed to load user email from Redis",
+			Cause:       err,
+		}
+	}
+
+	return &middleware.Authorization{
+		User: openapi.UserBasicInfo{
+			Id:    userID,
+			Email: email,
+		},
+		Subject: userID,
+	}, nil
+}
+
+// ListAPIKeys returns API keys of the user without secrets.
+func (r *Redis) ListAPIKeys(ctx context.Context, userID string) ([]APIKey, error) {
+	conn, err := r.replicaPool.GetContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	defer closeQuietly(conn)
+
+	values, err := redis.StringMap(conn.Do("HGETALL", r.key(apiKeysKey(userID))))
+	if err != nil {
+		return nil, middleware.ReadableError{
+			Description: "Failed to load API keys from Redis",
+			Cause:       err,
+		}
+	}
+
+	result := make([]APIKey, 0, len(values))
+	for keyID, data := range values {
+		apiKey, err := parseAPIKey(keyID, []byte(data))
+		if err != nil {
+			return nil, err
+		}
+
+		createdAt, err := timestamp.ParseISOFormat(apiKey.CreatedAt)
+		if err != nil {
+			return nil, errors.Wrapf(err, "parse API key [%s] creation time", keyID)
+		}
+
+		result = append(result, APIKey{
+			ID:        keyID,
+			Label:     apiKey.Label,
+			CreatedAt: createdAt,
+		})
+	}
+
+	return result, nil
+}
+
+// RevokeAPIKey deletes the API key of the user. Revoking unknown keys is not an error.
+func (r *Redis) RevokeAPIKey(ctx context.Context, userID, keyID string) error {
+	conn, err := r.redisPool.GetContext(ctx)
+	if err != nil {
+		return err
+	}
+
+	defer closeQuietly(conn)
+
+	owner, err := redis.String(conn.Do("HGET", r.key(apiKeysIndexKey), keyID))
+	switch {
+	case errors.Is(err, redis.ErrNil):
+		return nil
+	case err != nil:
+		return errors.Wrapf(err, "get %s", r.key(apiKeysIndexKey))
+	case owner != userID:
+		// keys of other users must not be revoked
+		return nil
+	}
+
+	if _, err := conn.Do("HDEL", r.key(apiKeysKey(userID)), keyID); err != nil {
+		return errors.Wrap(err, "delete API key")
+	}
+
+	if _, err := conn.Do("HDEL", r.key(apiKeysIndexKey), keyID); err != nil {
+		return errors.Wrapf(err, "update %s", r.key(apiKeysIndexKey))
+	}
+
+	return nil
+}
+
+// revokeAPIKeys deletes all API keys of the user.
+func (r *Redis) revokeAPIKeys(conn redis.Conn, userID string) error {
+	keyIDs, err := redis.Strings(conn.Do("HKEYS", r.key(apiKeysKey(userID))))
+	if err != nil {
+		return errors.Wrap(err, "get API keys")
+	}
+
+	if len(keyIDs) > 0 {
+		args := []interface{}{r.key(apiKeysIndexKey)}
+		for _, keyID := range keyIDs {
+			args = append(args, keyID)
+		}
+
+		if _, err := conn.Do("HDEL", args...); err != nil {
+			return errors.Wrapf(err, "update %s", r.key(apiKeysIndexKey))
+		}
+	}
+
+	if _, err := conn.Do("DEL", r.key(apiKeysKey(userID))); err != nil {
+		return errors.Wrap(err, "delete API keys")
+	}
+
+	return nil
+}
+
+func (r *Redis) getAPIKey(conn redis.Conn, userID, keyID string) (*redisAPIKey, error) {
+	data, err := redis.Bytes(conn.Do("HGET", r.key(apiKeysKey(userID)), keyID))
+	switch {
+	case errors.Is(err, redis.ErrNil):
+		return nil, errUnknownAPIKey
+	case err != nil:
+		return nil, middleware.ReadableError{
+			Description: "Failed to load API key from Redis",
+			Cause:       err,
+		}
+	}
+
+	return parseAPIKey(keyID, data)
+}
+
+func parseAPIKey(keyID string, data []byte) (*redisAPIKey, error) {
+	var apiKey redisAPIKey
+	if err := json.Unmarshal(data, &apiKey); err != nil {
+		return nil, errors.Wrapf(err, "malformed API key [%s] data", keyID)
+	}
+
+	return &apiKey, nil
+}
+
+func apiKeysKey(userID string) string {
+	return "api_keys#" + userID
+}
@@ -0,0 +1,199 @@
+package authorization
+
+import (
+	"context"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/jitsucom/jitsu/configurator/middleware"
+	"github.com/jitsucom/jitsu/configurator/openapi"
+	"github.com/jitsucom/jitsu/server/logging"
+	"github.com/jitsucom/jitsu/server/timestamp"
+	"github.com/pkg/errors"
+)
+
+// ExportUsers returns all users for backup or migration to another instance.
+// Exported records contain password hashes, so they must be stored as securely as Redis data.
+func (r *Redis) ExportUsers(ctx context.Context) ([]openapi.UserExport, error) {
+	conn, err := r.redisPool.GetContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	defer closeQuietly(conn)
+
+	users, err := r.listIndexedUsers(conn)
+	if err != nil {
+		return nil, middleware.ReadableError{
+			Description: "Failed to load users from Redis",
+			Cause:       err,
+		}
+	}
+
+	result := make([]openapi.UserExport, 0, len(users))
+	for _, user := range users {
+		values, err := redis.Strings(conn.Do("HMGET", r.key(userKey(user.Id)),
+			userEmailField, userHashedPasswordField, userUsernameField, userPasswordChangedAtField, userLockedField))
+		if err != nil {
+			return nil, errors.Wrapf(err, "get user [%s]", user.Id)
+		} else if values[0] == "" {
+			// dangling index entry
+			continue
+		}
+
+		export := openapi.UserExport{
+			Id:             user.Id,
+			Email:          values[0],
+			HashedPassword: values[1],
+		}
+
+		if values[2] != "" {
+			export.Username = &values[2]
+		}
+
+		if values[3] != "" {
+			export.PasswordChangedAt = &values[3]
+		}
+
+		if values[4] != "" {
+			locked := true
+			export.Locked = &locked
+		}
+
+		result = append(result, export)
+	}
+
+	return result, nil
+}
+
+// ImportUsers writes users exported with ExportUsers preserving their IDs and password hashes.
+// Users with the same IDs are overwritten, so failed imports may be retried. Emails and usernames
+// taken by other users are rejected with ErrUserExists and ErrUsernameExists, users before the failed one stay imported.
+func (r *Redis) ImportUsers(ctx context.Context, users []openapi.UserExport) error {
+	conn, err := r.redisPool.GetContext(ctx)
+	if err != nil {
+		return err
+	}
+
+	defer closeQuietly(conn)
+
+	for _, user := range users {
+		if err := r.importUser(conn, user); err != nil {
+			return errors.Wrapf(err, "import user [%s]", user.Id)
+		}
+	}
+
+	return nil
+}
+
+func (r *Redis) importUser(conn redis.Conn, user openapi.UserExport) (err error) {
+	if user.Id == "" || user.HashedPassword == "" {
+		return errors.New("user ID and hashed password are required")
+	}
+
+	if err := r.validatePasswordHash(user.HashedPassword); err != nil {
+		return err
+	}
+
+	if err := validateEmail(user.Email); err != nil {
+		return err
+	}
+
+	fields := []interface{}{
+		r.key(userKey(user.Id)),
+		userIDField, user.Id,
+		userEmailField, user.Email,
+		userHashedPasswordField, user.HashedPassword,
+	}
+
+	if user.PasswordChangedAt != nil {
+		if _, err := timestamp.ParseISOFormat(*user.PasswordChangedAt); err != nil {
+			return errors.Wrapf(err, "parse %s", userPasswordChangedAtField)
+		}
+
+		fields = append(fields, userPasswordChangedAtField, *user.PasswordChangedAt)
+	}
+
+	if user.Locked != nil && *user.Locked {
+		fields = append(fields, userLockedField, timestamp.ToISOFormat(r.now().UTC()))
+	}
+
+	var username string
+	if user.Username != nil && *user.Username != "" {
+		if username = *user.Username; !usernameRegex.MatchString(username) {
+			return errInvalidUsername
+		}
+
+		fields = append(fields, userUsernameField, username)
+	}
+
+	// entries claimed by this import are released if it fails, so that they don't point to users not imported
+	var claimed [][2]string
+	defer func() {
+		if err == nil {
+			return
+		}
+
+		for _, claim := range claimed {
+			if _, err := conn.Do("HDEL", claim[0], claim[1]); err != nil {
+				logging.SystemErrorf("Failed to release %s entry [%s] of not imported user [%s]: %v", claim[0], claim[1], user.Id, err)
+			}
+		}
+	}()
+
+	// HSETNX claims entries atomically, so that concurrent sign-ups can't take them meanwhile
+	claim := func(key, field string, conflict error) error {
+		if ok, err := redis.Bool(conn.Do("HSETNX", key, field, user.Id)); err != nil {
+			return errors.Wrapf(err, "update %s", key)
+		} else if ok {
+			claimed = append(claimed, [2]string{key, field})
+		} else if owner, err := redis.String(conn.Do("HGET", key, field)); err != nil {
+			return errors.Wrapf(err, "get %s", key)
+		} else if owner != user.Id {
+			return conflict
+		}
+
+		return nil
+	}
+
+	if err := claim(r.key(usersIndexKey), r.indexField(user.Email), ErrUserExists); err != nil {
+		return err
+	}
+
+	if username != "" {
+		if err := claim(r.key(usernamesIndexKey), username, ErrUsernameExists); err != nil {
+			return err
+		}
+	}
+
+	// overwritten users must not keep stale fields and index entries
+	previous, err := redis.Strings(conn.Do("HMGET", r.key(userKey(user.Id)), userEmailField, userUsernameField))
+	if err != nil {
+		return errors.Wrap(err, "get previous user data")
+	}
+
+	if previous[0] != "" && previous[0] != user.Email {
+		if _, err := conn.Do("HDEL", r.key(usersIndexKey), r.indexField(previous[0])); err != nil {
+			return errors.Wrapf(err, "remove %s from %s", previous[0], r.key(usersIndexKey))
+		}
+	}
+
+	if previous[1] != "" && previous[1] != username {
+		if _, err := conn.Do("HDEL", r.key(usernamesIndexKey), previous[1]); err != nil {
+			return errors.Wrapf(err, "remove %s from %s", previous[1], r.key(usernamesIndexKey))
+		}
+	}
+
+	if _, err := conn.Do("DEL", r.key(userKey(user.Id))); err != nil {
+		return errors.Wrap(err, "delete previous user data")
+	}
+
+	if _, err := conn.Do("HSET", fields...); err != nil {
+		return errors.Wrap(err, "save user")
+	}
+
+	if _, err := conn.Do("SADD", r.key(userIDsKey), user.Id); err != nil {
+		return errors.Wrapf(err, "update %s", r.key(userIDsKey))
+	}
+
+	return nil
+}
@@ -0,0 +1,329 @@
+package authorization
+
+import (
+	"context"
+	"sort"
+	"strings"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/jitsucom/jitsu/configurator/middleware"
+	"github.com/jitsucom/jitsu/server/logging"
+	"github.com/pkg/errors"
+)
+
+// Users index inconsistency kinds reported by FindOrphanedUsers.
+const (
+	// OrphanMissingUser is an index entry pointing to a user whose record does not exist.
+	OrphanMissingUser = "missing_user"
+
+	// OrphanEmailMismatch is an index entry pointing to a user whose record has no such primary or additional email.
+	OrphanEmailMismatch = "email_mismatch"
+
+	// OrphanUnindexedEmail is a user email absent from the index, so that the user can't sign in with it.
+	OrphanUnindexedEmail = "unindexed_email"
+
+	// OrphanConflictingEmail is a user email indexed to another user.
+	OrphanConflictingEmail = "conflicting_email"
+
+	// OrphanUserWithoutEmail is a user record without email, which can't be indexed at all.
+	OrphanUserWithoutEmail = "user_without_email"
+)
+
+// Users index repair actions taken by ReconcileUsersIndex.
+const (
+	RepairRemoveIndexEntry = "remove_index_entry"
+	RepairSetIndexEntry    = "set_index_entry"
+)
+
+// OrphanReport describes an inconsistency between the users index and user records.
+type OrphanReport struct {
+	Kind string
+
+	// IndexField is the users index field, which is the email hash if EmailIndexKey is configured.
+	IndexField string
+
+	// IndexedUserID is the user ID IndexField points to. It is empty if the field is absent from the index.
+	IndexedUserID string
+
+	// UserID and Email identify the user record and its email involved, if any.
+	UserID string
+	Email  string
+}
+
+// RepairAction is a users index change made by ReconcileUsersIndex or planned in dry run mode.
+type RepairAction struct {
+	Action string
+
+	// Report is the inconsistency fixed by the action.
+	Report OrphanReport
+
+	// UserID is the user the index entry is set to point to. It is empty for removals.
+	UserID string
+}
+
+// RepairReport lists users index changes and inconsistencies which need manual resolution.
+type RepairReport struct {
+	DryRun  bool
+	Actions []RepairAction
+	Skipped []OrphanReport
+}
+
+// FindOrphanedUsers cross-checks the users index against user records and reports index entries pointing to
+// missing users or to users without such emails, user emails missing from the index or indexed to other users
+// and users without emails. Reports are sorted by kind. It scans all user records, so it is expensive.
+func (r *Redis) FindOrphanedUsers(ctx context.Context) ([]OrphanReport, error) {
+	conn, err := r.redisPool.GetContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	defer closeQuietly(conn)
+
+	reports, _, err := r.findOrphanedUsers(conn)
+	return reports, err
+}
+
+// ReconcileUsersIndex fixes inconsistencies reported by FindOrphanedUsers treating user records as authoritative:
+//   - index entries of missing users and of emails the users don't have are removed, or repointed
+//     to the user whose record has the email, if there is exactly one such user;
+//   - user emails absent from the index are indexed, unless several users have the same email.
+//
+// Emails shared by several user records and users without emails need manual resolution, so they are reported
+// as skipped, as well as entries changed concurrently (e.g. by sign-ups) during the repair.
+// If dryRun is set, planned actions are reported, but nothing is changed. It scans all user records, so it is expensive.
+// Unlike RepairUsersIndex, which only removes entries of missing users, it relies on user records rather than the index.
+func (r *Redis) ReconcileUsersIndex(ctx context.Context, dryRun bool) (RepairReport, error) {
+	report := RepairReport{DryRun: dryRun}
+	conn, err := r.redisPool.GetContext(ctx)
+	if err != nil {
+		return report, err
+	}
+
+	defer closeQuietly(conn)
+
+	orphans, userEmails, err := r.findOrphanedUsers(conn)
+	if err != nil {
+		return report, err
+	}
+
+	actions, skipped := r.planIndexRepair(orphans, userEmails)
+	report.Skipped = skipped
+	if dryRun {
+		report.Actions = actions
+		return report, nil
+	}
+
+	for _, action := range actions {
+		if ok, err := r.applyIndexRepair(conn, action); err != nil {
+			return report, middleware.ReadableError{
+				Description: "Failed to repair users index",
+				Cause:       errors.Wrapf(err, "%s [%s]", action.Action, action.Report.IndexField),
+			}
+		} else if !ok {
+			report.Skipped = append(report.Skipped, action.Report)
+			continue
+		}
+
+		logging.Infof(withRequestID(ctx, "Repaired %s in %s: %s [%s] -> [%s]"),
+			action.Report.Kind, r.key(usersIndexKey), action.Action, action.Report.IndexField, action.UserID)
+		report.Actions = append(report.Actions, action)
+	}
+
+	return report, nil
+}
+
+func (r *Redis) findOrphanedUsers(conn redis.Conn) ([]OrphanReport, map[string][]string, error) {
+	index, err := r.getUsersIndex(conn)
+	if err != nil {
+		return nil, nil, middleware.ReadableError{
+			Description: "Failed to load users index from Redis",
+			Cause:       err,
+		}
+	}
+
+	userEmails, err := r.scanUserEmails(conn)
+	if err != nil {
+		return nil, nil, middleware.ReadableError{
+			Description: "Failed to load users from Redis",
+			Cause:       err,
+		}
+	}
+
+	return r.findOrphans(index, userEmails), userEmails, nil
+}
+
+func (r *Redis) findOrphans(index map[string]string, userEmails map[string][]string) []OrphanReport {
+	var reports []OrphanReport
+	claimed := make(map[string]map[string]bool, len(userEmails))
+	for userID, emails := range userEmails {
+		if len(emails) == 0 {
+			reports = append(reports, OrphanReport{Kind: OrphanUserWithoutEmail, UserID: userID})
+			continue
+		}
+
+		claimed[userID] = make(map[string]bool, len(emails))
+		for _, email := range emails {
+			field := r.indexField(email)
+			claimed[userID][field] = true
+			switch indexedUserID, ok := index[field]; {
+			case !ok:
+				reports = append(reports, OrphanReport{Kind: OrphanUnindexedEmail, IndexField: field, UserID: userID, Email: email})
+			case indexedUserID != userID:
+				reports = append(reports, OrphanReport{Kind: OrphanConflictingEmail, IndexField: field, IndexedUserID: indexedUserID, UserID: userID, Email: email})
+			}
+		}
+	}
+
+	for field, userID := range index {
+		if _, ok := userEmails[userID]; !ok {
+			reports = append(reports, OrphanReport{Kind: OrphanMissingUser, IndexField: field, IndexedUserID: userID})
+		} else if !claimed[userID][field] {
+			report := OrphanReport{Kind: OrphanEmailMismatch, IndexField: field, IndexedUserID: userID, UserID: userID}
+			if emails := userEmails[userID]; len(emails) > 0 {
+				report.Email = emails[0]
+			}
+
+			reports = append(reports, report)
+		}
+	}
+
+	sort.Slice(reports, func(i, j int) bool {
+		a, b := reports[i], reports[j]
+		if a.Kind != b.Kind {
+			return a.Kind < b.Kind
+		} else if a.UserID != b.UserID {
+			return a.UserID < b.UserID
+		} else {
+			return a.IndexField < b.IndexField
+		}
+	})
+
+	return reports
+}
+
+// scanUserEmails returns emails of all user records, the primary one goes first.
+// Users whose records have no email get empty slices.
+func (r *Redis) scanUserEmails(conn redis.Conn) (map[string][]string, error) {
+	prefix := r.key(userKey(""))
+	result := make(map[string][]string)
+	if err := r.forEachKeyBatch(conn, prefix+"*", func(keys []string) error {
+		for _, key := range keys {
+			userID := strings.TrimPrefix(key, prefix)
+			if err := conn.Send("HGET", key, userEmailField); err != nil {
+				return errors.Wrap(err, "send user email lookup")
+			}
+
+			if err := conn.Send("SMEMBERS", r.key(userEmailsKey(userID))); err != nil {
+				return errors.Wrap(err, "send additional emails lookup")
+			}
+		}
+
+		if err := conn.Flush(); err != nil {
+			return errors.Wrap(err, "flush user email lookups")
+		}
+
+		for _, key := range keys {
+			userID := strings.TrimPrefix(key, prefix)
+			email, err := redis.String(conn.Receive())
+			if err != nil && !errors.Is(err, redis.ErrNil) {
+				return errors.Wrapf(err, "get user [%s] email", userID)
+			}
+
+			additional, err := redis.Strings(conn.Receive())
+			if err != nil {
+				return errors.Wrapf(err, "get user [%s] additional emails", userID)
+			}
+
+			emails := make([]string, 0, 1+len(additional))
+			if email != "" {
+				sort.Strings(additional)
+				emails = append(append(emails, email), additional...)
+			}
+
+			result[userID] = emails
+		}
+
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// planIndexRepair returns actions fixing orphans and orphans which need manual resolution.
+func (r *Redis) planIndexRepair(orphans []OrphanReport, userEmails map[string][]string) ([]RepairAction, []OrphanReport) {
+	claimants := make(map[string][]string)
+	for userID, emails := range userEmails {
+		for _, email := range emails {
+			field := r.indexField(email)
+			claimants[field] = append(claimants[field], userID)
+		}
+	}
+
+	var actions []RepairAction
+	var skipped []OrphanReport
+	for _, orphan := range orphans {
+		users := claimants[orphan.IndexField]
+		switch orphan.Kind {
+		case OrphanMissingUser, OrphanEmailMismatch, OrphanUnindexedEmail:
+			if len(users) == 0 {
+				actions = append(actions, RepairAction{Action: RepairRemoveIndexEntry, Report: orphan})
+			} else if len(users) == 1 {
+				actions = append(actions, RepairAction{Action: RepairSetIndexEntry, Report: orphan, UserID: users[0]})
+			} else {
+				skipped = append(skipped, orphan)
+			}
+		case OrphanConflictingEmail:
+			// otherwise the index entry is repointed by the action fixing its missing_user or email_mismatch report
+			if len(users) > 1 {
+				skipped = append(skipped, orphan)
+			}
+		default:
+			skipped = append(skipped, orphan)
+		}
+	}
+
+	return actions, skipped
+}
+
+// applyIndexRepair changes the index entry if it still points to the reported user.
+// It returns false if the entry has been changed concurrently.
+func (r *Redis) applyIndexRepair(conn redis.Conn, action RepairAction) (bool, error) {
+	key := r.key(usersIndexKey)
+	if _, err := conn.Do("WATCH", key); err != nil {
+		return false, errors.Wrapf(err, "watch %s", key)
+	}
+
+	userID, err := redis.String(conn.Do("HGET", key, action.Report.IndexField))
+	if err != nil && !errors.Is(err, redis.ErrNil) {
+		_, _ = conn.Do("UNWATCH")
+		return false, errors.Wrapf(err, "get %s entry", key)
+	} else if userID != action.Report.IndexedUserID {
+		_, _ = conn.Do("UNWATCH")
+		return false, nil
+	}
+
+	if _, err := conn.Do("MULTI"); err != nil {
+		return false, errors.Wrap(err, "start transaction")
+	}
+
+	if action.Action == RepairRemoveIndexEntry {
+		_, err = conn.Do("HDEL", key, action.Report.IndexField)
+	} else {
+		_, err = conn.Do("HSET", key, action.Report.IndexField, action.UserID)
+	}
+
+	if err != nil {
+		discardQuietly(conn)
+		return false, err
+	}
+
+	if err := execTransaction(conn); errors.Is(err, redis.ErrNil) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
@@ -0,0 +1,94 @@
+package authorization
+
+import (
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/jitsucom/jitsu/server/meta"
+	"github.com/pkg/errors"
+)
+
+// Redis pool creation failure categories. NewRedis errors match one of them with errors.Is.
+var (
+	ErrRedisUnreachable = errors.New("Redis is unreachable")
+	ErrRedisAuth        = errors.New("Redis authentication failed")
+	ErrRedisTimeout     = errors.New("Redis connection timed out")
+	ErrRedisPool        = errors.New("Redis pool creation failed")
+)
+
+// redisPoolError keeps the original cause along with its category.
+type redisPoolError struct {
+	category error
+	cause    error
+}
+
+func (e *redisPoolError) Error() string {
+	return e.category.Error() + ": " + e.cause.Error()
+}
+
+func (e *redisPoolError) Is(target error) bool {
+	return e.category == target
+}
+
+func (e *redisPoolError) Unwrap() error {
+	return e.cause
+}
+
+// createRedisPool creates the pool and classifies failures, so that operators can tell
+// misconfigured credentials from network issues.
+func createRedisPool(factory *meta.RedisPoolFactory) (*meta.RedisPool, error) {
+	pool, err := factory.Create()
+	if err != nil {
+		return nil, &redisPoolError{category: classifyRedisPoolError(err), cause: err}
+	}
+
+	return pool, nil
+}
+
+// withCommandTimeouts returns a copy of factory with non-zero timeouts applied to every dialed connection,
+// so that the caller's factory is not modified.
+func withCommandTimeouts(factory *meta.RedisPoolFactory, readTimeout, writeTimeout time.Duration) *meta.RedisPoolFactory {
+	if readTimeout == 0 && writeTimeout == 0 {
+		return factory
+	}
+
+	options := factory.GetOptions()
+	if readTimeout > 0 {
+		options.DefaultDialReadTimeout = readTimeout
+	}
+
+	if writeTimeout > 0 {
+		options.DefaultDialWriteTimeout = writeTimeout
+	}
+
+	copied := *factory
+	return copied.WithOptions(options)
+}
+
+func classifyRedisPoolError(err error) error {
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() || errors.Is(err, os.ErrDeadlineExceeded) {
+		return ErrRedisTimeout
+	}
+
+	var redisErr redis.Error
+	if errors.As(err, &redisErr) {
+		message := strings.ToUpper(redisErr.Error())
+		for _, prefix := range []string{"NOAUTH", "WRONGPASS", "ERR INVALID PASSWORD", "ERR AUTH", "ERR CLIENT SENT AUTH"} {
+			if strings.HasPrefix(message, prefix) {
+				return ErrRedisAuth
+			}
+		}
+	}
+
+	var dnsErr *net.DNSError
+	var opErr *net.OpError
+	if errors.As(err, &dnsErr) || errors.As(err, &opErr) {
+		return ErrRedisUnreachable
+	}
+
+	return ErrRedisPool
+}
@@ -0,0 +1,2698 @@
+package authorization
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gomodule/redigo/redis"
+	"github.com/jitsucom/jitsu/configurator/handlers"
+	"github.com/jitsucom/jitsu/configurator/middleware"
+	"github.com/jitsucom/jitsu/configurator/openapi"
+	"github.com/jitsucom/jitsu/server/meta"
+	"github.com/jitsucom/jitsu/server/safego"
+	"github.com/jitsucom/jitsu/server/test"
+	"github.com/jitsucom/jitsu/server/timestamp"
+	"github.com/pkg/errors"
+	uuid "github.com/satori/go.uuid"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/bcrypt"
+)
+
+type mailSenderMock struct {
+	links []string
+}
+
+func (m *mailSenderMock) IsConfigured() bool {
+	return true
+}
+
+func (m *mailSenderMock) SendResetPassword(email, link string) error {
+	m.links = append(m.links, link)
+	return nil
+}
+
+func (m *mailSenderMock) SendAccountCreated(email, link string) error {
+	m.links = append(m.links, link)
+	return nil
+}
+
+func (m *mailSenderMock) SendEmailVerification(email, link string) error {
+	m.links = append(m.links, link)
+	return nil
+}
+
+// failingMailSender counts send attempts and fails them with err if set.
+type failingMailSender struct {
+	attempts int
+	err      error
+}
+
+func (m *failingMailSender) IsConfigured() bool {
+	return true
+}
+
+func (m *failingMailSender) SendResetPassword(email, link string) error {
+	m.attempts++
+	return m.err
+}
+
+func (m *failingMailSender) SendAccountCreated(email, link string) error {
+	m.attempts++
+	return m.err
+}
+
+func (m *failingMailSender) SendEmailVerification(email, link string) error {
+	m.attempts++
+	return m.err
+}
+
+func newTestRedis(t testing.TB, init RedisInit) *Redis {
+	ctx := context.Background()
+	container, err := test.NewRedisContainer(ctx)
+	require.NoError(t, err)
+	t.Cleanup(container.Close)
+
+	init.PoolFactory = meta.NewRedisPoolFactory(container.Host, container.Port, "", 0, false, "")
+	if init.MailSender == nil {
+		init.MailSender = new(mailSenderMock)
+	}
+
+	if init.BcryptCost == 0 {
+		init.BcryptCost = bcrypt.MinCost
+	}
+
+	// REDIS_TEST_PORT makes all tests share the same Redis
+	pool, err := init.PoolFactory.Create()
+	require.NoError(t, err)
+	conn := pool.Get()
+	_, err = conn.Do("FLUSHDB")
+	closeQuietly(conn)
+	closeQuietly(pool)
+	require.NoError(t, err)
+
+	r, err := NewRedis(init)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = r.Close() })
+
+	return r
+}
+
+func TestRedisGenerateTokenPairIsAtomic(t *testing.T) {
+	r := newTestRedis(t, RedisInit{})
+	conn := r.redisPool.Get()
+	defer closeQuietly(conn)
+
+	tokenPair, err := r.generateTokenPair(conn, "user-1", defaultTokenPairTTL)
+	require.NoError(t, err)
+	_, err = r.getToken(conn, accessTokenType, tokenPair.AccessToken)
+	require.NoError(t, err)
+	_, err = r.getToken(conn, refreshTokenType, tokenPair.RefreshToken)
+	require.NoError(t, err)
+
+	// make the refresh token HSET fail inside the transaction
+	_, err = conn.Do("DEL", accessTokenType.key())
+	require.NoError(t, err)
+	_, err = conn.Do("SET", refreshTokenType.key(), "not a hash")
+	require.NoError(t, err)
+
+	_, err = r.generateTokenPair(conn, "user-1", defaultTokenPairTTL)
+	require.Error(t, err)
+
+	accessTokens, err := redis.Int(conn.Do("HLEN", accessTokenType.key()))
+	require.NoError(t, err)
+	require.Zero(t, accessTokens, "access token must not be left orphaned")
+}
+
+func TestRedisTokenEncryption(t *testing.T) {
+	oldKey, newKey := []byte("0123456789abcdef"), []byte("fedcba9876543210")
+	r := newTestRedis(t, RedisInit{
+		TokenEncryptionKeys:  map[string][]byte{"old": oldKey},
+		TokenEncryptionKeyID: "old",
+	})
+
+	conn := r.redisPool.Get()
+	defer closeQuietly(conn)
+
+	oldPair, err := r.generateTokenPair(conn, "user-1", defaultTokenPairTTL)
+	require.NoError(t, err)
+
+	data, err := redis.String(conn.Do("HGET", accessTokenType.key(), oldPair.AccessToken))
+	require.NoError(t, err)
+	require.NotContains(t, data, "user-1")
+
+	// rotate the key and keep the old one for decryption only
+	r.tokenCipher, err = newTokenCipher(map[string][]byte{"old": oldKey, "new": newKey}, "new")
+	require.NoError(t, err)
+
+	newPair, err := r.generateTokenPair(conn, "user-1", defaultTokenPairTTL)
+	require.NoError(t, err)
+
+	for _, accessToken := range []string{oldPair.AccessToken, newPair.AccessToken} {
+		token, err := r.getToken(conn, accessTokenType, accessToken)
+		require.NoError(t, err)
+		require.Equal(t, "user-1", token.UserID)
+	}
+
+	// payloads are bound to their lookup keys
+	_, err = conn.Do("HSET", accessTokenType.key(), "stolen", data)
+	require.NoError(t, err)
+	_, err = r.getToken(conn, accessTokenType, "stolen")
+	require.Error(t, err)
+	_, err = conn.Do("HDEL", accessTokenType.key(), "stolen")
+	require.NoError(t, err)
+
+	require.NoError(t, r.revokeTokens(conn, "user-1"))
+	count, err := redis.Int(conn.Do("HLEN", accessTokenType.key()))
+	require.NoError(t, err)
+	require.Zero(t, count)
+}
+
+func TestRedisAuthorizeServerToken(t *testing.T) {
+	ctx := context.Background()
+	tests := []struct {
+		name        string
+		serverToken string
+		token       string
+		expectAdmin bool
+	}{
+		{"match", "server-token", "server-token", true},
+		{"mismatch", "server-token", "other-token", false},
+		{"empty configured", "", "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newTestRedis(t, RedisInit{ServerToken: tt.serverToken})
+			authorization, err := r.Authorize(ctx, tt.token)
+			if tt.expectAdmin {
+				require.NoError(t, err)
+				require.True(t, authorization.IsAdmin)
+			} else {
+				require.ErrorIs(t, err, errUnknownToken)
+			}
+		})
+	}
+}
+
+func TestRedisFindUserIDByEmail(t *testing.T) {
+	ctx := context.Background()
+	r := newTestRedis(t, RedisInit{})
+
+	tokenPair, err := r.SignUp(ctx, "user@example.com", "password")
+	require.NoError(t, err)
+
+	userID, err := r.FindUserIDByEmail(ctx, "user@example.com")
+	require.NoError(t, err)
+	require.Equal(t, tokenPair.UserId, userID)
+
+	_, err = r.FindUserIDByEmail(ctx, "unknown@example.com")
+	require.ErrorIs(t, err, ErrUserNotFound)
+}
+
+func TestRedisIDGenerator(t *testing.T) {
+	ctx := context.Background()
+	var seq int
+	r := newTestRedis(t, RedisInit{IDGenerator: func() string {
+		seq++
+		return fmt.Sprintf("id%d", seq)
+	}})
+
+	tokenPair, err := r.SignUp(ctx, "user@example.com", "password")
+	require.NoError(t, err)
+	require.Equal(t, "user-id1", tokenPair.UserId)
+
+	// secrets are never minted with IDGenerator
+	keyID, secret, err := r.CreateAPIKey(ctx, tokenPair.UserId, "ci")
+	require.NoError(t, err)
+	require.Equal(t, "id2", keyID)
+	for _, token := range []string{tokenPair.AccessToken, tokenPair.RefreshToken, secret} {
+		_, err := uuid.FromString(token)
+		require.NoError(t, err, token)
+	}
+}
+
+func TestRedisClock(t *testing.T) {
+	ctx := context.Background()
+	var seq int
+	now := time.Date(2022, 3, 1, 12, 0, 0, 0, time.UTC)
+	r := newTestRedis(t, RedisInit{
+		IDGenerator: func() string {
+			seq++
+			return fmt.Sprintf("id%d", seq)
+		},
+		Clock: func() time.Time { return now },
+	})
+
+	tokenPair, err := r.SignUp(ctx, "user@example.com", "password")
+	require.NoError(t, err)
+	require.Equal(t, &openapi.TokensResponse{
+		UserId:           "user-id1",
+		AccessToken:      tokenPair.AccessToken,
+		RefreshToken:     tokenPair.RefreshToken,
+		AccessExpiresAt:  "2022-03-02T12:00:00.000000Z",
+		RefreshExpiresAt: "2022-03-08T12:00:00.000000Z",
+	}, tokenPair)
+
+	tokens, err := r.ListActiveTokens(ctx, false)
+	require.NoError(t, err)
+	require.Len(t, tokens, 1)
+	require.Equal(t, "2022-03-01T12:00:00.000000Z", *tokens[0].IssuedAt)
+
+	now = now.Add(defaultTokenPairTTL.access)
+	_, err = r.Authorize(ctx, tokenPair.AccessToken)
+	require.NoError(t, err, "token is valid until its expiration time")
+	now = now.Add(time.Nanosecond)
+	_, err = r.Authorize(ctx, tokenPair.AccessToken)
+	require.ErrorIs(t, err, errExpiredToken)
+}
+
+func TestRedisRotateServerToken(t *testing.T) {
+	ctx := context.Background()
+	r := newTestRedis(t, RedisInit{ServerToken: "old-token"})
+
+	require.NoError(t, r.RotateServerToken(ctx, "new-token"))
+	for _, token := range []string{"old-token", "new-token"} {
+		authorization, err := r.Authorize(ctx, token)
+		require.NoError(t, err)
+		require.True(t, authorization.IsAdmin)
+	}
+
+	// grace period of the first token is over
+	require.NoError(t, r.RotateServerToken(ctx, "newest-token"))
+	_, err := r.Authorize(ctx, "old-token")
+	require.ErrorIs(t, err, errUnknownToken)
+	_, err = r.Authorize(ctx, "new-token")
+	require.NoError(t, err)
+}
+
+func TestRedisReconcileServerToken(t *testing.T) {
+	ctx := context.Background()
+	r := newTestRedis(t, RedisInit{ServerToken: "configured-token"})
+	conn := r.redisPool.Get()
+	defer closeQuietly(conn)
+
+	isServerToken := func(token string) bool {
+		ok, err := r.IsServerToken(ctx, token)
+		require.NoError(t, err)
+		return ok
+	}
+
+	// restarts with the same configured token keep the rotated one
+	require.NoError(t, r.RotateServerToken(ctx, "rotated-token"))
+	_, err := conn.Do("DEL", previousServerTokenKey)
+	require.NoError(t, err)
+	require.NoError(t, r.initServerToken("configured-token"))
+	require.True(t, isServerToken("rotated-token"))
+	require.False(t, isServerToken("configured-token"))
+
+	// changed configured token replaces the rotated one after the grace period
+	require.NoError(t, r.initServerToken("changed-token"))
+	require.True(t, isServerToken("changed-token"))
+	require.True(t, isServerToken("rotated-token"))
+	_, err = conn.Do("DEL", previousServerTokenKey)
+	require.NoError(t, err)
+	require.False(t, isServerToken("rotated-token"))
+
+	// lost server token is restored from the configuration
+	_, err = conn.Do("DEL", serverTokenKey)
+	require.NoError(t, err)
+	require.NoError(t, r.initServerToken("changed-token"))
+	require.True(t, isServerToken("changed-token"))
+}
+
+func TestRedisAuthorizeBatch(t *testing.T) {
+	ctx := context.Background()
+	r := newTestRedis(t, RedisInit{ServerToken: "server-token"})
+	conn := r.redisPool.Get()
+	defer closeQuietly(conn)
+
+	tokenPair, err := r.SignUp(ctx, "user@example.com", "password")
+	require.NoError(t, err)
+	expired, err := r.generateTokenPair(conn, tokenPair.UserId, tokenPairTTL{access: -time.Second, refresh: time.Hour})
+	require.NoError(t, err)
+
+	results, errs := r.AuthorizeBatch(ctx, []string{tokenPair.AccessToken, "unknown", expired.AccessToken, "server-token"})
+	require.NoError(t, errs[0])
+	require.Equal(t, "user@example.com", results[0].User.Email)
+	require.ErrorIs(t, errs[1], errUnknownToken)
+	require.ErrorIs(t, errs[2], errExpiredToken)
+	require.NoError(t, errs[3])
+	require.True(t, results[3].IsAdmin)
+
+	_, err = r.getToken(conn, accessTokenType, expired.AccessToken)
+	require.ErrorIs(t, err, errUnknownToken, "expired token must be deleted")
+}
+
+func TestRedisListActiveTokens(t *testing.T) {
+	ctx := context.Background()
+	r := newTestRedis(t, RedisInit{})
+	conn := r.redisPool.Get()
+	defer closeQuietly(conn)
+
+	tokenPair, err := r.SignUp(ctx, "user@example.com", "password")
+	require.NoError(t, err)
+	expired, err := r.generateTokenPair(conn, tokenPair.UserId, tokenPairTTL{access: -time.Second, refresh: time.Hour})
+	require.NoError(t, err)
+	_, err = conn.Do("HSET", accessTokenType.key(), "malformed", "{")
+	require.NoError(t, err)
+
+	tokens, err := r.ListActiveTokens(ctx, false)
+	require.NoError(t, err)
+	require.Len(t, tokens, 1)
+	require.Equal(t, tokenPair.UserId, tokens[0].UserId)
+	require.NotNil(t, tokens[0].IssuedAt)
+	_, err = r.getToken(conn, accessTokenType, expired.AccessToken)
+	require.NoError(t, err, "expired token must be kept without purge")
+
+	_, err = r.ListActiveTokens(ctx, true)
+	require.NoError(t, err)
+	_, err = r.getToken(conn, accessTokenType, expired.AccessToken)
+	require.ErrorIs(t, err, errUnknownToken, "expired token must be purged")
+	_, err = r.getToken(conn, refreshTokenType, expired.RefreshToken)
+	require.NoError(t, err, "refresh token must survive access token purge")
+}
+
+func TestRedisSignInRememberMe(t *testing.T) {
+	ctx := context.Background()
+	r := newTestRedis(t, RedisInit{})
+	conn := r.redisPool.Get()
+	defer closeQuietly(conn)
+
+	_, err := r.SignUp(ctx, "user@example.com", "password")
+	require.NoError(t, err)
+
+	refreshTTL := func(opts handlers.SignInOptions) time.Duration {
+		tokenPair, err := r.SignInWithOptions(ctx, "user@example.com", "password", opts)
+		require.NoError(t, err)
+		token, err := r.getToken(conn, refreshTokenType, tokenPair.RefreshToken)
+		require.NoError(t, err)
+		expiredAt, err := timestamp.ParseISOFormat(token.ExpiredAt)
+		require.NoError(t, err)
+		return time.Until(expiredAt)
+	}
+
+	require.InDelta(t, defaultTokenPairTTL.refresh, refreshTTL(handlers.SignInOptions{}), float64(time.Minute))
+	require.InDelta(t, defaultRememberMeRefreshTTL, refreshTTL(handlers.SignInOptions{RememberMe: true}), float64(time.Minute))
+}
+
+func TestRedisRefreshTokenKeepsRememberMe(t *testing.T) {
+	ctx := context.Background()
+	r := newTestRedis(t, RedisInit{})
+	conn := r.redisPool.Get()
+	defer closeQuietly(conn)
+
+	_, err := r.SignUp(ctx, "user@example.com", "password")
+	require.NoError(t, err)
+
+	refreshedTTL := func(opts handlers.SignInOptions) time.Duration {
+		tokenPair, err := r.SignInWithOptions(ctx, "user@example.com", "password", opts)
+		require.NoError(t, err)
+		for i := 0; i < 2; i++ {
+			tokenPair, err = r.RefreshToken(ctx, tokenPair.RefreshToken)
+			require.NoError(t, err)
+		}
+
+		token, err := r.getToken(conn, refreshTokenType, tokenPair.RefreshToken)
+		require.NoError(t, err)
+		expiredAt, err := timestamp.ParseISOFormat(token.ExpiredAt)
+		require.NoError(t, err)
+		return time.Until(expiredAt)
+	}
+
+	require.InDelta(t, defaultTokenPairTTL.refresh, refreshedTTL(handlers.SignInOptions{}), float64(time.Minute))
+	require.InDelta(t, defaultRememberMeRefreshTTL, refreshedTTL(handlers.SignInOptions{RememberMe: true}), float64(time.Minute))
+}
+
+func TestRedisSignUpValidatesEmail(t *testing.T) {
+	ctx := context.Background()
+	r := newTestRedis(t, RedisInit{})
+
+	for _, email := range []string{"", "user", "@example.com", "user@", "user@@example.com", "user@sub@example.com"} {
+		_, err := r.SignUp(ctx, email, "password")
+		require.ErrorIs(t, err, errInvalidEmail, email)
+	}
+
+	for _, email := range []string{"user@example.com", "user+tag@example.com", "\"quoted user\"@localhost"} {
+		_, err := r.SignUp(ctx, email, "password")
+		require.NoError(t, err, email)
+	}
+
+	users, err := r.ListUsers(ctx)
+	require.NoError(t, err)
+	require.Len(t, users, 3)
+}
+
+func TestRedisOnUserCreated(t *testing.T) {
+	ctx := context.Background()
+	recovered := make(chan interface{}, 1)
+	previousRecoverHandler := safego.GlobalRecoverHandler
+	safego.GlobalRecoverHandler = func(value interface{}) { recovered <- value }
+	t.Cleanup(func() { safego.GlobalRecoverHandler = previousRecoverHandler })
+
+	t.Run("configured", func(t *testing.T) {
+		created := make(chan string, 1)
+		r := newTestRedis(t, RedisInit{OnUserCreated: func(ctx context.Context, userID, email string) {
+			created <- userID + " " + email
+		}})
+
+		tokenPair, err := r.SignUp(ctx, "user@example.com", "password")
+		require.NoError(t, err)
+
+		select {
+		case value := <-created:
+			require.Equal(t, tokenPair.UserId+" user@example.com", value)
+		case <-time.After(time.Second):
+			require.Fail(t, "callback has not been called")
+		}
+	})
+
+	t.Run("nil", func(t *testing.T) {
+		r := newTestRedis(t, RedisInit{})
+		_, err := r.SignUp(ctx, "user@example.com", "password")
+		require.NoError(t, err)
+	})
+
+	t.Run("panicking", func(t *testing.T) {
+		r := newTestRedis(t, RedisInit{OnUserCreated: func(ctx context.Context, userID, email string) {
+			panic("callback failed")
+		}})
+
+		_, err := r.SignUp(ctx, "user@example.com", "password")
+		require.NoError(t, err)
+
+		select {
+		case value := <-recovered:
+			require.Equal(t, "callback failed", value)
+		case <-time.After(time.Second):
+			require.Fail(t, "panic has not been recovered")
+		}
+	})
+}
+
+func TestRedisOnPasswordReset(t *testing.T) {
+	ctx := context.Background()
+	recovered := make(chan interface{}, 1)
+	previousRecoverHandler := safego.GlobalRecoverHandler
+	safego.GlobalRecoverHandler = func(value interface{}) { recovered <- value }
+	t.Cleanup(func() { safego.GlobalRecoverHandler = previousRecoverHandler })
+
+	resetPassword := func(t *testing.T, r *Redis) string {
+		created, err := r.CreateUser(ctx, "user@example.com")
+		require.NoError(t, err)
+		_, err = r.ResetPassword(ctx, created.ResetID, "new password")
+		require.NoError(t, err)
+		return created.ID
+	}
+
+	t.Run("configured", func(t *testing.T) {
+		reset := make(chan string, 1)
+		r := newTestRedis(t, RedisInit{OnPasswordReset: func(userID string) { reset <- userID }})
+		userID := resetPassword(t, r)
+
+		select {
+		case value := <-reset:
+			require.Equal(t, userID, value)
+		case <-time.After(time.Second):
+			require.Fail(t, "hook has not been called")
+		}
+	})
+
+	t.Run("nil", func(t *testing.T) {
+		resetPassword(t, newTestRedis(t, RedisInit{}))
+	})
+
+	t.Run("slow", func(t *testing.T) {
+		release := make(chan struct{})
+		defer close(release)
+		resetPassword(t, newTestRedis(t, RedisInit{OnPasswordReset: func(userID string) { <-release }}))
+	})
+
+	t.Run("panicking", func(t *testing.T) {
+		resetPassword(t, newTestRedis(t, RedisInit{OnPasswordReset: func(userID string) { panic("hook failed") }}))
+
+		select {
+		case value := <-recovered:
+			require.Equal(t, "hook failed", value)
+		case <-time.After(time.Second):
+			require.Fail(t, "panic has not been recovered")
+		}
+	})
+}
+
+func TestRedisRevokeToken(t *testing.T) {
+	ctx := context.Background()
+	r := newTestRedis(t, RedisInit{})
+
+	_, err := r.SignUp(ctx, "user@example.com", "password")
+	require.NoError(t, err)
+	first, err := r.SignIn(ctx, "user@example.com", "password")
+	require.NoError(t, err)
+	second, err := r.SignIn(ctx, "user@example.com", "password")
+	require.NoError(t, err)
+
+	require.NoError(t, r.RevokeToken(ctx, first.RefreshToken))
+	_, err = r.Authorize(ctx, first.AccessToken)
+	require.ErrorIs(t, err, errUnknownToken)
+	_, err = r.Authorize(ctx, second.AccessToken)
+	require.NoError(t, err)
+
+	require.NoError(t, r.RevokeToken(ctx, second.AccessToken))
+	_, err = r.RefreshToken(ctx, second.RefreshToken)
+	require.ErrorIs(t, err, ErrRefreshUnknown)
+
+	require.NoError(t, r.RevokeToken(ctx, second.AccessToken), "revocation must be idempotent")
+}
+
+func TestRedisBcryptCost(t *testing.T) {
+	ctx := context.Background()
+	r := newTestRedis(t, RedisInit{BcryptCost: bcrypt.MinCost + 1})
+	conn := r.redisPool.Get()
+	defer closeQuietly(conn)
+
+	tokenPair, err := r.SignUp(ctx, "user@example.com", "password")
+	require.NoError(t, err)
+	hash, err := redis.Bytes(conn.Do("HGET", userKey(tokenPair.UserId), userHashedPasswordField))
+	require.NoError(t, err)
+	cost, err := bcrypt.Cost(hash)
+	require.NoError(t, err)
+	require.Equal(t, bcrypt.MinCost+1, cost)
+
+	encoder, err := newBcrypt(0)
+	require.NoError(t, err)
+	require.Equal(t, bcrypt.DefaultCost, encoder.cost)
+
+	for _, cost := range []int{bcrypt.MinCost - 1, bcrypt.MaxCost + 1} {
+		_, err := newBcrypt(cost)
+		require.Error(t, err)
+	}
+}
+
+func TestRedisPasswordChangedAt(t *testing.T) {
+	ctx := context.Background()
+	r := newTestRedis(t, RedisInit{MaxPasswordAge: time.Hour})
+	conn := r.redisPool.Get()
+	defer closeQuietly(conn)
+
+	tokenPair, err := r.SignUp(ctx, "user@example.com", "password")
+	require.NoError(t, err)
+	user, err := r.GetUser(ctx, tokenPair.UserId)
+	require.NoError(t, err)
+	require.Equal(t, "user@example.com", user.Email)
+	require.WithinDuration(t, time.Now(), user.PasswordChangedAt, time.Minute)
+
+	tokenPair, err = r.SignIn(ctx, "user@example.com", "password")
+	require.NoError(t, err)
+	require.Nil(t, tokenPair.PasswordExpired)
+
+	_, err = conn.Do("HSET", userKey(tokenPair.UserId), userPasswordChangedAtField, timestamp.ToISOFormat(time.Now().Add(-2*time.Hour)))
+	require.NoError(t, err)
+	tokenPair, err = r.SignIn(ctx, "user@example.com", "password")
+	require.NoError(t, err)
+	require.NotNil(t, tokenPair.PasswordExpired)
+	require.True(t, *tokenPair.PasswordExpired)
+
+	require.NoError(t, r.UpdatePassword(ctx, tokenPair.UserId, "new password"))
+	user, err = r.GetUser(ctx, tokenPair.UserId)
+	require.NoError(t, err)
+	require.WithinDuration(t, time.Now(), user.PasswordChangedAt, time.Minute)
+
+	_, err = r.GetUser(ctx, "unknown")
+	require.ErrorIs(t, err, ErrUserNotFound)
+}
+
+func TestRedisUpdatePasswordUnknownUser(t *testing.T) {
+	ctx := context.Background()
+	r := newTestRedis(t, RedisInit{})
+	conn := r.redisPool.Get()
+	defer closeQuietly(conn)
+
+	require.ErrorIs(t, r.UpdatePassword(ctx, "", "new password"), ErrUserNotFound)
+	require.ErrorIs(t, r.UpdatePassword(ctx, "unknown", "new password"), ErrUserNotFound)
+	exists, err := redis.Bool(conn.Do("EXISTS", userKey("unknown")))
+	require.NoError(t, err)
+	require.False(t, exists, "unknown users are not created partially")
+}
+
+func TestRedisVerifyTokenLinks(t *testing.T) {
+	ctx := context.Background()
+	r := newTestRedis(t, RedisInit{})
+	conn := r.redisPool.Get()
+	defer closeQuietly(conn)
+
+	valid, err := r.SignUp(ctx, "user@example.com", "password")
+	require.NoError(t, err)
+	orphaned, err := r.SignIn(ctx, "user@example.com", "password")
+	require.NoError(t, err)
+	_, err = conn.Do("HDEL", refreshTokenType.key(), orphaned.RefreshToken)
+	require.NoError(t, err)
+	expired, err := r.SignIn(ctx, "user@example.com", "password")
+	require.NoError(t, err)
+	_, err = conn.Do("HDEL", accessTokenType.key(), expired.AccessToken)
+	require.NoError(t, err)
+	_, err = conn.Do("HSET", refreshTokenType.key(), "malformed", "{")
+	require.NoError(t, err)
+
+	issues, err := r.VerifyTokenLinks(ctx, false)
+	require.NoError(t, err)
+	require.Len(t, issues, 2)
+
+	issues, err = r.VerifyTokenLinks(ctx, true)
+	require.NoError(t, err)
+	require.Len(t, issues, 2)
+
+	issues, err = r.VerifyTokenLinks(ctx, false)
+	require.NoError(t, err)
+	require.Empty(t, issues)
+	_, err = r.Authorize(ctx, valid.AccessToken)
+	require.NoError(t, err)
+	_, err = r.RefreshToken(ctx, expired.RefreshToken)
+	require.NoError(t, err)
+}
+
+func TestRedisReplicaReads(t *testing.T) {
+	ctx := context.Background()
+	primary := newTestRedis(t, RedisInit{})
+	tokenPair, err := primary.SignUp(ctx, "user@example.com", "password")
+	require.NoError(t, err)
+
+	// emulate a lagging replica with an empty database
+	container, err := test.NewRedisContainer(ctx)
+	require.NoError(t, err)
+	t.Cleanup(container.Close)
+	replicaPoolFactory := meta.NewRedisPoolFactory(container.Host, container.Port, "", 1, false, "")
+	replicaPool, err := replicaPoolFactory.Create()
+	require.NoError(t, err)
+	conn := replicaPool.Get()
+	_, err = conn.Do("FLUSHDB")
+	closeQuietly(conn)
+	closeQuietly(replicaPool)
+	require.NoError(t, err)
+
+	r, err := NewRedis(RedisInit{
+		PoolFactory:        meta.NewRedisPoolFactory(container.Host, container.Port, "", 0, false, ""),
+		ReplicaPoolFactory: replicaPoolFactory,
+		MailSender:         new(mailSenderMock),
+		BcryptCost:         bcrypt.MinCost,
+	})
+	require.NoError(t, err)
+	defer r.Close()
+
+	_, err = r.Authorize(ctx, tokenPair.AccessToken)
+	require.ErrorIs(t, err, errUnknownToken, "reads must go to replica")
+	_, err = r.FindUserIDByEmail(ctx, "user@example.com")
+	require.ErrorIs(t, err, ErrUserNotFound, "reads must go to replica")
+
+	_, err = r.SignIn(ctx, "user@example.com", "password")
+	require.NoError(t, err, "writes must go to primary")
+
+	require.NoError(t, r.RotateServerToken(ctx, "rotated-token"))
+	ok, err := r.IsServerToken(ctx, "rotated-token")
+	require.NoError(t, err)
+	require.True(t, ok, "rotated server token must be read from primary")
+
+	ok, err = r.VerifyPassword(ctx, tokenPair.UserId, "password")
+	require.NoError(t, err)
+	require.True(t, ok, "passwords must be verified on primary")
+	keyID, secret, err := r.CreateAPIKey(ctx, tokenPair.UserId, "ci")
+	require.NoError(t, err)
+	_, err = r.AuthorizeAPIKey(ctx, keyID+"."+secret)
+	require.NoError(t, err, "API keys must be authorized on primary")
+}
+
+func TestRedisTokenPairExpiration(t *testing.T) {
+	ctx := context.Background()
+	r := newTestRedis(t, RedisInit{})
+
+	tokenPair, err := r.SignUp(ctx, "user@example.com", "password")
+	require.NoError(t, err)
+
+	for expiresAt, ttl := range map[string]time.Duration{
+		tokenPair.AccessExpiresAt:  defaultTokenPairTTL.access,
+		tokenPair.RefreshExpiresAt: defaultTokenPairTTL.refresh,
+	} {
+		expiredAt, err := timestamp.ParseISOFormat(expiresAt)
+		require.NoError(t, err)
+		require.WithinDuration(t, time.Now().Add(ttl), expiredAt, time.Minute)
+	}
+}
+
+func TestRedisCheckToken(t *testing.T) {
+	ctx := context.Background()
+	r := newTestRedis(t, RedisInit{})
+	conn := r.redisPool.Get()
+	defer closeQuietly(conn)
+
+	tokenPair, err := r.SignUp(ctx, "user@example.com", "password")
+	require.NoError(t, err)
+	authorization, err := r.CheckToken(ctx, tokenPair.AccessToken)
+	require.NoError(t, err)
+	require.Equal(t, tokenPair.UserId, authorization.User.Id)
+
+	expired, err := r.generateTokenPair(conn, tokenPair.UserId, tokenPairTTL{access: -time.Second, refresh: time.Hour})
+	require.NoError(t, err)
+	for i := 0; i < 2; i++ {
+		_, err = r.CheckToken(ctx, expired.AccessToken)
+		require.ErrorIs(t, err, errExpiredToken, "expired token must not be deleted")
+	}
+
+	_, err = r.Authorize(ctx, expired.AccessToken)
+	require.ErrorIs(t, err, errExpiredToken)
+	_, err = r.CheckToken(ctx, expired.AccessToken)
+	require.ErrorIs(t, err, errUnknownToken)
+}
+
+func TestRedisKeyPrefix(t *testing.T) {
+	ctx := context.Background()
+	staging := newTestRedis(t, RedisInit{KeyPrefix: "staging"})
+	prod := newTestRedis(t, RedisInit{KeyPrefix: "prod"})
+
+	for _, r := range []*Redis{staging, prod} {
+		_, err := r.SignUp(ctx, "user@example.com", "password")
+		require.NoError(t, err)
+		users, err := r.ListUsers(ctx)
+		require.NoError(t, err)
+		require.Len(t, users, 1)
+	}
+
+	conn := prod.redisPool.Get()
+	defer closeQuietly(conn)
+	exists, err := redis.Bool(conn.Do("EXISTS", "staging:"+usersIndexKey))
+	require.NoError(t, err)
+	require.True(t, exists)
+
+	for _, prefix := range []string{"prod:eu", "prod*", "prod env", "{prod}"} {
+		_, err := NewRedis(RedisInit{KeyPrefix: prefix})
+		require.Error(t, err, prefix)
+	}
+}
+
+func TestRedisKeyPrefixIsolatesTokens(t *testing.T) {
+	ctx := context.Background()
+	first := newTestRedis(t, RedisInit{KeyPrefix: "first"})
+	second := newTestRedis(t, RedisInit{KeyPrefix: "second"})
+
+	firstTokens, err := first.SignUp(ctx, "user@example.com", "password")
+	require.NoError(t, err)
+	secondTokens, err := second.SignUp(ctx, "user@example.com", "password")
+	require.NoError(t, err)
+
+	_, err = second.Authorize(ctx, firstTokens.AccessToken)
+	require.ErrorIs(t, err, errUnknownToken)
+	_, err = second.RefreshToken(ctx, firstTokens.RefreshToken)
+	require.Error(t, err)
+
+	_, err = first.RevokeTokensIssuedBefore(ctx, time.Now().Add(time.Hour))
+	require.NoError(t, err)
+	_, err = first.Authorize(ctx, firstTokens.AccessToken)
+	require.ErrorIs(t, err, errUnknownToken)
+	_, err = second.Authorize(ctx, secondTokens.AccessToken)
+	require.NoError(t, err, "revocations don't cross instances")
+
+	conn := first.redisPool.Get()
+	defer closeQuietly(conn)
+	count, err := redis.Int(conn.Do("HLEN", "second:"+refreshTokenType.key()))
+	require.NoError(t, err)
+	require.Equal(t, 1, count)
+	exists, err := redis.Bool(conn.Do("EXISTS", refreshTokenType.key()))
+	require.NoError(t, err)
+	require.False(t, exists, "token hashes are namespaced")
+}
+
+func TestRedisUsersIndexCorruption(t *testing.T) {
+	ctx := context.Background()
+	r := newTestRedis(t, RedisInit{})
+	conn := r.redisPool.Get()
+	defer closeQuietly(conn)
+
+	tokenPair, err := r.SignUp(ctx, "user@example.com", "password")
+	require.NoError(t, err)
+	_, err = conn.Do("HSET", usersIndexKey, "malformed@example.com", "", "dangling@example.com", "user-missing")
+	require.NoError(t, err)
+
+	users, err := r.ListUsers(ctx)
+	require.NoError(t, err)
+	require.ElementsMatch(t, []openapi.UserBasicInfo{
+		{Id: tokenPair.UserId, Email: "user@example.com"},
+		{Id: "user-missing", Email: "dangling@example.com"},
+	}, users)
+
+	removed, err := r.RepairUsersIndex(ctx)
+	require.NoError(t, err)
+	require.Equal(t, []string{"dangling@example.com"}, removed)
+
+	user, err := r.FindOnlyUser(ctx)
+	require.NoError(t, err)
+	require.Equal(t, tokenPair.UserId, user.Id)
+}
+
+func TestRedisFindAnyUserID(t *testing.T) {
+	ctx := context.Background()
+	r := newTestRedis(t, RedisInit{})
+
+	hasUsers, err := r.HasUsers(ctx)
+	require.NoError(t, err)
+	require.False(t, hasUsers)
+	_, err = r.FindAnyUserID(ctx)
+	require.ErrorIs(t, err, ErrUserNotFound)
+
+	userIDs := make([]string, 3)
+	for i := range userIDs {
+		tokenPair, err := r.SignUp(ctx, fmt.Sprintf("user%d@example.com", i), "password")
+		require.NoError(t, err)
+		userIDs[i] = tokenPair.UserId
+	}
+
+	hasUsers, err = r.HasUsers(ctx)
+	require.NoError(t, err)
+	require.True(t, hasUsers)
+	userID, err := r.FindAnyUserID(ctx)
+	require.NoError(t, err)
+	require.Contains(t, userIDs, userID)
+}
+
+// benchmarkUsersIndex runs fn against a users index of 10000 entries.
+func benchmarkUsersIndex(b *testing.B, fn func(r *Redis)) {
+	r := newTestRedis(b, RedisInit{})
+	conn := r.redisPool.Get()
+	args := []interface{}{r.key(usersIndexKey)}
+	for i := 0; i < 10000; i++ {
+		args = append(args, fmt.Sprintf("user%d@example.com", i), fmt.Sprintf("user%d", i))
+	}
+
+	_, err := conn.Do("HSET", args...)
+	closeQuietly(conn)
+	require.NoError(b, err)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		fn(r)
+	}
+}
+
+func BenchmarkRedisHasUsersIndexLoad(b *testing.B) {
+	benchmarkUsersIndex(b, func(r *Redis) {
+		// the previous implementation loaded the whole index
+		_, _ = r.FindOnlyUser(context.Background())
+	})
+}
+
+func BenchmarkRedisHasUsers(b *testing.B) {
+	benchmarkUsersIndex(b, func(r *Redis) {
+		_, _ = r.HasUsers(context.Background())
+	})
+}
+
+func BenchmarkRedisFindAnyUserID(b *testing.B) {
+	benchmarkUsersIndex(b, func(r *Redis) {
+		_, _ = r.FindAnyUserID(context.Background())
+	})
+}
+
+func benchmarkAuthorize(b *testing.B, authorize func(r *Redis, tokens []string)) {
+	ctx := context.Background()
+	r := newTestRedis(b, RedisInit{})
+	tokens := make([]string, 100)
+	for i := range tokens {
+		tokenPair, err := r.SignUp(ctx, fmt.Sprintf("user%d@example.com", i), "password")
+		require.NoError(b, err)
+		tokens[i] = tokenPair.AccessToken
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		authorize(r, tokens)
+	}
+}
+
+func BenchmarkRedisAuthorizeLoop(b *testing.B) {
+	benchmarkAuthorize(b, func(r *Redis, tokens []string) {
+		for _, token := range tokens {
+			_, _ = r.Authorize(context.Background(), token)
+		}
+	})
+}
+
+func BenchmarkRedisAuthorizeBatch(b *testing.B) {
+	benchmarkAuthorize(b, func(r *Redis, tokens []string) {
+		_, _ = r.AuthorizeBatch(context.Background(), tokens)
+	})
+}
+
+func TestRedisSignInScoped(t *testing.T) {
+	ctx := context.Background()
+	r := newTestRedis(t, RedisInit{})
+	conn := r.redisPool.Get()
+	defer closeQuietly(conn)
+
+	tokenPair, err := r.SignUp(ctx, "user@example.com", "password")
+	require.NoError(t, err)
+	auth, err := r.Authorize(ctx, tokenPair.AccessToken)
+	require.NoError(t, err)
+	require.Equal(t, []string{middleware.FullAccessScope}, auth.Scopes)
+
+	scoped, err := r.SignInScoped(ctx, "user@example.com", "password", []string{middleware.ReadOnlyScope})
+	require.NoError(t, err)
+	auth, err = r.Authorize(ctx, scoped.AccessToken)
+	require.NoError(t, err)
+	authority := &middleware.Authority{Scopes: auth.Scopes}
+	require.True(t, authority.HasScope(middleware.ReadOnlyScope))
+	require.False(t, authority.HasScope(middleware.FullAccessScope))
+
+	refreshed, err := r.RefreshToken(ctx, scoped.RefreshToken)
+	require.NoError(t, err)
+	auth, err = r.Authorize(ctx, refreshed.AccessToken)
+	require.NoError(t, err)
+	require.Equal(t, []string{middleware.ReadOnlyScope}, auth.Scopes)
+
+	_, err = r.SignInScoped(ctx, "user@example.com", "password", []string{"unknown"})
+	require.Error(t, err)
+
+	// tokens issued before scopes were introduced keep full access
+	legacy, err := r.generateScopedTokenPair(conn, tokenPair.UserId, defaultTokenPairTTL, nil)
+	require.NoError(t, err)
+	auth, err = r.Authorize(ctx, legacy.AccessToken)
+	require.NoError(t, err)
+	require.Empty(t, auth.Scopes)
+	authority = &middleware.Authority{Scopes: auth.Scopes}
+	require.True(t, authority.HasScope(middleware.FullAccessScope))
+}
+
+func TestRedisResetPasswordCooldown(t *testing.T) {
+	ctx := context.Background()
+	mailSender := new(mailSenderMock)
+	r := newTestRedis(t, RedisInit{MailSender: mailSender, ResetPasswordCooldown: time.Minute})
+	conn := r.redisPool.Get()
+	defer closeQuietly(conn)
+
+	_, err := r.SignUp(ctx, "user@example.com", "password")
+	require.NoError(t, err)
+
+	require.NoError(t, r.SendResetPasswordLink(ctx, "user@example.com", "callback"))
+	require.Len(t, mailSender.links, 1)
+
+	// within cooldown: success without sending
+	require.NoError(t, r.SendResetPasswordLink(ctx, "user@example.com", "callback"))
+	require.Len(t, mailSender.links, 1)
+
+	ttl, err := redis.Int64(conn.Do("PTTL", r.key(resetCooldownKey("user@example.com"))))
+	require.NoError(t, err)
+	require.True(t, ttl > 0 && ttl <= time.Minute.Milliseconds(), ttl)
+
+	// past cooldown
+	_, err = conn.Do("DEL", r.key(resetCooldownKey("user@example.com")))
+	require.NoError(t, err)
+	require.NoError(t, r.SendResetPasswordLink(ctx, "user@example.com", "callback"))
+	require.Len(t, mailSender.links, 2)
+
+	mailSender = new(mailSenderMock)
+	disabled := newTestRedis(t, RedisInit{MailSender: mailSender, ResetPasswordCooldown: -1})
+	_, err = disabled.SignUp(ctx, "user@example.com", "password")
+	require.NoError(t, err)
+	require.NoError(t, disabled.SendResetPasswordLink(ctx, "user@example.com", "callback"))
+	require.NoError(t, disabled.SendResetPasswordLink(ctx, "user@example.com", "callback"))
+	require.Len(t, mailSender.links, 2)
+}
+
+func TestRedisMigrateTokenStorage(t *testing.T) {
+	ctx := context.Background()
+	legacy := newTestRedis(t, RedisInit{})
+	conn := legacy.redisPool.Get()
+	defer closeQuietly(conn)
+
+	_, err := NewRedis(RedisInit{TokenStorageVersion: 3})
+	require.Error(t, err)
+	_, err = legacy.MigrateTokenStorage(ctx)
+	require.Error(t, err, "migration requires token storage version 2")
+
+	tokenPair, err := legacy.SignUp(ctx, "user@example.com", "password")
+	require.NoError(t, err)
+	_, err = legacy.generateTokenPair(conn, tokenPair.UserId, tokenPairTTL{access: -time.Second, refresh: time.Hour})
+	require.NoError(t, err)
+
+	// emulate an instance with token storage version 2 sharing the same Redis
+	current := *legacy
+	current.tokenStorageVersion = tokenStorageKeys
+	migrated, err := current.MigrateTokenStorage(ctx)
+	require.NoError(t, err)
+	require.Equal(t, 3, migrated, "expired access token must be dropped")
+
+	for _, tokenType := range []redisTokenType{accessTokenType, refreshTokenType} {
+		count, err := redis.Int(conn.Do("HLEN", tokenType.key()))
+		require.NoError(t, err)
+		require.Zero(t, count)
+	}
+
+	ttl, err := redis.Int64(conn.Do("PTTL", tokenKey(accessTokenType, tokenPair.AccessToken)))
+	require.NoError(t, err)
+	require.InDelta(t, defaultTokenPairTTL.access.Milliseconds(), ttl, float64(time.Minute.Milliseconds()))
+
+	// both schemes are readable by both versions
+	newPair, err := current.SignIn(ctx, "user@example.com", "password")
+	require.NoError(t, err)
+	legacyPair, err := legacy.SignIn(ctx, "user@example.com", "password")
+	require.NoError(t, err)
+	for _, r := range []*Redis{legacy, &current} {
+		_, errs := r.AuthorizeBatch(ctx, []string{tokenPair.AccessToken, newPair.AccessToken, legacyPair.AccessToken})
+		for _, err := range errs {
+			require.NoError(t, err)
+		}
+	}
+
+	_, err = legacy.RefreshToken(ctx, newPair.RefreshToken)
+	require.NoError(t, err)
+	_, err = current.Authorize(ctx, newPair.AccessToken)
+	require.ErrorIs(t, err, errUnknownToken)
+
+	tokens, err := current.ListActiveTokens(ctx, false)
+	require.NoError(t, err)
+	require.Len(t, tokens, 3)
+
+	failed, err := current.SignOutUsers(ctx, []string{tokenPair.UserId})
+	require.NoError(t, err)
+	require.Empty(t, failed)
+	tokens, err = legacy.ListActiveTokens(ctx, false)
+	require.NoError(t, err)
+	require.Empty(t, tokens)
+}
+
+func TestRedisSignOutUsers(t *testing.T) {
+	ctx := context.Background()
+	r := newTestRedis(t, RedisInit{})
+
+	var userIDs []string
+	tokens := make(map[string]string)
+	for _, email := range []string{"first@example.com", "second@example.com", "kept@example.com"} {
+		tokenPair, err := r.SignUp(ctx, email, "password")
+		require.NoError(t, err)
+		userIDs = append(userIDs, tokenPair.UserId)
+		tokens[tokenPair.UserId] = tokenPair.AccessToken
+	}
+
+	// malformed token data fails revocation of every user, but the call keeps going
+	conn := r.redisPool.Get()
+	defer closeQuietly(conn)
+	_, err := conn.Do("HSET", r.key(accessTokenType.key()), "malformed", "not a token")
+	require.NoError(t, err)
+
+	signedOut := userIDs[:2]
+	failed, err := r.SignOutUsers(ctx, signedOut)
+	require.NoError(t, err)
+	require.Len(t, failed, 2)
+	for _, userID := range signedOut {
+		require.Error(t, failed[userID], userID)
+	}
+
+	_, err = conn.Do("HDEL", r.key(accessTokenType.key()), "malformed")
+	require.NoError(t, err)
+	failed, err = r.SignOutUsers(ctx, signedOut)
+	require.NoError(t, err)
+	require.Empty(t, failed)
+
+	for _, userID := range signedOut {
+		_, err := r.Authorize(ctx, tokens[userID])
+		require.ErrorIs(t, err, errUnknownToken, userID)
+	}
+
+	_, err = r.Authorize(ctx, tokens[userIDs[2]])
+	require.NoError(t, err)
+}
+
+func TestRedisMaxUsersCountsUserIDs(t *testing.T) {
+	ctx := context.Background()
+	r := newTestRedis(t, RedisInit{})
+	first, err := r.SignUp(ctx, "first@example.com", "password")
+	require.NoError(t, err)
+	require.NoError(t, r.AddUserEmail(ctx, first.UserId, "alias@example.com"))
+
+	// users created before the user IDs set are counted after restart with the limit
+	conn := r.redisPool.Get()
+	defer closeQuietly(conn)
+	_, err = conn.Do("DEL", r.key(userIDsKey))
+	require.NoError(t, err)
+	r.maxUsers = 2
+	require.NoError(t, r.initUserIDs())
+
+	second, err := r.SignUp(ctx, "second@example.com", "password")
+	require.NoError(t, err)
+	_, err = r.SignUp(ctx, "third@example.com", "password")
+	require.ErrorIs(t, err, errUserLimitReached, "users with additional emails are counted once")
+
+	require.NoError(t, r.DeleteUser(ctx, second.UserId))
+	_, err = r.SignUp(ctx, "third@example.com", "password")
+	require.NoError(t, err, "deleted users free their slots")
+}
+
+func TestRedisMaxUsers(t *testing.T) {
+	ctx := context.Background()
+	r := newTestRedis(t, RedisInit{MaxUsers: 2})
+
+	// below the limit
+	_, err := r.SignUp(ctx, "user1@example.com", "password")
+	require.NoError(t, err)
+	// reaching the limit
+	_, err = r.SignUp(ctx, "user2@example.com", "password")
+	require.NoError(t, err)
+	// above the limit
+	_, err = r.SignUp(ctx, "user3@example.com", "password")
+	require.ErrorIs(t, err, errUserLimitReached)
+	_, err = r.SignUp(ctx, "user1@example.com", "password")
+	require.ErrorIs(t, err, ErrUserExists, "existing users are reported regardless of the limit")
+
+	_, err = r.CreateUser(ctx, "admin-created@example.com")
+	require.NoError(t, err, "admins bypass the limit by default")
+	users, err := r.ListUsers(ctx)
+	require.NoError(t, err)
+	require.Len(t, users, 3)
+
+	r = newTestRedis(t, RedisInit{MaxUsers: 1, MaxUsersAppliesToAdmins: true})
+	_, err = r.CreateUser(ctx, "user1@example.com")
+	require.NoError(t, err)
+	_, err = r.CreateUser(ctx, "user2@example.com")
+	require.ErrorIs(t, err, errUserLimitReached)
+	_, err = r.SignUp(ctx, "user2@example.com", "password")
+	require.ErrorIs(t, err, errUserLimitReached)
+}
+
+func TestRedisChangeEmailRace(t *testing.T) {
+	ctx := context.Background()
+	r := newTestRedis(t, RedisInit{})
+
+	for i := 0; i < 10; i++ {
+		first, second := fmt.Sprintf("first-%d@example.com", i), fmt.Sprintf("second-%d@example.com", i)
+		claimed := fmt.Sprintf("claimed-%d@example.com", i)
+		for _, email := range []string{first, second} {
+			_, err := r.SignUp(ctx, email, "password")
+			require.NoError(t, err)
+		}
+
+		var wg sync.WaitGroup
+		errs := make([]error, 2)
+		for j, email := range []string{first, second} {
+			wg.Add(1)
+			go func(j int, email string) {
+				defer wg.Done()
+				_, errs[j] = r.ChangeEmail(ctx, email, claimed)
+			}(j, email)
+		}
+
+		wg.Wait()
+		if errs[0] == nil {
+			require.ErrorIs(t, errs[1], ErrUserExists)
+		} else {
+			require.ErrorIs(t, errs[0], ErrUserExists)
+			require.NoError(t, errs[1])
+		}
+
+		userID, err := r.FindUserIDByEmail(ctx, claimed)
+		require.NoError(t, err)
+		email, err := r.GetUserEmail(ctx, userID)
+		require.NoError(t, err)
+		require.Equal(t, claimed, email)
+	}
+
+	users, err := r.ListUsers(ctx)
+	require.NoError(t, err)
+	require.Len(t, users, 20, "no index entry may be lost or duplicated")
+}
+
+func TestRedisSignUpChangeEmailRace(t *testing.T) {
+	ctx := context.Background()
+	r := newTestRedis(t, RedisInit{})
+
+	for i := 0; i < 10; i++ {
+		existing, claimed := fmt.Sprintf("existing-%d@example.com", i), fmt.Sprintf("claimed-%d@example.com", i)
+		tokenPair, err := r.SignUp(ctx, existing, "password")
+		require.NoError(t, err)
+
+		var (
+			wg                   sync.WaitGroup
+			signUpErr, changeErr error
+			signedUp             *openapi.TokensResponse
+		)
+
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			signedUp, signUpErr = r.SignUp(ctx, claimed, "password")
+		}()
+		go func() {
+			defer wg.Done()
+			_, changeErr = r.ChangeEmail(ctx, existing, claimed)
+		}()
+
+		wg.Wait()
+		winner := tokenPair.UserId
+		if signUpErr == nil {
+			require.ErrorIs(t, changeErr, ErrUserExists)
+			winner = signedUp.UserId
+		} else {
+			require.ErrorIs(t, signUpErr, ErrUserExists)
+			require.NoError(t, changeErr)
+		}
+
+		userID, err := r.FindUserIDByEmail(ctx, claimed)
+		require.NoError(t, err)
+		require.Equal(t, winner, userID)
+		email, err := r.GetUserEmail(ctx, userID)
+		require.NoError(t, err)
+		require.Equal(t, claimed, email)
+	}
+
+	orphans, err := r.FindOrphanedUsers(ctx)
+	require.NoError(t, err)
+	require.Empty(t, orphans, "no index entry may be lost or overwritten")
+}
+
+func TestRedisEmailIndexKey(t *testing.T) {
+	ctx := context.Background()
+	plain := newTestRedis(t, RedisInit{})
+	conn := plain.redisPool.Get()
+	defer closeQuietly(conn)
+
+	_, err := plain.SignUp(ctx, "legacy@example.com", "password")
+	require.NoError(t, err)
+
+	// emulate a restart with EmailIndexKey configured
+	r := *plain
+	r.emailIndexKey = []byte("secret")
+	require.NoError(t, r.hashUsersIndex())
+
+	_, err = r.SignUp(ctx, "user@example.com", "password")
+	require.NoError(t, err)
+	_, err = r.SignUp(ctx, "user@example.com", "password")
+	require.ErrorIs(t, err, ErrUserExists)
+
+	fields, err := redis.Strings(conn.Do("HKEYS", usersIndexKey))
+	require.NoError(t, err)
+	require.Len(t, fields, 2)
+	for _, field := range fields {
+		require.NotContains(t, field, "@")
+	}
+
+	for _, email := range []string{"legacy@example.com", "user@example.com"} {
+		_, err := r.SignIn(ctx, email, "password")
+		require.NoError(t, err, email)
+	}
+
+	userID, err := r.ChangeEmail(ctx, "legacy@example.com", "changed@example.com")
+	require.NoError(t, err)
+	_, err = r.FindUserIDByEmail(ctx, "legacy@example.com")
+	require.ErrorIs(t, err, ErrUserNotFound)
+
+	users, err := r.ListUsers(ctx)
+	require.NoError(t, err)
+	require.Len(t, users, 2)
+	require.ElementsMatch(t, []string{"changed@example.com", "user@example.com"}, []string{users[0].Email, users[1].Email})
+
+	require.NoError(t, r.DeleteUser(ctx, userID))
+	count, err := redis.Int(conn.Do("HLEN", usersIndexKey))
+	require.NoError(t, err)
+	require.Equal(t, 1, count)
+	user, err := r.FindOnlyUser(ctx)
+	require.NoError(t, err)
+	require.Equal(t, "user@example.com", user.Email)
+}
+
+func TestRedisTokenDecorator(t *testing.T) {
+	ctx := context.Background()
+	r := newTestRedis(t, RedisInit{TokenDecorator: func(userID string, metadata map[string]string) {
+		metadata["tenant_id"] = "tenant-" + userID
+	}})
+
+	tokenPair, err := r.SignUp(ctx, "user@example.com", "password")
+	require.NoError(t, err)
+	auth, err := r.Authorize(ctx, tokenPair.AccessToken)
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{"tenant_id": "tenant-" + tokenPair.UserId}, auth.Metadata)
+
+	refreshed, err := r.RefreshToken(ctx, tokenPair.RefreshToken)
+	require.NoError(t, err)
+	auths, errs := r.AuthorizeBatch(ctx, []string{refreshed.AccessToken})
+	require.NoError(t, errs[0])
+	require.Equal(t, "tenant-"+tokenPair.UserId, auths[0].Metadata["tenant_id"])
+
+	// tokens without metadata are unchanged
+	r.tokenDecorator = nil
+	tokenPair, err = r.SignIn(ctx, "user@example.com", "password")
+	require.NoError(t, err)
+	auth, err = r.Authorize(ctx, tokenPair.AccessToken)
+	require.NoError(t, err)
+	require.Nil(t, auth.Metadata)
+}
+
+func TestRedisClockSkewGrace(t *testing.T) {
+	ctx := context.Background()
+	grace := 10 * time.Second
+	now := timestamp.Now().Truncate(time.Second)
+	expiredAgo := func(d time.Duration) *redisToken {
+		return newRedisToken(now, "user-1", accessTokenType, "token", -d, nil)
+	}
+
+	require.NoError(t, expiredAgo(grace-time.Second).validate(now, grace), "expired within grace")
+	require.NoError(t, expiredAgo(grace).validate(now, grace), "expired exactly at grace boundary")
+	require.ErrorIs(t, expiredAgo(grace+time.Second).validate(now, grace), errExpiredToken, "expired beyond grace")
+	require.ErrorIs(t, expiredAgo(time.Second).validate(now, 0), errExpiredToken, "no grace by default")
+
+	_, err := NewRedis(RedisInit{ClockSkewGrace: -time.Second})
+	require.Error(t, err)
+
+	r := newTestRedis(t, RedisInit{ClockSkewGrace: grace})
+	conn := r.redisPool.Get()
+	defer closeQuietly(conn)
+	tokenPair, err := r.SignUp(ctx, "user@example.com", "password")
+	require.NoError(t, err)
+
+	skewed, err := r.generateTokenPair(conn, tokenPair.UserId, tokenPairTTL{access: -time.Second, refresh: time.Hour})
+	require.NoError(t, err)
+	_, err = r.Authorize(ctx, skewed.AccessToken)
+	require.NoError(t, err)
+
+	expired, err := r.generateTokenPair(conn, tokenPair.UserId, tokenPairTTL{access: -grace - time.Second, refresh: time.Hour})
+	require.NoError(t, err)
+	_, err = r.Authorize(ctx, expired.AccessToken)
+	require.ErrorIs(t, err, errExpiredToken)
+}
+
+func TestRedisAPIKeys(t *testing.T) {
+	ctx := context.Background()
+	r := newTestRedis(t, RedisInit{})
+
+	tokenPair, err := r.SignUp(ctx, "user@example.com", "password")
+	require.NoError(t, err)
+	userID := tokenPair.UserId
+
+	_, _, err = r.CreateAPIKey(ctx, "unknown", "label")
+	require.ErrorIs(t, err, ErrUserNotFound)
+
+	keyID, secret, err := r.CreateAPIKey(ctx, userID, "ci")
+	require.NoError(t, err)
+	otherKeyID, otherSecret, err := r.CreateAPIKey(ctx, userID, "backup")
+	require.NoError(t, err)
+
+	auth, err := r.AuthorizeAPIKey(ctx, keyID+"."+secret)
+	require.NoError(t, err)
+	require.Equal(t, openapi.UserBasicInfo{Id: userID, Email: "user@example.com"}, auth.User)
+	_, err = r.Authorize(ctx, keyID+"."+secret)
+	require.ErrorIs(t, err, middleware.ErrUnknownToken, "AuthorizationInterceptor falls back to AuthorizeAPIKey")
+
+	for _, key := range []string{keyID + ".wrong", keyID, "." + secret, "unknown." + secret, otherKeyID + "." + secret} {
+		_, err := r.AuthorizeAPIKey(ctx, key)
+		require.ErrorIs(t, err, errUnknownAPIKey, key)
+	}
+
+	keys, err := r.ListAPIKeys(ctx, userID)
+	require.NoError(t, err)
+	require.Len(t, keys, 2)
+
+	// API keys survive password changes, unlike session tokens
+	_, err = r.ChangePassword(ctx, tokenPair.AccessToken, "new password")
+	require.NoError(t, err)
+	_, err = r.AuthorizeAPIKey(ctx, keyID+"."+secret)
+	require.NoError(t, err)
+
+	require.NoError(t, r.RevokeAPIKey(ctx, "another-user", keyID))
+	_, err = r.AuthorizeAPIKey(ctx, keyID+"."+secret)
+	require.NoError(t, err, "keys of other users must not be revoked")
+
+	require.NoError(t, r.RevokeAPIKey(ctx, userID, keyID))
+	_, err = r.AuthorizeAPIKey(ctx, keyID+"."+secret)
+	require.ErrorIs(t, err, errUnknownAPIKey)
+	_, err = r.AuthorizeAPIKey(ctx, otherKeyID+"."+otherSecret)
+	require.NoError(t, err, "keys are revoked individually")
+
+	require.NoError(t, r.DeleteUser(ctx, userID))
+	_, err = r.AuthorizeAPIKey(ctx, otherKeyID+"."+otherSecret)
+	require.ErrorIs(t, err, errUnknownAPIKey)
+}
+
+func TestRedisUsernames(t *testing.T) {
+	ctx := context.Background()
+	r := newTestRedis(t, RedisInit{})
+
+	_, err := r.SignUpWithUsername(ctx, "user@example.com", "user", "password")
+	require.NoError(t, err)
+	_, err = r.SignUpWithUsername(ctx, "other@example.com", "user", "password")
+	require.ErrorIs(t, err, ErrUsernameExists)
+	_, err = r.SignUpWithUsername(ctx, "other@example.com", "no spaces", "password")
+	require.ErrorIs(t, err, errInvalidUsername)
+
+	_, err = r.SignInByUsername(ctx, "user", "password")
+	require.NoError(t, err)
+	_, err = r.SignIn(ctx, "user@example.com", "password")
+	require.NoError(t, err, "email still works")
+	_, err = r.SignInByUsername(ctx, "user", "wrong")
+	require.Error(t, err)
+	_, err = r.SignInByUsername(ctx, "unknown", "password")
+	require.ErrorIs(t, err, ErrUserNotFound)
+
+	userID, err := r.GetUserIDByEmail(ctx, "user@example.com")
+	require.NoError(t, err)
+	user, err := r.GetUser(ctx, userID)
+	require.NoError(t, err)
+	require.Equal(t, "user", user.Username)
+
+	require.NoError(t, r.DeleteUser(ctx, userID))
+	_, err = r.SignUpWithUsername(ctx, "other@example.com", "user", "password")
+	require.NoError(t, err, "username is released with the user")
+}
+
+func TestRedisRevokeTokensIssuedBefore(t *testing.T) {
+	ctx := context.Background()
+	start := time.Date(2022, 3, 1, 12, 0, 0, 0, time.UTC)
+	cutoff := start.Add(time.Hour)
+	now := start
+	r := newTestRedis(t, RedisInit{Clock: func() time.Time { return now }})
+
+	before, err := r.SignUp(ctx, "user1@example.com", "password")
+	require.NoError(t, err)
+	now = cutoff.Add(-time.Second)
+	otherBefore, err := r.SignUp(ctx, "user2@example.com", "password")
+	require.NoError(t, err)
+	now = cutoff
+	atCutoff, err := r.SignIn(ctx, "user1@example.com", "password")
+	require.NoError(t, err)
+	now = cutoff.Add(time.Hour)
+	after, err := r.SignIn(ctx, "user2@example.com", "password")
+	require.NoError(t, err)
+
+	revoked, err := r.RevokeTokensIssuedBefore(ctx, cutoff)
+	require.NoError(t, err)
+	require.Equal(t, 2, revoked)
+
+	for _, tokenPair := range []*openapi.TokensResponse{before, otherBefore} {
+		_, err = r.Authorize(ctx, tokenPair.AccessToken)
+		require.ErrorIs(t, err, errUnknownToken)
+		_, err = r.RefreshToken(ctx, tokenPair.RefreshToken)
+		require.Error(t, err)
+	}
+
+	for _, tokenPair := range []*openapi.TokensResponse{atCutoff, after} {
+		_, err = r.Authorize(ctx, tokenPair.AccessToken)
+		require.NoError(t, err)
+	}
+
+	revoked, err = r.RevokeTokensIssuedBefore(ctx, cutoff)
+	require.NoError(t, err)
+	require.Zero(t, revoked)
+}
+
+func TestNewRedisPoolErrors(t *testing.T) {
+	ctx := context.Background()
+	container, err := test.NewRedisContainer(ctx)
+	require.NoError(t, err)
+	t.Cleanup(container.Close)
+
+	options := meta.DefaultOptions
+	options.PingTimeout = time.Millisecond
+	for _, tt := range []struct {
+		name     string
+		factory  *meta.RedisPoolFactory
+		expected error
+	}{
+		{"unreachable", meta.NewRedisPoolFactory("127.0.0.1", 1, "", 0, false, ""), ErrRedisUnreachable},
+		{"auth", meta.NewRedisPoolFactory(container.Host, container.Port, "wrong", 0, false, ""), ErrRedisAuth},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewRedis(RedisInit{PoolFactory: tt.factory.WithOptions(options), MailSender: new(mailSenderMock)})
+			require.ErrorIs(t, err, tt.expected)
+		})
+	}
+
+	require.ErrorIs(t, classifyRedisPoolError(&net.DNSError{IsTimeout: true}), ErrRedisTimeout)
+	require.ErrorIs(t, classifyRedisPoolError(errors.New("unknown")), ErrRedisPool)
+}
+
+// startSlowRedis serves a Redis stub which answers PING and never answers other commands.
+func startSlowRedis(t *testing.T) (string, int) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			t.Cleanup(func() { _ = conn.Close() })
+			go func() {
+				reader := bufio.NewReader(conn)
+				for {
+					line, err := reader.ReadString('\n')
+					if err != nil {
+						return
+					}
+
+					if strings.EqualFold(strings.TrimSpace(line), "PING") {
+						_, _ = conn.Write([]byte("+PONG\r\n"))
+					}
+				}
+			}()
+		}
+	}()
+
+	addr := listener.Addr().(*net.TCPAddr)
+	return addr.IP.String(), addr.Port
+}
+
+func TestRedisCommandTimeouts(t *testing.T) {
+	host, port := startSlowRedis(t)
+	factory := meta.NewRedisPoolFactory(host, port, "", 0, false, "")
+	r, err := NewRedis(RedisInit{
+		PoolFactory:        factory,
+		MailSender:         new(mailSenderMock),
+		CommandReadTimeout: 100 * time.Millisecond,
+	})
+	require.NoError(t, err)
+	defer r.Close()
+
+	start := time.Now()
+	_, err = r.HasUsers(context.Background())
+	require.Error(t, err)
+	require.Less(t, time.Since(start), 5*time.Second, "slow command is bounded by read timeout")
+	require.Equal(t, meta.DefaultOptions.DefaultDialReadTimeout, factory.GetOptions().DefaultDialReadTimeout,
+		"caller's factory is not modified")
+
+	_, err = NewRedis(RedisInit{PoolFactory: factory, MailSender: new(mailSenderMock), CommandWriteTimeout: -time.Second})
+	require.Error(t, err)
+}
+
+func TestRedisMailBreaker(t *testing.T) {
+	ctx := context.Background()
+	now := timestamp.Now()
+	mailSender := &failingMailSender{err: errors.New("dial timeout")}
+	r := newTestRedis(t, RedisInit{
+		MailSender:            mailSender,
+		MailBreakerThreshold:  2,
+		MailBreakerCooldown:   time.Minute,
+		ResetPasswordCooldown: -1,
+		Clock:                 func() time.Time { return now },
+	})
+
+	_, err := r.SignUp(ctx, "user@example.com", "password")
+	require.NoError(t, err)
+
+	for i := 0; i < 2; i++ {
+		require.Equal(t, MailBreakerClosed, r.MailBreakerState())
+		require.Error(t, r.SendResetPasswordLink(ctx, "user@example.com", "callback"))
+	}
+
+	require.Equal(t, MailBreakerOpen, r.MailBreakerState())
+	require.ErrorIs(t, r.SendResetPasswordLink(ctx, "user@example.com", "callback"), errMailServiceUnavailable)
+	require.Equal(t, 2, mailSender.attempts, "open breaker fails fast")
+
+	// failed probe opens the breaker again
+	now = now.Add(time.Minute)
+	require.Equal(t, MailBreakerHalfOpen, r.MailBreakerState())
+	require.Error(t, r.SendResetPasswordLink(ctx, "user@example.com", "callback"))
+	require.Equal(t, 3, mailSender.attempts)
+	require.Equal(t, MailBreakerOpen, r.MailBreakerState())
+
+	// successful probe closes the breaker
+	now = now.Add(time.Minute)
+	mailSender.err = nil
+	require.NoError(t, r.SendResetPasswordLink(ctx, "user@example.com", "callback"))
+	require.Equal(t, MailBreakerClosed, r.MailBreakerState())
+
+	disabled := newTestRedis(t, RedisInit{MailSender: mailSender, MailBreakerThreshold: -1})
+	require.Equal(t, MailBreakerClosed, disabled.MailBreakerState())
+}
+
+// temporaryError mimics emails.SendError.
+type temporaryError struct {
+	temporary bool
+}
+
+func (e temporaryError) Error() string   { return "SMTP failure" }
+func (e temporaryError) Temporary() bool { return e.temporary }
+
+func TestRedisSendResetPasswordLinkMailErrors(t *testing.T) {
+	ctx := context.Background()
+	mailSender := new(failingMailSender)
+	r := newTestRedis(t, RedisInit{MailSender: mailSender, MailBreakerThreshold: 3, ResetPasswordCooldown: -1})
+	_, err := r.SignUp(ctx, "user@example.com", "password")
+	require.NoError(t, err)
+
+	for _, tt := range []struct {
+		err      error
+		expected error
+	}{
+		{temporaryError{temporary: true}, ErrMailTransient},
+		{temporaryError{temporary: false}, ErrMailPermanent},
+		{errors.New("template error"), ErrMailPermanent},
+	} {
+		mailSender.err = tt.err
+		err := r.SendResetPasswordLink(ctx, "user@example.com", "callback")
+		require.ErrorIs(t, err, tt.expected, tt.err.Error())
+		require.ErrorIs(t, err, tt.err, "cause is kept")
+		if tt.expected == ErrMailTransient {
+			require.NotErrorIs(t, err, ErrMailPermanent)
+		} else {
+			require.NotErrorIs(t, err, ErrMailTransient)
+		}
+	}
+
+	require.Equal(t, MailBreakerOpen, r.MailBreakerState())
+	require.ErrorIs(t, r.SendResetPasswordLink(ctx, "user@example.com", "callback"), ErrMailTransient, "open breaker is transient")
+
+	err = r.SendResetPasswordLink(ctx, "unknown@example.com", "callback")
+	require.ErrorIs(t, err, ErrUserNotFound)
+	require.NotErrorIs(t, err, ErrMailPermanent, "other failures are not mail errors")
+}
+
+func TestRedisTokenGenerator(t *testing.T) {
+	ctx := context.Background()
+	var tokenSeq int
+	token := func() string {
+		tokenSeq++
+		return fmt.Sprintf("token%011d", tokenSeq)
+	}
+
+	_, err := NewRedis(RedisInit{TokenGenerator: token, TokenEntropyBits: 64})
+	require.Error(t, err, "weak generators are rejected")
+	_, err = NewRedis(RedisInit{TokenGenerator: token})
+	require.Error(t, err, "entropy must be declared")
+	_, err = NewRedis(RedisInit{TokenGenerator: token, TokenEntropyBits: 256})
+	require.Error(t, err, "values must be long enough to carry the declared entropy")
+	_, err = NewRedis(RedisInit{TokenGenerator: func() string { return "constant-but-long-enough" }, TokenEntropyBits: 128})
+	require.Error(t, err, "values must not repeat")
+
+	var idSeq int
+	tokenSeq = 0
+	r := newTestRedis(t, RedisInit{
+		IDGenerator: func() string {
+			idSeq++
+			return fmt.Sprintf("id%d", idSeq)
+		},
+		TokenGenerator:   token,
+		TokenEntropyBits: 128,
+	})
+
+	// the first values are drawn by NewRedis for checking
+	tokenPair, err := r.SignUp(ctx, "user@example.com", "password")
+	require.NoError(t, err)
+	require.Equal(t, "user-id1", tokenPair.UserId)
+	require.Equal(t, fmt.Sprintf("token%011d", tokenGeneratorSamples+1), tokenPair.AccessToken)
+	require.Equal(t, fmt.Sprintf("token%011d", tokenGeneratorSamples+2), tokenPair.RefreshToken)
+
+	keyID, secret, err := r.CreateAPIKey(ctx, tokenPair.UserId, "ci")
+	require.NoError(t, err)
+	require.Equal(t, "id2", keyID)
+	require.Equal(t, fmt.Sprintf("token%011d", tokenGeneratorSamples+3), secret)
+}
+
+func TestRedisPasswordChangeInvalidatesResetLinks(t *testing.T) {
+	ctx := context.Background()
+	mailSender := new(mailSenderMock)
+	r := newTestRedis(t, RedisInit{MailSender: mailSender, ResetPasswordCooldown: -1})
+
+	tokenPair, err := r.SignUp(ctx, "user@example.com", "password")
+	require.NoError(t, err)
+
+	// reset with one of the links
+	require.NoError(t, r.SendResetPasswordLink(ctx, "user@example.com", "{{token}}"))
+	require.NoError(t, r.SendResetPasswordLink(ctx, "user@example.com", "{{token}}"))
+	tokenPair, err = r.ResetPassword(ctx, mailSender.links[0], "new-password")
+	require.NoError(t, err)
+	_, err = r.ResetPassword(ctx, mailSender.links[1], "another-password")
+	require.Error(t, err, "second reset link is rejected after password reset")
+
+	// in-session password change
+	require.NoError(t, r.SendResetPasswordLink(ctx, "user@example.com", "{{token}}"))
+	_, err = r.ChangePassword(ctx, tokenPair.AccessToken, "changed-password")
+	require.NoError(t, err)
+	_, err = r.ResetPassword(ctx, mailSender.links[2], "another-password")
+	require.Error(t, err, "reset link is rejected after password change")
+
+	_, err = r.SignIn(ctx, "user@example.com", "changed-password")
+	require.NoError(t, err)
+}
+
+func TestRedisIssueAccessOnly(t *testing.T) {
+	ctx := context.Background()
+	r := newTestRedis(t, RedisInit{})
+
+	_, err := r.IssueAccessOnly(ctx, "unknown")
+	require.Error(t, err)
+
+	tokenPair, err := r.SignUp(ctx, "user@example.com", "password")
+	require.NoError(t, err)
+	accessOnly, err := r.IssueAccessOnly(ctx, tokenPair.UserId)
+	require.NoError(t, err)
+	require.NotEmpty(t, accessOnly.AccessToken)
+	require.Empty(t, accessOnly.RefreshToken)
+	require.Empty(t, accessOnly.RefreshExpiresAt)
+
+	authorization, err := r.Authorize(ctx, accessOnly.AccessToken)
+	require.NoError(t, err)
+	require.Equal(t, tokenPair.UserId, authorization.User.Id)
+
+	issues, err := r.VerifyTokenLinks(ctx, true)
+	require.NoError(t, err)
+	require.Empty(t, issues, "access-only tokens are not broken")
+
+	require.NoError(t, r.SignOut(ctx, accessOnly.AccessToken))
+	_, err = r.Authorize(ctx, accessOnly.AccessToken)
+	require.ErrorIs(t, err, errUnknownToken)
+	_, err = r.Authorize(ctx, tokenPair.AccessToken)
+	require.NoError(t, err, "other sessions are intact")
+}
+
+func TestRedisSetUserLocked(t *testing.T) {
+	ctx := context.Background()
+	r := newTestRedis(t, RedisInit{})
+
+	require.Error(t, r.SetUserLocked(ctx, "unknown", true))
+
+	tokenPair, err := r.SignUp(ctx, "user@example.com", "password")
+	require.NoError(t, err)
+	other, err := r.SignUp(ctx, "other@example.com", "password")
+	require.NoError(t, err)
+	keyID, secret, err := r.CreateAPIKey(ctx, tokenPair.UserId, "ci")
+	require.NoError(t, err)
+
+	require.NoError(t, r.SetUserLocked(ctx, tokenPair.UserId, true))
+	user, err := r.GetUser(ctx, tokenPair.UserId)
+	require.NoError(t, err)
+	require.True(t, user.Locked)
+
+	_, err = r.SignIn(ctx, "user@example.com", "password")
+	require.ErrorIs(t, err, errAccountLocked)
+	_, err = r.Authorize(ctx, tokenPair.AccessToken)
+	require.Error(t, err, "sessions are revoked on lock")
+	_, err = r.AuthorizeAPIKey(ctx, keyID+"."+secret)
+	require.ErrorIs(t, err, errAccountLocked)
+
+	// tokens issued while locked are rejected too
+	accessOnly, err := r.IssueAccessOnly(ctx, tokenPair.UserId)
+	require.NoError(t, err)
+	_, err = r.Authorize(ctx, accessOnly.AccessToken)
+	require.ErrorIs(t, err, errAccountLocked)
+	_, errs := r.AuthorizeBatch(ctx, []string{accessOnly.AccessToken, other.AccessToken})
+	require.ErrorIs(t, errs[0], errAccountLocked)
+	require.NoError(t, errs[1], "other users are unaffected")
+
+	require.NoError(t, r.SetUserLocked(ctx, tokenPair.UserId, false))
+	_, err = r.SignIn(ctx, "user@example.com", "password")
+	require.NoError(t, err)
+	_, err = r.AuthorizeAPIKey(ctx, keyID+"."+secret)
+	require.NoError(t, err, "API keys are kept")
+}
+
+func TestRedisExportImportUsers(t *testing.T) {
+	ctx := context.Background()
+	source := newTestRedis(t, RedisInit{})
+
+	_, err := source.SignUpWithUsername(ctx, "user@example.com", "user", "password")
+	require.NoError(t, err)
+	locked, err := source.SignUp(ctx, "locked@example.com", "password")
+	require.NoError(t, err)
+	require.NoError(t, source.SetUserLocked(ctx, locked.UserId, true))
+
+	users, err := source.ExportUsers(ctx)
+	require.NoError(t, err)
+	require.Len(t, users, 2)
+	for _, user := range users {
+		require.NotEmpty(t, user.HashedPassword)
+	}
+
+	// another instance sharing the same Redis
+	target := *source
+	target.keyPrefix = "target"
+	require.NoError(t, target.ImportUsers(ctx, users))
+	require.NoError(t, target.ImportUsers(ctx, users), "import may be retried")
+
+	imported, err := target.ExportUsers(ctx)
+	require.NoError(t, err)
+	require.ElementsMatch(t, users, imported)
+
+	tokenPair, err := target.SignInByUsername(ctx, "user", "password")
+	require.NoError(t, err, "passwords survive round trip")
+	sourceUserID, err := source.GetUserIDByEmail(ctx, "user@example.com")
+	require.NoError(t, err)
+	require.Equal(t, sourceUserID, tokenPair.UserId, "IDs are preserved")
+	_, err = target.SignIn(ctx, "locked@example.com", "password")
+	require.ErrorIs(t, err, errAccountLocked)
+
+	conflicting := users[0]
+	conflicting.Id = "user-other"
+	require.ErrorIs(t, target.ImportUsers(ctx, []openapi.UserExport{conflicting}), ErrUserExists)
+}
+
+func TestRedisImportUsersReleasesClaims(t *testing.T) {
+	ctx := context.Background()
+	r := newTestRedis(t, RedisInit{})
+	_, err := r.SignUpWithUsername(ctx, "owner@example.com", "taken", "password")
+	require.NoError(t, err)
+
+	const hash = "$2a$04$Dxwpkk1cMYchcGXP55iUsuvjP7qWoqAV4oUl9BSBLvNgE6N0pxOBy"
+	username := "taken"
+	user := openapi.UserExport{Id: "user-imported", Email: "imported@example.com", HashedPassword: hash, Username: &username}
+	require.ErrorIs(t, r.ImportUsers(ctx, []openapi.UserExport{user}), ErrUsernameExists)
+	_, err = r.FindUserIDByEmail(ctx, "imported@example.com")
+	require.ErrorIs(t, err, ErrUserNotFound, "email claimed by the failed import is released")
+
+	malformed := openapi.UserExport{Id: "user-malformed", Email: "malformed@example.com", HashedPassword: "not a hash"}
+	require.Error(t, r.ImportUsers(ctx, []openapi.UserExport{malformed}))
+	_, err = r.FindUserIDByEmail(ctx, "malformed@example.com")
+	require.ErrorIs(t, err, ErrUserNotFound)
+
+	username = "imported"
+	require.NoError(t, r.ImportUsers(ctx, []openapi.UserExport{user}))
+	tokenPair, err := r.SignInByUsername(ctx, "imported", "imported password")
+	require.NoError(t, err)
+	require.Equal(t, "user-imported", tokenPair.UserId)
+}
+
+func TestRedisCallbackAllowlist(t *testing.T) {
+	ctx := context.Background()
+	mailSender := new(mailSenderMock)
+	r := newTestRedis(t, RedisInit{
+		MailSender:       mailSender,
+		AllowedCallbacks: []string{"https://app.example.com/reset", "Jitsu.example.com"},
+	})
+
+	_, err := r.SignUp(ctx, "user@example.com", "password")
+	require.NoError(t, err)
+	conn := r.redisPool.Get()
+	defer closeQuietly(conn)
+
+	for _, callback := range []string{
+		"https://app.example.com/reset?token={{token}}",
+		"https://app.example.com/reset/{{token}}",
+		"https://jitsu.example.com/any?token={{token}}",
+	} {
+		require.NoError(t, r.SendResetPasswordLink(ctx, "user@example.com", callback), callback)
+		_, err := conn.Do("DEL", r.key(resetCooldownKey("user@example.com")))
+		require.NoError(t, err)
+	}
+
+	for _, callback := range []string{
+		"https://evil.example.com/reset?token={{token}}",
+		"https://app.example.com.evil.com/reset?token={{token}}",
+		"https://app.example.com/resetting?token={{token}}",
+		"https://evil.com/?next=jitsu.example.com",
+	} {
+		require.ErrorIs(t, r.SendResetPasswordLink(ctx, "user@example.com", callback), errCallbackNotAllowed, callback)
+	}
+
+	require.Len(t, mailSender.links, 3)
+
+	callback := "https://evil.example.com/?token={{token}}"
+	_, err = r.AutoSignUp(ctx, "new@example.com", &callback)
+	require.ErrorIs(t, err, errCallbackNotAllowed)
+	_, err = r.GetUserIDByEmail(ctx, "new@example.com")
+	require.ErrorIs(t, err, ErrUserNotFound)
+}
+
+func TestRedisAllowedEmailDomains(t *testing.T) {
+	ctx := context.Background()
+	r := newTestRedis(t, RedisInit{AllowedEmailDomains: []string{"Example.com", "*.corp.example.org"}})
+
+	// signed up before the policy
+	allowedDomains := r.allowedDomains
+	r.allowedDomains = nil
+	_, err := r.SignUp(ctx, "legacy@evil.com", "password")
+	require.NoError(t, err)
+	r.allowedDomains = allowedDomains
+
+	for _, email := range []string{"user@example.com", "upper@EXAMPLE.COM", "user@eu.corp.example.org", "user@a.b.corp.example.org"} {
+		_, err := r.SignUp(ctx, email, "password")
+		require.NoError(t, err, email)
+	}
+
+	for _, email := range []string{"user@corp.example.org", "user@example.com.evil.com", "user@evil-example.com", "user@evil.com"} {
+		_, err := r.SignUp(ctx, email, "password")
+		require.ErrorIs(t, err, errDomainNotAllowed, email)
+	}
+
+	_, err = r.CreateUser(ctx, "admin@evil.com")
+	require.ErrorIs(t, err, errDomainNotAllowed)
+	_, err = r.AutoSignUp(ctx, "auto@evil.com", nil)
+	require.ErrorIs(t, err, errDomainNotAllowed)
+	_, err = r.GetUserIDByEmail(ctx, "auto@evil.com")
+	require.ErrorIs(t, err, ErrUserNotFound)
+
+	userID, err := r.GetUserIDByEmail(ctx, "user@example.com")
+	require.NoError(t, err)
+	require.ErrorIs(t, r.AddUserEmail(ctx, userID, "alias@evil.com"), errDomainNotAllowed)
+	_, err = r.ChangeEmail(ctx, "user@example.com", "user@evil.com")
+	require.ErrorIs(t, err, errDomainNotAllowed)
+
+	_, err = r.SignIn(ctx, "legacy@evil.com", "password")
+	require.NoError(t, err)
+	r.checkDomainOnSignIn = true
+	_, err = r.SignIn(ctx, "legacy@evil.com", "password")
+	require.ErrorIs(t, err, errDomainNotAllowed)
+	_, err = r.SignIn(ctx, "user@example.com", "password")
+	require.NoError(t, err)
+
+	for _, domain := range []string{"", "*.", "*", "user@example.com", "*.*.example.com"} {
+		_, err := NewRedis(RedisInit{AllowedEmailDomains: []string{domain}})
+		require.Error(t, err, domain)
+	}
+}
+
+func TestRedisAdditionalEmails(t *testing.T) {
+	ctx := context.Background()
+	mailSender := new(mailSenderMock)
+	r := newTestRedis(t, RedisInit{MailSender: mailSender, MaxUsers: 3})
+
+	tokenPair, err := r.SignUp(ctx, "work@example.com", "password")
+	require.NoError(t, err)
+	userID := tokenPair.UserId
+	_, err = r.SignUp(ctx, "other@example.com", "password")
+	require.NoError(t, err)
+
+	require.NoError(t, r.AddUserEmail(ctx, userID, "personal@example.com"))
+	require.NoError(t, r.AddUserEmail(ctx, userID, "personal@example.com"), "adding the same email is a no-op")
+	require.NoError(t, r.AddUserEmail(ctx, userID, "extra@example.com"))
+	require.NoError(t, r.RemoveUserEmail(ctx, userID, "extra@example.com"))
+	require.ErrorIs(t, r.AddUserEmail(ctx, userID, "other@example.com"), ErrUserExists)
+	require.ErrorIs(t, r.AddUserEmail(ctx, "user-missing", "missing@example.com"), ErrUserNotFound)
+
+	user, err := r.GetUser(ctx, userID)
+	require.NoError(t, err)
+	require.Equal(t, "work@example.com", user.Email)
+	require.Equal(t, []string{"personal@example.com"}, user.AdditionalEmails)
+
+	users, err := r.ListUsers(ctx)
+	require.NoError(t, err)
+	require.Len(t, users, 2, "users are not duplicated")
+	require.Contains(t, users, openapi.UserBasicInfo{Id: userID, Email: "work@example.com"})
+	_, err = r.SignUp(ctx, "third@example.com", "password")
+	require.NoError(t, err, "users with additional emails are counted once")
+
+	tokenPair, err = r.SignIn(ctx, "personal@example.com", "password")
+	require.NoError(t, err)
+	require.Equal(t, userID, tokenPair.UserId)
+	require.NoError(t, r.SendResetPasswordLink(ctx, "personal@example.com", "{{token}}"))
+	require.Len(t, mailSender.links, 1)
+
+	_, err = r.ChangeEmail(ctx, "personal@example.com", "home@example.com")
+	require.NoError(t, err)
+	user, err = r.GetUser(ctx, userID)
+	require.NoError(t, err)
+	require.Equal(t, "work@example.com", user.Email)
+	require.Equal(t, []string{"home@example.com"}, user.AdditionalEmails)
+	_, err = r.SignIn(ctx, "personal@example.com", "password")
+	require.ErrorIs(t, err, ErrUserNotFound)
+
+	require.ErrorIs(t, r.RemoveUserEmail(ctx, userID, "work@example.com"), errPrimaryEmailRemoval)
+	require.ErrorIs(t, r.RemoveUserEmail(ctx, userID, "other@example.com"), errUnknownUserEmail)
+	require.NoError(t, r.RemoveUserEmail(ctx, userID, "home@example.com"))
+	_, err = r.SignIn(ctx, "home@example.com", "password")
+	require.ErrorIs(t, err, ErrUserNotFound)
+
+	require.NoError(t, r.AddUserEmail(ctx, userID, "personal@example.com"))
+	require.NoError(t, r.DeleteUser(ctx, userID))
+	_, err = r.FindUserIDByEmail(ctx, "personal@example.com")
+	require.ErrorIs(t, err, ErrUserNotFound)
+	_, err = r.SignUp(ctx, "personal@example.com", "password")
+	require.NoError(t, err, "deleted user emails are released")
+}
+
+func TestRedisSignOutAccessOnly(t *testing.T) {
+	ctx := context.Background()
+	r := newTestRedis(t, RedisInit{})
+
+	tokenPair, err := r.SignUp(ctx, "user@example.com", "password")
+	require.NoError(t, err)
+
+	require.NoError(t, r.SignOutAccessOnly(ctx, tokenPair.AccessToken))
+	require.NoError(t, r.SignOutAccessOnly(ctx, tokenPair.AccessToken), "unknown tokens are ignored")
+	_, err = r.Authorize(ctx, tokenPair.AccessToken)
+	require.ErrorIs(t, err, errUnknownToken)
+
+	issues, err := r.VerifyTokenLinks(ctx, true)
+	require.NoError(t, err)
+	require.Empty(t, issues)
+
+	refreshed, err := r.RefreshToken(ctx, tokenPair.RefreshToken)
+	require.NoError(t, err, "refresh token is still valid")
+	authorization, err := r.Authorize(ctx, refreshed.AccessToken)
+	require.NoError(t, err)
+	require.Equal(t, tokenPair.UserId, authorization.User.Id)
+	_, err = r.RefreshToken(ctx, tokenPair.RefreshToken)
+	require.ErrorIs(t, err, ErrRefreshUnknown, "refresh token is single-use as usual")
+
+	require.NoError(t, r.SignOut(ctx, refreshed.AccessToken))
+	_, err = r.RefreshToken(ctx, refreshed.RefreshToken)
+	require.ErrorIs(t, err, ErrRefreshUnknown, "SignOut still revokes both tokens")
+}
+
+// blockingMailSender signals sending on started and waits for release.
+type blockingMailSender struct {
+	mailSenderMock
+	started chan struct{}
+	release chan struct{}
+}
+
+func (m *blockingMailSender) SendResetPassword(email, link string) error {
+	close(m.started)
+	<-m.release
+	return m.mailSenderMock.SendResetPassword(email, link)
+}
+
+func TestRedisSetMailSender(t *testing.T) {
+	ctx := context.Background()
+	oldSender := &blockingMailSender{started: make(chan struct{}), release: make(chan struct{})}
+	r := newTestRedis(t, RedisInit{MailSender: oldSender, MailBreakerThreshold: 1, ResetPasswordCooldown: -1})
+
+	for _, email := range []string{"first@example.com", "second@example.com"} {
+		_, err := r.SignUp(ctx, email, "password")
+		require.NoError(t, err)
+	}
+
+	inFlight := make(chan error, 1)
+	go func() { inFlight <- r.SendResetPasswordLink(ctx, "first@example.com", "{{token}}") }()
+	<-oldSender.started
+
+	newSender := new(mailSenderMock)
+	r.SetMailSender(newSender)
+	close(oldSender.release)
+	require.NoError(t, <-inFlight)
+	require.Len(t, oldSender.links, 1, "in-flight send completes with the previous sender")
+
+	require.NoError(t, r.SendResetPasswordLink(ctx, "second@example.com", "{{token}}"))
+	require.Len(t, newSender.links, 1)
+	require.Len(t, oldSender.links, 1)
+
+	r.SetMailSender(&failingMailSender{err: errors.New("dial timeout")})
+	require.Error(t, r.SendResetPasswordLink(ctx, "first@example.com", "{{token}}"))
+	require.Equal(t, MailBreakerOpen, r.MailBreakerState())
+	r.SetMailSender(newSender)
+	require.Equal(t, MailBreakerClosed, r.MailBreakerState(), "new sender gets a fresh breaker")
+}
+
+func TestRedisSlidingSessions(t *testing.T) {
+	for _, storageVersion := range []int{tokenStorageHashes, tokenStorageKeys} {
+		t.Run(fmt.Sprintf("storage v%d", storageVersion), func(t *testing.T) {
+			ctx := context.Background()
+			start := time.Date(2022, 3, 1, 12, 0, 0, 0, time.UTC)
+			now := start
+			r := newTestRedis(t, RedisInit{
+				Clock:                     func() time.Time { return now },
+				TokenStorageVersion:       storageVersion,
+				SlidingSessionTTL:         48 * time.Hour,
+				SlidingSessionMaxLifetime: 72 * time.Hour,
+			})
+			conn := r.redisPool.Get()
+			defer closeQuietly(conn)
+
+			tokenPair, err := r.SignUp(ctx, "user@example.com", "password")
+			require.NoError(t, err)
+			expiresAt := func() string {
+				token, err := r.getToken(conn, accessTokenType, tokenPair.AccessToken)
+				require.NoError(t, err)
+				return token.ExpiredAt
+			}
+
+			now = start.Add(20 * time.Hour)
+			_, err = r.CheckToken(ctx, tokenPair.AccessToken)
+			require.NoError(t, err)
+			require.Equal(t, "2022-03-02T12:00:00.000000Z", expiresAt(), "CheckToken does not extend tokens")
+
+			_, err = r.Authorize(ctx, tokenPair.AccessToken)
+			require.NoError(t, err)
+			require.Equal(t, "2022-03-04T08:00:00.000000Z", expiresAt())
+
+			now = start.Add(60 * time.Hour)
+			_, err = r.Authorize(ctx, tokenPair.AccessToken)
+			require.NoError(t, err, "active session is kept alive")
+			require.Equal(t, "2022-03-04T12:00:00.000000Z", expiresAt(), "extension is capped by max lifetime")
+
+			now = start.Add(73 * time.Hour)
+			_, err = r.CheckToken(ctx, tokenPair.AccessToken)
+			require.ErrorIs(t, err, errExpiredToken)
+
+			now = start.Add(time.Hour)
+			require.NoError(t, r.SignOut(ctx, tokenPair.AccessToken))
+			require.NoError(t, r.slideToken(ctx, &redisToken{
+				UserID:      tokenPair.UserId,
+				IssuedAt:    timestamp.ToISOFormat(start),
+				ExpiredAt:   tokenPair.AccessExpiresAt,
+				AccessToken: tokenPair.AccessToken,
+			}))
+			_, err = r.getToken(conn, accessTokenType, tokenPair.AccessToken)
+			require.ErrorIs(t, err, errUnknownToken, "revoked tokens are not resurrected")
+		})
+	}
+}
+
+func TestRedisAuthorizationCache(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2022, 3, 1, 12, 0, 0, 0, time.UTC)
+	r := newTestRedis(t, RedisInit{
+		Clock:                 func() time.Time { return now },
+		AuthorizationCacheTTL: 5 * time.Second,
+	})
+	conn := r.redisPool.Get()
+	defer closeQuietly(conn)
+
+	tokenPair, err := r.SignUp(ctx, "user@example.com", "password")
+	require.NoError(t, err)
+
+	_, err = r.Authorize(ctx, "unknown")
+	require.Error(t, err, "misses fall through to Redis")
+
+	authorization, err := r.Authorize(ctx, tokenPair.AccessToken)
+	require.NoError(t, err)
+	require.Equal(t, "user@example.com", authorization.User.Email)
+
+	// bypass eviction, as if the token was revoked by another instance
+	_, err = conn.Do("HDEL", r.key(accessTokenType.key()), tokenPair.AccessToken)
+	require.NoError(t, err)
+
+	cached, err := r.Authorize(ctx, tokenPair.AccessToken)
+	require.NoError(t, err, "hits don't reach Redis")
+	require.Equal(t, authorization, cached)
+
+	_, err = r.CheckToken(ctx, tokenPair.AccessToken)
+	require.ErrorIs(t, err, errUnknownToken, "CheckToken is not cached")
+
+	now = now.Add(5 * time.Second)
+	_, err = r.Authorize(ctx, tokenPair.AccessToken)
+	require.ErrorIs(t, err, errUnknownToken, "expired entries are reloaded")
+
+	tokenPair, err = r.SignIn(ctx, "user@example.com", "password")
+	require.NoError(t, err)
+	_, err = r.Authorize(ctx, tokenPair.AccessToken)
+	require.NoError(t, err)
+	require.NoError(t, r.SignOut(ctx, tokenPair.AccessToken))
+	_, err = r.Authorize(ctx, tokenPair.AccessToken)
+	require.ErrorIs(t, err, errUnknownToken, "local revocations evict immediately")
+}
+
+func TestRedisForEachTokenBatch(t *testing.T) {
+	for _, storageVersion := range []int{tokenStorageHashes, tokenStorageKeys} {
+		t.Run(fmt.Sprintf("storage v%d", storageVersion), func(t *testing.T) {
+			r := newTestRedis(t, RedisInit{TokenStorageVersion: storageVersion})
+			conn := r.redisPool.Get()
+			defer closeQuietly(conn)
+
+			tokens := 2*tokenScanBatchSize + 10
+			for i := 0; i < tokens; i++ {
+				userID := "user-1"
+				if i%2 == 0 {
+					userID = "user-2"
+				}
+
+				_, err := r.generateTokenPair(conn, userID, defaultTokenPairTTL)
+				require.NoError(t, err)
+			}
+
+			seen := make(map[string]bool)
+			require.NoError(t, r.forEachTokenBatch(conn, accessTokenType, func(batch map[string][]byte) error {
+				for key := range batch {
+					seen[key] = true
+				}
+
+				return nil
+			}))
+			require.Len(t, seen, tokens)
+
+			stop := errors.New("stop")
+			require.ErrorIs(t, r.forEachTokenBatch(conn, accessTokenType, func(batch map[string][]byte) error { return stop }), stop)
+
+			require.NoError(t, r.revokeTokens(conn, "user-1"))
+			remaining, err := r.scanTokens(conn, refreshTokenType)
+			require.NoError(t, err)
+			require.Len(t, remaining, tokens/2)
+			for key, data := range remaining {
+				token, err := r.decodeToken(key, data)
+				require.NoError(t, err)
+				require.Equal(t, "user-2", token.UserID)
+			}
+		})
+	}
+}
+
+func TestRedisVerifyPassword(t *testing.T) {
+	ctx := context.Background()
+	r := newTestRedis(t, RedisInit{})
+
+	tokenPair, err := r.SignUp(ctx, "user@example.com", "password")
+	require.NoError(t, err)
+	tokens, err := r.ListActiveTokens(ctx, false)
+	require.NoError(t, err)
+
+	ok, err := r.VerifyPassword(ctx, tokenPair.UserId, "password")
+	require.NoError(t, err)
+	require.True(t, ok)
+
+	ok, err = r.VerifyPassword(ctx, tokenPair.UserId, "wrong password")
+	require.NoError(t, err)
+	require.False(t, ok)
+
+	ok, err = r.VerifyPassword(ctx, "user-missing", "password")
+	require.ErrorIs(t, err, ErrUserNotFound)
+	require.False(t, ok)
+
+	after, err := r.ListActiveTokens(ctx, false)
+	require.NoError(t, err)
+	require.Len(t, after, len(tokens), "no tokens are issued")
+}
+
+func TestRedisSignUpWithVerification(t *testing.T) {
+	ctx := context.Background()
+	mailSender := new(mailSenderMock)
+	r := newTestRedis(t, RedisInit{MailSender: mailSender})
+
+	_, err := r.SignUpWithVerification(ctx, "user@example.com", "password", "")
+	require.Error(t, err)
+
+	userID, err := r.SignUpWithVerification(ctx, "user@example.com", "password", "{{token}}")
+	require.NoError(t, err)
+	require.Len(t, mailSender.links, 1)
+	user, err := r.GetUser(ctx, userID)
+	require.NoError(t, err)
+	require.True(t, user.Unverified)
+
+	_, err = r.SignIn(ctx, "user@example.com", "wrong password")
+	require.NotErrorIs(t, err, errEmailNotVerified, "verification status is disclosed only to the user")
+	_, err = r.SignIn(ctx, "user@example.com", "password")
+	require.ErrorIs(t, err, errEmailNotVerified)
+
+	require.Error(t, r.VerifyEmail(ctx, "verify-unknown"))
+	require.NoError(t, r.VerifyEmail(ctx, mailSender.links[0]))
+	require.Error(t, r.VerifyEmail(ctx, mailSender.links[0]), "verification IDs are single-use")
+	tokenPair, err := r.SignIn(ctx, "user@example.com", "password")
+	require.NoError(t, err)
+	require.Equal(t, userID, tokenPair.UserId)
+
+	// reset link proves email ownership too
+	userID, err = r.SignUpWithVerification(ctx, "other@example.com", "password", "{{token}}")
+	require.NoError(t, err)
+	require.NoError(t, r.SendResetPasswordLink(ctx, "other@example.com", "{{token}}"))
+	_, err = r.ResetPassword(ctx, mailSender.links[2], "new password")
+	require.NoError(t, err)
+	_, err = r.SignIn(ctx, "other@example.com", "new password")
+	require.NoError(t, err)
+
+	failing := newTestRedis(t, RedisInit{MailSender: &failingMailSender{err: errors.New("dial timeout")}})
+	_, err = failing.SignUpWithVerification(ctx, "user@example.com", "password", "{{token}}")
+	require.Error(t, err)
+	_, err = failing.FindUserIDByEmail(ctx, "user@example.com")
+	require.ErrorIs(t, err, ErrUserNotFound, "user is not created if the link can't be sent")
+}
+
+func TestRedisRevokeAllResetLinks(t *testing.T) {
+	ctx := context.Background()
+	mailSender := new(mailSenderMock)
+	r := newTestRedis(t, RedisInit{MailSender: mailSender, ResetPasswordCooldown: -1})
+
+	_, err := r.SignUp(ctx, "user@example.com", "password")
+	require.NoError(t, err)
+	created, err := r.CreateUser(ctx, "created@example.com")
+	require.NoError(t, err)
+	for i := 0; i < 2; i++ {
+		require.NoError(t, r.SendResetPasswordLink(ctx, "user@example.com", "{{token}}"))
+	}
+
+	// keys of another environment sharing the Redis are intact
+	other := *r
+	other.keyPrefix = "other"
+	_, err = other.SignUp(ctx, "user@example.com", "password")
+	require.NoError(t, err)
+	require.NoError(t, other.SendResetPasswordLink(ctx, "user@example.com", "{{token}}"))
+
+	revoked, err := r.RevokeAllResetLinks(ctx)
+	require.NoError(t, err)
+	require.Equal(t, 3, revoked)
+	for _, resetID := range []string{mailSender.links[0], mailSender.links[1], created.ResetID} {
+		_, err = r.ResetPassword(ctx, resetID, "new password")
+		require.Error(t, err, resetID)
+	}
+
+	_, err = other.ResetPassword(ctx, mailSender.links[2], "new password")
+	require.NoError(t, err)
+
+	require.NoError(t, r.SendResetPasswordLink(ctx, "user@example.com", "{{token}}"))
+	_, err = r.ResetPassword(ctx, mailSender.links[3], "new password")
+	require.NoError(t, err, "new links work")
+}
+
+func TestRedisCreateUserWithHash(t *testing.T) {
+	ctx := context.Background()
+	r := newTestRedis(t, RedisInit{})
+
+	// bcrypt hash of "imported password" with cost 4 created by another system
+	const hash = "$2a$04$Dxwpkk1cMYchcGXP55iUsuvjP7qWoqAV4oUl9BSBLvNgE6N0pxOBy"
+	userID, err := r.CreateUserWithHash(ctx, "imported@example.com", hash)
+	require.NoError(t, err)
+
+	tokenPair, err := r.SignIn(ctx, "imported@example.com", "imported password")
+	require.NoError(t, err)
+	require.Equal(t, userID, tokenPair.UserId)
+	_, err = r.SignIn(ctx, "imported@example.com", "password")
+	require.Error(t, err)
+
+	_, err = r.CreateUserWithHash(ctx, "imported@example.com", hash)
+	require.ErrorIs(t, err, ErrUserExists)
+
+	for _, invalid := range []string{"", "imported password", "$1$salt$hash", "$2a$04$short"} {
+		_, err := r.CreateUserWithHash(ctx, "invalid@example.com", invalid)
+		require.Error(t, err, invalid)
+	}
+
+	_, err = r.FindUserIDByEmail(ctx, "invalid@example.com")
+	require.ErrorIs(t, err, ErrUserNotFound)
+}
+
+func TestRedisReassignUserID(t *testing.T) {
+	ctx := context.Background()
+	r := newTestRedis(t, RedisInit{})
+
+	tokenPair, err := r.SignUp(ctx, "reassigned@example.com", "password")
+	require.NoError(t, err)
+	oldID := tokenPair.UserId
+	keyID, secret, err := r.CreateAPIKey(ctx, oldID, "ci")
+	require.NoError(t, err)
+	other, err := r.SignUp(ctx, "other@example.com", "password")
+	require.NoError(t, err)
+
+	// cache the authorization under the old ID
+	_, err = r.Authorize(ctx, tokenPair.AccessToken)
+	require.NoError(t, err)
+
+	require.ErrorIs(t, r.ReassignUserID(ctx, oldID, other.UserId), ErrUserExists)
+	require.ErrorIs(t, r.ReassignUserID(ctx, "missing", "new-id"), ErrUserNotFound)
+	require.NoError(t, r.ReassignUserID(ctx, oldID, "new-id"))
+
+	auth, err := r.Authorize(ctx, tokenPair.AccessToken)
+	require.NoError(t, err)
+	require.Equal(t, "new-id", auth.User.Id)
+	require.Equal(t, oldID, auth.Subject)
+
+	auth, err = r.AuthorizeAPIKey(ctx, keyID+apiKeySeparator+secret)
+	require.NoError(t, err)
+	require.Equal(t, "new-id", auth.User.Id)
+
+	refreshed, err := r.RefreshToken(ctx, tokenPair.RefreshToken)
+	require.NoError(t, err)
+	require.Equal(t, "new-id", refreshed.UserId)
+
+	signedIn, err := r.SignIn(ctx, "reassigned@example.com", "password")
+	require.NoError(t, err)
+	require.Equal(t, "new-id", signedIn.UserId)
+
+	_, err = r.GetUser(ctx, oldID)
+	require.ErrorIs(t, err, ErrUserNotFound)
+	user, err := r.GetUser(ctx, "new-id")
+	require.NoError(t, err)
+	require.Equal(t, "reassigned@example.com", user.Email)
+
+	auth, err = r.Authorize(ctx, other.AccessToken)
+	require.NoError(t, err)
+	require.Equal(t, other.UserId, auth.User.Id)
+}
+
+func TestRedisListPendingResets(t *testing.T) {
+	ctx := context.Background()
+	mailSender := new(mailSenderMock)
+	r := newTestRedis(t, RedisInit{MailSender: mailSender, ResetPasswordCooldown: -1})
+
+	resets, err := r.ListPendingResets(ctx)
+	require.NoError(t, err)
+	require.Empty(t, resets)
+
+	first, err := r.SignUp(ctx, "first@example.com", "password")
+	require.NoError(t, err)
+	second, err := r.SignUp(ctx, "second@example.com", "password")
+	require.NoError(t, err)
+	for _, email := range []string{"first@example.com", "second@example.com", "second@example.com"} {
+		require.NoError(t, r.SendResetPasswordLink(ctx, email, "{{token}}"))
+	}
+
+	conn := r.redisPool.Get()
+	defer closeQuietly(conn)
+	_, err = conn.Do("SET", r.key(resetKey("reset-deleted")), "deleted", "EX", 60)
+	require.NoError(t, err)
+
+	resets, err = r.ListPendingResets(ctx)
+	require.NoError(t, err)
+	require.Len(t, resets, 4)
+
+	expected := map[string]string{first.UserId: "first@example.com", second.UserId: "second@example.com", "deleted": ""}
+	for _, reset := range resets {
+		require.Equal(t, expected[reset.UserID], reset.Email, reset.UserID)
+		require.Greater(t, reset.ExpiresIn, time.Duration(0))
+		require.LessOrEqual(t, reset.ExpiresIn, time.Duration(resetIDTTLSeconds)*time.Second)
+	}
+
+	require.True(t, sort.SliceIsSorted(resets, func(i, j int) bool { return resets[i].UserID < resets[j].UserID }))
+
+	_, err = r.ResetPassword(ctx, mailSender.links[2], "new password")
+	require.NoError(t, err)
+	resets, err = r.ListPendingResets(ctx)
+	require.NoError(t, err)
+	require.Len(t, resets, 2, "completed resets invalidate other links of the user")
+}
+
+func TestRedisRevokeResetID(t *testing.T) {
+	ctx := context.Background()
+	mailSender := new(mailSenderMock)
+	r := newTestRedis(t, RedisInit{MailSender: mailSender, ResetPasswordCooldown: -1})
+
+	tokenPair, err := r.SignUp(ctx, "user@example.com", "password")
+	require.NoError(t, err)
+	for i := 0; i < 2; i++ {
+		require.NoError(t, r.SendResetPasswordLink(ctx, "user@example.com", "{{token}}"))
+	}
+
+	require.NoError(t, r.RevokeResetID(ctx, mailSender.links[0]))
+	require.NoError(t, r.RevokeResetID(ctx, mailSender.links[0]), "revoke is idempotent")
+	require.NoError(t, r.RevokeResetID(ctx, "reset-unknown"))
+
+	_, err = r.ResetPassword(ctx, mailSender.links[0], "new password")
+	require.Error(t, err)
+
+	conn := r.redisPool.Get()
+	defer closeQuietly(conn)
+	resetIDs, err := redis.Strings(conn.Do("SMEMBERS", r.key(userResetsKey(tokenPair.UserId))))
+	require.NoError(t, err)
+	require.Equal(t, []string{mailSender.links[1]}, resetIDs)
+
+	_, err = r.ResetPassword(ctx, mailSender.links[1], "new password")
+	require.NoError(t, err, "other links work")
+}
+
+func TestRedisListUsersWithFields(t *testing.T) {
+	ctx := context.Background()
+	r := newTestRedis(t, RedisInit{})
+
+	first, err := r.SignUpWithUsername(ctx, "first@example.com", "first", "password")
+	require.NoError(t, err)
+	second, err := r.SignUp(ctx, "second@example.com", "password")
+	require.NoError(t, err)
+	require.NoError(t, r.SetUserLocked(ctx, second.UserId, true))
+
+	_, err = r.ListUsersWithFields(ctx, []string{userEmailField, userHashedPasswordField})
+	require.Error(t, err, "password hash can't be listed")
+
+	users, err := r.ListUsersWithFields(ctx, []string{userEmailField, userUsernameField, userLockedField})
+	require.NoError(t, err)
+	require.Len(t, users, 2)
+	for _, user := range users {
+		require.NotContains(t, user, userHashedPasswordField)
+		switch user[userIDField] {
+		case first.UserId:
+			require.Equal(t, map[string]string{userIDField: first.UserId, userEmailField: "first@example.com", userUsernameField: "first"}, user)
+		case second.UserId:
+			require.Equal(t, "second@example.com", user[userEmailField])
+			require.NotEmpty(t, user[userLockedField])
+			require.NotContains(t, user, userUsernameField)
+		default:
+			require.Fail(t, "unexpected user", user)
+		}
+	}
+
+	users, err = r.ListUsersWithFields(ctx, nil)
+	require.NoError(t, err)
+	require.ElementsMatch(t, []map[string]string{{userIDField: first.UserId}, {userIDField: second.UserId}}, users)
+}
+
+func TestRedisFindOrphanedUsers(t *testing.T) {
+	ctx := context.Background()
+	r := newTestRedis(t, RedisInit{})
+	conn := r.redisPool.Get()
+	defer closeQuietly(conn)
+
+	first, err := r.SignUp(ctx, "first@example.com", "password")
+	require.NoError(t, err)
+	second, err := r.SignUp(ctx, "second@example.com", "password")
+	require.NoError(t, err)
+	third, err := r.SignUp(ctx, "third@example.com", "password")
+	require.NoError(t, err)
+	require.NoError(t, r.AddUserEmail(ctx, third.UserId, "third-alias@example.com"))
+
+	reports, err := r.FindOrphanedUsers(ctx)
+	require.NoError(t, err)
+	require.Empty(t, reports, "consistent users")
+
+	for _, command := range [][]interface{}{
+		{"HSET", r.key(usersIndexKey), "ghost@example.com", "ghost"},
+		{"HSET", r.key(usersIndexKey), "stale@example.com", second.UserId},
+		{"HDEL", r.key(usersIndexKey), "third-alias@example.com"},
+		{"HSET", r.key(userKey("duplicate")), userIDField, "duplicate", userEmailField, "first@example.com"},
+		{"HSET", r.key(userKey("partial")), userHashedPasswordField, "hash"},
+	} {
+		_, err := conn.Do(command[0].(string), command[1:]...)
+		require.NoError(t, err)
+	}
+
+	reports, err = r.FindOrphanedUsers(ctx)
+	require.NoError(t, err)
+	require.ElementsMatch(t, []OrphanReport{
+		{Kind: OrphanMissingUser, IndexField: "ghost@example.com", IndexedUserID: "ghost"},
+		{Kind: OrphanEmailMismatch, IndexField: "stale@example.com", IndexedUserID: second.UserId, UserID: second.UserId, Email: "second@example.com"},
+		{Kind: OrphanUnindexedEmail, IndexField: "third-alias@example.com", UserID: third.UserId, Email: "third-alias@example.com"},
+		{Kind: OrphanConflictingEmail, IndexField: "first@example.com", IndexedUserID: first.UserId, UserID: "duplicate", Email: "first@example.com"},
+		{Kind: OrphanUserWithoutEmail, UserID: "partial"},
+	}, reports)
+}
+
+func TestRedisReconcileUsersIndex(t *testing.T) {
+	ctx := context.Background()
+	r := newTestRedis(t, RedisInit{})
+	conn := r.redisPool.Get()
+	defer closeQuietly(conn)
+
+	first, err := r.SignUp(ctx, "first@example.com", "password")
+	require.NoError(t, err)
+	second, err := r.SignUp(ctx, "second@example.com", "password")
+	require.NoError(t, err)
+	third, err := r.SignUp(ctx, "third@example.com", "password")
+	require.NoError(t, err)
+
+	for _, command := range [][]interface{}{
+		{"HSET", r.key(usersIndexKey), "ghost@example.com", "ghost"},
+		{"HSET", r.key(usersIndexKey), "stale@example.com", second.UserId},
+		{"HDEL", r.key(usersIndexKey), "third@example.com"},
+		{"HSET", r.key(usersIndexKey), "moved@example.com", "ghost"},
+		{"HSET", r.key(userKey("moved")), userIDField, "moved", userEmailField, "moved@example.com"},
+		{"HSET", r.key(userKey("duplicate")), userIDField, "duplicate", userEmailField, "first@example.com"},
+		{"HSET", r.key(userKey("partial")), userHashedPasswordField, "hash"},
+	} {
+		_, err := conn.Do(command[0].(string), command[1:]...)
+		require.NoError(t, err)
+	}
+
+	expectedActions := []RepairAction{
+		{Action: RepairRemoveIndexEntry, Report: OrphanReport{Kind: OrphanMissingUser, IndexField: "ghost@example.com", IndexedUserID: "ghost"}},
+		{Action: RepairSetIndexEntry, Report: OrphanReport{Kind: OrphanMissingUser, IndexField: "moved@example.com", IndexedUserID: "ghost"}, UserID: "moved"},
+		{Action: RepairRemoveIndexEntry, Report: OrphanReport{Kind: OrphanEmailMismatch, IndexField: "stale@example.com", IndexedUserID: second.UserId, UserID: second.UserId, Email: "second@example.com"}},
+		{Action: RepairSetIndexEntry, Report: OrphanReport{Kind: OrphanUnindexedEmail, IndexField: "third@example.com", UserID: third.UserId, Email: "third@example.com"}, UserID: third.UserId},
+	}
+	expectedSkipped := []OrphanReport{
+		{Kind: OrphanConflictingEmail, IndexField: "first@example.com", IndexedUserID: first.UserId, UserID: "duplicate", Email: "first@example.com"},
+		{Kind: OrphanUserWithoutEmail, UserID: "partial"},
+	}
+
+	before, err := r.FindOrphanedUsers(ctx)
+	require.NoError(t, err)
+	report, err := r.ReconcileUsersIndex(ctx, true)
+	require.NoError(t, err)
+	require.True(t, report.DryRun)
+	require.ElementsMatch(t, expectedActions, report.Actions)
+	require.ElementsMatch(t, expectedSkipped, report.Skipped)
+	after, err := r.FindOrphanedUsers(ctx)
+	require.NoError(t, err)
+	require.Equal(t, before, after, "dry run changes nothing")
+
+	report, err = r.ReconcileUsersIndex(ctx, false)
+	require.NoError(t, err)
+	require.False(t, report.DryRun)
+	require.ElementsMatch(t, expectedActions, report.Actions)
+	require.ElementsMatch(t, expectedSkipped, report.Skipped)
+
+	after, err = r.FindOrphanedUsers(ctx)
+	require.NoError(t, err)
+	require.ElementsMatch(t, expectedSkipped, after, "only inconsistencies needing manual resolution are left")
+
+	_, err = r.SignIn(ctx, "third@example.com", "password")
+	require.NoError(t, err, "reindexed user can sign in")
+	userID, err := r.GetUserIDByEmail(ctx, "moved@example.com")
+	require.NoError(t, err)
+	require.Equal(t, "moved", userID)
+}
+
+func TestRedisFindToken(t *testing.T) {
+	ctx := context.Background()
+	r := newTestRedis(t, RedisInit{})
+
+	tokenPair, err := r.SignUp(ctx, "user@example.com", "password")
+	require.NoError(t, err)
+
+	info, tokenType, err := r.FindToken(ctx, tokenPair.AccessToken)
+	require.NoError(t, err)
+	require.Equal(t, accessTokenType, tokenType)
+	require.Equal(t, tokenPair.UserId, info.UserID)
+	require.Equal(t, tokenPair.UserId, info.Subject)
+	require.Equal(t, tokenPair.AccessExpiresAt, timestamp.ToISOFormat(info.ExpiresAt))
+	require.False(t, info.IssuedAt.IsZero())
+
+	info, tokenType, err = r.FindToken(ctx, tokenPair.RefreshToken)
+	require.NoError(t, err)
+	require.Equal(t, refreshTokenType, tokenType)
+	require.Equal(t, tokenPair.RefreshExpiresAt, timestamp.ToISOFormat(info.ExpiresAt))
+
+	_, _, err = r.FindToken(ctx, "unknown")
+	require.ErrorIs(t, err, errUnknownToken)
+
+	require.NoError(t, r.RevokeToken(ctx, tokenPair.RefreshToken))
+	_, _, err = r.FindToken(ctx, tokenPair.AccessToken)
+	require.ErrorIs(t, err, errUnknownToken, "revoking refresh token revokes the pair")
+}
+
+func TestRedisTokenSubject(t *testing.T) {
+	ctx := context.Background()
+	r := newTestRedis(t, RedisInit{ServerToken: "server"})
+	conn := r.redisPool.Get()
+	defer closeQuietly(conn)
+
+	tokenPair, err := r.SignUp(ctx, "user@example.com", "password")
+	require.NoError(t, err)
+
+	authorization, err := r.Authorize(ctx, tokenPair.AccessToken)
+	require.NoError(t, err)
+	require.Equal(t, tokenPair.UserId, authorization.Subject)
+
+	_, err = r.ChangeEmail(ctx, "user@example.com", "changed@example.com")
+	require.NoError(t, err)
+	tokenPair, err = r.SignIn(ctx, "changed@example.com", "password")
+	require.NoError(t, err)
+	authorizations, errs := r.AuthorizeBatch(ctx, []string{tokenPair.AccessToken})
+	require.NoError(t, errs[0])
+	require.Equal(t, tokenPair.UserId, authorizations[0].Subject, "subject survives email changes")
+
+	legacy := newRedisToken(r.now(), tokenPair.UserId, accessTokenType, "legacy", time.Hour, nil)
+	legacy.Subject = ""
+	require.NoError(t, r.saveToken(conn, accessTokenType, legacy))
+	authorization, err = r.Authorize(ctx, "legacy")
+	require.NoError(t, err)
+	require.Equal(t, tokenPair.UserId, authorization.Subject, "tokens issued without subject fall back to user ID")
+
+	authorization, err = r.Authorize(ctx, "server")
+	require.NoError(t, err)
+	require.Empty(t, authorization.Subject)
+}
+
+func TestWithRequestID(t *testing.T) {
+	ctx := new(gin.Context)
+	require.Equal(t, "User [user-1] has signed in", fmt.Sprintf(withRequestID(ctx, "User [%s] has signed in"), "user-1"))
+
+	ctx.Set("request_id", "abc%s%s")
+	require.Equal(t, "[request_id: abc%s%s] User [user-1] has signed in",
+		fmt.Sprintf(withRequestID(ctx, "User [%s] has signed in"), "user-1"))
+}
@@ -3,14 +3,17 @@ package authorization
 import (
 	"time"
 
+	"github.com/jitsucom/jitsu/configurator/middleware"
 	"github.com/jitsucom/jitsu/server/timestamp"
 	"github.com/pkg/errors"
-	uuid "github.com/satori/go.uuid"
 )
 
 type tokenPairTTL struct {
 	access  time.Duration
 	refresh time.Duration
+
+	// rememberMe marks tokens of SignInOptions.RememberMe sessions, so that renewed pairs keep the refresh TTL.
+	rememberMe bool
 }
 
 var defaultTokenPairTTL = tokenPairTTL{
@@ -18,24 +21,147 @@ var defaultTokenPairTTL = tokenPairTTL{
 	refresh: 7 * 24 * time.Hour,
 }
 
+const defaultRememberMeRefreshTTL = 30 * 24 * time.Hour
+
+const (
+	defaultSlidingSessionMaxLifetime = 7 * 24 * time.Hour
+	// minSlidingExtension keeps Authorize from rewriting the token on every request.
+	minSlidingExtension = time.Minute
+)
+
+const (
+	// tokenStorageHashes stores tokens as fields of per token type hashes.
+	tokenStorageHashes = 1
+	// tokenStorageKeys stores each token under its own key, which expires together with the token.
+	tokenStorageKeys = 2
+
+	// tokenScanBatchSize is the COUNT hint for SCAN and HSCAN over tokens.
+	tokenScanBatchSize = 1000
+)
+
 type redisToken struct {
-	UserID       string `json:"user_id"`
-	ExpiredAt    string `json:"expired_at"`
-	TokenType    string `json:"token_type"`
-	AccessToken  string `json:"access_token"`
-	RefreshToken string `json:"refresh_token"`
+	UserID       string            `json:"user_id"`
+	IssuedAt     string            `json:"issued_at,omitempty"`
+	ExpiredAt    string            `json:"expired_at"`
+	TokenType    string            `json:"token_type"`
+	AccessToken  string            `json:"access_token"`
+	RefreshToken string            `json:"refresh_token"`
+	Scopes       []string          `json:"scopes,omitempty"`
+	Metadata     map[string]string `json:"metadata,omitempty"`
+	// Subject is the stable principal identifier for external services, see middleware.Authorization.Subject.
+	// It is empty in tokens issued before it was introduced, use subject instead.
+	Subject string `json:"sub,omitempty"`
+	// RememberMe is set in tokens of SignInOptions.RememberMe sessions.
+	RememberMe bool `json:"remember_me,omitempty"`
+}
+
+// subject returns the token subject falling back to the user ID for tokens issued without it.
+func (t *redisToken) subject() string {
+	if t.Subject != "" {
+		return t.Subject
+	}
+
+	return t.UserID
 }
 
-func (t *redisToken) validate() error {
-	if expiredAt, err := timestamp.ParseISOFormat(t.ExpiredAt); err != nil {
-		return errors.Wrap(err, "parse expiration field")
-	} else if timestamp.Now().After(expiredAt) {
+// validate checks the token has not expired. Tokens expired within grace are still valid,
+// which compensates clock skew between nodes.
+func (t *redisToken) validate(now time.Time, grace time.Duration) error {
+	if ttl, err := t.ttl(now); err != nil {
+		return err
+	} else if ttl+grace < 0 {
 		return errExpiredToken
 	} else {
 		return nil
 	}
 }
 
+// ttl returns time left since now until the token expires. It is negative for expired tokens.
+func (t *redisToken) ttl(now time.Time) (time.Duration, error) {
+	expiredAt, err := timestamp.ParseISOFormat(t.ExpiredAt)
+	if err != nil {
+		return 0, errors.Wrap(err, "parse expiration field")
+	}
+
+	return expiredAt.Sub(now), nil
+}
+
+// slidingExpiration returns the expiration time extended to ttl since now, but no later than maxLifetime since issue.
+// It returns false if the token can't be extended, e.g. it has no issue time or the cap is reached.
+func (t *redisToken) slidingExpiration(now time.Time, ttl, maxLifetime time.Duration) (time.Time, bool, error) {
+	if t.IssuedAt == "" {
+		return time.Time{}, false, nil
+	}
+
+	issuedAt, err := timestamp.ParseISOFormat(t.IssuedAt)
+	if err != nil {
+		return time.Time{}, false, errors.Wrap(err, "parse issue time field")
+	}
+
+	expiredAt, err := timestamp.ParseISOFormat(t.ExpiredAt)
+	if err != nil {
+		return time.Time{}, false, errors.Wrap(err, "parse expiration field")
+	}
+
+	extended := now.Add(ttl)
+	if limit := issuedAt.Add(maxLifetime); extended.After(limit) {
+		extended = limit
+	}
+
+	return extended, extended.Sub(expiredAt) >= minSlidingExtension, nil
+}
+
+// issuedBefore reports whether the token has been issued before cutoff. Tokens without issue time are considered so.
+func (t *redisToken) issuedBefore(cutoff time.Time) (bool, error) {
+	if t.IssuedAt == "" {
+		return true, nil
+	}
+
+	issuedAt, err := timestamp.ParseISOFormat(t.IssuedAt)
+	if err != nil {
+		return false, errors.Wrap(err, "parse issue time field")
+	}
+
+	return issuedAt.Before(cutoff), nil
+}
+
+// TokenInfo describes a stored access or refresh token.
+type TokenInfo struct {
+	UserID  string
+	Subject string
+	Scopes  []string
+
+	// Metadata contains claims added by the token decorator.
+	Metadata map[string]string
+
+	// IssuedAt is zero for tokens issued before issue time tracking.
+	IssuedAt  time.Time
+	ExpiresAt time.Time
+}
+
+// info converts the token to TokenInfo.
+func (t *redisToken) info() (*TokenInfo, error) {
+	info := &TokenInfo{
+		UserID:   t.UserID,
+		Subject:  t.subject(),
+		Scopes:   t.Scopes,
+		Metadata: t.Metadata,
+	}
+
+	var err error
+	if info.ExpiresAt, err = timestamp.ParseISOFormat(t.ExpiredAt); err != nil {
+		return nil, errors.Wrap(err, "parse expiration field")
+	}
+
+	if t.IssuedAt != "" {
+		if info.IssuedAt, err = timestamp.ParseISOFormat(t.IssuedAt); err != nil {
+			return nil, errors.Wrap(err, "parse issue time field")
+		}
+	}
+
+	return info, nil
+}
+
 type redisTokenType interface {
 	key() string
 	name() string
@@ -62,14 +188,38 @@ var (
 	refreshTokenType redisTokenType = _refreshTokenType{}
 )
 
-func newRedisToken(now time.Time, userID string, tokenType redisTokenType, ttl time.Duration) *redisToken {
+// defaultTokenScopes are granted to tokens issued without explicit scopes.
+var defaultTokenScopes = []string{middleware.FullAccessScope}
+
+func validateScopes(scopes []string) error {
+	for _, scope := range scopes {
+		known := false
+		for _, knownScope := range middleware.KnownScopes {
+			if scope == knownScope {
+				known = true
+				break
+			}
+		}
+
+		if !known {
+			return errors.Errorf("unknown token scope [%s]", scope)
+		}
+	}
+
+	return nil
+}
+
+func newRedisToken(now time.Time, userID string, tokenType redisTokenType, value string, ttl time.Duration, scopes []string) *redisToken {
 	token := &redisToken{
 		UserID:    userID,
+		Subject:   userID,
+		IssuedAt:  timestamp.ToISOFormat(now.UTC()),
 		ExpiredAt: timestamp.ToISOFormat(now.UTC().Add(ttl)),
 		TokenType: tokenType.name(),
+		Scopes:    scopes,
 	}
 
-	tokenType.set(token, uuid.NewV4().String())
+	tokenType.set(token, value)
 	return token
 }
 
@@ -0,0 +1,92 @@
+package authorization
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const encryptedTokenPrefix = "enc:"
+
+// tokenCipher encrypts persisted token payloads with AES-GCM.
+// Encrypted payload format is enc:<key ID>:<base64(nonce + ciphertext)>, so that
+// tokens encrypted with previous keys can still be decrypted during key rotation.
+type tokenCipher struct {
+	keyID string
+	aeads map[string]cipher.AEAD
+}
+
+func newTokenCipher(keys map[string][]byte, keyID string) (*tokenCipher, error) {
+	if _, ok := keys[keyID]; !ok {
+		return nil, errors.Errorf("token encryption key [%s] is not configured", keyID)
+	}
+
+	aeads := make(map[string]cipher.AEAD, len(keys))
+	for id, key := range keys {
+		if id == "" || strings.Contains(id, ":") {
+			return nil, errors.Errorf("token encryption key ID [%s] must be non-empty and must not contain ':'", id)
+		}
+
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, errors.Wrapf(err, "create cipher for key [%s]", id)
+		}
+
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, errors.Wrapf(err, "create GCM for key [%s]", id)
+		}
+
+		aeads[id] = aead
+	}
+
+	return &tokenCipher{
+		keyID: keyID,
+		aeads: aeads,
+	}, nil
+}
+
+// encrypt seals data with the current key. additionalData binds the ciphertext to its lookup key.
+func (c *tokenCipher) encrypt(data, additionalData []byte) ([]byte, error) {
+	aead := c.aeads[c.keyID]
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, errors.Wrap(err, "generate nonce")
+	}
+
+	sealed := aead.Seal(nonce, nonce, data, additionalData)
+	return []byte(encryptedTokenPrefix + c.keyID + ":" + base64.StdEncoding.EncodeToString(sealed)), nil
+}
+
+func (c *tokenCipher) decrypt(data, additionalData []byte) ([]byte, error) {
+	parts := strings.SplitN(strings.TrimPrefix(string(data), encryptedTokenPrefix), ":", 2)
+	if len(parts) != 2 {
+		return nil, errors.New("malformed encrypted token")
+	}
+
+	aead, ok := c.aeads[parts[0]]
+	if !ok {
+		return nil, errors.Errorf("unknown token encryption key [%s]", parts[0])
+	}
+
+	sealed, err := base64.StdEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, errors.Wrap(err, "decode encrypted token")
+	}
+
+	if len(sealed) < aead.NonceSize() {
+		return nil, errors.New("malformed encrypted token")
+	}
+
+	nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	return aead.Open(nil, nonce, ciphertext, additionalData)
+}
+
+func isEncryptedToken(data []byte) bool {
+	return bytes.HasPrefix(data, []byte(encryptedTokenPrefix))
+}
@@ -2,7 +2,11 @@ package emails
 
 import (
 	"bytes"
+	"io"
+	"net"
+	"net/textproto"
 	"text/template"
+	"time"
 
 	"github.com/jitsucom/jitsu/server/logging"
 	"github.com/pkg/errors"
@@ -11,6 +15,36 @@ import (
 
 var ErrSMTPNotConfigured = errors.New("SMTP isn't configured")
 
+const (
+	defaultDialTimeoutSeconds = 10
+	defaultSendRetries        = 2
+	defaultRetryBackoffMs     = 500
+)
+
+// SendError is returned when email sending has failed.
+// Temporary errors (e.g. network failures or 4xx SMTP replies) persisted through all retries, so the user can try again later.
+// Other errors (e.g. 5xx SMTP replies like authentication failure) most probably mean SMTP misconfiguration.
+type SendError struct {
+	Err       error
+	temporary bool
+}
+
+func (e *SendError) Error() string {
+	if e.temporary {
+		return "temporary SMTP failure: " + e.Err.Error()
+	}
+
+	return "permanent SMTP failure: " + e.Err.Error()
+}
+
+func (e *SendError) Unwrap() error {
+	return e.Err
+}
+
+func (e *SendError) Temporary() bool {
+	return e.temporary
+}
+
 type SMTPConfiguration struct {
 	Host      string `json:"host"`
 	Port      int    `json:"port"`
@@ -19,6 +53,13 @@ type SMTPConfiguration struct {
 	From      string `json:"from"`
 	Signature string `json:"signature"`
 	ReplyTo   string `json:"reply_to"`
+
+	// DialTimeoutSeconds limits SMTP server connection and read/write operations.
+	DialTimeoutSeconds int `json:"dial_timeout_seconds"`
+	// Retries is the number of extra send attempts on temporary failures. Negative value disables retries.
+	Retries int `json:"retries"`
+	// RetryBackoffMs is the delay before the first retry. It doubles with every next retry.
+	RetryBackoffMs int `json:"retry_backoff_ms"`
 }
 
 func (sc *SMTPConfiguration) Validate() error {
@@ -42,6 +83,20 @@ func (sc *SMTPConfiguration) Validate() error {
 		sc.Signature = "Your Jitsu - an open-source data collection platform team"
 	}
 
+	if sc.DialTimeoutSeconds <= 0 {
+		sc.DialTimeoutSeconds = defaultDialTimeoutSeconds
+	}
+
+	if sc.Retries == 0 {
+		sc.Retries = defaultSendRetries
+	} else if sc.Retries < 0 {
+		sc.Retries = 0
+	}
+
+	if sc.RetryBackoffMs <= 0 {
+		sc.RetryBackoffMs = defaultRetryBackoffMs
+	}
+
 	return nil
 }
 
@@ -107,8 +162,23 @@ func (s *Service) send(subject templateSubject, email, link string) error {
 
 	msg.SetBody("text/html", body.String())
 
-	dialer := gomail.NewDialer(s.smtp.Host, s.smtp.Port, s.smtp.User, s.smtp.Password)
-	return dialer.DialAndSend(msg)
+	dialer := dialer(s.smtp)
+	backoff := time.Duration(s.smtp.RetryBackoffMs) * time.Millisecond
+	for attempt := 0; ; attempt++ {
+		err := dialer.DialAndSend(msg)
+		if err == nil {
+			return nil
+		}
+
+		temporary := isTemporary(err)
+		if !temporary || attempt >= s.smtp.Retries {
+			return &SendError{Err: err, temporary: temporary}
+		}
+
+		logging.Warnf("Failed to send email [%s] (attempt %d), retrying in %s: %v", subject, attempt+1, backoff, err)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
 }
 
 func (s *Service) SendResetPassword(email, link string) error {
@@ -119,6 +189,32 @@ func (s *Service) SendAccountCreated(email, link string) error {
 	return s.send(accountCreated, email, link)
 }
 
+func (s *Service) SendEmailVerification(email, link string) error {
+	return s.send(verifyEmail, email, link)
+}
+
 func dialer(cfg *SMTPConfiguration) *gomail.Dialer {
-	return gomail.NewDialer(cfg.Host, cfg.Port, cfg.User, cfg.Password)
+	dialer := gomail.NewDialer(cfg.Host, cfg.Port, cfg.User, cfg.Password)
+	if cfg.DialTimeoutSeconds > 0 {
+		dialer.Timeout = time.Duration(cfg.DialTimeoutSeconds) * time.Second
+	}
+
+	return dialer
+}
+
+// isTemporary reports whether email sending may succeed on retry.
+// Network errors and SMTP replies with 4xx codes are temporary, 5xx replies and other errors (e.g. TLS or auth setup) are not.
+func isTemporary(err error) bool {
+	var sendErr *gomail.SendError
+	if errors.As(err, &sendErr) {
+		err = sendErr.Cause
+	}
+
+	var protoErr *textproto.Error
+	if errors.As(err, &protoErr) {
+		return protoErr.Code < 500
+	}
+
+	var netErr net.Error
+	return errors.As(err, &netErr) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
 }
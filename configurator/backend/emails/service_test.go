@@ -0,0 +1,114 @@
+package emails
+
+import (
+	"fmt"
+	"net"
+	"net/textproto"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+// smtpStub is a minimal SMTP server which rejects connections with failCode greeting
+// until failures are exhausted and accepts all messages after that.
+type smtpStub struct {
+	listener    net.Listener
+	failures    int
+	failCode    int
+	connections int32
+	messages    int32
+}
+
+func newSMTPStub(t *testing.T, failures, failCode int) *smtpStub {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = listener.Close() })
+
+	stub := &smtpStub{listener: listener, failures: failures, failCode: failCode}
+	go stub.serve()
+	return stub
+}
+
+func (s *smtpStub) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		if atomic.AddInt32(&s.connections, 1) <= int32(s.failures) {
+			_, _ = fmt.Fprintf(conn, "%d service is not available\r\n", s.failCode)
+			_ = conn.Close()
+			continue
+		}
+
+		s.handle(conn)
+	}
+}
+
+func (s *smtpStub) handle(conn net.Conn) {
+	defer conn.Close()
+	text := textproto.NewConn(conn)
+	_ = text.PrintfLine("220 localhost ESMTP")
+	for {
+		line, err := text.ReadLine()
+		if err != nil {
+			return
+		}
+
+		switch command := strings.ToUpper(strings.SplitN(line, " ", 2)[0]); command {
+		case "EHLO", "HELO", "MAIL", "RCPT", "RSET", "NOOP":
+			_ = text.PrintfLine("250 OK")
+		case "DATA":
+			_ = text.PrintfLine("354 go ahead")
+			if _, err := text.ReadDotBytes(); err != nil {
+				return
+			}
+
+			atomic.AddInt32(&s.messages, 1)
+			_ = text.PrintfLine("250 OK")
+		case "QUIT":
+			_ = text.PrintfLine("221 bye")
+			return
+		default:
+			_ = text.PrintfLine("502 unknown command")
+		}
+	}
+}
+
+func (s *smtpStub) service(t *testing.T) *Service {
+	addr := s.listener.Addr().(*net.TCPAddr)
+	config := &SMTPConfiguration{Host: addr.IP.String(), Port: addr.Port, User: "user", RetryBackoffMs: 1}
+	require.NoError(t, config.Validate())
+	templates, err := parseTemplates()
+	require.NoError(t, err)
+	return &Service{smtp: config, templates: templates}
+}
+
+func TestServiceRetriesTemporaryFailures(t *testing.T) {
+	stub := newSMTPStub(t, 2, 421)
+	require.NoError(t, stub.service(t).SendResetPassword("user@example.com", "https://example.com/reset"))
+	require.Equal(t, int32(3), atomic.LoadInt32(&stub.connections))
+	require.Equal(t, int32(1), atomic.LoadInt32(&stub.messages))
+}
+
+func TestServiceGivesUpOnTemporaryFailures(t *testing.T) {
+	stub := newSMTPStub(t, 3, 421)
+	err := stub.service(t).SendResetPassword("user@example.com", "https://example.com/reset")
+	var sendErr *SendError
+	require.True(t, errors.As(err, &sendErr))
+	require.True(t, sendErr.Temporary())
+	require.Equal(t, int32(3), atomic.LoadInt32(&stub.connections))
+}
+
+func TestServiceDoesNotRetryPermanentFailures(t *testing.T) {
+	stub := newSMTPStub(t, 1, 554)
+	err := stub.service(t).SendResetPassword("user@example.com", "https://example.com/reset")
+	var sendErr *SendError
+	require.True(t, errors.As(err, &sendErr))
+	require.False(t, sendErr.Temporary())
+	require.Equal(t, int32(1), atomic.LoadInt32(&stub.connections))
+}
@@ -21,6 +21,7 @@ type templateValues struct {
 const (
 	resetPassword  templateSubject = "Reset your password for Jitsu - an open-source data collection platform"
 	accountCreated templateSubject = "Your Jitsu account has been created"
+	verifyEmail    templateSubject = "Verify your email for Jitsu - an open-source data collection platform"
 )
 
 func parseTemplates() (map[templateSubject]*template.Template, error) {
@@ -57,5 +58,16 @@ var rawTemplates = map[templateSubject]string{
 	<p>Thanks,</p>
 	<p>{{.Signature}}</p>
 </body>
+</html>`,
+
+	verifyEmail: `<!DOCTYPE html>
+<html>
+<body>
+	<p>Hello and welcome!</p>
+	<p>Follow this <a href='{{.Link}}'>link</a> to verify your email and activate your new Jitsu {{.Email}} account.</p>
+	<p>If you didn't sign up, you can safely ignore this email.</p>
+	<p>Thanks,</p>
+	<p>{{.Signature}}</p>
+</body>
 </html>`,
 }
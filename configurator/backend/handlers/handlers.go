@@ -10,7 +10,17 @@ import (
 
 var (
 	ErrUserExists       = errors.New("User already exists")
+	ErrRefreshExpired   = errors.New("Refresh token is expired")
+	ErrRefreshUnknown   = errors.New("Refresh token is unknown or has already been used")
 	errSSLNotConfigured = errors.New("SSL is not configured in Jitsu configuration")
+
+	// ErrNoChangesRequested is returned for user updates not setting any field.
+	ErrNoChangesRequested = errors.New("No changes requested")
+
+	// ErrMailTransient and ErrMailPermanent classify email sending failures: transient ones (e.g. SMTP outages)
+	// may succeed on retry, while permanent ones (e.g. SMTP misconfiguration) need fixing.
+	ErrMailTransient = errors.New("Email service is temporarily unavailable")
+	ErrMailPermanent = errors.New("Email service failed to send email")
 )
 
 type CreatedUser struct {
@@ -18,6 +28,14 @@ type CreatedUser struct {
 	ResetID string
 }
 
+// SignInOptions tweaks issued token pair.
+type SignInOptions struct {
+	// RememberMe selects a longer-lived refresh token.
+	RememberMe bool
+	// Scopes limit what the issued tokens may access. Empty scopes grant full access.
+	Scopes []string
+}
+
 type SSOSession struct {
 	UserID      string
 	Email       string
@@ -36,6 +54,7 @@ type Authorizator interface {
 type LocalAuthorizator interface {
 	SignUp(ctx context.Context, email, password string) (*openapi.TokensResponse, error)
 	SignIn(ctx context.Context, email, password string) (*openapi.TokensResponse, error)
+	SignInWithOptions(ctx context.Context, email, password string, opts SignInOptions) (*openapi.TokensResponse, error)
 	SignInSSO(ctx context.Context, provider string, session *SSOSession, ttl time.Duration) (*openapi.TokensResponse, error)
 	SignOut(ctx context.Context, accessToken string) error
 	RefreshToken(ctx context.Context, refreshToken string) (*openapi.TokensResponse, error)
@@ -48,6 +67,10 @@ type LocalAuthorizator interface {
 	DeleteUser(ctx context.Context, userID string) error
 	UpdatePassword(ctx context.Context, userID, password string) error
 	GetUserIDByEmail(ctx context.Context, userEmail string) (string, error)
+	ListActiveTokens(ctx context.Context, purgeExpired bool) ([]openapi.TokenSummary, error)
+	ExportUsers(ctx context.Context) ([]openapi.UserExport, error)
+	ImportUsers(ctx context.Context, users []openapi.UserExport) error
+	RotateServerToken(ctx context.Context, newToken string) error
 }
 
 type CloudAuthorizator interface {}
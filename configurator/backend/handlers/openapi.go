@@ -650,7 +650,11 @@ func (oa *OpenAPI) UserPasswordReset(ctx *gin.Context) {
 		mw.RequiredField(ctx, "email")
 	} else if req.Callback == nil || *req.Callback == "" {
 		mw.RequiredField(ctx, "callback")
-	} else if err := authorizator.SendResetPasswordLink(ctx, req.Email, *req.Callback); err != nil {
+	} else if err := authorizator.SendResetPasswordLink(ctx, req.Email, *req.Callback); errors.Is(err, ErrMailTransient) {
+		mw.Error(ctx, http.StatusServiceUnavailable, "Failed to send password reset link", err)
+	} else if errors.Is(err, ErrMailPermanent) {
+		mw.InternalError(ctx, "Failed to send password reset link", err)
+	} else if err != nil {
 		mw.BadRequest(ctx, "Failed to send password reset link", err)
 	} else {
 		mw.StatusOk(ctx)
@@ -671,10 +675,30 @@ func (oa *OpenAPI) UserSignIn(ctx *gin.Context) {
 		mw.RequiredField(ctx, "email")
 	} else if req.Password == "" {
 		mw.RequiredField(ctx, "password")
-	} else if tokenPair, err := authorizator.SignIn(ctx, req.Email, req.Password); err != nil {
+	} else if tokenPair, err := authorizator.SignInWithOptions(ctx, req.Email, req.Password, SignInOptions{
+		RememberMe: req.RememberMe != nil && *req.RememberMe,
+	}); err != nil {
 		mw.Unauthorized(ctx, err)
+	} else if mustChangePassword, err := oa.mustChangePassword(tokenPair.UserId); err != nil {
+		mw.InternalError(ctx, "Failed to load user info", err)
 	} else {
-		ctx.JSON(http.StatusOK, tokenPair)
+		ctx.JSON(http.StatusOK, openapi.SignInResponse{
+			TokensResponse:     *tokenPair,
+			MustChangePassword: mustChangePassword,
+		})
+	}
+}
+
+// mustChangePassword reports whether the user has been forced to change the password by an admin.
+func (oa *OpenAPI) mustChangePassword(userID string) (bool, error) {
+	userInfo, err := oa.Configurations.GetUserInfo(userID)
+	switch {
+	case errors.Is(err, storages.ErrConfigurationNotFound):
+		return false, nil
+	case err != nil:
+		return false, err
+	default:
+		return userInfo.ForcePasswordChange != nil && *userInfo.ForcePasswordChange, nil
 	}
 }
 
@@ -706,8 +730,10 @@ func (oa *OpenAPI) UserAuthorizationTokenRefresh(ctx *gin.Context) {
 		mw.InvalidInputJSON(ctx, err)
 	} else if req.RefreshToken == "" {
 		mw.RequiredField(ctx, "refresh_token")
-	} else if tokenPair, err := authorizator.RefreshToken(ctx, req.RefreshToken); err != nil {
+	} else if tokenPair, err := authorizator.RefreshToken(ctx, req.RefreshToken); errors.Is(err, ErrRefreshExpired) || errors.Is(err, ErrRefreshUnknown) {
 		mw.Unauthorized(ctx, err)
+	} else if err != nil {
+		mw.InternalError(ctx, "Failed to refresh token", err)
 	} else {
 		ctx.JSON(http.StatusOK, tokenPair)
 	}
@@ -1133,6 +1159,64 @@ func (oa *OpenAPI) ListUsers(ctx *gin.Context) {
 	}
 }
 
+func (oa *OpenAPI) ExportUsers(ctx *gin.Context) {
+	if ctx.IsAborted() {
+		return
+	}
+
+	if authorizator, err := oa.Authorizator.Local(); err != nil {
+		mw.Unsupported(ctx, err)
+	} else if users, err := authorizator.ExportUsers(ctx); err != nil {
+		mw.BadRequest(ctx, "Failed to export users", err)
+	} else {
+		ctx.JSON(http.StatusOK, users)
+	}
+}
+
+func (oa *OpenAPI) ImportUsers(ctx *gin.Context) {
+	if ctx.IsAborted() {
+		return
+	}
+
+	authorizator, err := oa.Authorizator.Local()
+	if err != nil {
+		mw.Unsupported(ctx, err)
+		return
+	}
+
+	var req openapi.ImportUsersJSONRequestBody
+	if err := ctx.BindJSON(&req); err != nil {
+		mw.InvalidInputJSON(ctx, err)
+	} else if err := authorizator.ImportUsers(ctx, req); err != nil {
+		mw.BadRequest(ctx, "Failed to import users", err)
+	} else {
+		mw.StatusOk(ctx)
+	}
+}
+
+func (oa *OpenAPI) RotateServerToken(ctx *gin.Context) {
+	if ctx.IsAborted() {
+		return
+	}
+
+	authorizator, err := oa.Authorizator.Local()
+	if err != nil {
+		mw.Unsupported(ctx, err)
+		return
+	}
+
+	var req openapi.RotateServerTokenJSONRequestBody
+	if err := ctx.BindJSON(&req); err != nil {
+		mw.InvalidInputJSON(ctx, err)
+	} else if req.Token == "" {
+		mw.RequiredField(ctx, "token")
+	} else if err := authorizator.RotateServerToken(ctx, req.Token); err != nil {
+		mw.BadRequest(ctx, "Failed to rotate server token", err)
+	} else {
+		mw.StatusOk(ctx)
+	}
+}
+
 func (oa *OpenAPI) CreateNewUser(ctx *gin.Context) {
 	if ctx.IsAborted() {
 		return
@@ -1236,6 +1320,11 @@ func (oa *OpenAPI) UpdateUser(ctx *gin.Context, userID openapi.UserId) {
 		return
 	}
 
+	if req.Password == nil && req.Name == nil && req.ForcePasswordChange == nil && req.PlatformAdmin == nil {
+		mw.BadRequest(ctx, "update user failed", ErrNoChangesRequested)
+		return
+	}
+
 	if req.Password != nil {
 		if authorizator, err := oa.Authorizator.Local(); err != nil {
 			mw.Unsupported(ctx, err)
@@ -1296,6 +1385,21 @@ func (oa *OpenAPI) PurgeAudit(ctx *gin.Context, params openapi.PurgeAuditParams)
 	mw.StatusOk(ctx)
 }
 
+func (oa *OpenAPI) ListActiveTokens(ctx *gin.Context, params openapi.ListActiveTokensParams) {
+	if ctx.IsAborted() {
+		return
+	}
+
+	purgeExpired := params.PurgeExpired != nil && *params.PurgeExpired
+	if authorizator, err := oa.Authorizator.Local(); err != nil {
+		mw.Unsupported(ctx, err)
+	} else if tokens, err := authorizator.ListActiveTokens(ctx, purgeExpired); err != nil {
+		mw.BadRequest(ctx, "Failed to list active tokens", err)
+	} else {
+		ctx.JSON(http.StatusOK, tokens)
+	}
+}
+
 func (oa *OpenAPI) makeUserPlatformAdmin(ctx *gin.Context, userEmail string, authorizator LocalAuthorizator) error {
 	var platformAdmin = true
 
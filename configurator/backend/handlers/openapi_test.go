@@ -0,0 +1,137 @@
+package handlers_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jitsucom/jitsu/configurator/authorization"
+	"github.com/jitsucom/jitsu/configurator/entities"
+	"github.com/jitsucom/jitsu/configurator/handlers"
+	"github.com/jitsucom/jitsu/configurator/middleware"
+	"github.com/jitsucom/jitsu/configurator/openapi"
+	"github.com/jitsucom/jitsu/configurator/storages"
+	"github.com/jitsucom/jitsu/server/meta"
+	"github.com/jitsucom/jitsu/server/test"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// newTestOpenAPI returns OpenAPI backed by Redis authorizator and configurations storage in a flushed test Redis.
+func newTestOpenAPI(t *testing.T) (*handlers.OpenAPI, *authorization.Redis, *storages.Redis) {
+	ctx := context.Background()
+	container, err := test.NewRedisContainer(ctx)
+	require.NoError(t, err)
+	t.Cleanup(container.Close)
+
+	poolFactory := meta.NewRedisPoolFactory(container.Host, container.Port, "", 0, false, "")
+	pool, err := poolFactory.Create()
+	require.NoError(t, err)
+	conn := pool.Get()
+	_, err = conn.Do("FLUSHDB")
+	_ = conn.Close()
+	_ = pool.Close()
+	require.NoError(t, err)
+
+	authorizator, err := authorization.NewRedis(authorization.RedisInit{PoolFactory: poolFactory, BcryptCost: bcrypt.MinCost})
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = authorizator.Close() })
+	storage, err := storages.NewRedis(poolFactory)
+	require.NoError(t, err)
+
+	oa := &handlers.OpenAPI{
+		Authorizator:   authorizator,
+		Configurations: storages.NewConfigurationsService(storage, nil, nil),
+	}
+
+	return oa, authorizator, storage
+}
+
+func TestUserSignInMustChangePassword(t *testing.T) {
+	ctx := context.Background()
+	oa, authorizator, storage := newTestOpenAPI(t)
+
+	router := gin.New()
+	router.POST("/signin", oa.UserSignIn)
+	signIn := func(email string) openapi.SignInResponse {
+		body := `{"email": "` + email + `", "password": "password"}`
+		resp := httptest.NewRecorder()
+		router.ServeHTTP(resp, httptest.NewRequest(http.MethodPost, "/signin", strings.NewReader(body)))
+		require.Equal(t, http.StatusOK, resp.Code, resp.Body.String())
+
+		var result openapi.SignInResponse
+		require.NoError(t, json.Unmarshal(resp.Body.Bytes(), &result))
+		require.NotEmpty(t, result.AccessToken)
+		return result
+	}
+
+	for _, email := range []string{"forced@example.com", "regular@example.com"} {
+		_, err := authorizator.SignUp(ctx, email, "password")
+		require.NoError(t, err)
+	}
+
+	forced, err := authorizator.FindUserIDByEmail(ctx, "forced@example.com")
+	require.NoError(t, err)
+	forcePasswordChange := true
+	data, err := json.Marshal(entities.UserInfo{Uid: forced, ForcePasswordChange: &forcePasswordChange})
+	require.NoError(t, err)
+	require.NoError(t, storage.Store(new(entities.UserInfo).ObjectType(), forced, data))
+
+	require.True(t, signIn("forced@example.com").MustChangePassword)
+	require.False(t, signIn("regular@example.com").MustChangePassword)
+}
+
+func TestUpdateUserNoChanges(t *testing.T) {
+	ctx := context.Background()
+	oa, authorizator, _ := newTestOpenAPI(t)
+
+	tokenPair, err := authorizator.SignUp(ctx, "user@example.com", "password")
+	require.NoError(t, err)
+
+	router := gin.New()
+	router.PATCH("/users/:id", func(ctx *gin.Context) { oa.UpdateUser(ctx, openapi.UserId(ctx.Param("id"))) })
+	for _, body := range []string{`{}`, `{"name": null}`} {
+		resp := httptest.NewRecorder()
+		router.ServeHTTP(resp, httptest.NewRequest(http.MethodPatch, "/users/"+tokenPair.UserId, strings.NewReader(body)))
+		require.Equal(t, http.StatusBadRequest, resp.Code, body)
+		require.Contains(t, resp.Body.String(), handlers.ErrNoChangesRequested.Error(), body)
+	}
+}
+
+func TestRotateServerToken(t *testing.T) {
+	ctx := context.Background()
+	oa, authorizator, _ := newTestOpenAPI(t)
+	require.NoError(t, authorizator.RotateServerToken(ctx, "server-token"))
+
+	interceptor := &middleware.AuthorizationInterceptor{
+		ServerToken:    "configured-token",
+		Authorizator:   authorizator,
+		Configurations: oa.Configurations,
+	}
+
+	router := gin.New()
+	openapi.RegisterHandlersWithOptions(router, oa, openapi.GinServerOptions{
+		Middlewares: []openapi.MiddlewareFunc{interceptor.Intercept},
+	})
+
+	rotate := func(token, newToken string) int {
+		req := httptest.NewRequest(http.MethodPost, "/api/v2/tokens/server", strings.NewReader(`{"token": "`+newToken+`"}`))
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp := httptest.NewRecorder()
+		router.ServeHTTP(resp, req)
+		return resp.Code
+	}
+
+	require.Equal(t, http.StatusUnauthorized, rotate("configured-token", "new-token"))
+	require.Equal(t, http.StatusBadRequest, rotate("server-token", ""))
+	require.Equal(t, http.StatusOK, rotate("server-token", "new-token"))
+	require.Equal(t, http.StatusOK, rotate("new-token", "newest-token"))
+
+	ok, err := authorizator.IsServerToken(ctx, "newest-token")
+	require.NoError(t, err)
+	require.True(t, ok)
+}
@@ -196,7 +196,14 @@ func main() {
 	}
 
 	authorizator, err := newAuthorizator(ctx, viper.GetViper(), emailsService)
-	if err != nil {
+	switch {
+	case errors.Is(err, authorization.ErrRedisAuth):
+		logging.Fatalf("Error creating authorization service: check auth.redis.password: %v", err)
+	case errors.Is(err, authorization.ErrRedisUnreachable):
+		logging.Fatalf("Error creating authorization service: check auth.redis.host and auth.redis.port are reachable: %v", err)
+	case errors.Is(err, authorization.ErrRedisTimeout):
+		logging.Fatalf("Error creating authorization service: Redis did not respond in time, check network and Redis load: %v", err)
+	case err != nil:
 		logging.Fatalf("Error creating authorization service: %v", err)
 	}
 	appconfig.Instance.ScheduleClosing(authorizator)
@@ -273,6 +280,10 @@ func newEmailService(vp *viper.Viper) (*emails.Service, error) {
 			From:      viper.GetString("smtp.from"),
 			Signature: viper.GetString("smtp.signature"),
 			ReplyTo:   viper.GetString("smtp.reply_to"),
+
+			DialTimeoutSeconds: viper.GetInt("smtp.dial_timeout_seconds"),
+			Retries:            viper.GetInt("smtp.retries"),
+			RetryBackoffMs:     viper.GetInt("smtp.retry_backoff_ms"),
 		}
 	} else {
 		return nil, nil
@@ -352,8 +363,13 @@ func newAuthorizator(ctx context.Context, vp *viper.Viper, mailSender authorizat
 		}
 
 		return authorization.NewRedis(authorization.RedisInit{
-			PoolFactory: redisPoolFactory,
-			MailSender:  mailSender,
+			PoolFactory:           redisPoolFactory,
+			MailSender:            mailSender,
+			ServerToken:           vp.GetString("server.auth"),
+			AllowedCallbacks:      vp.GetStringSlice("auth.redis.allowed_callbacks"),
+			AuthorizationCacheTTL: vp.GetDuration("auth.redis.authorization_cache_ttl"),
+			CommandReadTimeout:    vp.GetDuration("auth.redis.read_timeout"),
+			CommandWriteTimeout:   vp.GetDuration("auth.redis.write_timeout"),
 		})
 	} else {
 		return nil, errors.New("Unknown 'auth' section type. Supported: firebase, redis")
@@ -365,7 +381,7 @@ func SetupRouter(jitsuService *jitsu.Service, configurationsService *storages.Co
 	emailService *emails.Service) *gin.Engine {
 	gin.SetMode(gin.ReleaseMode)
 	router := gin.New()
-	router.Use(gin.Recovery(), enmiddleware.GinLogErrorBody)
+	router.Use(gin.Recovery(), middleware.RequestID, enmiddleware.GinLogErrorBody)
 	router.Use(gin.CustomRecovery(func(c *gin.Context, recovered interface{}) {
 		logging.SystemErrorf("Panic on request %s: %v\n%s", c.Request.URL.String(), recovered, string(debug.Stack()))
 		logging.Errorf("%v", *c.Request)
@@ -454,7 +470,11 @@ func SetupRouter(jitsuService *jitsu.Service, configurationsService *storages.Co
 
 	return openapi.RegisterHandlersWithOptions(router, openAPIHandler, openapi.GinServerOptions{
 		BaseURL:     "",
-		Middlewares: []openapi.MiddlewareFunc{authenticatorMiddleware.Intercept, contentChangesMiddleware.IfModifiedSince},
+		Middlewares: []openapi.MiddlewareFunc{
+			authenticatorMiddleware.Intercept,
+			openapi.MiddlewareFunc(middleware.RequireScopeForWrites(middleware.FullAccessScope)),
+			contentChangesMiddleware.IfModifiedSince,
+		},
 	})
 }
 
@@ -4,26 +4,48 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"fmt"
 	"github.com/gin-gonic/gin"
 	"github.com/jitsucom/jitsu/configurator/entities"
 	"github.com/jitsucom/jitsu/configurator/openapi"
 	"github.com/jitsucom/jitsu/server/logging"
 	"github.com/pkg/errors"
 	"io/ioutil"
+	"net/http"
+	"strings"
 )
 
 var (
 	errUnauthorized        = errors.New("unauthorized")
 	errServerTokenMismatch = errors.New("server token mismatch")
+
+	// ErrUnknownToken is returned by Authorizator.Authorize for tokens which have not been issued.
+	ErrUnknownToken = errors.New("unknown token")
 )
 
 const (
 	authorityKey = "__authority"
+
+	// FullAccessScope grants access to every route.
+	FullAccessScope = "full"
+	// ReadOnlyScope grants access to routes which do not modify configuration.
+	ReadOnlyScope = "read"
 )
 
+// KnownScopes lists all scopes which may be assigned to a token.
+var KnownScopes = []string{FullAccessScope, ReadOnlyScope}
+
 type Authorization struct {
 	User    openapi.UserBasicInfo
 	IsAdmin bool
+	// Scopes limit what the token may access. Empty scopes mean full access.
+	Scopes []string
+	// Metadata contains custom token claims, e.g. tenant ID. It is nil for tokens without claims.
+	Metadata map[string]string
+	// Subject is a stable identifier of the authorized user for external services ("sub" claim).
+	// It is the user ID, which never changes unlike the email, so services should key off it.
+	// It is empty for the server token.
+	Subject string
 }
 type ProjectIDBody struct {
 	ProjectID string `json:"project_id"`
@@ -33,7 +55,31 @@ type Authority struct {
 	Token    string
 	IsAdmin  bool
 	Projects map[string]*entities.ProjectPermissions
-	user     *openapi.UserBasicInfo
+	Scopes   []string
+	Metadata map[string]string
+	// Subject is Authorization.Subject of the token. It is empty for the server token.
+	Subject string
+	user    *openapi.UserBasicInfo
+}
+
+// HasScope checks if the authority token has been granted the scope.
+// Unscoped tokens and tokens with FullAccessScope are granted every scope.
+func (a *Authority) HasScope(scope string) bool {
+	return hasScope(a.Scopes, scope)
+}
+
+func hasScope(scopes []string, scope string) bool {
+	if len(scopes) == 0 {
+		return true
+	}
+
+	for _, s := range scopes {
+		if s == FullAccessScope || s == scope {
+			return true
+		}
+	}
+
+	return false
 }
 
 func (a *Authority) Allow(projectID string) bool {
@@ -76,6 +122,18 @@ type Authorizator interface {
 	FindOnlyUser(ctx context.Context) (*openapi.UserBasicInfo, error)
 }
 
+// ServerTokenAuthorizator is implemented by authorizators storing the server token, so that it may be rotated
+// without restarts. AuthorizationInterceptor checks server tokens with it instead of comparing them with ServerToken.
+type ServerTokenAuthorizator interface {
+	IsServerToken(ctx context.Context, token string) (bool, error)
+}
+
+// APIKeyAuthorizator is implemented by authorizators issuing long-lived <key ID>.<secret> API keys.
+// AuthorizationInterceptor falls back to it for such tokens rejected by Authorize with ErrUnknownToken.
+type APIKeyAuthorizator interface {
+	AuthorizeAPIKey(ctx context.Context, key string) (*Authorization, error)
+}
+
 type Configurations interface {
 	UpdateUserInfo(ctx context.Context, id string, patch interface{}) (*entities.UserInfo, error)
 	GetUserProjects(userID string) ([]string, error)
@@ -83,6 +141,7 @@ type Configurations interface {
 }
 
 type AuthorizationInterceptor struct {
+	// ServerToken is the cluster admin token. It is used only if Authorizator is not a ServerTokenAuthorizator.
 	ServerToken    string
 	Authorizator   Authorizator
 	Configurations Configurations
@@ -99,14 +158,18 @@ func (i *AuthorizationInterceptor) Intercept(ctx *gin.Context) {
 	var authority Authority
 	if token := GetToken(ctx); ctx.IsAborted() {
 		return
-	} else if i.ServerToken == token {
+	} else if isServerToken, err := i.isServerToken(ctx, token); err != nil {
+		logging.SystemErrorf("server request [%s] has been denied: failed to check server token: %v", ctx.Request.URL.String(), err)
+		invalidToken(ctx, err)
+		return
+	} else if isServerToken {
 		authority = Authority{
 			Token:   token,
 			IsAdmin: true,
 		}
 
 		if !managementScope {
-			ctx.Set(authorityKey, authority)
+			ctx.Set(authorityKey, &authority)
 			return
 		}
 
@@ -117,15 +180,18 @@ func (i *AuthorizationInterceptor) Intercept(ctx *gin.Context) {
 		logging.SystemErrorf("server request [%s] with [%s] token has been denied: token mismatch", ctx.Request.URL.String(), token)
 		invalidToken(ctx, errServerTokenMismatch)
 		return
-	} else if auth, err := i.Authorizator.Authorize(ctx, token); err != nil {
+	} else if auth, err := i.authorize(ctx, token); err != nil {
 		logging.Errorf("failed to authenticate with token %s: %s", token, err)
 		invalidToken(ctx, err)
 		return
 	} else {
 		authority = Authority{
-			Token:   token,
-			IsAdmin: auth.IsAdmin,
-			user:    &auth.User,
+			Token:    token,
+			Subject:  auth.Subject,
+			IsAdmin:  auth.IsAdmin,
+			Scopes:   auth.Scopes,
+			Metadata: auth.Metadata,
+			user:     &auth.User,
 		}
 	}
 
@@ -162,16 +228,67 @@ func (i *AuthorizationInterceptor) Intercept(ctx *gin.Context) {
 	ctx.Set(authorityKey, &authority)
 }
 
+func (i *AuthorizationInterceptor) isServerToken(ctx context.Context, token string) (bool, error) {
+	if authorizator, ok := i.Authorizator.(ServerTokenAuthorizator); ok {
+		return authorizator.IsServerToken(ctx, token)
+	}
+
+	return i.ServerToken == token, nil
+}
+
+func (i *AuthorizationInterceptor) authorize(ctx context.Context, token string) (*Authorization, error) {
+	auth, err := i.Authorizator.Authorize(ctx, token)
+	if errors.Is(err, ErrUnknownToken) && strings.Contains(token, ".") {
+		if authorizator, ok := i.Authorizator.(APIKeyAuthorizator); ok {
+			return authorizator.AuthorizeAPIKey(ctx, token)
+		}
+	}
+
+	return auth, err
+}
+
 func (i *AuthorizationInterceptor) ManagementWrapper(body gin.HandlerFunc) gin.HandlerFunc {
+	requireScope := RequireScopeForWrites(FullAccessScope)
 	return func(ctx *gin.Context) {
 		ctx.Set(openapi.ConfigurationManagementAuthScopes, "")
 		i.Intercept(ctx)
+		requireScope(ctx)
 		if !ctx.IsAborted() {
 			body(ctx)
 		}
 	}
 }
 
+// RequireScope returns a handler which denies the request if the authority token has not been granted the scope.
+// It must be placed after the authorization interceptor.
+func RequireScope(scope string) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		if authority, err := GetAuthority(ctx); err != nil {
+			Unauthorized(ctx, err)
+		} else if !authority.HasScope(scope) {
+			Forbidden(ctx, fmt.Sprintf("Token does not have %s scope", scope))
+		}
+	}
+}
+
+// RequireScopeForWrites returns a handler which applies RequireScope to requests modifying data, i.e. all but
+// GET, HEAD and OPTIONS ones. Aborted requests and requests to routes without authorization are passed through,
+// so that it may follow the authorization interceptor in middleware chains shared by all routes.
+func RequireScopeForWrites(scope string) gin.HandlerFunc {
+	requireScope := RequireScope(scope)
+	return func(ctx *gin.Context) {
+		if _, ok := ctx.Get(authorityKey); !ok || ctx.IsAborted() {
+			return
+		}
+
+		switch ctx.Request.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+		default:
+			requireScope(ctx)
+		}
+	}
+}
+
 func GetAuthority(ctx context.Context) (*Authority, error) {
 	if value, ok := ctx.Value(authorityKey).(*Authority); !ok {
 		return nil, errUnauthorized
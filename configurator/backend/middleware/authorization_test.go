@@ -0,0 +1,195 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jitsucom/jitsu/configurator/entities"
+	"github.com/jitsucom/jitsu/configurator/openapi"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+type scopedAuthorizator map[string][]string
+
+func (a scopedAuthorizator) Authorize(ctx context.Context, token string) (*Authorization, error) {
+	if scopes, ok := a[token]; ok {
+		return &Authorization{User: openapi.UserBasicInfo{Id: token}, Scopes: scopes}, nil
+	}
+
+	return nil, ErrUnknownToken
+}
+
+func (a scopedAuthorizator) FindOnlyUser(ctx context.Context) (*openapi.UserBasicInfo, error) {
+	return nil, errors.New("not supported")
+}
+
+// rotatedServerTokenAuthorizator stores the server token like Redis authorizator does.
+type rotatedServerTokenAuthorizator struct {
+	scopedAuthorizator
+	serverToken string
+}
+
+func (a rotatedServerTokenAuthorizator) IsServerToken(ctx context.Context, token string) (bool, error) {
+	return a.serverToken == token, nil
+}
+
+// apiKeyAuthorizator accepts API keys besides scoped session tokens.
+type apiKeyAuthorizator struct {
+	scopedAuthorizator
+	apiKeys map[string]string
+}
+
+func (a apiKeyAuthorizator) AuthorizeAPIKey(ctx context.Context, key string) (*Authorization, error) {
+	if userID, ok := a.apiKeys[key]; ok {
+		return &Authorization{User: openapi.UserBasicInfo{Id: userID}, Subject: userID}, nil
+	}
+
+	return nil, errors.New("unknown API key")
+}
+
+type emptyConfigurations struct{}
+
+func (emptyConfigurations) UpdateUserInfo(ctx context.Context, id string, patch interface{}) (*entities.UserInfo, error) {
+	return &entities.UserInfo{}, nil
+}
+
+func (emptyConfigurations) GetUserProjects(userID string) ([]string, error) {
+	return nil, nil
+}
+
+func (emptyConfigurations) GetProjectPermissions(userId, projectId string) (*entities.ProjectPermissions, error) {
+	return nil, errors.New("not found")
+}
+
+func TestRequireScope(t *testing.T) {
+	tests := []struct {
+		name     string
+		scopes   []string
+		expected int
+	}{
+		{"unscoped", nil, http.StatusOK},
+		{"full access", []string{FullAccessScope}, http.StatusOK},
+		{"matching scope", []string{ReadOnlyScope}, http.StatusOK},
+		{"missing scope", []string{"other"}, http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			router := gin.New()
+			router.GET("/", func(c *gin.Context) {
+				c.Set(authorityKey, &Authority{Scopes: tt.scopes})
+			}, RequireScope(ReadOnlyScope), StatusOk)
+
+			resp := httptest.NewRecorder()
+			router.ServeHTTP(resp, httptest.NewRequest(http.MethodGet, "/", nil))
+			require.Equal(t, tt.expected, resp.Code)
+		})
+	}
+
+	router := gin.New()
+	router.GET("/", RequireScope(ReadOnlyScope), StatusOk)
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, httptest.NewRequest(http.MethodGet, "/", nil))
+	require.Equal(t, http.StatusUnauthorized, resp.Code)
+}
+
+func TestManagementWrapperRequiresFullAccessForWrites(t *testing.T) {
+	interceptor := &AuthorizationInterceptor{
+		ServerToken:    "server",
+		Authorizator:   scopedAuthorizator{"read": {ReadOnlyScope}, "full": {FullAccessScope}, "unscoped": nil},
+		Configurations: emptyConfigurations{},
+	}
+
+	router := gin.New()
+	router.Any("/", interceptor.ManagementWrapper(StatusOk))
+
+	tests := []struct {
+		token    string
+		method   string
+		expected int
+	}{
+		{"read", http.MethodGet, http.StatusOK},
+		{"read", http.MethodPost, http.StatusForbidden},
+		{"read", http.MethodDelete, http.StatusForbidden},
+		{"full", http.MethodPost, http.StatusOK},
+		{"unscoped", http.MethodPost, http.StatusOK},
+		{"server", http.MethodPost, http.StatusOK},
+		{"unknown", http.MethodPost, http.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest(tt.method, "/", nil)
+		req.Header.Set("Authorization", "Bearer "+tt.token)
+		resp := httptest.NewRecorder()
+		router.ServeHTTP(resp, req)
+		require.Equal(t, tt.expected, resp.Code, "%s %s", tt.token, tt.method)
+	}
+}
+
+func TestInterceptStoredServerToken(t *testing.T) {
+	interceptor := &AuthorizationInterceptor{
+		ServerToken:    "configured",
+		Authorizator:   rotatedServerTokenAuthorizator{serverToken: "rotated"},
+		Configurations: emptyConfigurations{},
+	}
+
+	router := gin.New()
+	router.GET("/", func(ctx *gin.Context) {
+		ctx.Set(openapi.ClusterAdminAuthScopes, []string{""})
+		interceptor.Intercept(ctx)
+		if !ctx.IsAborted() {
+			StatusOk(ctx)
+		}
+	})
+
+	for token, expected := range map[string]int{"rotated": http.StatusOK, "configured": http.StatusUnauthorized} {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp := httptest.NewRecorder()
+		router.ServeHTTP(resp, req)
+		require.Equal(t, expected, resp.Code, token)
+	}
+}
+
+func TestInterceptAPIKey(t *testing.T) {
+	interceptor := &AuthorizationInterceptor{
+		Authorizator: apiKeyAuthorizator{
+			scopedAuthorizator: scopedAuthorizator{"session": nil},
+			apiKeys:            map[string]string{"key.secret": "user"},
+		},
+		Configurations: emptyConfigurations{},
+	}
+
+	router := gin.New()
+	router.GET("/", interceptor.ManagementWrapper(func(ctx *gin.Context) {
+		authority, err := GetAuthority(ctx)
+		require.NoError(t, err)
+		ctx.String(http.StatusOK, authority.Subject)
+	}))
+
+	tests := []struct {
+		token    string
+		expected int
+		subject  string
+	}{
+		{"key.secret", http.StatusOK, "user"},
+		{"session", http.StatusOK, ""},
+		{"key.wrong", http.StatusUnauthorized, ""},
+		{"key", http.StatusUnauthorized, ""},
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("Authorization", "Bearer "+tt.token)
+		resp := httptest.NewRecorder()
+		router.ServeHTTP(resp, req)
+		require.Equal(t, tt.expected, resp.Code, tt.token)
+		if tt.expected == http.StatusOK {
+			require.Equal(t, tt.subject, resp.Body.String(), tt.token)
+		}
+	}
+}
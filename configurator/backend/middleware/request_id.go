@@ -0,0 +1,43 @@
+package middleware
+
+import (
+	"context"
+	"regexp"
+
+	"github.com/gin-gonic/gin"
+	uuid "github.com/satori/go.uuid"
+)
+
+const (
+	RequestIDHeader = "X-Request-ID"
+
+	// requestIDKey is a string, because gin.Context.Value looks up only string keys in context values.
+	requestIDKey          = "request_id"
+	maxRequestIDHeaderLen = 128
+)
+
+var requestIDRegex = regexp.MustCompile(`^[A-Za-z0-9._-]+$`)
+
+// RequestID puts request ID from X-Request-ID header (or a generated one) to request context and response headers,
+// so that log lines may be correlated with the request.
+func RequestID(c *gin.Context) {
+	requestID := c.GetHeader(RequestIDHeader)
+	if !isValidRequestID(requestID) {
+		requestID = uuid.NewV4().String()
+	}
+
+	c.Set(requestIDKey, requestID)
+	c.Header(RequestIDHeader, requestID)
+	c.Next()
+}
+
+// GetRequestID returns request ID put by RequestID middleware or empty string.
+func GetRequestID(ctx context.Context) string {
+	requestID, _ := ctx.Value(requestIDKey).(string)
+	return requestID
+}
+
+// isValidRequestID prevents log injection via client-provided request IDs.
+func isValidRequestID(requestID string) bool {
+	return len(requestID) <= maxRequestIDHeaderLen && requestIDRegex.MatchString(requestID)
+}
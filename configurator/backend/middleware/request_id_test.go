@@ -0,0 +1,47 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRequestID(t *testing.T) {
+	tests := []struct {
+		name     string
+		header   string
+		expected string
+	}{
+		{"client provided", "abc-123", "abc-123"},
+		{"missing", "", ""},
+		{"log injection", "abc\nfake log line", ""},
+		{"format verbs", "user-1%s%s", ""},
+		{"spaces", "abc def", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var requestID string
+			router := gin.New()
+			router.GET("/", RequestID, func(c *gin.Context) {
+				requestID = GetRequestID(c)
+			})
+
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.Header.Set(RequestIDHeader, tt.header)
+			resp := httptest.NewRecorder()
+			router.ServeHTTP(resp, req)
+
+			require.NotEmpty(t, requestID)
+			require.Equal(t, requestID, resp.Header().Get(RequestIDHeader))
+			if tt.expected != "" {
+				require.Equal(t, tt.expected, requestID)
+			} else {
+				require.NotEqual(t, tt.header, requestID)
+			}
+		})
+	}
+}
@@ -1,10 +1,24 @@
 package events
 
 import (
+	"errors"
+	"fmt"
+	"github.com/hashicorp/go-multierror"
+	"github.com/jitsucom/jitsu/server/geo"
+	"github.com/jitsucom/jitsu/server/jsonutils"
 	"github.com/jitsucom/jitsu/server/timestamp"
+	"strings"
 	"time"
 )
 
+//ErrMissingRequiredField is wrapped by every error returned from CheckRequiredFields
+var ErrMissingRequiredField = errors.New("missing required field")
+
+//MalformedEventnHook is called when eventn_ctx is present, but isn't an object (e.g. a client sent a string there),
+//so that enrichers fall back to flattened eventn_ctx_ fields. key is the enriched eventn_ctx field and actualType
+//is the eventn_ctx value type. It is nil (no logging) by default and must be set before events are processed
+var MalformedEventnHook func(key, actualType string)
+
 const (
 	//SrcKey is a system field
 	SrcKey = "src"
@@ -14,8 +28,36 @@ const (
 	TimeIntervalEnd   = "_interval_end"
 	CollectionIDKey   = "_collection_id"
 	SourceIDKey       = "_source_id"
+	//EventnKey is an event context object. Flattened objects contain its fields with "eventn_ctx_" prefix
+	EventnKey       = "eventn_ctx"
+	EventIDKey      = "event_id"
+	AnonymousIDKey  = "anonymous_id"
+	ProcessingMsKey = "processing_ms"
+	LocationKey     = "location"
+	//SchemaVersionKey is eventn_ctx field of the event schema version set by ingestion config
+	SchemaVersionKey = "schema_version"
+	//ConsentKey is eventn_ctx object of consent categories granted by the user
+	ConsentKey = "consent"
+
+	//ConsentAnalytics and ConsentMarketing are common consent categories
+	ConsentAnalytics = "analytics"
+	ConsentMarketing = "marketing"
+	//PIIConsentCategory is the consent category required for keeping fields stripped by StripPIIWithoutConsent
+	PIIConsentCategory = ConsentAnalytics
 )
 
+//TimeInterval is a time chunk of synchronized data. drivers/base.TimeInterval satisfies it
+type TimeInterval interface {
+	String() string
+	LowerEndpoint() time.Time
+	UpperEndpoint() time.Time
+}
+
+//GeoResolver resolves IP address to geo data. geo.Resolver implementations satisfy it
+type GeoResolver interface {
+	Resolve(ip string) (*geo.Data, error)
+}
+
 // EnrichWithCollection puts collection string to object
 func EnrichWithCollection(object map[string]interface{}, collection string) {
 	object[CollectionIDKey] = collection
@@ -32,3 +74,197 @@ func EnrichWithTimeInterval(object map[string]interface{}, interval string, lowe
 	object[TimeIntervalStart] = timestamp.ToISOFormat(lower)
 	object[TimeIntervalEnd] = timestamp.ToISOFormat(upper)
 }
+
+// EnrichStandard applies EnrichWithEventId, EnrichWithCollection and EnrichWithTimeInterval in one pass
+// resolving eventn_ctx once. Empty eventId and nil interval are ignored
+func EnrichStandard(object map[string]interface{}, eventId, collection string, interval TimeInterval) {
+	if eventId != "" {
+		if eventnCtx, ok := getEventnObject(object, EventIDKey); ok {
+			if _, ok := eventnCtx[EventIDKey]; !ok {
+				eventnCtx[EventIDKey] = eventId
+			}
+		} else if _, ok := object[EventnKey+"_"+EventIDKey]; !ok {
+			object[EventnKey+"_"+EventIDKey] = eventId
+		}
+	}
+
+	object[CollectionIDKey] = collection
+	if interval != nil {
+		EnrichWithTimeInterval(object, interval.String(), interval.LowerEndpoint(), interval.UpperEndpoint())
+	}
+}
+
+// EnrichWithEventId puts event id to eventn_ctx if it isn't set by the client. Empty eventId is ignored
+func EnrichWithEventId(object map[string]interface{}, eventId string) {
+	if eventId == "" {
+		return
+	}
+
+	if _, ok := getEventnValue(object, EventIDKey); !ok {
+		setEventnValue(object, EventIDKey, eventId)
+	}
+}
+
+// EnrichWithAnonymousID puts anonymous id to eventn_ctx if it isn't set by the client. Empty anonID is ignored
+func EnrichWithAnonymousID(object map[string]interface{}, anonID string) {
+	if anonID == "" {
+		return
+	}
+
+	if _, ok := getEventnValue(object, AnonymousIDKey); !ok {
+		setEventnValue(object, AnonymousIDKey, anonID)
+	}
+}
+
+// EnrichWithProcessingTime puts milliseconds elapsed since start to eventn_ctx (overwrites)
+func EnrichWithProcessingTime(object map[string]interface{}, start time.Time) {
+	setEventnValue(object, ProcessingMsKey, time.Since(start).Milliseconds())
+}
+
+// EnrichWithSchemaVersion puts schema version to eventn_ctx (overwrites, because ingestion config is authoritative).
+// Empty version is ignored
+func EnrichWithSchemaVersion(object map[string]interface{}, version string) {
+	if version == "" {
+		return
+	}
+
+	setEventnValue(object, SchemaVersionKey, version)
+}
+
+// EnrichWithConsent puts consent categories to eventn_ctx.consent (overwrites, because consent state tracked
+// on the server is authoritative). Categories absent from consent are removed from the event as well
+func EnrichWithConsent(object map[string]interface{}, consent map[string]bool) {
+	values := make(map[string]interface{}, len(consent))
+	for category, granted := range consent {
+		values[category] = granted
+	}
+
+	if eventnCtx, ok := getEventnObject(object, ConsentKey); ok {
+		eventnCtx[ConsentKey] = values
+		return
+	}
+
+	prefix := EventnKey + "_" + ConsentKey + "_"
+	for key := range object {
+		if strings.HasPrefix(key, prefix) {
+			delete(object, key)
+		}
+	}
+
+	for category, granted := range values {
+		object[prefix+category] = granted
+	}
+}
+
+// StripPIIWithoutConsent removes fields (JSON paths, e.g. /user/email) from the event unless PIIConsentCategory
+// consent is granted in eventn_ctx. Events without consent state are treated as non-consenting
+func StripPIIWithoutConsent(object map[string]interface{}, piiFields []string) {
+	if granted, _ := getConsent(object, PIIConsentCategory); granted {
+		return
+	}
+
+	for _, field := range piiFields {
+		jsonutils.NewJSONPath(field).GetAndRemove(object)
+	}
+}
+
+// getConsent returns consent category value from eventn_ctx.consent object or flattened eventn_ctx_consent_ fields.
+// The second value is false if the category is absent
+func getConsent(object map[string]interface{}, category string) (bool, bool) {
+	if consent, ok := getEventnValue(object, ConsentKey); ok {
+		if categories, ok := consent.(map[string]interface{}); ok {
+			granted, ok := categories[category].(bool)
+			return granted, ok
+		}
+	}
+
+	granted, ok := object[EventnKey+"_"+ConsentKey+"_"+category].(bool)
+	return granted, ok
+}
+
+// EnrichWithGeo puts country, region and city resolved from ip to eventn_ctx.location (overwrites).
+// Empty ip, resolver errors and empty results are ignored, so that the event is still processed
+func EnrichWithGeo(object map[string]interface{}, ip string, resolver GeoResolver) {
+	if ip == "" || resolver == nil {
+		return
+	}
+
+	data, err := resolver.Resolve(ip)
+	if err != nil || data == nil {
+		return
+	}
+
+	location := make(map[string]interface{})
+	for key, value := range map[string]string{"country": data.Country, "region": data.Region, "city": data.City} {
+		if value != "" {
+			location[key] = value
+		}
+	}
+
+	if len(location) == 0 {
+		return
+	}
+
+	if eventnCtx, ok := getEventnObject(object, LocationKey); ok {
+		eventnCtx[LocationKey] = location
+	} else {
+		for key, value := range location {
+			object[EventnKey+"_"+LocationKey+"_"+key] = value
+		}
+	}
+}
+
+// CheckRequiredFields returns an error listing all required eventn_ctx fields which are absent or null
+// both in eventn_ctx object and in flattened eventn_ctx_ fields. Returns nil if all fields are present
+func CheckRequiredFields(object map[string]interface{}, required []string) error {
+	var result *multierror.Error
+	for _, key := range required {
+		if value, ok := getEventnValue(object, key); ok && value != nil {
+			continue
+		}
+
+		if value, ok := object[EventnKey+"_"+key]; ok && value != nil {
+			continue
+		}
+
+		result = multierror.Append(result, fmt.Errorf("%w: %s", ErrMissingRequiredField, key))
+	}
+
+	return result.ErrorOrNil()
+}
+
+// getEventnValue returns eventn_ctx.key value if eventn_ctx is an object or eventn_ctx_key value otherwise
+func getEventnValue(object map[string]interface{}, key string) (interface{}, bool) {
+	if eventnCtx, ok := object[EventnKey].(map[string]interface{}); ok {
+		value, ok := eventnCtx[key]
+		return value, ok
+	}
+
+	value, ok := object[EventnKey+"_"+key]
+	return value, ok
+}
+
+// setEventnValue puts value to eventn_ctx.key if eventn_ctx is an object or to eventn_ctx_key otherwise
+func setEventnValue(object map[string]interface{}, key string, value interface{}) {
+	if eventnCtx, ok := getEventnObject(object, key); ok {
+		eventnCtx[key] = value
+	} else {
+		object[EventnKey+"_"+key] = value
+	}
+}
+
+// getEventnObject returns eventn_ctx object for enriching it with key.
+// eventn_ctx of other types is reported to MalformedEventnHook
+func getEventnObject(object map[string]interface{}, key string) (map[string]interface{}, bool) {
+	value, ok := object[EventnKey]
+	if !ok {
+		return nil, false
+	}
+
+	eventnCtx, ok := value.(map[string]interface{})
+	if !ok && MalformedEventnHook != nil {
+		MalformedEventnHook(key, fmt.Sprintf("%T", value))
+	}
+
+	return eventnCtx, ok
+}
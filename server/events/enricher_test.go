@@ -0,0 +1,376 @@
+package events
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jitsucom/jitsu/server/geo"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEnrichWithAnonymousID(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    map[string]interface{}
+		anonID   string
+		expected map[string]interface{}
+	}{
+		{
+			"nested eventn_ctx",
+			map[string]interface{}{"eventn_ctx": map[string]interface{}{"event_id": "1"}},
+			"anon1",
+			map[string]interface{}{"eventn_ctx": map[string]interface{}{"event_id": "1", "anonymous_id": "anon1"}},
+		},
+		{
+			"flat eventn_ctx",
+			map[string]interface{}{"eventn_ctx_event_id": "1"},
+			"anon1",
+			map[string]interface{}{"eventn_ctx_event_id": "1", "eventn_ctx_anonymous_id": "anon1"},
+		},
+		{
+			"client value wins in nested eventn_ctx",
+			map[string]interface{}{"eventn_ctx": map[string]interface{}{"anonymous_id": "client"}},
+			"anon1",
+			map[string]interface{}{"eventn_ctx": map[string]interface{}{"anonymous_id": "client"}},
+		},
+		{
+			"client value wins in flat eventn_ctx",
+			map[string]interface{}{"eventn_ctx_anonymous_id": "client"},
+			"anon1",
+			map[string]interface{}{"eventn_ctx_anonymous_id": "client"},
+		},
+		{
+			"empty anonymous id",
+			map[string]interface{}{"eventn_ctx": map[string]interface{}{}},
+			"",
+			map[string]interface{}{"eventn_ctx": map[string]interface{}{}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			EnrichWithAnonymousID(tt.input, tt.anonID)
+			require.Equal(t, tt.expected, tt.input)
+		})
+	}
+}
+
+type timeIntervalMock struct {
+	lower, upper time.Time
+}
+
+func (ti *timeIntervalMock) String() string           { return "DAY" }
+func (ti *timeIntervalMock) LowerEndpoint() time.Time { return ti.lower }
+func (ti *timeIntervalMock) UpperEndpoint() time.Time { return ti.upper }
+
+func TestEnrichStandard(t *testing.T) {
+	interval := &timeIntervalMock{lower: time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC), upper: time.Date(2022, 1, 2, 0, 0, 0, 0, time.UTC)}
+	inputs := map[string]func() map[string]interface{}{
+		"nested eventn_ctx": func() map[string]interface{} {
+			return map[string]interface{}{"eventn_ctx": map[string]interface{}{"anonymous_id": "anon1"}}
+		},
+		"flat eventn_ctx": func() map[string]interface{} {
+			return map[string]interface{}{"eventn_ctx_anonymous_id": "anon1"}
+		},
+		"client value wins in nested eventn_ctx": func() map[string]interface{} {
+			return map[string]interface{}{"eventn_ctx": map[string]interface{}{"event_id": "client"}}
+		},
+		"client value wins in flat eventn_ctx": func() map[string]interface{} {
+			return map[string]interface{}{"eventn_ctx_event_id": "client", "_collection_id": "stale"}
+		},
+		"malformed eventn_ctx": func() map[string]interface{} {
+			return map[string]interface{}{"eventn_ctx": "malformed"}
+		},
+	}
+	for name, input := range inputs {
+		t.Run(name, func(t *testing.T) {
+			expected := input()
+			EnrichWithEventId(expected, "event1")
+			EnrichWithCollection(expected, "collection")
+			EnrichWithTimeInterval(expected, interval.String(), interval.LowerEndpoint(), interval.UpperEndpoint())
+
+			actual := input()
+			EnrichStandard(actual, "event1", "collection", interval)
+			require.Equal(t, expected, actual)
+		})
+	}
+
+	object := map[string]interface{}{"eventn_ctx": map[string]interface{}{}}
+	EnrichStandard(object, "", "collection", nil)
+	require.Equal(t, map[string]interface{}{"eventn_ctx": map[string]interface{}{}, "_collection_id": "collection"}, object)
+}
+
+func BenchmarkEnrichSequential(b *testing.B) {
+	interval := &timeIntervalMock{lower: time.Now(), upper: time.Now().Add(time.Hour)}
+	for i := 0; i < b.N; i++ {
+		object := map[string]interface{}{"eventn_ctx": map[string]interface{}{"anonymous_id": "anon1"}}
+		EnrichWithEventId(object, "event1")
+		EnrichWithCollection(object, "collection")
+		EnrichWithTimeInterval(object, interval.String(), interval.LowerEndpoint(), interval.UpperEndpoint())
+	}
+}
+
+func BenchmarkEnrichStandard(b *testing.B) {
+	interval := &timeIntervalMock{lower: time.Now(), upper: time.Now().Add(time.Hour)}
+	for i := 0; i < b.N; i++ {
+		object := map[string]interface{}{"eventn_ctx": map[string]interface{}{"anonymous_id": "anon1"}}
+		EnrichStandard(object, "event1", "collection", interval)
+	}
+}
+
+func TestEnrichWithProcessingTime(t *testing.T) {
+	object := map[string]interface{}{"eventn_ctx": map[string]interface{}{"processing_ms": "stale"}}
+	EnrichWithProcessingTime(object, time.Now().Add(-time.Second))
+
+	processingMs, ok := object["eventn_ctx"].(map[string]interface{})["processing_ms"].(int64)
+	require.True(t, ok, "processing_ms must be numeric")
+	require.GreaterOrEqual(t, processingMs, int64(1000))
+
+	object = map[string]interface{}{}
+	EnrichWithProcessingTime(object, time.Now())
+
+	processingMs, ok = object["eventn_ctx_processing_ms"].(int64)
+	require.True(t, ok, "eventn_ctx_processing_ms must be numeric")
+	require.GreaterOrEqual(t, processingMs, int64(0))
+}
+
+func TestEnrichWithSchemaVersion(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    map[string]interface{}
+		version  string
+		expected map[string]interface{}
+	}{
+		{
+			"nested eventn_ctx",
+			map[string]interface{}{"eventn_ctx": map[string]interface{}{"schema_version": "client"}},
+			"2",
+			map[string]interface{}{"eventn_ctx": map[string]interface{}{"schema_version": "2"}},
+		},
+		{
+			"flat eventn_ctx",
+			map[string]interface{}{"eventn_ctx_event_id": "1"},
+			"2",
+			map[string]interface{}{"eventn_ctx_event_id": "1", "eventn_ctx_schema_version": "2"},
+		},
+		{
+			"empty version",
+			map[string]interface{}{"eventn_ctx_schema_version": "1"},
+			"",
+			map[string]interface{}{"eventn_ctx_schema_version": "1"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			EnrichWithSchemaVersion(tt.input, tt.version)
+			require.Equal(t, tt.expected, tt.input)
+		})
+	}
+}
+
+func TestMalformedEventnHook(t *testing.T) {
+	var reported []string
+	MalformedEventnHook = func(key, actualType string) {
+		reported = append(reported, key+":"+actualType)
+	}
+	defer func() { MalformedEventnHook = nil }()
+
+	object := map[string]interface{}{"eventn_ctx": "malformed"}
+	EnrichWithAnonymousID(object, "anon1")
+	EnrichWithProcessingTime(object, time.Now())
+	EnrichWithSchemaVersion(object, "2")
+	require.Equal(t, []string{"anonymous_id:string", "processing_ms:string", "schema_version:string"}, reported)
+	require.Equal(t, "anon1", object["eventn_ctx_anonymous_id"], "enrichers fall back to flat fields")
+
+	reported = nil
+	EnrichWithSchemaVersion(map[string]interface{}{"eventn_ctx": map[string]interface{}{}}, "2")
+	EnrichWithSchemaVersion(map[string]interface{}{"eventn_ctx_event_id": "1"}, "2")
+	require.Empty(t, reported, "objects and flat fields are not reported")
+
+	MalformedEventnHook = nil
+	EnrichWithSchemaVersion(map[string]interface{}{"eventn_ctx": 1}, "2")
+}
+
+func TestEnrichWithConsent(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    map[string]interface{}
+		consent  map[string]bool
+		expected map[string]interface{}
+	}{
+		{
+			"nested eventn_ctx",
+			map[string]interface{}{"eventn_ctx": map[string]interface{}{"event_id": "1", "consent": map[string]interface{}{"ads": true}}},
+			map[string]bool{"analytics": true, "marketing": false},
+			map[string]interface{}{"eventn_ctx": map[string]interface{}{"event_id": "1", "consent": map[string]interface{}{"analytics": true, "marketing": false}}},
+		},
+		{
+			"flat eventn_ctx",
+			map[string]interface{}{"eventn_ctx_event_id": "1", "eventn_ctx_consent_ads": true},
+			map[string]bool{"analytics": true, "marketing": false},
+			map[string]interface{}{"eventn_ctx_event_id": "1", "eventn_ctx_consent_analytics": true, "eventn_ctx_consent_marketing": false},
+		},
+		{
+			"empty consent",
+			map[string]interface{}{"eventn_ctx": map[string]interface{}{"consent": map[string]interface{}{"analytics": true}}},
+			nil,
+			map[string]interface{}{"eventn_ctx": map[string]interface{}{"consent": map[string]interface{}{}}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			EnrichWithConsent(tt.input, tt.consent)
+			require.Equal(t, tt.expected, tt.input)
+		})
+	}
+}
+
+func TestStripPIIWithoutConsent(t *testing.T) {
+	piiFields := []string{"/user/email", "ip"}
+	tests := []struct {
+		name     string
+		consent  map[string]bool
+		nested   bool
+		expected map[string]interface{}
+	}{
+		{
+			"consented nested eventn_ctx",
+			map[string]bool{"analytics": true},
+			true,
+			map[string]interface{}{"user": map[string]interface{}{"id": "u1", "email": "user@example.com"}, "ip": "1.1.1.1"},
+		},
+		{
+			"consented flat eventn_ctx",
+			map[string]bool{"analytics": true, "marketing": false},
+			false,
+			map[string]interface{}{"user": map[string]interface{}{"id": "u1", "email": "user@example.com"}, "ip": "1.1.1.1"},
+		},
+		{
+			"not consented nested eventn_ctx",
+			map[string]bool{"analytics": false, "marketing": true},
+			true,
+			map[string]interface{}{"user": map[string]interface{}{"id": "u1"}},
+		},
+		{
+			"not consented flat eventn_ctx",
+			map[string]bool{"analytics": false},
+			false,
+			map[string]interface{}{"user": map[string]interface{}{"id": "u1"}},
+		},
+		{
+			"no consent state",
+			nil,
+			false,
+			map[string]interface{}{"user": map[string]interface{}{"id": "u1"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			object := map[string]interface{}{"user": map[string]interface{}{"id": "u1", "email": "user@example.com"}, "ip": "1.1.1.1"}
+			if tt.nested {
+				object[EventnKey] = map[string]interface{}{}
+			}
+
+			if tt.consent != nil {
+				EnrichWithConsent(object, tt.consent)
+			}
+
+			StripPIIWithoutConsent(object, piiFields)
+			for key := range object {
+				if key == EventnKey || strings.HasPrefix(key, EventnKey+"_") {
+					delete(object, key)
+				}
+			}
+
+			require.Equal(t, tt.expected, object)
+		})
+	}
+}
+
+func TestCheckRequiredFields(t *testing.T) {
+	required := []string{"event_id", "anonymous_id", "user_agent"}
+
+	require.NoError(t, CheckRequiredFields(map[string]interface{}{
+		"eventn_ctx": map[string]interface{}{"event_id": "1", "anonymous_id": "anon1", "user_agent": "ua"},
+	}, required))
+	require.NoError(t, CheckRequiredFields(map[string]interface{}{
+		"eventn_ctx_event_id": "1", "eventn_ctx_anonymous_id": "anon1", "eventn_ctx_user_agent": "ua",
+	}, required))
+	require.NoError(t, CheckRequiredFields(map[string]interface{}{
+		"eventn_ctx":            map[string]interface{}{"event_id": "1", "anonymous_id": "anon1"},
+		"eventn_ctx_user_agent": "ua",
+	}, required), "flat fields complement eventn_ctx object")
+	require.NoError(t, CheckRequiredFields(map[string]interface{}{}, nil))
+
+	err := CheckRequiredFields(map[string]interface{}{
+		"eventn_ctx": map[string]interface{}{"event_id": "1", "anonymous_id": nil},
+	}, required)
+	require.ErrorIs(t, err, ErrMissingRequiredField)
+	require.Contains(t, err.Error(), "anonymous_id")
+	require.Contains(t, err.Error(), "user_agent")
+	require.NotContains(t, err.Error(), "event_id")
+}
+
+type geoResolverMock map[string]*geo.Data
+
+func (m geoResolverMock) Resolve(ip string) (*geo.Data, error) {
+	if data, ok := m[ip]; ok {
+		return data, nil
+	}
+
+	return nil, errors.New("unknown ip")
+}
+
+func TestEnrichWithGeo(t *testing.T) {
+	resolver := geoResolverMock{
+		"10.0.0.1": {Country: "US", Region: "CA", City: "San Francisco", Lat: 37.7},
+		"10.0.0.2": {},
+	}
+
+	tests := []struct {
+		name     string
+		input    map[string]interface{}
+		ip       string
+		expected map[string]interface{}
+	}{
+		{
+			"nested eventn_ctx",
+			map[string]interface{}{"eventn_ctx": map[string]interface{}{"event_id": "1"}},
+			"10.0.0.1",
+			map[string]interface{}{"eventn_ctx": map[string]interface{}{"event_id": "1",
+				"location": map[string]interface{}{"country": "US", "region": "CA", "city": "San Francisco"}}},
+		},
+		{
+			"flat eventn_ctx",
+			map[string]interface{}{"eventn_ctx_event_id": "1"},
+			"10.0.0.1",
+			map[string]interface{}{"eventn_ctx_event_id": "1", "eventn_ctx_location_country": "US",
+				"eventn_ctx_location_region": "CA", "eventn_ctx_location_city": "San Francisco"},
+		},
+		{
+			"empty ip",
+			map[string]interface{}{"eventn_ctx": map[string]interface{}{}},
+			"",
+			map[string]interface{}{"eventn_ctx": map[string]interface{}{}},
+		},
+		{
+			"resolver error",
+			map[string]interface{}{"eventn_ctx": map[string]interface{}{}},
+			"10.0.0.3",
+			map[string]interface{}{"eventn_ctx": map[string]interface{}{}},
+		},
+		{
+			"empty result",
+			map[string]interface{}{"eventn_ctx_event_id": "1"},
+			"10.0.0.2",
+			map[string]interface{}{"eventn_ctx_event_id": "1"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			EnrichWithGeo(tt.input, tt.ip, resolver)
+			require.Equal(t, tt.expected, tt.input)
+		})
+	}
+}
@@ -136,7 +136,7 @@ func (rpf *RedisPoolFactory) Create() (*RedisPool, error) {
 
 	if err != nil {
 		_ = poolToRedis.Close()
-		return nil, fmt.Errorf("testing Redis connection during %s: %v", rpf.options.PingTimeout, err)
+		return nil, fmt.Errorf("testing Redis connection during %s: %w", rpf.options.PingTimeout, err)
 	}
 
 	return &RedisPool{
@@ -0,0 +1,25 @@
+package ipc
+
+import (
+	"context"
+	"strings"
+)
+
+// CorrelationIDKey is the context key of the upstream request ID which is included in exchange log lines.
+// It is a string, because gin.Context.Value looks up only string keys, and it matches the key
+// of the configurator RequestID middleware, so that gin request contexts may be passed to exchanges as is.
+const CorrelationIDKey = "request_id"
+
+// WithCorrelationID returns a context carrying the correlation ID for callers outside of HTTP handlers.
+func WithCorrelationID(ctx context.Context, correlationID string) context.Context {
+	return context.WithValue(ctx, CorrelationIDKey, correlationID)
+}
+
+// withCorrelationID prefixes log format with the correlation ID from the context if there is one.
+func withCorrelationID(ctx context.Context, format string) string {
+	if correlationID, _ := ctx.Value(CorrelationIDKey).(string); correlationID != "" {
+		return "[request_id: " + strings.ReplaceAll(correlationID, "%", "%%") + "] " + format
+	}
+
+	return format
+}
@@ -1,18 +1,41 @@
 package ipc
 
 import (
+	"bytes"
 	"context"
 	"fmt"
 	"go.uber.org/atomic"
 	"io"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/jitsucom/jitsu/server/logging"
+	"github.com/jitsucom/jitsu/server/safego"
 	"github.com/pkg/errors"
 )
 
 var ErrOutOfMemory = errors.New("out of memory")
 
+const defaultInitTimeout = 10 * time.Second
+
+// ErrOverloaded is returned by Exchange when too many callers are already waiting for the process.
+var ErrOverloaded = errors.New("process is overloaded")
+
+// AppError describes an application-level error (e.g. user code failure reported by the script)
+// which does not mean that the process is dead. Governor returns it as is without respawning the process.
+type AppError struct {
+	Err error
+}
+
+func (e *AppError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *AppError) Unwrap() error {
+	return e.Err
+}
+
 // Interface describes generic IPC interface.
 type Interface interface {
 
@@ -25,6 +48,13 @@ type Interface interface {
 	Receive(ctx context.Context, listener DataListener) ([]byte, error)
 }
 
+// MetaSender is implemented by processes which can pass request metadata separately from the payload.
+type MetaSender interface {
+
+	// SendWithMeta sends a message to the process along with metadata.
+	SendWithMeta(ctx context.Context, data []byte, meta map[string]string) error
+}
+
 // Process describes a process with no acquired state (except for the initial state acquired on start)
 // which can be restarted (respawned) with no data or other loss. Process instance should not be started manually –
 // instead, it should contain all that is necessary to start the process and be supplied to Govern function.
@@ -42,37 +72,571 @@ type Process interface {
 
 	// Wait waits for the current process to exit. Returns stderr output if present
 	Wait() (string, error)
+
+	// PID returns the OS process ID of the current running process.
+	// It returns false if the process has no PID, e.g. when it is not an OS process or has not been started.
+	PID() (int, bool)
+}
+
+// Snapshotter is implemented by processes with expensive initialization (e.g. loading large lookup tables),
+// so that respawns restore the initialized state instead of paying for initialization again.
+//
+// Governor takes a snapshot right after the process is spawned, before any exchange, and keeps it in memory
+// for the Governor lifetime. The snapshot is opaque to Governor: its format is up to the process, but it must
+// contain everything Restore needs and must be restorable by any process created from the same
+// configuration (script version, settings). It must not depend on exchange state, since it is never refreshed.
+type Snapshotter interface {
+
+	// Snapshot returns the serialized state of the initialized process.
+	Snapshot() ([]byte, error)
+
+	// Restore starts a new process copy from the snapshot skipping initialization, like Spawn does otherwise.
+	// Governor falls back to the cold spawn if it fails.
+	Restore(snapshot []byte) (Process, error)
+}
+
+// ExchangeResult is the response of Governor.ExchangeDetailed along with the identity of the process which served it.
+type ExchangeResult struct {
+	Data []byte
+
+	// Respawns is the number of times the process died and was respawned during the exchange.
+	Respawns int
+
+	// Process is the String() of the process which served the exchange.
+	Process string
+
+	// PID is the OS process ID of the process which served the exchange. It is zero if the process has no PID.
+	PID int
+}
+
+// ProcessFactory starts a new process. Governor calls it for the initial spawn and for every respawn.
+type ProcessFactory func() (Process, error)
+
+// GovernorOptions configures optional Governor behavior. Zero value means defaults.
+type GovernorOptions struct {
+	// LargeProcess handles payloads larger than LargePayloadThreshold bytes, so that big batches
+	// do not put memory pressure on the main process. It may be configured with different resource limits.
+	// It is spawned along with the main process and governed separately.
+	LargeProcess          Process
+	LargePayloadThreshold int
+
+	// IdleTimeout makes Governor kill the process after no exchanges during this period.
+	// The process is respawned on the next exchange. Zero value means the process is never killed when idle.
+	IdleTimeout time.Duration
+
+	// MaxQueueDepth makes Exchange and ExchangeDirect fail fast with ErrOverloaded when that many callers
+	// are already waiting for the process, so that load can be shed upstream. Zero value means no limit.
+	MaxQueueDepth int
+
+	// Quota limits running processes of governors sharing it, see Supervisor.GovernTenant.
+	// Nil value means no limit.
+	Quota *ProcessQuota
+
+	// WarmStandby makes Governor keep a spare process spawned in the background, so that a dead process
+	// is replaced with it instantly instead of waiting for the cold start. A new standby is spawned
+	// asynchronously after each promotion. It costs an extra idle process (and a Quota slot) per Governor.
+	WarmStandby bool
+
+	// InitPayload is sent to every spawned process, including respawned and standby ones, before any exchange,
+	// e.g. script configuration or lookup tables, so that all processes are initialized identically.
+	// The spawn fails if the process does not respond within InitTimeout (10 seconds by default) or responds
+	// with anything but InitAck, unless InitAck is nil, which accepts any response. Processes restored from
+	// a snapshot are not initialized again, since the snapshot is taken after initialization. Nil value disables it.
+	InitPayload []byte
+	InitAck     []byte
+	InitTimeout time.Duration
 }
 
 // Governor is responsible for keeping the Process alive.
 // It will restart the process if it dies.
 type Governor struct {
+	factory    ProcessFactory
 	process    Process
 	mu         Mutex
 	standalone bool
 	closed     *atomic.Bool
+	stats      *stats
+	logs       *logBroadcaster
+
+	// current publishes process for reading without lock, e.g. by PID during a wedged exchange.
+	current atomic.Value
+
+	// logTee is set if processes implement LogTee. It is decided on start, since all processes come from the factory.
+	logTee bool
+
+	// latency of exchanges served by the process excluding respawns.
+	latency latencyHistogram
+
+	waiting       *atomic.Int32
+	maxQueueDepth int
+
+	large          *Governor
+	largeThreshold int
+
+	// snapshot of the initialized process state if the process implements Snapshotter. Guarded by mu.
+	snapshot []byte
+
+	// quota slot is held by the running process while quotaHeld is set.
+	quota     *ProcessQuota
+	quotaHeld *atomic.Bool
+
+	// standby is the spare process if WarmStandby is enabled. Guarded by standbyMu, so that it is
+	// replenished in the background without waiting for exchanges.
+	warmStandby     bool
+	standbyMu       sync.Mutex
+	standby         Process
+	standbySpawning bool
+
+	// idle is set when the process has been killed by idle timeout. Guarded by mu along with lastExchange.
+	idle         bool
+	lastExchange time.Time
+	stopReaper   context.CancelFunc
 }
 
 // Govern starts the process and passes it to Governor instance.
 func Govern(process Process, standalone bool) (*Governor, error) {
-	process, err := process.Spawn()
+	return GovernWithOptions(process, standalone, GovernorOptions{})
+}
+
+// GovernWithOptions starts the process and passes it to Governor instance configured with options.
+func GovernWithOptions(process Process, standalone bool, options GovernorOptions) (*Governor, error) {
+	return GovernFactory(process.Spawn, standalone, options)
+}
+
+// GovernFactory starts a process with the factory and passes it to Governor instance configured with options.
+// Respawned processes are created with the factory as well.
+func GovernFactory(factory ProcessFactory, standalone bool, options GovernorOptions) (*Governor, error) {
+	var large *Governor
+	if options.LargeProcess != nil {
+		if options.LargePayloadThreshold <= 0 {
+			return nil, errors.New("large payload threshold must be positive")
+		}
+
+		var err error
+		largeOptions := GovernorOptions{
+			MaxQueueDepth: options.MaxQueueDepth,
+			Quota:         options.Quota,
+			InitPayload:   options.InitPayload,
+			InitAck:       options.InitAck,
+			InitTimeout:   options.InitTimeout,
+		}
+
+		if large, err = GovernWithOptions(options.LargeProcess, standalone, largeOptions); err != nil {
+			return nil, errors.Wrap(err, "govern large process")
+		}
+	}
+
+	// spawned processes stream output to subscribers if supported
+	logs := newLogBroadcaster()
+	spawn := func() (Process, error) {
+		process, err := factory()
+		if err != nil {
+			return nil, err
+		}
+
+		teeLogs(process, logs)
+		if err := initProcess(process, options); err != nil {
+			process.Kill()
+			return nil, errors.Wrapf(err, "init %s", process)
+		}
+
+		return process, nil
+	}
+
+	process, err := spawnWithQuota(spawn, options.Quota)
 	if err != nil {
+		if large != nil {
+			_ = large.Close()
+		}
+
 		return nil, errors.Wrap(err, "spawn")
 	}
 
+	stats := new(stats)
+	stats.spawned()
+
 	logging.Debugf("%s started successfully", process)
-	return &Governor{process: process, standalone: standalone, closed: atomic.NewBool(false)}, nil
+	g := &Governor{
+		factory:        spawn,
+		standalone:     standalone,
+		closed:         atomic.NewBool(false),
+		stats:          stats,
+		logs:           logs,
+		logTee:         isLogTee(process),
+		waiting:        atomic.NewInt32(0),
+		maxQueueDepth:  options.MaxQueueDepth,
+		large:          large,
+		largeThreshold: options.LargePayloadThreshold,
+		quota:          options.Quota,
+		quotaHeld:      atomic.NewBool(true),
+		warmStandby:    options.WarmStandby,
+		lastExchange:   time.Now(),
+		stopReaper:     func() {},
+	}
+
+	g.setProcess(process)
+	g.takeSnapshot(process)
+	g.spawnStandby()
+	if options.IdleTimeout > 0 {
+		ctx, cancel := context.WithCancel(context.Background())
+		g.stopReaper = cancel
+		safego.Run(func() { g.reapIdle(ctx, options.IdleTimeout) })
+	}
+
+	return g, nil
+}
+
+// processRef wraps processes stored in Governor.current, since atomic.Value requires values of the same type.
+type processRef struct {
+	Process
+}
+
+// setProcess replaces the running process. Must be called under lock.
+func (g *Governor) setProcess(process Process) {
+	g.process = process
+	g.current.Store(processRef{process})
+}
+
+// currentProcess returns the running process without waiting for the lock.
+func (g *Governor) currentProcess() Process {
+	return g.current.Load().(processRef).Process
+}
+
+// reapIdle kills the process when there are no exchanges for idleTimeout.
+func (g *Governor) reapIdle(ctx context.Context, idleTimeout time.Duration) {
+	ticker := time.NewTicker(idleTimeout / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		// busy process is not idle
+		unlock, ok := g.mu.TryLock()
+		if !ok {
+			continue
+		}
+
+		if !g.idle && !g.closed.Load() && time.Since(g.lastExchange) >= idleTimeout {
+			logging.Debugf("%s is idle for %s, killing", g.process, idleTimeout)
+			g.process.Kill()
+			_, _ = g.process.Wait()
+			g.releaseQuota()
+			g.killStandby()
+			g.idle = true
+		}
+
+		unlock()
+	}
+}
+
+// wake respawns the process killed by idle timeout. Must be called under lock.
+func (g *Governor) wake() error {
+	if !g.idle {
+		return nil
+	}
+
+	process, err := g.respawn()
+	if err != nil {
+		return errors.Wrap(err, "respawn idle process")
+	}
+
+	g.stats.spawned()
+	logging.Debugf("%s respawned after idle as %s", g.process, process)
+	g.setProcess(process)
+	g.idle = false
+	return nil
+}
+
+// respawn creates a process in place of the dead or idle one. The warm standby is promoted if it is ready,
+// otherwise the process is restored from the snapshot if possible or spawned from scratch.
+// The dead process quota slot is handed over to the new one, so that other spawns can't take it meanwhile,
+// while idle processes have released their slots and take a new one. Must be called under lock.
+func (g *Governor) respawn() (Process, error) {
+	defer g.spawnStandby()
+	if standby := g.takeStandby(); standby != nil {
+		// the standby has a slot of its own
+		g.releaseQuota()
+		g.quotaHeld.Store(true)
+		return standby, nil
+	}
+
+	if !g.quotaHeld.Load() {
+		if err := g.quota.acquire(); err != nil {
+			return nil, err
+		}
+
+		g.quotaHeld.Store(true)
+	}
+
+	if snapshotter, ok := g.process.(Snapshotter); ok && g.snapshot != nil {
+		process, err := snapshotter.Restore(g.snapshot)
+		if err == nil {
+			teeLogs(process, g.logs)
+			return process, nil
+		}
+
+		logging.Warnf("%s failed to restore from snapshot, spawning from scratch: %v", g.process, err)
+	}
+
+	process, err := g.factory()
+	if err != nil {
+		g.releaseQuota()
+		return nil, err
+	}
+
+	g.takeSnapshot(process)
+	return process, nil
+}
+
+// spawnStandby spawns the standby process in the background if WarmStandby is enabled and there is none.
+// Failures are logged, so that the next respawn just spawns a process from scratch.
+func (g *Governor) spawnStandby() {
+	g.standbyMu.Lock()
+	defer g.standbyMu.Unlock()
+	if !g.warmStandby || g.standby != nil || g.standbySpawning || g.closed.Load() {
+		return
+	}
+
+	// g.process must not be read without lock in background
+	name := g.process.String()
+	g.standbySpawning = true
+	safego.Run(func() {
+		process, err := spawnWithQuota(g.factory, g.quota)
+		g.standbyMu.Lock()
+		defer g.standbyMu.Unlock()
+		g.standbySpawning = false
+		if err != nil {
+			logging.Warnf("%s failed to spawn standby process: %v", name, err)
+			return
+		}
+
+		if g.closed.Load() {
+			process.Kill()
+			g.quota.release()
+			return
+		}
+
+		logging.Debugf("%s standby process %s is ready", name, process)
+		g.standby = process
+	})
+}
+
+// takeStandby returns the ready standby process along with its quota slot or nil if there is none.
+func (g *Governor) takeStandby() Process {
+	g.standbyMu.Lock()
+	defer g.standbyMu.Unlock()
+	standby := g.standby
+	g.standby = nil
+	return standby
+}
+
+// killStandby kills the standby process if there is one.
+func (g *Governor) killStandby() {
+	if standby := g.takeStandby(); standby != nil {
+		standby.Kill()
+		g.quota.release()
+	}
+}
+
+// releaseQuota frees the quota slot of the exited process if it holds one.
+func (g *Governor) releaseQuota() {
+	if g.quotaHeld.CAS(true, false) {
+		g.quota.release()
+	}
+}
+
+// spawnWithQuota spawns a process if there is a free quota slot and takes the slot.
+func spawnWithQuota(spawn ProcessFactory, quota *ProcessQuota) (Process, error) {
+	if err := quota.acquire(); err != nil {
+		return nil, err
+	}
+
+	process, err := spawn()
+	if err != nil {
+		quota.release()
+		return nil, err
+	}
+
+	return process, nil
+}
+
+// takeSnapshot snapshots the freshly spawned process if it supports snapshots and there is no snapshot yet.
+// Failures are logged, so that respawns just spawn from scratch. Must be called under lock.
+func (g *Governor) takeSnapshot(process Process) {
+	snapshotter, ok := process.(Snapshotter)
+	if !ok || g.snapshot != nil {
+		return
+	}
+
+	snapshot, err := snapshotter.Snapshot()
+	if err != nil {
+		logging.Warnf("%s failed to take snapshot: %v", process, err)
+		return
+	}
+
+	g.snapshot = snapshot
+}
+
+// initProcess sends the init payload to the process and waits for the ack if the payload is set.
+// The process is expected to be killed on failure, which aborts the pending receive.
+func initProcess(process Process, options GovernorOptions) error {
+	if options.InitPayload == nil {
+		return nil
+	}
+
+	timeout := options.InitTimeout
+	if timeout <= 0 {
+		timeout = defaultInitTimeout
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	// processes may not support context, so the ack is not waited for in place
+	done := make(chan error, 1)
+	go func() {
+		if err := process.Send(ctx, options.InitPayload); err != nil {
+			done <- errors.Wrap(err, "send init payload")
+			return
+		}
+
+		ack, err := process.Receive(ctx, nil)
+		if err != nil {
+			done <- errors.Wrap(err, "receive init ack")
+		} else if options.InitAck != nil && !bytes.Equal(ack, options.InitAck) {
+			done <- errors.Errorf("unexpected init ack: %s", ack)
+		} else {
+			done <- nil
+		}
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return errors.Errorf("no init ack within %s", timeout)
+	}
+}
+
+func isLogTee(process Process) bool {
+	_, ok := process.(LogTee)
+	return ok
+}
+
+func teeLogs(process Process, logs *logBroadcaster) {
+	if tee, ok := process.(LogTee); ok {
+		tee.TeeLogs(logs.publish)
+	}
+}
+
+// lock acquires the process, counting the caller in QueueDepth while it waits.
+func (g *Governor) lock(ctx context.Context) (unlock func(), err error) {
+	depth := g.waiting.Inc()
+	defer g.waiting.Dec()
+	if g.maxQueueDepth > 0 && int(depth) > g.maxQueueDepth {
+		return func() {}, ErrOverloaded
+	}
+
+	return g.mu.Lock(ctx)
+}
+
+// QueueDepth returns the number of callers currently waiting for the process.
+func (g *Governor) QueueDepth() int {
+	return int(g.waiting.Load())
+}
+
+// touch marks the end of the last exchange for idle timeout. Must be called under lock.
+func (g *Governor) touch() {
+	g.lastExchange = time.Now()
+}
+
+// route returns the governor of the large process for oversized payloads and g otherwise.
+func (g *Governor) route(data []byte) *Governor {
+	if g.large != nil && len(data) > g.largeThreshold {
+		return g.large
+	}
+
+	return g
 }
 
 // Exchange sends request data and returns response data.
 func (g *Governor) Exchange(ctx context.Context, data []byte, listener DataListener) ([]byte, error) {
-	cancel, err := g.mu.Lock(ctx)
+	result, err := g.ExchangeDetailed(ctx, data, listener)
+	if err != nil {
+		return nil, err
+	}
+
+	return result.Data, nil
+}
+
+// ExchangeDetailed acts like Exchange, but also reports which process served the request
+// and how many respawns it took, e.g. for debugging responses of respawned processes.
+func (g *Governor) ExchangeDetailed(ctx context.Context, data []byte, listener DataListener) (*ExchangeResult, error) {
+	if target := g.route(data); target != g {
+		return target.ExchangeDetailed(ctx, data, listener)
+	}
+
+	cancel, err := g.lock(ctx)
 	if err != nil {
 		return nil, err
 	}
 
 	defer cancel()
+	return g.exchangeWithRespawn(ctx, data, nil, listener)
+}
+
+// ExchangeWithMeta acts like Exchange, but also passes metadata (e.g. destination ID) to the process
+// separately from the payload. The process must implement MetaSender unless meta is empty.
+func (g *Governor) ExchangeWithMeta(ctx context.Context, data []byte, meta map[string]string, listener DataListener) ([]byte, error) {
+	if target := g.route(data); target != g {
+		return target.ExchangeWithMeta(ctx, data, meta, listener)
+	}
+
+	cancel, err := g.lock(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	defer cancel()
+	result, err := g.exchangeWithRespawn(ctx, data, meta, listener)
+	if err != nil {
+		return nil, err
+	}
+
+	return result.Data, nil
+}
 
+// TryExchange acts like Exchange, but returns false immediately if the process is busy with another exchange.
+func (g *Governor) TryExchange(ctx context.Context, data []byte, listener DataListener) ([]byte, bool, error) {
+	if target := g.route(data); target != g {
+		return target.TryExchange(ctx, data, listener)
+	}
+
+	cancel, ok := g.mu.TryLock()
+	if !ok {
+		return nil, false, nil
+	}
+
+	defer cancel()
+	result, err := g.exchangeWithRespawn(ctx, data, nil, listener)
+	if err != nil {
+		return nil, true, err
+	}
+
+	return result.Data, true, nil
+}
+
+// exchangeWithRespawn performs exchange respawning the process if it is dead. Must be called under lock.
+func (g *Governor) exchangeWithRespawn(ctx context.Context, data []byte, meta map[string]string, listener DataListener) (*ExchangeResult, error) {
+	defer g.touch()
+	if err := g.wake(); err != nil {
+		return nil, err
+	}
+
+	respawns := 0
 	for {
 		select {
 		case <-ctx.Done():
@@ -83,14 +647,22 @@ func (g *Governor) Exchange(ctx context.Context, data []byte, listener DataListe
 			return nil, fmt.Errorf("governor was closed.")
 		}
 
-		data, err := g.exchange(ctx, data, listener)
+		data, err := g.timedExchange(ctx, data, meta, listener)
 		if err == nil {
-			return data, nil
+			pid, _ := g.process.PID()
+			return &ExchangeResult{Data: data, Respawns: respawns, Process: g.process.String(), PID: pid}, nil
+		}
+
+		var appErr *AppError
+		if errors.As(err, &appErr) {
+			return nil, err
 		}
+
+		g.stats.exchangeFailed()
 		if g.closed.Load() {
 			return nil, fmt.Errorf("governor was closed.")
 		}
-		logging.Warnf("%s exchange error: %v", g.process, err)
+		logging.Warnf(withCorrelationID(ctx, "%s exchange error: %v"), g.process, err)
 
 		if errors.Is(err, io.EOF) ||
 			strings.Contains(err.Error(), "file already closed") ||
@@ -103,13 +675,16 @@ func (g *Governor) Exchange(ctx context.Context, data []byte, listener DataListe
 
 			if !g.standalone {
 				//Respawn only if this is not standalone instance
-				process, err := g.process.Spawn()
+				process, err := g.respawn()
 				if err != nil {
 					return nil, errors.Wrap(err, "respawn")
 				}
 
-				logging.Debugf("%s respawned as %s", g.process, process)
-				g.process = process
+				g.stats.spawned()
+				g.stats.respawned()
+				logging.Debugf(withCorrelationID(ctx, "%s respawned as %s"), g.process, process)
+				g.setProcess(process)
+				respawns++
 				continue
 			} else {
 				reason := "shutdown with error: " + err.Error()
@@ -124,33 +699,87 @@ func (g *Governor) Exchange(ctx context.Context, data []byte, listener DataListe
 	}
 }
 
-func (g *Governor) exchange(ctx context.Context, data []byte, listener DataListener) ([]byte, error) {
-	if err := g.process.Send(ctx, data); err != nil {
+// timedExchange performs exchange recording its latency if the process has served it, successfully or with AppError.
+func (g *Governor) timedExchange(ctx context.Context, data []byte, meta map[string]string, listener DataListener) ([]byte, error) {
+	start := time.Now()
+	data, err := g.exchange(ctx, data, meta, listener)
+	var appErr *AppError
+	if err == nil || errors.As(err, &appErr) {
+		g.latency.record(time.Since(start))
+	}
+
+	return data, err
+}
+
+func (g *Governor) exchange(ctx context.Context, data []byte, meta map[string]string, listener DataListener) ([]byte, error) {
+	if err := g.send(ctx, data, meta); err != nil {
 		return nil, err
 	}
 
 	return g.process.Receive(ctx, listener)
 }
 
+func (g *Governor) send(ctx context.Context, data []byte, meta map[string]string) error {
+	if len(meta) == 0 {
+		return g.process.Send(ctx, data)
+	}
+
+	sender, ok := g.process.(MetaSender)
+	if !ok {
+		return errors.Errorf("%s does not support metadata", g.process)
+	}
+
+	return sender.SendWithMeta(ctx, data, meta)
+}
+
 func (g *Governor) ExchangeDirect(ctx context.Context, data []byte, listener DataListener) ([]byte, error) {
-	cancel, err := g.mu.Lock(ctx)
+	if target := g.route(data); target != g {
+		return target.ExchangeDirect(ctx, data, listener)
+	}
+
+	cancel, err := g.lock(ctx)
 	if err != nil {
 		return nil, err
 	}
 
 	defer cancel()
-	return g.exchange(ctx, data, listener)
+	defer g.touch()
+	if err := g.wake(); err != nil {
+		return nil, err
+	}
+
+	data, err = g.timedExchange(ctx, data, nil, listener)
+	var appErr *AppError
+	if err != nil && !errors.As(err, &appErr) {
+		g.stats.exchangeFailed()
+		logging.Warnf(withCorrelationID(ctx, "%s exchange error: %v"), g.process, err)
+	}
+
+	return data, err
 }
 
 func (g *Governor) Close() error {
+	if g.large != nil {
+		_ = g.large.Close()
+	}
+
+	g.stopReaper()
 	g.closed.Store(true)
-	g.process.Kill()
-	logging.Debugf("%s completed successfully", g.process)
+	g.logs.close()
+	process := g.currentProcess()
+	process.Kill()
+	g.releaseQuota()
+	g.killStandby()
+	logging.Debugf("%s completed successfully", process)
 	return nil
 }
 
 // kill kills the running process.
 func (g *Governor) kill() {
+	if g.large != nil {
+		g.large.kill()
+	}
+
 	cancel, _ := g.mu.Lock(context.Background())
 	defer cancel()
 	g.process.Kill()
@@ -158,16 +787,81 @@ func (g *Governor) kill() {
 
 // wait waits for the running process to exit.
 func (g *Governor) wait() error {
-	cancel, _ := g.mu.Lock(context.Background())
-	defer cancel()
-	if _, err := g.process.Wait(); err != nil {
+	return g.WaitContext(context.Background())
+}
+
+// WaitContext waits for the running process to exit. If ctx is done first, the process is killed
+// and ctx error is returned, so that orchestrated shutdowns don't hang on stuck processes.
+func (g *Governor) WaitContext(ctx context.Context) error {
+	if g.large != nil {
+		if err := g.large.WaitContext(ctx); err != nil {
+			return err
+		}
+	}
+
+	unlock, err := g.mu.Lock(ctx)
+	if err != nil {
+		// the process is stuck in an exchange, killing it aborts the exchange
+		g.currentProcess().Kill()
 		return err
 	}
 
-	logging.Debugf("%s completed successfully", g.process)
-	return nil
+	process := g.process
+	done := make(chan error, 1)
+	go func() {
+		// the lock is held until the process exits, so that it is not respawned meanwhile
+		defer unlock()
+		_, err := process.Wait()
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			return err
+		}
+
+		logging.Debugf("%s completed successfully", process)
+		return nil
+	case <-ctx.Done():
+		process.Kill()
+		return ctx.Err()
+	}
+}
+
+// Stats returns process lifecycle counters of this Governor.
+func (g *Governor) Stats() Stats {
+	return g.stats.snapshot()
+}
+
+// LatencyQuantiles returns p50, p95 and p99 of exchange latency since the Governor start keyed by quantile,
+// or an empty map if there were no exchanges. Only the time the process has spent serving exchanges is counted:
+// waiting for the lock and respawns are excluded, as well as exchanges failed due to dead processes.
+// Values are approximate with up to 9% error. Exchanges routed to the large process are not included.
+func (g *Governor) LatencyQuantiles() map[float64]time.Duration {
+	return g.latency.quantiles(defaultLatencyQuantiles...)
+}
+
+// PID returns the OS process ID of the governed process for attaching debuggers and profilers.
+// It does not wait for the running exchange, so it may be used for diagnosing wedged processes.
+// Note that the PID changes when the process is respawned.
+func (g *Governor) PID() (int, bool) {
+	return g.currentProcess().PID()
+}
+
+// Subscribe returns a channel of the process stdout and stderr lines, which survives respawns, and a function
+// to unsubscribe. The channel is bounded: if the subscriber lags behind, the oldest lines are dropped.
+// The channel is closed right away if the process does not implement LogTee, and on Close.
+func (g *Governor) Subscribe() (<-chan LogLine, func()) {
+	if !g.logTee {
+		ch := make(chan LogLine)
+		close(ch)
+		return ch, func() {}
+	}
+
+	return g.logs.subscribe()
 }
 
 func (g *Governor) String() string {
-	return g.process.String()
+	return g.currentProcess().String()
 }
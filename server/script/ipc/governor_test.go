@@ -0,0 +1,600 @@
+package ipc
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+type processMock struct {
+	id      int
+	spawned *int
+	respond func(p *processMock, data []byte) ([]byte, error)
+	request []byte
+	killed  bool
+}
+
+func newProcessMock(respond func(p *processMock, data []byte) ([]byte, error)) *processMock {
+	return &processMock{spawned: new(int), respond: respond}
+}
+
+func (p *processMock) Spawn() (Process, error) {
+	*p.spawned++
+	return &processMock{id: *p.spawned, spawned: p.spawned, respond: p.respond}, nil
+}
+
+func (p *processMock) Send(_ context.Context, data []byte) error {
+	p.request = data
+	return nil
+}
+
+func (p *processMock) Receive(_ context.Context, _ DataListener) ([]byte, error) {
+	return p.respond(p, p.request)
+}
+
+func (p *processMock) Kill() {
+	p.killed = true
+}
+
+func (p *processMock) Wait() (string, error) {
+	return "", nil
+}
+
+func (p *processMock) PID() (int, bool) {
+	return 1000 + p.id, true
+}
+
+func (p *processMock) String() string {
+	return fmt.Sprintf("mock-%d", p.id)
+}
+
+func TestGovernorRespawnsDeadProcess(t *testing.T) {
+	process := newProcessMock(func(p *processMock, data []byte) ([]byte, error) {
+		if p.id == 1 {
+			return nil, io.EOF
+		}
+
+		return data, nil
+	})
+
+	governor, err := Govern(process, false)
+	require.NoError(t, err)
+	defer governor.Close()
+
+	data, err := governor.Exchange(context.Background(), []byte("ping"), nil)
+	require.NoError(t, err)
+	require.Equal(t, "ping", string(data))
+	require.Equal(t, 2, *process.spawned)
+	require.Equal(t, Stats{Spawns: 2, Respawns: 1, ExchangeErrors: 1}, governor.Stats())
+}
+
+func TestGovernorPID(t *testing.T) {
+	process := newProcessMock(func(p *processMock, data []byte) ([]byte, error) {
+		if p.id == 1 {
+			return nil, io.EOF
+		}
+
+		return data, nil
+	})
+
+	governor, err := Govern(process, false)
+	require.NoError(t, err)
+	defer governor.Close()
+
+	pid, ok := governor.PID()
+	require.True(t, ok)
+	require.Equal(t, 1001, pid)
+
+	_, err = governor.Exchange(context.Background(), []byte("ping"), nil)
+	require.NoError(t, err)
+	pid, ok = governor.PID()
+	require.True(t, ok)
+	require.Equal(t, 1002, pid, "PID must follow respawned process")
+}
+
+func TestGovernorPIDDuringRespawns(t *testing.T) {
+	process := newProcessMock(func(p *processMock, data []byte) ([]byte, error) {
+		if p.id%2 == 1 {
+			return nil, io.EOF
+		}
+
+		return data, nil
+	})
+
+	governor, err := Govern(process, false)
+	require.NoError(t, err)
+	defer governor.Close()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			if _, err := governor.Exchange(context.Background(), []byte("ping"), nil); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+
+	// go test -race reports unsynchronized access to the respawned process
+	for {
+		select {
+		case <-done:
+			return
+		default:
+			_, ok := governor.PID()
+			require.True(t, ok)
+			_ = governor.String()
+		}
+	}
+}
+
+func TestGovernorExchangeDetailed(t *testing.T) {
+	process := newProcessMock(func(p *processMock, data []byte) ([]byte, error) {
+		if p.id < 3 {
+			return nil, io.EOF
+		}
+
+		return data, nil
+	})
+
+	governor, err := Govern(process, false)
+	require.NoError(t, err)
+	defer governor.Close()
+
+	result, err := governor.ExchangeDetailed(context.Background(), []byte("ping"), nil)
+	require.NoError(t, err)
+	require.Equal(t, &ExchangeResult{Data: []byte("ping"), Respawns: 2, Process: "mock-3", PID: 1003}, result)
+
+	result, err = governor.ExchangeDetailed(context.Background(), []byte("pong"), nil)
+	require.NoError(t, err)
+	require.Equal(t, &ExchangeResult{Data: []byte("pong"), Process: "mock-3", PID: 1003}, result)
+}
+
+func TestGovernorLatencyQuantilesExcludeRespawns(t *testing.T) {
+	process := newProcessMock(func(p *processMock, data []byte) ([]byte, error) {
+		if p.id == 1 {
+			return nil, io.EOF
+		}
+
+		return data, nil
+	})
+
+	spawned := false
+	factory := func() (Process, error) {
+		if spawned {
+			time.Sleep(100 * time.Millisecond)
+		}
+
+		spawned = true
+		return process.Spawn()
+	}
+
+	governor, err := GovernFactory(factory, false, GovernorOptions{})
+	require.NoError(t, err)
+	defer governor.Close()
+	require.Empty(t, governor.LatencyQuantiles())
+
+	for i := 0; i < 10; i++ {
+		_, err := governor.Exchange(context.Background(), []byte("ping"), nil)
+		require.NoError(t, err)
+	}
+
+	quantiles := governor.LatencyQuantiles()
+	require.Len(t, quantiles, 3)
+	require.Less(t, quantiles[0.99], 100*time.Millisecond, "respawn must not be counted")
+}
+
+func TestGovernorSendsInitPayloadAfterRespawn(t *testing.T) {
+	var requests []string
+	process := newProcessMock(func(p *processMock, data []byte) ([]byte, error) {
+		requests = append(requests, fmt.Sprintf("%s: %s", p, data))
+		if p.id == 1 && string(data) == "ping" {
+			return nil, io.EOF
+		}
+
+		return data, nil
+	})
+
+	governor, err := GovernWithOptions(process, false, GovernorOptions{InitPayload: []byte("init")})
+	require.NoError(t, err)
+	defer governor.Close()
+
+	data, err := governor.Exchange(context.Background(), []byte("ping"), nil)
+	require.NoError(t, err)
+	require.Equal(t, "ping", string(data))
+	require.Equal(t, []string{"mock-1: init", "mock-1: ping", "mock-2: init", "mock-2: ping"}, requests)
+}
+
+func TestGovernorFailsSpawnOnInitError(t *testing.T) {
+	process := newProcessMock(func(p *processMock, data []byte) ([]byte, error) {
+		return nil, &AppError{Err: errors.New("invalid config")}
+	})
+
+	_, err := GovernWithOptions(process, false, GovernorOptions{InitPayload: []byte("init")})
+	var appErr *AppError
+	require.ErrorAs(t, err, &appErr)
+}
+
+func TestGovernorKillsProcessWithoutInitAck(t *testing.T) {
+	stuck := &stuckProcessMock{processMock: processMock{spawned: new(int)}, exited: make(chan struct{})}
+	stuck.respond = func(p *processMock, data []byte) ([]byte, error) {
+		<-stuck.exited
+		return nil, io.EOF
+	}
+
+	options := GovernorOptions{InitPayload: []byte("init"), InitTimeout: 20 * time.Millisecond}
+	_, err := GovernFactory(func() (Process, error) { return stuck, nil }, false, options)
+	require.Error(t, err)
+	select {
+	case <-stuck.exited:
+	default:
+		require.Fail(t, "process without init ack must be killed")
+	}
+
+	process := newProcessMock(func(p *processMock, data []byte) ([]byte, error) { return []byte("nope"), nil })
+	_, err = GovernWithOptions(process, false, GovernorOptions{InitPayload: []byte("init"), InitAck: []byte("ok")})
+	require.Error(t, err, "unexpected init ack must fail the spawn")
+}
+
+func TestGovernorDoesNotRespawnOnAppError(t *testing.T) {
+	process := newProcessMock(func(p *processMock, data []byte) ([]byte, error) {
+		return nil, &AppError{Err: errors.New("user code failed: broken pipe")}
+	})
+
+	governor, err := Govern(process, false)
+	require.NoError(t, err)
+	defer governor.Close()
+
+	_, err = governor.Exchange(context.Background(), []byte("ping"), nil)
+	var appErr *AppError
+	require.ErrorAs(t, err, &appErr)
+	require.Equal(t, 1, *process.spawned)
+}
+
+func TestGovernorGlobalStats(t *testing.T) {
+	process := newProcessMock(func(p *processMock, data []byte) ([]byte, error) {
+		if p.id%2 == 1 {
+			return nil, io.EOF
+		}
+
+		return data, nil
+	})
+
+	before := GlobalStats()
+	for i := 0; i < 2; i++ {
+		governor, err := Govern(process, false)
+		require.NoError(t, err)
+		_, err = governor.Exchange(context.Background(), []byte("ping"), nil)
+		require.NoError(t, err)
+		require.NoError(t, governor.Close())
+	}
+
+	after := GlobalStats()
+	require.Equal(t, uint64(4), after.Spawns-before.Spawns)
+	require.Equal(t, uint64(2), after.Respawns-before.Respawns)
+	require.Equal(t, uint64(2), after.ExchangeErrors-before.ExchangeErrors)
+}
+
+func TestGovernorTryExchange(t *testing.T) {
+	process := newProcessMock(func(p *processMock, data []byte) ([]byte, error) {
+		return data, nil
+	})
+
+	governor, err := Govern(process, false)
+	require.NoError(t, err)
+	defer governor.Close()
+
+	unlock, err := governor.mu.Lock(context.Background())
+	require.NoError(t, err)
+	_, ok, err := governor.TryExchange(context.Background(), []byte("ping"), nil)
+	require.NoError(t, err)
+	require.False(t, ok, "busy governor must not block")
+
+	unlock()
+	data, ok, err := governor.TryExchange(context.Background(), []byte("ping"), nil)
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, "ping", string(data))
+}
+
+func TestGovernorQueueDepth(t *testing.T) {
+	release := make(chan struct{})
+	process := newProcessMock(func(p *processMock, data []byte) ([]byte, error) {
+		<-release
+		return data, nil
+	})
+
+	governor, err := GovernWithOptions(process, false, GovernorOptions{MaxQueueDepth: 2})
+	require.NoError(t, err)
+	defer governor.Close()
+
+	var wg sync.WaitGroup
+	errs := make([]error, 3)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, errs[i] = governor.Exchange(context.Background(), []byte("ping"), nil)
+		}(i)
+	}
+
+	// one caller holds the process, the others wait
+	require.Eventually(t, func() bool { return governor.QueueDepth() == 2 }, time.Second, time.Millisecond)
+	_, err = governor.Exchange(context.Background(), []byte("ping"), nil)
+	require.ErrorIs(t, err, ErrOverloaded)
+	require.Equal(t, 2, governor.QueueDepth())
+
+	close(release)
+	wg.Wait()
+	for _, err := range errs {
+		require.NoError(t, err)
+	}
+
+	require.Zero(t, governor.QueueDepth())
+}
+
+func TestGovernFactory(t *testing.T) {
+	created := 0
+	factory := func() (Process, error) {
+		created++
+		return &processMock{id: created, spawned: new(int), respond: func(p *processMock, data []byte) ([]byte, error) {
+			if p.id == 1 {
+				return nil, io.EOF
+			}
+
+			return data, nil
+		}}, nil
+	}
+
+	governor, err := GovernFactory(factory, false, GovernorOptions{})
+	require.NoError(t, err)
+	defer governor.Close()
+	require.Equal(t, 1, created)
+
+	data, err := governor.Exchange(context.Background(), []byte("ping"), nil)
+	require.NoError(t, err)
+	require.Equal(t, "ping", string(data))
+	require.Equal(t, 2, created, "dead process must be respawned with the factory")
+
+	_, err = GovernFactory(func() (Process, error) { return nil, io.ErrClosedPipe }, false, GovernorOptions{})
+	require.ErrorIs(t, err, io.ErrClosedPipe)
+}
+
+func TestGovernorRoutesLargePayloads(t *testing.T) {
+	respond := func(name string) func(p *processMock, data []byte) ([]byte, error) {
+		return func(p *processMock, data []byte) ([]byte, error) {
+			return []byte(name), nil
+		}
+	}
+
+	main, large := newProcessMock(respond("main")), newProcessMock(respond("large"))
+	governor, err := GovernWithOptions(main, false, GovernorOptions{LargeProcess: large, LargePayloadThreshold: 4})
+	require.NoError(t, err)
+
+	data, err := governor.Exchange(context.Background(), []byte("ping"), nil)
+	require.NoError(t, err)
+	require.Equal(t, "main", string(data))
+
+	data, err = governor.Exchange(context.Background(), []byte("large ping"), nil)
+	require.NoError(t, err)
+	require.Equal(t, "large", string(data))
+
+	require.NoError(t, governor.Close())
+	require.True(t, governor.process.(*processMock).killed)
+	require.True(t, governor.large.process.(*processMock).killed)
+}
+
+func TestGovernorKillsIdleProcess(t *testing.T) {
+	process := newProcessMock(func(p *processMock, data []byte) ([]byte, error) {
+		return data, nil
+	})
+
+	governor, err := GovernWithOptions(process, false, GovernorOptions{IdleTimeout: 20 * time.Millisecond})
+	require.NoError(t, err)
+	defer governor.Close()
+
+	spawned := governor.process.(*processMock)
+	require.Eventually(t, func() bool {
+		unlock, err := governor.mu.Lock(context.Background())
+		require.NoError(t, err)
+		defer unlock()
+		return governor.idle
+	}, time.Second, 10*time.Millisecond)
+	require.True(t, spawned.killed)
+
+	data, err := governor.Exchange(context.Background(), []byte("ping"), nil)
+	require.NoError(t, err)
+	require.Equal(t, "ping", string(data))
+	require.Equal(t, 2, *process.spawned)
+}
+
+func TestGovernorExchangeWithMetaRequiresMetaSender(t *testing.T) {
+	governor, err := Govern(newProcessMock(func(p *processMock, data []byte) ([]byte, error) { return data, nil }), false)
+	require.NoError(t, err)
+	defer governor.Close()
+
+	ctx := context.Background()
+	data, err := governor.ExchangeWithMeta(ctx, []byte("ping"), nil, nil)
+	require.NoError(t, err, "empty meta is sent as is")
+	require.Equal(t, "ping", string(data))
+	_, err = governor.ExchangeWithMeta(ctx, []byte("ping"), map[string]string{"destination": "d1"}, nil)
+	require.Error(t, err)
+}
+
+func TestWithCorrelationID(t *testing.T) {
+	ctx := context.Background()
+	require.Equal(t, "%s exchange error: %v", withCorrelationID(ctx, "%s exchange error: %v"))
+
+	ctx = WithCorrelationID(ctx, "req-100%")
+	require.Equal(t, "[request_id: req-100%] process exchange error: EOF",
+		fmt.Sprintf(withCorrelationID(ctx, "%s exchange error: %v"), "process", io.EOF))
+}
+
+// stuckProcessMock does not exit until killed.
+type stuckProcessMock struct {
+	processMock
+	exited chan struct{}
+	once   sync.Once
+}
+
+func (p *stuckProcessMock) Kill() {
+	p.once.Do(func() { close(p.exited) })
+}
+
+func (p *stuckProcessMock) Wait() (string, error) {
+	<-p.exited
+	return "", nil
+}
+
+func TestGovernorWaitContext(t *testing.T) {
+	governor, err := Govern(newProcessMock(func(p *processMock, data []byte) ([]byte, error) { return data, nil }), false)
+	require.NoError(t, err)
+	defer governor.Close()
+	require.NoError(t, governor.WaitContext(context.Background()), "exited process is waited for")
+
+	stuck := &stuckProcessMock{processMock: processMock{spawned: new(int)}, exited: make(chan struct{})}
+	governor, err = GovernFactory(func() (Process, error) { return stuck, nil }, false, GovernorOptions{})
+	require.NoError(t, err)
+	defer governor.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	require.ErrorIs(t, governor.WaitContext(ctx), context.DeadlineExceeded)
+	select {
+	case <-stuck.exited:
+	default:
+		require.Fail(t, "stuck process must be killed")
+	}
+
+	require.NoError(t, governor.wait(), "killed process has exited")
+}
+
+type snapshotProcessMock struct {
+	*processMock
+	snapshots  *int
+	restored   *[]string
+	restoreErr error
+}
+
+func (p *snapshotProcessMock) Spawn() (Process, error) {
+	spawned, err := p.processMock.Spawn()
+	if err != nil {
+		return nil, err
+	}
+
+	return &snapshotProcessMock{processMock: spawned.(*processMock), snapshots: p.snapshots, restored: p.restored, restoreErr: p.restoreErr}, nil
+}
+
+func (p *snapshotProcessMock) Snapshot() ([]byte, error) {
+	*p.snapshots++
+	return []byte(fmt.Sprintf("state-%d", p.id)), nil
+}
+
+func (p *snapshotProcessMock) Restore(snapshot []byte) (Process, error) {
+	if p.restoreErr != nil {
+		return nil, p.restoreErr
+	}
+
+	*p.restored = append(*p.restored, string(snapshot))
+	return p.Spawn()
+}
+
+func TestGovernorRestoresProcessFromSnapshot(t *testing.T) {
+	for _, tt := range []struct {
+		name       string
+		restoreErr error
+		restored   []string
+	}{
+		{"restored", nil, []string{"state-1"}},
+		{"cold spawn fallback", errors.New("corrupted snapshot"), nil},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			process := &snapshotProcessMock{
+				processMock: newProcessMock(func(p *processMock, data []byte) ([]byte, error) {
+					if p.id == 1 {
+						return nil, io.EOF
+					}
+
+					return data, nil
+				}),
+				snapshots:  new(int),
+				restored:   new([]string),
+				restoreErr: tt.restoreErr,
+			}
+
+			governor, err := Govern(process, false)
+			require.NoError(t, err)
+			defer governor.Close()
+			require.Equal(t, 1, *process.snapshots, "initialized process is snapshotted once")
+
+			data, err := governor.Exchange(context.Background(), []byte("ping"), nil)
+			require.NoError(t, err)
+			require.Equal(t, "ping", string(data))
+			require.Equal(t, tt.restored, *process.restored)
+			require.Equal(t, 1, *process.snapshots, "snapshot is kept for the governor lifetime")
+			require.Equal(t, Stats{Spawns: 2, Respawns: 1, ExchangeErrors: 1}, governor.Stats())
+		})
+	}
+}
+
+func TestGovernorPromotesWarmStandby(t *testing.T) {
+	const coldStart = 300 * time.Millisecond
+	var mu sync.Mutex
+	var spawned []*processMock
+	factory := func() (Process, error) {
+		mu.Lock()
+		id := len(spawned) + 1
+		mu.Unlock()
+		if id > 1 {
+			time.Sleep(coldStart)
+		}
+
+		process := &processMock{id: id, spawned: new(int), respond: func(p *processMock, data []byte) ([]byte, error) {
+			if p.id == 1 {
+				return nil, io.EOF
+			}
+
+			return data, nil
+		}}
+
+		mu.Lock()
+		defer mu.Unlock()
+		spawned = append(spawned, process)
+		return process, nil
+	}
+
+	standbyReady := func(governor *Governor) func() bool {
+		return func() bool {
+			governor.standbyMu.Lock()
+			defer governor.standbyMu.Unlock()
+			return governor.standby != nil
+		}
+	}
+
+	governor, err := GovernFactory(factory, false, GovernorOptions{WarmStandby: true})
+	require.NoError(t, err)
+	require.Eventually(t, standbyReady(governor), 2*coldStart, 10*time.Millisecond)
+
+	start := time.Now()
+	data, err := governor.Exchange(context.Background(), []byte("ping"), nil)
+	require.NoError(t, err)
+	require.Equal(t, "ping", string(data))
+	require.Less(t, time.Since(start), coldStart, "standby is promoted without cold start")
+	require.Equal(t, 2, governor.process.(*processMock).id)
+	require.Equal(t, Stats{Spawns: 2, Respawns: 1, ExchangeErrors: 1}, governor.Stats())
+
+	// a new standby is spawned in the background and killed on close
+	require.Eventually(t, standbyReady(governor), 2*coldStart, 10*time.Millisecond)
+	require.NoError(t, governor.Close())
+	mu.Lock()
+	defer mu.Unlock()
+	require.Len(t, spawned, 3)
+	require.True(t, spawned[2].killed)
+}
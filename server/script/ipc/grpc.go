@@ -0,0 +1,152 @@
+package ipc
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/pkg/errors"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+const (
+	// GRPCExchangeMethod is the bidi streaming method the sidecar must serve:
+	//
+	//	service Transform {
+	//	  rpc Exchange(stream google.protobuf.BytesValue) returns (stream google.protobuf.BytesValue);
+	//	}
+	//
+	// in package jitsu.ipc. Every request message must be answered with exactly one response message.
+	GRPCExchangeMethod = "/jitsu.ipc.Transform/Exchange"
+
+	// DefaultGRPCDialTimeout is the default time to wait for the sidecar connection on spawn.
+	DefaultGRPCDialTimeout = 10 * time.Second
+)
+
+var grpcExchangeStream = &grpc.StreamDesc{
+	StreamName:    "Exchange",
+	ServerStreams: true,
+	ClientStreams: true,
+}
+
+// GRPC allows to communicate to a sidecar service via a gRPC bidi stream, so that scripts may run
+// out of process across the network. Spawning connects to the sidecar, killing closes the connection.
+// Stream errors are reported as io.EOF, so that Governor reconnects the same way it respawns dead processes.
+type GRPC struct {
+	// Target is the sidecar address in gRPC name syntax, e.g. localhost:9090 or dns:///transform:9090.
+	Target string
+
+	// DialTimeout limits connecting on spawn. DefaultGRPCDialTimeout is used when not set.
+	DialTimeout time.Duration
+
+	// DialOptions are passed to grpc.Dial, e.g. transport credentials. Insecure credentials are used when not set.
+	DialOptions []grpc.DialOption
+
+	conn   *grpc.ClientConn
+	stream grpc.ClientStream
+	ctx    context.Context
+	cancel func()
+}
+
+func (p *GRPC) Spawn() (Process, error) {
+	dialTimeout := p.DialTimeout
+	if dialTimeout <= 0 {
+		dialTimeout = DefaultGRPCDialTimeout
+	}
+
+	dialOptions := p.DialOptions
+	if len(dialOptions) == 0 {
+		dialOptions = []grpc.DialOption{grpc.WithTransportCredentials(insecure.NewCredentials())}
+	}
+
+	dialCtx, cancelDial := context.WithTimeout(context.Background(), dialTimeout)
+	defer cancelDial()
+	conn, err := grpc.DialContext(dialCtx, p.Target, append(dialOptions, grpc.WithBlock())...)
+	if err != nil {
+		return nil, errors.Wrapf(err, "dial %s", p.Target)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stream, err := conn.NewStream(ctx, grpcExchangeStream, GRPCExchangeMethod)
+	if err != nil {
+		cancel()
+		_ = conn.Close()
+		return nil, errors.Wrap(err, "open exchange stream")
+	}
+
+	return &GRPC{
+		Target:      p.Target,
+		DialTimeout: p.DialTimeout,
+		DialOptions: p.DialOptions,
+		conn:        conn,
+		stream:      stream,
+		ctx:         ctx,
+		cancel:      cancel,
+	}, nil
+}
+
+func (p *GRPC) Send(_ context.Context, data []byte) error {
+	if err := p.stream.SendMsg(wrapperspb.Bytes(data)); err != nil {
+		return p.broken(err)
+	}
+
+	return nil
+}
+
+func (p *GRPC) Receive(ctx context.Context, _ DataListener) ([]byte, error) {
+	done := make(chan bool)
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			p.cancel()
+		case <-done:
+		}
+	}()
+
+	response := new(wrapperspb.BytesValue)
+	if err := p.stream.RecvMsg(response); err != nil {
+		if ctx.Err() != nil {
+			p.Kill()
+			return nil, ctx.Err()
+		}
+
+		return nil, p.broken(err)
+	}
+
+	return response.GetValue(), nil
+}
+
+// broken closes the connection after stream failures, since the stream can't be used afterwards,
+// and makes the error match io.EOF.
+func (p *GRPC) broken(err error) error {
+	p.Kill()
+	if errors.Is(err, io.EOF) {
+		return err
+	}
+
+	return errors.Wrapf(io.EOF, "stream failed: %v", err)
+}
+
+func (p *GRPC) Kill() {
+	p.cancel()
+	_ = p.conn.Close()
+}
+
+// Wait waits for the connection to be closed by Kill or after a stream failure. There is no stderr output to return.
+func (p *GRPC) Wait() (string, error) {
+	<-p.ctx.Done()
+	return "", nil
+}
+
+// PID always returns false, since the sidecar is not a local OS process.
+func (p *GRPC) PID() (int, bool) {
+	return 0, false
+}
+
+func (p *GRPC) String() string {
+	return fmt.Sprintf("grpc %s", p.Target)
+}
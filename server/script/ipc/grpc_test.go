@@ -0,0 +1,93 @@
+package ipc
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/atomic"
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+// startSidecar serves GRPCExchangeMethod answering every request with respond.
+// Streams are closed after streamLimit messages if it is positive.
+func startSidecar(t *testing.T, streamLimit int, respond func(data []byte) []byte) (string, *atomic.Int32) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	streams := atomic.NewInt32(0)
+	server := grpc.NewServer()
+	server.RegisterService(&grpc.ServiceDesc{
+		ServiceName: "jitsu.ipc.Transform",
+		HandlerType: (*interface{})(nil),
+		Streams: []grpc.StreamDesc{{
+			StreamName:    "Exchange",
+			ServerStreams: true,
+			ClientStreams: true,
+			Handler: func(_ interface{}, stream grpc.ServerStream) error {
+				streams.Inc()
+				for i := 0; streamLimit <= 0 || i < streamLimit; i++ {
+					request := new(wrapperspb.BytesValue)
+					if err := stream.RecvMsg(request); err != nil {
+						return nil
+					}
+
+					if err := stream.SendMsg(wrapperspb.Bytes(respond(request.GetValue()))); err != nil {
+						return err
+					}
+				}
+
+				return nil
+			},
+		}},
+	}, nil)
+
+	go func() { _ = server.Serve(listener) }()
+	t.Cleanup(server.Stop)
+	return listener.Addr().String(), streams
+}
+
+func TestGRPCExchange(t *testing.T) {
+	target, _ := startSidecar(t, 0, func(data []byte) []byte { return append([]byte("echo "), data...) })
+	governor, err := Govern(&GRPC{Target: target}, false)
+	require.NoError(t, err)
+	defer governor.Close()
+
+	for _, request := range []string{"first", "second"} {
+		response, err := governor.Exchange(context.Background(), []byte(request), nil)
+		require.NoError(t, err)
+		require.Equal(t, "echo "+request, string(response))
+	}
+
+	_, ok := governor.process.PID()
+	require.False(t, ok)
+}
+
+func TestGRPCReconnectsOnStreamError(t *testing.T) {
+	target, streams := startSidecar(t, 1, func(data []byte) []byte { return data })
+	governor, err := Govern(&GRPC{Target: target}, false)
+	require.NoError(t, err)
+	defer governor.Close()
+
+	for _, request := range []string{"first", "second", "third"} {
+		response, err := governor.Exchange(context.Background(), []byte(request), nil)
+		require.NoError(t, err)
+		require.Equal(t, request, string(response))
+	}
+
+	require.Equal(t, int32(3), streams.Load())
+	require.Equal(t, uint64(2), governor.stats.snapshot().Respawns)
+}
+
+func TestGRPCSpawnFailsWithoutSidecar(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	target := listener.Addr().String()
+	require.NoError(t, listener.Close())
+
+	_, err = (&GRPC{Target: target, DialTimeout: 100 * time.Millisecond}).Spawn()
+	require.Error(t, err)
+}
@@ -0,0 +1,82 @@
+package ipc
+
+import (
+	"math"
+	"time"
+
+	"go.uber.org/atomic"
+)
+
+const (
+	// latencyBucketsPerDoubling bounds quantile error to 2^(1/8), about 9%.
+	latencyBucketsPerDoubling = 8
+	// latencyBuckets cover latencies from minLatency to about an hour, longer ones fall into the last bucket.
+	latencyBuckets = 32 * latencyBucketsPerDoubling
+	minLatency     = time.Microsecond
+)
+
+// defaultLatencyQuantiles are reported by Governor.LatencyQuantiles.
+var defaultLatencyQuantiles = []float64{0.5, 0.95, 0.99}
+
+// latencyHistogram counts latencies in exponential buckets. Recording is lock-free and allocation-free,
+// so that it does not add to exchange latency. Quantiles are approximated by bucket upper bounds.
+type latencyHistogram struct {
+	buckets [latencyBuckets]atomic.Uint64
+}
+
+func latencyBucket(latency time.Duration) int {
+	if latency <= minLatency {
+		return 0
+	}
+
+	bucket := int(math.Ceil(math.Log2(float64(latency)/float64(minLatency)) * latencyBucketsPerDoubling))
+	if bucket >= latencyBuckets {
+		return latencyBuckets - 1
+	}
+
+	return bucket
+}
+
+func latencyBucketBound(bucket int) time.Duration {
+	return time.Duration(float64(minLatency) * math.Exp2(float64(bucket)/latencyBucketsPerDoubling))
+}
+
+func (h *latencyHistogram) record(latency time.Duration) {
+	h.buckets[latencyBucket(latency)].Inc()
+}
+
+// quantiles returns latencies at the quantiles, or an empty map if nothing has been recorded.
+func (h *latencyHistogram) quantiles(quantiles ...float64) map[float64]time.Duration {
+	var (
+		counts [latencyBuckets]uint64
+		total  uint64
+	)
+
+	// concurrent records may be missed, but the snapshot stays consistent with its total
+	for i := range h.buckets {
+		counts[i] = h.buckets[i].Load()
+		total += counts[i]
+	}
+
+	result := make(map[float64]time.Duration, len(quantiles))
+	if total == 0 {
+		return result
+	}
+
+	for _, q := range quantiles {
+		rank := uint64(math.Ceil(q * float64(total)))
+		if rank == 0 {
+			rank = 1
+		}
+
+		var seen uint64
+		for bucket, count := range counts {
+			if seen += count; seen >= rank {
+				result[q] = latencyBucketBound(bucket)
+				break
+			}
+		}
+	}
+
+	return result
+}
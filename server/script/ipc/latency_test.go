@@ -0,0 +1,30 @@
+package ipc
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLatencyHistogramQuantiles(t *testing.T) {
+	h := new(latencyHistogram)
+	require.Empty(t, h.quantiles(defaultLatencyQuantiles...))
+
+	for i := 1; i <= 100; i++ {
+		h.record(time.Duration(i) * time.Millisecond)
+	}
+
+	quantiles := h.quantiles(0, 0.5, 0.95, 0.99, 1)
+	for q, expected := range map[float64]time.Duration{0: time.Millisecond, 0.5: 50 * time.Millisecond,
+		0.95: 95 * time.Millisecond, 0.99: 99 * time.Millisecond, 1: 100 * time.Millisecond} {
+		require.GreaterOrEqual(t, quantiles[q], expected, q)
+		require.LessOrEqual(t, float64(quantiles[q]), float64(expected)*1.1, q)
+	}
+
+	h.record(0)
+	h.record(24 * time.Hour)
+	quantiles = h.quantiles(0, 1)
+	require.Equal(t, minLatency, quantiles[0])
+	require.Greater(t, quantiles[1], time.Hour)
+}
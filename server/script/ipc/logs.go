@@ -0,0 +1,143 @@
+package ipc
+
+import (
+	"bytes"
+	"sync"
+)
+
+const (
+	StdoutStream = "stdout"
+	StderrStream = "stderr"
+
+	// logSubscriptionBuffer is the number of lines a subscriber may lag behind before the oldest ones are dropped.
+	logSubscriptionBuffer = 256
+)
+
+// LogLine is a line of process output.
+type LogLine struct {
+	Stream string `json:"stream"`
+	Text   string `json:"text"`
+}
+
+// LogTee is implemented by processes which can stream their output. Governor passes the sink
+// to every spawned process, so that subscriptions survive respawns.
+type LogTee interface {
+
+	// TeeLogs makes the process pass every stdout and stderr line to sink in addition to the usual handling.
+	TeeLogs(sink func(line LogLine))
+}
+
+// logBroadcaster fans out process output lines to subscribers. Slow subscribers lose the oldest lines.
+type logBroadcaster struct {
+	mu          sync.Mutex
+	subscribers map[chan LogLine]bool
+	closed      bool
+}
+
+func newLogBroadcaster() *logBroadcaster {
+	return &logBroadcaster{subscribers: make(map[chan LogLine]bool)}
+}
+
+func (b *logBroadcaster) publish(line LogLine) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for ch := range b.subscribers {
+		select {
+		case ch <- line:
+			continue
+		default:
+		}
+
+		// drop the oldest line to make room
+		select {
+		case <-ch:
+		default:
+		}
+
+		select {
+		case ch <- line:
+		default:
+		}
+	}
+}
+
+func (b *logBroadcaster) subscribe() (<-chan LogLine, func()) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	ch := make(chan LogLine, logSubscriptionBuffer)
+	if b.closed {
+		close(ch)
+		return ch, func() {}
+	}
+
+	b.subscribers[ch] = true
+	once := new(sync.Once)
+	return ch, func() {
+		once.Do(func() {
+			b.mu.Lock()
+			defer b.mu.Unlock()
+			if b.subscribers[ch] {
+				delete(b.subscribers, ch)
+				close(ch)
+			}
+		})
+	}
+}
+
+// close closes all subscriptions. Subsequent subscriptions get closed channels.
+func (b *logBroadcaster) close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.closed = true
+	for ch := range b.subscribers {
+		delete(b.subscribers, ch)
+		close(ch)
+	}
+}
+
+// logTee passes process output stream lines to the sink set after the process has started.
+// It is also an io.Writer splitting written data into lines for streams which are not read line by line, e.g. stderr.
+type logTee struct {
+	stream string
+	mu     sync.Mutex
+	sink   func(line LogLine)
+	buf    []byte
+}
+
+func (t *logTee) setSink(sink func(line LogLine)) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.sink = sink
+}
+
+// emit passes a complete line to the sink if it is set.
+func (t *logTee) emit(line []byte) {
+	t.mu.Lock()
+	sink := t.sink
+	t.mu.Unlock()
+	if sink != nil {
+		sink(LogLine{Stream: t.stream, Text: string(bytes.TrimRight(line, "\r\n"))})
+	}
+}
+
+func (t *logTee) Write(data []byte) (int, error) {
+	t.mu.Lock()
+	t.buf = append(t.buf, data...)
+	var lines [][]byte
+	for {
+		i := bytes.IndexByte(t.buf, '\n')
+		if i < 0 {
+			break
+		}
+
+		lines = append(lines, t.buf[:i+1])
+		t.buf = t.buf[i+1:]
+	}
+
+	t.mu.Unlock()
+	for _, line := range lines {
+		t.emit(line)
+	}
+
+	return len(data), nil
+}
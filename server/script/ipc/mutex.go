@@ -22,3 +22,15 @@ func (mu *Mutex) Lock(ctx context.Context) (unlock func(), err error) {
 		return func() { once.Do(func() { <-mu.taken }) }, nil
 	}
 }
+
+// TryLock attempts to lock the mutex without blocking. Returns false if the mutex is already locked.
+func (mu *Mutex) TryLock() (unlock func(), ok bool) {
+	mu.once.Do(func() { mu.taken = make(chan bool, 1) })
+	select {
+	case mu.taken <- true:
+		once := new(sync.Once)
+		return func() { once.Do(func() { <-mu.taken }) }, true
+	default:
+		return func() {}, false
+	}
+}
@@ -0,0 +1,53 @@
+package ipc
+
+import "go.uber.org/atomic"
+
+// Stats contains Governor process lifecycle counters.
+type Stats struct {
+	// Spawns is the number of successfully spawned processes including respawns.
+	Spawns uint64 `json:"spawns"`
+
+	// Respawns is the number of processes spawned in place of dead ones.
+	Respawns uint64 `json:"respawns"`
+
+	// ExchangeErrors is the number of failed exchanges with processes. AppError failures are not counted.
+	ExchangeErrors uint64 `json:"exchange_errors"`
+}
+
+type stats struct {
+	spawns         atomic.Uint64
+	respawns       atomic.Uint64
+	exchangeErrors atomic.Uint64
+}
+
+// globalStats aggregates counters of all governors in the process.
+var globalStats stats
+
+// GlobalStats returns counters aggregated across all governors in the process.
+func GlobalStats() Stats {
+	return globalStats.snapshot()
+}
+
+// spawned increments governor counter along with the global one. So do respawned and exchangeFailed.
+func (s *stats) spawned() {
+	s.spawns.Inc()
+	globalStats.spawns.Inc()
+}
+
+func (s *stats) respawned() {
+	s.respawns.Inc()
+	globalStats.respawns.Inc()
+}
+
+func (s *stats) exchangeFailed() {
+	s.exchangeErrors.Inc()
+	globalStats.exchangeErrors.Inc()
+}
+
+func (s *stats) snapshot() Stats {
+	return Stats{
+		Spawns:         s.spawns.Load(),
+		Respawns:       s.respawns.Load(),
+		ExchangeErrors: s.exchangeErrors.Load(),
+	}
+}
@@ -17,6 +17,16 @@ import (
 
 const (
 	JitsuScriptResultCommand = "_JITSU_RESULT"
+
+	// JitsuScriptMetaHeader prefixes the metadata line sent by StdIO.SendWithMeta right before the payload line.
+	JitsuScriptMetaHeader = "_JITSU_META"
+
+	// DefaultReadBufferSize is the default size of the process stdout read buffer.
+	// It matches the default pipe capacity on Linux, so that a full pipe can be drained with a single read.
+	DefaultReadBufferSize = 64 * 1024
+
+	// DefaultWriteBufferSize is the default size of the process stdin write buffer.
+	DefaultWriteBufferSize = 64 * 1024
 )
 
 // DataListener is used to listen for multiline execution output.
@@ -34,12 +44,23 @@ type StdIO struct {
 	Args []string
 	Env  []string
 
+	// ReadBufferSize and WriteBufferSize set the sizes of stdout and stdin buffers.
+	// DefaultReadBufferSize and DefaultWriteBufferSize are used when not set.
+	// Larger buffers reduce the number of syscalls for large payloads at the cost of memory per process.
+	ReadBufferSize  int
+	WriteBufferSize int
+
 	cmd    *exec.Cmd
 	stdin  io.WriteCloser
 	stdout io.ReadCloser
 	stderr *bytes.Buffer
+	reader *bufio.Reader
+	writer *bufio.Writer
 	cancel func()
 
+	stdoutLogs *logTee
+	stderrLogs *logTee
+
 	CommandProcessor func(commandName string, payload []byte) (*CommandResponse, error)
 }
 
@@ -70,7 +91,8 @@ func (p *StdIO) Spawn() (Process, error) {
 	}
 
 	stderr := new(bytes.Buffer)
-	cmd.Stderr = stderr
+	stderrLogs := &logTee{stream: StderrStream}
+	cmd.Stderr = io.MultiWriter(stderr, stderrLogs)
 
 	if err := cmd.Start(); err != nil {
 		_ = stdin.Close()
@@ -79,23 +101,68 @@ func (p *StdIO) Spawn() (Process, error) {
 		return nil, errors.Wrap(err, "start process")
 	}
 
+	readBufferSize := p.ReadBufferSize
+	if readBufferSize <= 0 {
+		readBufferSize = DefaultReadBufferSize
+	}
+
+	writeBufferSize := p.WriteBufferSize
+	if writeBufferSize <= 0 {
+		writeBufferSize = DefaultWriteBufferSize
+	}
+
 	return &StdIO{
 		Dir:              p.Dir,
 		Path:             p.Path,
 		Args:             p.Args,
+		ReadBufferSize:   p.ReadBufferSize,
+		WriteBufferSize:  p.WriteBufferSize,
 		cmd:              cmd,
 		stdin:            stdin,
 		stdout:           stdout,
 		stderr:           stderr,
+		reader:           bufio.NewReaderSize(stdout, readBufferSize),
+		writer:           bufio.NewWriterSize(stdin, writeBufferSize),
 		cancel:           cancel,
+		stdoutLogs:       &logTee{stream: StdoutStream},
+		stderrLogs:       stderrLogs,
 		CommandProcessor: p.CommandProcessor,
 	}, nil
 }
 
 func (p *StdIO) Send(_ context.Context, data []byte) error {
-	data = append(data, '\n')
-	_, err := p.stdin.Write(data)
-	return err
+	if _, err := p.writer.Write(data); err != nil {
+		return err
+	}
+
+	if err := p.writer.WriteByte('\n'); err != nil {
+		return err
+	}
+
+	return p.writer.Flush()
+}
+
+// SendWithMeta sends meta as a J$_JITSU_META:<JSON object> line followed by the payload line,
+// so that the script can read metadata without parsing the payload.
+func (p *StdIO) SendWithMeta(ctx context.Context, data []byte, meta map[string]string) error {
+	header, err := json.Marshal(meta)
+	if err != nil {
+		return errors.Wrap(err, "marshal meta")
+	}
+
+	if _, err := p.writer.WriteString("J$" + JitsuScriptMetaHeader + ":"); err != nil {
+		return err
+	}
+
+	if _, err := p.writer.Write(header); err != nil {
+		return err
+	}
+
+	if err := p.writer.WriteByte('\n'); err != nil {
+		return err
+	}
+
+	return p.Send(ctx, data)
 }
 
 func (p *StdIO) Receive(ctx context.Context, listener DataListener) ([]byte, error) {
@@ -110,9 +177,8 @@ func (p *StdIO) Receive(ctx context.Context, listener DataListener) ([]byte, err
 		}
 	}()
 
-	reader := bufio.NewReader(p.stdout)
 	for {
-		line, err := reader.ReadBytes('\n')
+		line, err := p.reader.ReadBytes('\n')
 		if err != nil {
 			done <- true
 			return line, err
@@ -144,6 +210,7 @@ func (p *StdIO) Receive(ctx context.Context, listener DataListener) ([]byte, err
 			}
 		}
 		if len(line) > 1 {
+			p.stdoutLogs.emit(line)
 			if listener != nil {
 				listener.Data(line)
 			} else {
@@ -153,6 +220,12 @@ func (p *StdIO) Receive(ctx context.Context, listener DataListener) ([]byte, err
 	}
 }
 
+// TeeLogs implements LogTee. It must be called on spawned processes only.
+func (p *StdIO) TeeLogs(sink func(line LogLine)) {
+	p.stdoutLogs.setSink(sink)
+	p.stderrLogs.setSink(sink)
+}
+
 func (p *StdIO) Kill() {
 	p.cancel()
 }
@@ -198,6 +271,14 @@ func (p *StdIO) Wait() (string, error) {
 	return "", nil
 }
 
+func (p *StdIO) PID() (int, bool) {
+	if p.cmd == nil || p.cmd.Process == nil {
+		return 0, false
+	}
+
+	return p.cmd.Process.Pid, true
+}
+
 func (p *StdIO) String() string {
 	return fmt.Sprintf("%s %s (%d)", p.Path, strings.Join(p.Args, " "), p.cmd.Process.Pid)
 }
@@ -0,0 +1,150 @@
+package ipc
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+const helperProcessEnv = "JITSU_IPC_HELPER_PROCESS"
+
+// TestStdIOHelperProcess isn't a real test. It is started as a child process which echoes every line as a script result.
+// Lines starting with "log:" are also written to stdout and stderr as is.
+func TestStdIOHelperProcess(t *testing.T) {
+	if os.Getenv(helperProcessEnv) != "1" {
+		return
+	}
+
+	reader := bufio.NewReader(os.Stdin)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err != nil {
+			os.Exit(0)
+		}
+
+		if bytes.HasPrefix(line, []byte("log:")) {
+			_, _ = os.Stderr.Write(line)
+			_, _ = os.Stdout.Write(line)
+		}
+
+		_, _ = os.Stdout.Write(append([]byte("J$"+JitsuScriptResultCommand+":"), line...))
+	}
+}
+
+func newHelperProcess(readBufferSize, writeBufferSize int) *StdIO {
+	return &StdIO{
+		Path:            os.Args[0],
+		Args:            []string{"-test.run=TestStdIOHelperProcess"},
+		Env:             []string{helperProcessEnv + "=1"},
+		ReadBufferSize:  readBufferSize,
+		WriteBufferSize: writeBufferSize,
+	}
+}
+
+func TestStdIOPID(t *testing.T) {
+	template := newHelperProcess(0, 0)
+	_, ok := template.PID()
+	require.False(t, ok, "process template has not been started")
+
+	process, err := template.Spawn()
+	require.NoError(t, err)
+	defer func() {
+		process.Kill()
+		_, _ = process.Wait()
+	}()
+
+	pid, ok := process.PID()
+	require.True(t, ok)
+	require.NotEqual(t, os.Getpid(), pid)
+	require.Positive(t, pid)
+}
+
+func TestStdIOSendWithMeta(t *testing.T) {
+	process, err := newHelperProcess(0, 0).Spawn()
+	require.NoError(t, err)
+	defer func() {
+		process.Kill()
+		_, _ = process.Wait()
+	}()
+
+	ctx := context.Background()
+	require.NoError(t, process.(MetaSender).SendWithMeta(ctx, []byte("ping"), map[string]string{"destination": "d1"}))
+
+	// helper process echoes the header and the payload as separate lines
+	header, err := process.Receive(ctx, nil)
+	require.NoError(t, err)
+	require.Equal(t, "J$"+JitsuScriptMetaHeader+`:{"destination":"d1"}`+"\n", string(header))
+	payload, err := process.Receive(ctx, nil)
+	require.NoError(t, err)
+	require.Equal(t, "ping\n", string(payload))
+}
+
+func TestGovernorSubscribe(t *testing.T) {
+	governor, err := Govern(newHelperProcess(0, 0), false)
+	require.NoError(t, err)
+
+	logs, unsubscribe := governor.Subscribe()
+	defer unsubscribe()
+	_, err = governor.Exchange(context.Background(), []byte("log:hello"), new(discardListener))
+	require.NoError(t, err)
+
+	received := make(map[LogLine]bool)
+	for len(received) < 2 {
+		select {
+		case line := <-logs:
+			received[line] = true
+		case <-time.After(10 * time.Second):
+			t.Fatalf("timed out waiting for log lines, received: %v", received)
+		}
+	}
+
+	require.Equal(t, map[LogLine]bool{{StdoutStream, "log:hello"}: true, {StderrStream, "log:hello"}: true}, received)
+	require.NoError(t, governor.Close())
+	_, ok := <-logs
+	require.False(t, ok, "subscriptions are closed along with the governor")
+
+	mock, err := Govern(newProcessMock(func(p *processMock, data []byte) ([]byte, error) { return data, nil }), false)
+	require.NoError(t, err)
+	defer mock.Close()
+	logs, _ = mock.Subscribe()
+	_, ok = <-logs
+	require.False(t, ok, "processes without LogTee support get closed channels")
+}
+
+type discardListener struct{}
+
+func (discardListener) Data([]byte) {}
+
+func benchmarkStdIOBufferSize(b *testing.B, bufferSize int) {
+	process, err := newHelperProcess(bufferSize, bufferSize).Spawn()
+	require.NoError(b, err)
+	defer func() {
+		process.Kill()
+		_, _ = process.Wait()
+	}()
+
+	payload := bytes.Repeat([]byte("a"), 1024*1024)
+	ctx := context.Background()
+	b.SetBytes(int64(len(payload)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		require.NoError(b, process.Send(ctx, payload))
+		result, err := process.Receive(ctx, nil)
+		require.NoError(b, err)
+		require.Len(b, result, len(payload)+1)
+	}
+}
+
+func BenchmarkStdIOBufferSize(b *testing.B) {
+	for _, bufferSize := range []int{4 * 1024, DefaultReadBufferSize, 1024 * 1024} {
+		b.Run(fmt.Sprintf("%dKiB", bufferSize/1024), func(b *testing.B) {
+			benchmarkStdIOBufferSize(b, bufferSize)
+		})
+	}
+}
@@ -0,0 +1,195 @@
+package ipc
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/hashicorp/go-multierror"
+	"github.com/pkg/errors"
+	"go.uber.org/atomic"
+)
+
+// ErrTenantProcessLimit is returned when spawning a process would exceed the tenant process quota.
+var ErrTenantProcessLimit = errors.New("tenant process limit exceeded")
+
+// ProcessQuota limits the number of running processes of governors sharing it, e.g. of a single tenant.
+// A process holds its slot until it exits, so respawns of a dead process don't consume extra slots,
+// while spawns beyond the limit fail with ErrTenantProcessLimit. It is safe for concurrent use.
+type ProcessQuota struct {
+	max     atomic.Int32
+	running atomic.Int32
+}
+
+// NewProcessQuota returns a ProcessQuota allowing maxProcesses running processes. Zero value means no limit.
+func NewProcessQuota(maxProcesses int) *ProcessQuota {
+	q := new(ProcessQuota)
+	q.max.Store(int32(maxProcesses))
+	return q
+}
+
+// Running returns the number of running processes holding slots.
+func (q *ProcessQuota) Running() int {
+	if q == nil {
+		return 0
+	}
+
+	return int(q.running.Load())
+}
+
+// acquire takes a slot for a new process. Nil quota is unlimited.
+func (q *ProcessQuota) acquire() error {
+	if q == nil {
+		return nil
+	}
+
+	for {
+		running, max := q.running.Load(), q.max.Load()
+		if max > 0 && running >= max {
+			return ErrTenantProcessLimit
+		}
+
+		if q.running.CAS(running, running+1) {
+			return nil
+		}
+	}
+}
+
+// release frees the slot of an exited process.
+func (q *ProcessQuota) release() {
+	if q != nil {
+		q.running.Dec()
+	}
+}
+
+// Supervisor holds named Governor instances so that they can be enumerated and managed together.
+// It is safe for concurrent use.
+type Supervisor struct {
+	mu        sync.RWMutex
+	governors map[string]*Governor
+	quotas    map[string]*ProcessQuota
+}
+
+// NewSupervisor returns an empty Supervisor.
+func NewSupervisor() *Supervisor {
+	return &Supervisor{governors: make(map[string]*Governor), quotas: make(map[string]*ProcessQuota)}
+}
+
+// SetTenantQuota limits the number of running processes of all tenant governors, including ones
+// already registered with GovernTenant. Zero value means no limit. Lowering the limit does not kill
+// running processes, but new spawns fail until enough of them exit.
+func (s *Supervisor) SetTenantQuota(tenant string, maxProcesses int) {
+	s.tenantQuota(tenant).max.Store(int32(maxProcesses))
+}
+
+// TenantProcesses returns the number of running processes of tenant governors.
+func (s *Supervisor) TenantProcesses(tenant string) int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.quotas[tenant].Running()
+}
+
+// GovernTenant starts a process with the factory under the tenant quota and registers its governor under the name.
+// Spawns and respawns beyond the quota, including ones of the large process, fail with ErrTenantProcessLimit.
+func (s *Supervisor) GovernTenant(tenant, name string, factory ProcessFactory, standalone bool, options GovernorOptions) (*Governor, error) {
+	options.Quota = s.tenantQuota(tenant)
+	governor, err := GovernFactory(factory, standalone, options)
+	if err != nil {
+		return nil, errors.Wrapf(err, "govern [%s] of tenant [%s]", name, tenant)
+	}
+
+	if err := s.Add(name, governor); err != nil {
+		_ = governor.Close()
+		return nil, err
+	}
+
+	return governor, nil
+}
+
+func (s *Supervisor) tenantQuota(tenant string) *ProcessQuota {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	quota, ok := s.quotas[tenant]
+	if !ok {
+		quota = NewProcessQuota(0)
+		s.quotas[tenant] = quota
+	}
+
+	return quota
+}
+
+// Add registers the governor under the name. Names must be unique.
+func (s *Supervisor) Add(name string, governor *Governor) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.governors[name]; ok {
+		return errors.Errorf("governor [%s] is already registered", name)
+	}
+
+	s.governors[name] = governor
+	return nil
+}
+
+// Get returns the governor registered under the name.
+func (s *Supervisor) Get(name string) (*Governor, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	governor, ok := s.governors[name]
+	return governor, ok
+}
+
+// Names returns sorted names of registered governors.
+func (s *Supervisor) Names() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	names := make([]string, 0, len(s.governors))
+	for name := range s.governors {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+	return names
+}
+
+// KillAll kills processes of all registered governors. Like with a crash, governors respawn them on the next exchange.
+func (s *Supervisor) KillAll() {
+	for _, governor := range s.snapshot() {
+		governor.kill()
+	}
+}
+
+// WaitAll waits for processes of all registered governors to exit and returns all wait errors.
+func (s *Supervisor) WaitAll() error {
+	var result error
+	for name, governor := range s.snapshot() {
+		if err := governor.wait(); err != nil {
+			result = multierror.Append(result, errors.Wrapf(err, "wait [%s]", name))
+		}
+	}
+
+	return result
+}
+
+// Stats returns counters aggregated across all registered governors.
+func (s *Supervisor) Stats() Stats {
+	var total Stats
+	for _, governor := range s.snapshot() {
+		stats := governor.Stats()
+		total.Spawns += stats.Spawns
+		total.Respawns += stats.Respawns
+		total.ExchangeErrors += stats.ExchangeErrors
+	}
+
+	return total
+}
+
+// snapshot copies the registry so that governors are not called under the lock.
+func (s *Supervisor) snapshot() map[string]*Governor {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	governors := make(map[string]*Governor, len(s.governors))
+	for name, governor := range s.governors {
+		governors[name] = governor
+	}
+
+	return governors
+}
@@ -0,0 +1,151 @@
+package ipc
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSupervisor(t *testing.T) {
+	supervisor := NewSupervisor()
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			process := newProcessMock(func(p *processMock, data []byte) ([]byte, error) {
+				if p.id == 1 {
+					return nil, io.EOF
+				}
+
+				return data, nil
+			})
+
+			governor, err := Govern(process, false)
+			require.NoError(t, err)
+			require.NoError(t, supervisor.Add(fmt.Sprintf("governor-%d", i), governor))
+		}(i)
+	}
+
+	wg.Wait()
+	require.Equal(t, []string{"governor-0", "governor-1", "governor-2", "governor-3"}, supervisor.Names())
+
+	governor, ok := supervisor.Get("governor-0")
+	require.True(t, ok)
+	require.Error(t, supervisor.Add("governor-0", governor), "names must be unique")
+	_, ok = supervisor.Get("unknown")
+	require.False(t, ok)
+
+	_, err := governor.Exchange(context.Background(), []byte("ping"), nil)
+	require.NoError(t, err)
+	require.Equal(t, Stats{Spawns: 5, Respawns: 1, ExchangeErrors: 1}, supervisor.Stats())
+
+	supervisor.KillAll()
+	require.True(t, governor.process.(*processMock).killed)
+	require.NoError(t, supervisor.WaitAll())
+}
+
+func TestSupervisorTenantQuota(t *testing.T) {
+	supervisor := NewSupervisor()
+	supervisor.SetTenantQuota("a", 2)
+	supervisor.SetTenantQuota("b", 3)
+
+	echo := newProcessMock(func(p *processMock, data []byte) ([]byte, error) { return data, nil })
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	governed := map[string][]*Governor{}
+	for i := 0; i < 5; i++ {
+		for _, tenant := range []string{"a", "b"} {
+			wg.Add(1)
+			go func(tenant string, i int) {
+				defer wg.Done()
+				governor, err := supervisor.GovernTenant(tenant, fmt.Sprintf("%s-%d", tenant, i), echo.Spawn, false, GovernorOptions{})
+				if err != nil {
+					require.ErrorIs(t, err, ErrTenantProcessLimit)
+					return
+				}
+
+				mu.Lock()
+				defer mu.Unlock()
+				governed[tenant] = append(governed[tenant], governor)
+			}(tenant, i)
+		}
+	}
+
+	wg.Wait()
+	require.Len(t, governed["a"], 2)
+	require.Len(t, governed["b"], 3)
+	require.Equal(t, 2, supervisor.TenantProcesses("a"))
+	require.Equal(t, 3, supervisor.TenantProcesses("b"))
+	require.Len(t, supervisor.Names(), 5)
+
+	// respawn of a dead process reuses its slot
+	dying := newProcessMock(func(p *processMock, data []byte) ([]byte, error) {
+		if p.id == 1 {
+			return nil, io.EOF
+		}
+
+		return data, nil
+	})
+	supervisor.SetTenantQuota("a", 3)
+	governor, err := supervisor.GovernTenant("a", "a-dying", dying.Spawn, false, GovernorOptions{})
+	require.NoError(t, err)
+	_, err = governor.Exchange(context.Background(), []byte("ping"), nil)
+	require.NoError(t, err)
+	require.Equal(t, 3, supervisor.TenantProcesses("a"))
+
+	_, err = supervisor.GovernTenant("a", "a-extra", echo.Spawn, false, GovernorOptions{})
+	require.ErrorIs(t, err, ErrTenantProcessLimit)
+
+	// closed governors free slots for the tenant only
+	require.NoError(t, governed["a"][0].Close())
+	require.Equal(t, 2, supervisor.TenantProcesses("a"))
+	_, err = supervisor.GovernTenant("b", "b-extra", echo.Spawn, false, GovernorOptions{})
+	require.ErrorIs(t, err, ErrTenantProcessLimit)
+	_, err = supervisor.GovernTenant("a", "a-extra", echo.Spawn, false, GovernorOptions{})
+	require.NoError(t, err)
+}
+
+func TestGovernorRespawnAtFullQuota(t *testing.T) {
+	quota := NewProcessQuota(1)
+	process := newProcessMock(func(p *processMock, data []byte) ([]byte, error) {
+		if p.id == 1 {
+			return nil, io.EOF
+		}
+
+		return data, nil
+	})
+
+	governor, err := GovernFactory(process.Spawn, false, GovernorOptions{Quota: quota, WarmStandby: true})
+	require.NoError(t, err)
+	defer governor.Close()
+
+	// respawn is held while it checks for the standby
+	governor.standbyMu.Lock()
+	type result struct {
+		data []byte
+		err  error
+	}
+
+	done := make(chan result)
+	go func() {
+		data, err := governor.Exchange(context.Background(), []byte("ping"), nil)
+		done <- result{data, err}
+	}()
+
+	// the dead process slot is handed over to the respawned one, so that other spawns can't take it meanwhile
+	require.Never(t, func() bool { return quota.Running() == 0 }, 100*time.Millisecond, time.Millisecond)
+	_, err = GovernFactory(process.Spawn, false, GovernorOptions{Quota: quota})
+	require.ErrorIs(t, err, ErrTenantProcessLimit)
+
+	governor.standbyMu.Unlock()
+	respawned := <-done
+	require.NoError(t, respawned.err)
+	require.Equal(t, "ping", string(respawned.data))
+	require.Equal(t, 1, quota.Running())
+}
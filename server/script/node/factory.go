@@ -110,6 +110,7 @@ func NewFactory(poolSize, maxSpace int, transformStorage script.Storage, tmpDir
 	}
 
 	replacer := strings.NewReplacer("[[JITSU_RESULT_COMMAND]]", ipc.JitsuScriptResultCommand,
+		"[[JITSU_META_HEADER]]", ipc.JitsuScriptMetaHeader,
 		"[[JITSU_KV_GET_COMMAND]]", JitsuKvGetCommand,
 		"[[JITSU_KV_SET_COMMAND]]", JitsuKvSetCommand)
 
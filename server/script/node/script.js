@@ -4,8 +4,11 @@ const __jts_log__ = [];
 const __jts_result = "[[JITSU_RESULT_COMMAND]]";
 const __jts_keyvalue_get = "[[JITSU_KV_GET_COMMAND]]";
 const __jts_keyvalue_set = "[[JITSU_KV_SET_COMMAND]]";
+const __jts_meta_header = "J$[[JITSU_META_HEADER]]:";
 const __jts_command_callbacks = new Map();
 let __jts_command_id = 0;
+// metadata sent in a header line right before the request line
+let __jts_meta = {};
 
 for (let level of ["trace", "info", "warn", "error"]) {
   console[level] = (...args) => {
@@ -256,6 +259,18 @@ readline
     input: process.stdin,
   })
   .on("line", async (line) => {
+    if (line.startsWith(__jts_meta_header)) {
+      try {
+        __jts_meta = JSON.parse(line.substring(__jts_meta_header.length));
+      } catch (error) {
+        __jts_meta = {};
+      }
+
+      return;
+    }
+
+    const meta = __jts_meta;
+    __jts_meta = {};
     let req = {};
     try {
       req = JSON.parse(line);
@@ -325,10 +340,12 @@ readline
             entry.sandbox.fetch = fetch;
           }
 
+          entry.sandbox.$meta = meta;
           try {
             result = await (func ? exec[func](...args) : exec(...args));
           } finally {
             entry.sandbox.fetch = undefined;
+            entry.sandbox.$meta = undefined;
           }
 
           break;